@@ -3,6 +3,7 @@ package raft
 import (
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/iproj/raft/protobuf"
@@ -16,6 +17,15 @@ type AppendEntriesRequest struct {
 	CommitIndex  uint64
 	LeaderName   string
 	Entries      []*protobuf.LogEntry
+	ClusterID    string
+
+	// Set when the leader hands leadership to the receiver, which starts an
+	// election as soon as its log matches the leader's.
+	TimeoutNow bool
+
+	// How much longer the receiver holds off elections, as asked by Quiesce
+	// on the leader. Zero when the cluster is not quiesced.
+	Quiesce time.Duration
 }
 
 // The response returned from a server appending entries to the log.
@@ -54,6 +64,9 @@ func (req *AppendEntriesRequest) Encode(w io.Writer) (int, error) {
 		CommitIndex:  proto.Uint64(req.CommitIndex),
 		LeaderName:   proto.String(req.LeaderName),
 		Entries:      req.Entries,
+		ClusterID:    proto.String(req.ClusterID),
+		TimeoutNow:   proto.Bool(req.TimeoutNow),
+		Quiesce:      proto.Uint64(uint64(req.Quiesce)),
 	}
 
 	p, err := proto.Marshal(pb)
@@ -84,6 +97,9 @@ func (req *AppendEntriesRequest) Decode(r io.Reader) (int, error) {
 	req.CommitIndex = pb.GetCommitIndex()
 	req.LeaderName = pb.GetLeaderName()
 	req.Entries = pb.GetEntries()
+	req.ClusterID = pb.GetClusterID()
+	req.TimeoutNow = pb.GetTimeoutNow()
+	req.Quiesce = time.Duration(pb.GetQuiesce())
 
 	return len(data), nil
 }
@@ -0,0 +1,80 @@
+package raft
+
+import (
+	gocontext "context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// UnauthorizedError is reported by errors.Is for commands refused by the
+// application's Authorizer.
+var UnauthorizedError = errors.New("raft: Command is not authorized")
+
+// An Identity tells who submitted a command, as far as the transport knows:
+// the certificates a TLS client presented, a bearer token and the address
+// the command came from.
+type Identity struct {
+	Certificates []*x509.Certificate
+	Token        string
+	Addr         string
+}
+
+// An Authorizer lets the application refuse commands by who submitted them,
+// so that tenants or roles can be kept to the commands they may run. It is
+// called before a command is accepted by Do and its variants, and by the
+// join, remove and forward handlers of the HTTP transporter. The identity is
+// nil for commands submitted in-process without WithIdentity. A command
+// forwarded by a follower is authorized there and again by the leader, with
+// the token it was submitted with but the certificates and the address of
+// the follower. The commands the server submits itself are
+// not authorized.
+type Authorizer interface {
+	Authorize(identity *Identity, command Command) error
+}
+
+// An AuthorizationError wraps the error an Authorizer refused a command with.
+// errors.Is reports it as UnauthorizedError.
+type AuthorizationError struct {
+	Err error
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("%v: %v", UnauthorizedError, e.Err)
+}
+
+func (e *AuthorizationError) Is(target error) bool {
+	return target == UnauthorizedError
+}
+
+func (e *AuthorizationError) Unwrap() error {
+	return e.Err
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying identity, for the commands that
+// are submitted with it.
+func WithIdentity(ctx gocontext.Context, identity *Identity) gocontext.Context {
+	return gocontext.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity ctx carries, or nil.
+func IdentityFromContext(ctx gocontext.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// Retrieves the identity of the client of an HTTP request.
+func requestIdentity(r *http.Request) *Identity {
+	identity := &Identity{Addr: r.RemoteAddr}
+	if r.TLS != nil {
+		identity.Certificates = r.TLS.PeerCertificates
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		identity.Token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return identity
+}
@@ -0,0 +1,718 @@
+package raft
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CBORCodec encodes commands in CBOR (RFC 8949), a binary encoding that,
+// like JSON, describes itself, so that entries are smaller without a schema
+// to maintain. Struct fields are named as they are in JSON, following their
+// json tags, and values implementing encoding.TextMarshaler are encoded as
+// their text. Channels, functions and complex numbers are not supported.
+var CBORCodec CommandCodec = cborCodec{}
+
+// Major types of CBOR data items.
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// Simple values and the head of a double precision float.
+const (
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborUndef   = 0xf7
+	cborFloat16 = 0xf9
+	cborFloat32 = 0xfa
+	cborFloat64 = 0xfb
+)
+
+// The deepest nesting of data items that is decoded, as in encoding/json, so
+// that hostile data cannot exhaust the stack.
+const cborMaxDepth = 10000
+
+var errCBORTruncated = errors.New("raft: CBOR data is truncated")
+var errCBORTooDeep = errors.New("raft: CBOR data is nested too deeply")
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+type cborCodec struct{}
+
+func (cborCodec) Encode(w io.Writer, command Command) error {
+	var buf bytes.Buffer
+	if err := cborEncode(&buf, reflect.ValueOf(command)); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (cborCodec) Decode(r io.Reader, command Command) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(command)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("raft: Cannot decode into %T", command)
+	}
+	d := &cborDecoder{data: data}
+	if err := d.decode(v.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return fmt.Errorf("raft: Unexpected data after CBOR item at offset %d", d.off)
+	}
+	return nil
+}
+
+//--------------------------------------
+// Encoding
+//--------------------------------------
+
+// Writes the head of a data item holding its major type and argument.
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{major | 24, byte(n)})
+	case n <= math.MaxUint16:
+		buf.Write([]byte{major | 25, byte(n >> 8), byte(n)})
+	case n <= math.MaxUint32:
+		buf.Write([]byte{major | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	default:
+		buf.Write([]byte{major | 27, byte(n >> 56), byte(n >> 48), byte(n >> 40), byte(n >> 32), byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+}
+
+// Encodes a value as a data item.
+func cborEncode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(cborNull)
+		return nil
+	}
+	if v.Type().Implements(textMarshalerType) && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		cborHead(buf, cborText, uint64(len(text)))
+		buf.Write(text)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n >= 0 {
+			cborHead(buf, cborUint, uint64(n))
+		} else {
+			cborHead(buf, cborNegint, uint64(-1-n))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cborHead(buf, cborUint, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		bits := math.Float64bits(v.Float())
+		buf.WriteByte(cborFloat64)
+		for shift := 56; shift >= 0; shift -= 8 {
+			buf.WriteByte(byte(bits >> uint(shift)))
+		}
+	case reflect.String:
+		cborHead(buf, cborText, uint64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			cborHead(buf, cborBytes, uint64(v.Len()))
+			buf.Write(v.Bytes())
+			return nil
+		}
+		return cborEncodeArray(buf, v)
+	case reflect.Array:
+		return cborEncodeArray(buf, v)
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		return cborEncodeMap(buf, v)
+	case reflect.Struct:
+		return cborEncodeStruct(buf, v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		return cborEncode(buf, v.Elem())
+	default:
+		return fmt.Errorf("raft: Cannot encode %s as CBOR", v.Type())
+	}
+	return nil
+}
+
+func cborEncodeArray(buf *bytes.Buffer, v reflect.Value) error {
+	cborHead(buf, cborArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if err := cborEncode(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encodes a map with its keys in the order of their encoding, so that equal
+// maps are encoded alike.
+func cborEncodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	type pair struct{ key, value []byte }
+	pairs := make([]pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var key, value bytes.Buffer
+		if err := cborEncode(&key, iter.Key()); err != nil {
+			return err
+		}
+		if err := cborEncode(&value, iter.Value()); err != nil {
+			return err
+		}
+		pairs = append(pairs, pair{key.Bytes(), value.Bytes()})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i].key, pairs[j].key) < 0 })
+
+	cborHead(buf, cborMap, uint64(len(pairs)))
+	for _, p := range pairs {
+		buf.Write(p.key)
+		buf.Write(p.value)
+	}
+	return nil
+}
+
+func cborEncodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	var fields []cborField
+	for _, f := range cborFields(v.Type()) {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && cborIsEmpty(fv) {
+			continue
+		}
+		fields = append(fields, cborField{name: f.name, index: f.index})
+	}
+
+	cborHead(buf, cborMap, uint64(len(fields)))
+	for _, f := range fields {
+		cborHead(buf, cborText, uint64(len(f.name)))
+		buf.WriteString(f.name)
+		if err := cborEncode(buf, v.FieldByIndex(f.index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks whether a value is empty in the sense of the omitempty option.
+func cborIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// A struct field as it is named in CBOR.
+type cborField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// Retrieves the fields of a struct that are encoded, named as in JSON. The
+// fields of embedded structs without a name are promoted.
+func cborFields(t reflect.Type) []cborField {
+	var fields []cborField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range cborFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, cborField{name: name, index: []int{i}, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+	}
+	return fields
+}
+
+//--------------------------------------
+// Decoding
+//--------------------------------------
+
+// Decodes data items from a buffer.
+type cborDecoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+// Reads the head of the next data item, returning its major type, the
+// additional information and its argument.
+func (d *cborDecoder) head() (byte, byte, uint64, error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, errCBORTruncated
+	}
+	b := d.data[d.off]
+	d.off++
+	major, info := b>>5, b&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, fmt.Errorf("raft: Unsupported CBOR item 0x%x", b)
+	}
+	if len(d.data)-d.off < size {
+		return 0, 0, 0, errCBORTruncated
+	}
+	var n uint64
+	for _, c := range d.data[d.off : d.off+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.off += size
+	return major, info, n, nil
+}
+
+// Reads the content of a byte or text string of length n.
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if uint64(len(d.data)-d.off) < n {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b, nil
+}
+
+// Checks that a container of n items, each size data items of at least a byte,
+// fits in the remaining data, so that a huge length is refused before
+// anything is allocated for it.
+func (d *cborDecoder) fits(n uint64, size uint64) error {
+	if uint64(len(d.data)-d.off)/size < n {
+		return errCBORTruncated
+	}
+	return nil
+}
+
+// Enters a nested data item, which must be left when it has been decoded.
+func (d *cborDecoder) enter() error {
+	if d.depth >= cborMaxDepth {
+		return errCBORTooDeep
+	}
+	d.depth++
+	return nil
+}
+
+// Checks whether the next data item is null or undefined, and skips it if so.
+func (d *cborDecoder) null() bool {
+	if d.off < len(d.data) && (d.data[d.off] == cborNull || d.data[d.off] == cborUndef) {
+		d.off++
+		return true
+	}
+	return false
+}
+
+// Decodes the next data item into v.
+func (d *cborDecoder) decode(v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer func() { d.depth-- }()
+
+	// Tags only annotate the item that follows.
+	if d.off < len(d.data) && d.data[d.off]>>5 == cborTag {
+		if _, _, _, err := d.head(); err != nil {
+			return err
+		}
+		return d.decode(v)
+	}
+	if d.null() {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.value()
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		major, _, n, err := d.head()
+		if err != nil {
+			return err
+		}
+		if major != cborText {
+			return fmt.Errorf("raft: Cannot decode CBOR major type %d into %s", major, v.Type())
+		}
+		text, err := d.bytes(n)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(text)
+	}
+
+	start := d.off
+	major, info, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	mismatch := func() error {
+		return fmt.Errorf("raft: Cannot decode CBOR major type %d at offset %d into %s", major, start, v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if major != cborSimple || (info != cborFalse&0x1f && info != cborTrue&0x1f) {
+			return mismatch()
+		}
+		v.SetBool(info == cborTrue&0x1f)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch {
+		case major == cborUint && n <= math.MaxInt64:
+			i = int64(n)
+		case major == cborNegint && n <= math.MaxInt64:
+			i = -1 - int64(n)
+		default:
+			return mismatch()
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("raft: CBOR integer %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if major != cborUint {
+			return mismatch()
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("raft: CBOR integer %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := cborFloat(major, info, n)
+		if err != nil {
+			return mismatch()
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if major != cborText {
+			return mismatch()
+		}
+		b, err := d.bytes(n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && major == cborBytes {
+			b, err := d.bytes(n)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		if major != cborArray {
+			return mismatch()
+		}
+		if err := d.fits(n, 1); err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), int(n), int(n))
+		for i := 0; i < int(n); i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		if major != cborArray || n != uint64(v.Len()) {
+			return mismatch()
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if major != cborMap {
+			return mismatch()
+		}
+		if err := d.fits(n, 2); err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), int(n))
+		for i := uint64(0); i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+				return fmt.Errorf("raft: Unsupported CBOR map key of type %s", key.Elem().Type())
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		if major != cborMap {
+			return mismatch()
+		}
+		return d.decodeStruct(v, n)
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// Decodes the n pairs of a map into the fields of a struct. Keys are matched
+// to field names exactly and then regardless of case, as in JSON, and pairs
+// without a field are skipped.
+func (d *cborDecoder) decodeStruct(v reflect.Value, n uint64) error {
+	fields := cborFields(v.Type())
+	for i := uint64(0); i < n; i++ {
+		var name string
+		if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+		var field *cborField
+		for j := range fields {
+			if fields[j].name == name {
+				field = &fields[j]
+				break
+			}
+		}
+		if field == nil {
+			for j := range fields {
+				if strings.EqualFold(fields[j].name, name) {
+					field = &fields[j]
+					break
+				}
+			}
+		}
+		if field == nil {
+			if _, err := d.value(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.FieldByIndex(field.index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes the next data item without a type to decode into, as JSON decodes
+// into an empty interface. Maps with text keys are decoded as
+// map[string]interface{}.
+func (d *cborDecoder) value() (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegint:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("raft: CBOR integer -1-%d overflows int64", n)
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case cborText:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborArray:
+		if err := d.fits(n, 1); err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case cborMap:
+		if err := d.fits(n, 2); err != nil {
+			return nil, err
+		}
+		keys := make([]interface{}, n)
+		values := make([]interface{}, n)
+		text := true
+		for i := range keys {
+			if keys[i], err = d.value(); err != nil {
+				return nil, err
+			}
+			if values[i], err = d.value(); err != nil {
+				return nil, err
+			}
+			if _, ok := keys[i].(string); !ok {
+				text = false
+			}
+		}
+		if text {
+			m := make(map[string]interface{}, n)
+			for i, key := range keys {
+				m[key.(string)] = values[i]
+			}
+			return m, nil
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i, key := range keys {
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				return nil, fmt.Errorf("raft: Unsupported CBOR map key of type %T", key)
+			}
+			m[key] = values[i]
+		}
+		return m, nil
+	case cborTag:
+		// Tags only annotate the item that follows.
+		return d.value()
+	default:
+		switch info {
+		case cborFalse & 0x1f:
+			return false, nil
+		case cborTrue & 0x1f:
+			return true, nil
+		case cborNull & 0x1f, cborUndef & 0x1f:
+			return nil, nil
+		}
+		return cborFloat(major, info, n)
+	}
+}
+
+// Converts the argument of a float data item to a float64.
+func cborFloat(major byte, info byte, n uint64) (float64, error) {
+	if major != cborSimple {
+		return 0, fmt.Errorf("raft: CBOR major type %d is not a float", major)
+	}
+	switch info {
+	case cborFloat16 & 0x1f:
+		return cborHalf(uint16(n)), nil
+	case cborFloat32 & 0x1f:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case cborFloat64 & 0x1f:
+		return math.Float64frombits(n), nil
+	}
+	return 0, fmt.Errorf("raft: Unsupported CBOR simple value %d", info)
+}
+
+// Converts a half precision float, which other encoders may write.
+func cborHalf(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,30 @@
+//go:build go1.18
+
+package raft
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Ensure that decoding arbitrary data never panics, and that whatever is
+// decoded can be encoded again.
+func FuzzCBORCodec(f *testing.F) {
+	for _, c := range testCBORCorpus {
+		f.Add(c.data)
+	}
+	var buf bytes.Buffer
+	CBORCodec.Encode(&buf, &testCBORCommand{Val: "foo", Any: []interface{}{uint64(1), "a"}, Keys: map[interface{}]int{"k": 1}})
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var command testCBORCommand
+		var buf bytes.Buffer
+		if err := CBORCodec.Decode(bytes.NewReader(data), &command); err != nil {
+			return
+		}
+		if err := CBORCodec.Encode(&buf, &command); err != nil {
+			t.Fatalf("Unable to encode decoded data: %v", err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// A CommandCodec encodes the payload of commands of a type in log entries.
+// It is chosen for a command type when the command is registered with
+// RegisterCommandCodec, and must not change once entries have been written.
+type CommandCodec interface {
+	Encode(w io.Writer, command Command) error
+	Decode(r io.Reader, command Command) error
+}
+
+var (
+	// JSONCodec encodes commands as JSON. It is used for commands
+	// registered without a codec.
+	JSONCodec CommandCodec = jsonCodec{}
+
+	// ProtobufCodec encodes commands that are protocol buffer messages in
+	// the protocol buffer wire format, which is more compact than JSON.
+	ProtobufCodec CommandCodec = protobufCodec{}
+)
+
+// The codecs of the command types registered with one, by name.
+var commandCodecs = map[string]CommandCodec{}
+
+// Retrieves the codec for a command. Commands that encode themselves take
+// precedence over the codec they were registered with.
+func commandCodec(command Command) CommandCodec {
+	if _, ok := command.(CommandEncoder); ok {
+		return encoderCodec{}
+	}
+	if codec := commandCodecs[command.CommandName()]; codec != nil {
+		return codec
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, command Command) error {
+	return json.NewEncoder(w).Encode(command)
+}
+
+func (jsonCodec) Decode(r io.Reader, command Command) error {
+	return json.NewDecoder(r).Decode(command)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Encode(w io.Writer, command Command) error {
+	m, ok := command.(proto.Message)
+	if !ok {
+		return fmt.Errorf("raft: Command is not a protocol buffer message: %s", command.CommandName())
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (protobufCodec) Decode(r io.Reader, command Command) error {
+	m, ok := command.(proto.Message)
+	if !ok {
+		return fmt.Errorf("raft: Command is not a protocol buffer message: %s", command.CommandName())
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// Encodes commands that implement CommandEncoder with their own methods.
+type encoderCodec struct{}
+
+func (encoderCodec) Encode(w io.Writer, command Command) error {
+	return command.(CommandEncoder).Encode(w)
+}
+
+func (encoderCodec) Decode(r io.Reader, command Command) error {
+	return command.(CommandEncoder).Decode(r)
+}
@@ -0,0 +1,198 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/iproj/raft/protobuf"
+)
+
+// Ensure that commands are encoded with the codec of their type.
+func TestCommandCodec(t *testing.T) {
+	e, err := newLogEntry(nil, nil, 1, 1, &testProtoCommand{Val: proto.String("foo")})
+	if err != nil {
+		t.Fatalf("Unable to encode: %v", err)
+	}
+	if json.Valid(e.Command()) {
+		t.Fatalf("Expected the command to be encoded as a protocol buffer: %q", e.Command())
+	}
+	command, err := newCommand(e.CommandName(), e.Command())
+	if err != nil || command.(*testProtoCommand).GetVal() != "foo" {
+		t.Fatalf("Unable to decode: %v %v", command, err)
+	}
+
+	e, _ = newLogEntry(nil, nil, 2, 1, &testCommand1{Val: "bar"})
+	if !json.Valid(e.Command()) {
+		t.Fatalf("Expected the command to be encoded as JSON: %q", e.Command())
+	}
+
+	if err := ProtobufCodec.Encode(nil, &testCommand2{}); err == nil {
+		t.Fatal("Expected a command that is not a message to be refused")
+	}
+}
+
+// Ensure that commands encoded as CBOR are decoded as they were and are
+// smaller than in JSON.
+func TestCBORCodec(t *testing.T) {
+	c := &testCBORCommand{
+		Val:    "foo",
+		I:      -300,
+		Data:   []byte{0, 1, 2},
+		Tags:   []string{"a", "b"},
+		Labels: map[string]uint32{"x": 1, "y": 70000},
+		Next:   &testCBORCommand{Val: "bar", F: 1.5},
+		Any:    map[string]interface{}{"n": uint64(7), "s": []interface{}{"t", true, nil}},
+		At:     time.Date(2014, 1, 2, 3, 4, 5, 6, time.UTC),
+	}
+	e, err := newLogEntry(nil, nil, 1, 1, c)
+	if err != nil {
+		t.Fatalf("Unable to encode: %v", err)
+	}
+	b, _ := json.Marshal(c)
+	if len(e.Command()) >= len(b) {
+		t.Fatalf("Expected CBOR to be smaller than JSON: %d >= %d", len(e.Command()), len(b))
+	}
+	command, err := newCommand(e.CommandName(), e.Command())
+	if err != nil {
+		t.Fatalf("Unable to decode: %v", err)
+	}
+	d := command.(*testCBORCommand)
+	if !d.At.Equal(c.At) {
+		t.Fatalf("Unexpected time: %v", d.At)
+	}
+	d.At, c.At = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(d, c) {
+		t.Fatalf("Unexpected command: %#v", d)
+	}
+
+	var buf bytes.Buffer
+	if err := CBORCodec.Encode(&buf, &testCBORCommand{Labels: map[string]uint32{}}); err != nil {
+		t.Fatalf("Unable to encode: %v", err)
+	}
+	if buf.Bytes()[0] != 0xa7 {
+		t.Fatalf("Expected a map of 7 pairs, got 0x%x", buf.Bytes()[0])
+	}
+	if err := CBORCodec.Decode(bytes.NewReader(e.Command()[:len(e.Command())-1]), &testCBORCommand{}); err == nil {
+		t.Fatal("Expected truncated data to be refused")
+	}
+}
+
+// Malformed and unusual CBOR data, which fuzzing the codec also starts from.
+var testCBORCorpus = []struct {
+	name  string
+	data  []byte
+	valid bool
+}{
+	{"tagged", []byte("\xa1\x63val\xc1\x63foo"), true},
+	{"tags", append(append([]byte("\xa1\x63any"), bytes.Repeat([]byte{0xc0}, cborMaxDepth)...), 0), false},
+	{"arrays", append(append([]byte("\xa1\x63any"), bytes.Repeat([]byte{0x81}, cborMaxDepth)...), 0), false},
+	{"maps", append(append([]byte("\xa1\x63any"), bytes.Repeat([]byte{0xa1, 0}, cborMaxDepth)...), 0), false},
+	{"structs", append(bytes.Repeat([]byte("\xa1\x64next"), cborMaxDepth), 0xa0), false},
+	{"huge array", []byte("\xa1\x64tags\x9b\xff\xff\xff\xff\xff\xff\xff\xff"), false},
+	{"huge map", []byte("\xa1\x66labels\xbb\xff\xff\xff\xff\xff\xff\xff\xff"), false},
+	{"huge map of keys", []byte("\xa1\x64keys\xbb\x7f\xff\xff\xff\xff\xff\xff\xff\x00\x00"), false},
+	{"huge bytes", []byte("\xa1\x64data\x5b\xff\xff\xff\xff\xff\xff\xff\xff"), false},
+	{"huge text", []byte("\xa1\x63val\x7b\xff\xff\xff\xff\xff\xff\xff\xff"), false},
+	{"array key", []byte("\xa1\x64keys\xa1\x80\x01"), false},
+	{"map key", []byte("\xa1\x64keys\xa1\xa0\x01"), false},
+	{"bytes key", []byte("\xa1\x64keys\xa1\x41\x00\x01"), false},
+	{"untyped array key", []byte("\xa1\x63any\xa1\x80\x01"), false},
+	{"integer key", []byte("\xa1\x64keys\xa1\x01\x02"), true},
+	{"null key", []byte("\xa1\x64keys\xa1\xf6\x02"), true},
+}
+
+// Ensure that malformed CBOR data is refused without exhausting the stack or
+// memory, and without panicking.
+func TestCBORCodecMalformed(t *testing.T) {
+	for _, c := range testCBORCorpus {
+		var command testCBORCommand
+		err := CBORCodec.Decode(bytes.NewReader(c.data), &command)
+		if c.valid && err != nil {
+			t.Fatalf("%s: Unable to decode: %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Fatalf("%s: Expected the data to be refused: %#v", c.name, command)
+		}
+	}
+
+	var command testCBORCommand
+	CBORCodec.Decode(bytes.NewReader(testCBORCorpus[0].data), &command)
+	if command.Val != "foo" {
+		t.Fatalf("Expected the tag to be skipped: %q", command.Val)
+	}
+	CBORCodec.Decode(bytes.NewReader([]byte("\xa1\x64keys\xa1\x01\x02")), &command)
+	if !reflect.DeepEqual(command.Keys, map[interface{}]int{uint64(1): 2}) {
+		t.Fatalf("Unexpected keys: %#v", command.Keys)
+	}
+}
+
+// Ensure that commands are decoded at the version they were encoded with and
+// upgraded from older versions.
+func TestCommandVersion(t *testing.T) {
+	e, _ := newLogEntry(nil, nil, 1, 1, &testVersionedCommand{First: "Ben", Last: "Johnson"})
+	if e.CommandVersion() != 2 {
+		t.Fatalf("Unexpected version: %d", e.CommandVersion())
+	}
+	if command, err := e.decodeCommand(); err != nil || *command.(*testVersionedCommand) != (testVersionedCommand{"Ben", "Johnson"}) {
+		t.Fatalf("Unable to decode: %v %v", command, err)
+	}
+
+	entry := func(version uint32, data string) *LogEntry {
+		return &LogEntry{pb: &protobuf.LogEntry{
+			Index:          proto.Uint64(1),
+			Term:           proto.Uint64(1),
+			CommandName:    proto.String("cmd_versioned"),
+			Command:        []byte(data),
+			CommandVersion: proto.Uint32(version),
+		}}
+	}
+	for _, version := range []uint32{0, 1} {
+		command, err := entry(version, `{"Name":"Xiang Li"}`).decodeCommand()
+		if err != nil || *command.(*testVersionedCommand) != (testVersionedCommand{"Xiang", "Li"}) {
+			t.Fatalf("Unable to upgrade from version %d: %v %v", version, command, err)
+		}
+	}
+	if _, err := entry(3, `{}`).decodeCommand(); err == nil {
+		t.Fatal("Expected a newer version to be refused")
+	}
+
+	// Types without a version are unaffected.
+	e, _ = newLogEntry(nil, nil, 1, 1, &testCommand1{Val: "foo"})
+	if e.pb.CommandVersion != nil {
+		t.Fatalf("Unexpected version: %d", e.CommandVersion())
+	}
+}
+
+// Ensure that commands registered with an ID are written and decoded by it.
+func TestCommandID(t *testing.T) {
+	e, _ := newLogEntry(nil, nil, 1, 1, &testCBORCommand{Val: "foo"})
+	if e.CommandID() != 1 || e.pb.GetCommandName() != "" || e.CommandName() != "cmd_cbor" {
+		t.Fatalf("Unexpected command type: %d %q %q", e.CommandID(), e.pb.GetCommandName(), e.CommandName())
+	}
+
+	var buf bytes.Buffer
+	if _, err := e.Encode(&buf); err != nil {
+		t.Fatalf("Unable to encode: %v", err)
+	}
+	decoded := &LogEntry{pb: &protobuf.LogEntry{}}
+	if _, err := decoded.Decode(&buf); err != nil {
+		t.Fatalf("Unable to decode: %v", err)
+	}
+	if command, err := decoded.decodeCommand(); err != nil || command.(*testCBORCommand).Val != "foo" {
+		t.Fatalf("Unable to decode the command: %v %v", command, err)
+	}
+
+	decoded.pb.CommandID = proto.Uint32(1000)
+	if _, err := decoded.decodeCommand(); err == nil {
+		t.Fatal("Expected an unregistered ID to be refused")
+	}
+
+	// Types without an ID are written by name.
+	e, _ = newLogEntry(nil, nil, 1, 1, &testCommand1{Val: "foo"})
+	if e.pb.CommandID != nil || e.CommandName() != "cmd_1" {
+		t.Fatalf("Unexpected command type: %d %q", e.CommandID(), e.CommandName())
+	}
+}
@@ -10,6 +10,20 @@ import (
 
 var commandTypes map[string]Command
 
+// The current versions of the command types registered with one, and the
+// functions upgrading their older versions, by name.
+var commandVersions = map[string]uint32{}
+var commandUpgraders = map[string]CommandUpgrader{}
+
+// The numeric IDs of the command types registered with one, by name, and the
+// names of the command types by ID.
+var commandIDs = map[string]uint32{}
+var commandIDNames = map[uint32]string{}
+
+// The types of the results the command types registered with one are
+// applied with, by name.
+var commandResults = map[string]reflect.Type{}
+
 func init() {
 	commandTypes = map[string]Command{}
 }
@@ -19,6 +33,60 @@ type Command interface {
 	CommandName() string
 }
 
+// ClientCommand is a command sent within a client session. A client numbers
+// its commands with increasing sequence numbers and retries a command with
+// the same number, for example after a leader failover. A command is only
+// applied if its sequence is above the last one applied for its client.
+type ClientCommand interface {
+	Command
+	ClientID() string
+	Sequence() uint64
+}
+
+// IdempotentCommand is a command that carries a key identifying it, so that
+// it is applied once however often it is sent. A command whose key is among
+// the most recently applied keys returns the result the key was applied with.
+type IdempotentCommand interface {
+	Command
+	IdempotencyKey() string
+}
+
+// A CommandValidator lets the application refuse commands before the leader
+// appends them, so that an invalid command fails when it is submitted rather
+// than when it is applied on every server. NOPs and configuration changes
+// are not validated.
+type CommandValidator interface {
+	Validate(command Command) error
+}
+
+// A DryRunner is a command that can be evaluated without being appended, as
+// Server.DryRun does. DryRun returns what Apply would and must not change
+// the state machine.
+type DryRunner interface {
+	DryRun(Context) (interface{}, error)
+}
+
+// A Simulator lets the application evaluate commands that are not
+// DryRunners for Server.DryRun, against a copy of its state for example. It
+// must not change the state machine.
+type Simulator interface {
+	Simulate(context Context, command Command) (interface{}, error)
+}
+
+// A ReadOnlyCommand is a command that does not change the state machine, such
+// as a query that must follow every write before it in the log. Consecutive
+// commands whose ReadOnly returns true are applied concurrently with each
+// other, while writes remain serialized, so their Apply must be safe to call
+// concurrently. Their commit events and apply hooks are still dispatched one
+// at a time, in the order of the log, but the events dispatched while they
+// are applied, when one is abandoned or panics, may be dispatched
+// concurrently. Commands in a client session or with an idempotency key are
+// always applied serially.
+type ReadOnlyCommand interface {
+	Command
+	ReadOnly() bool
+}
+
 // CommandApply represents the interface to apply a command to the server.
 type CommandApply interface {
 	Apply(Context) (interface{}, error)
@@ -29,19 +97,43 @@ type deprecatedCommandApply interface {
 	Apply(Server) (interface{}, error)
 }
 
+// CommandEncoder can be implemented by a command to encode itself in log
+// entries, in place of the codec of its type.
 type CommandEncoder interface {
 	Encode(w io.Writer) error
 	Decode(r io.Reader) error
 }
 
+// A CommandUpgrader decodes a command from data encoded with an older
+// version of its type, as found in log entries written by a previous version
+// of the application. It returns the command as of the current version.
+type CommandUpgrader func(version uint32, data []byte) (Command, error)
+
 // Creates a new instance of a command by name.
 func newCommand(name string, data []byte) (Command, error) {
+	return newCommandVersion(name, commandVersions[name], data)
+}
+
+// Creates a new instance of a command by name from data encoded with a
+// version of its type. Data from an older version is handed to the upgrader
+// of the type, while data from a newer version cannot be decoded.
+func newCommandVersion(name string, version uint32, data []byte) (Command, error) {
 	// Find the registered command.
 	command := commandTypes[name]
 	if command == nil {
 		return nil, fmt.Errorf("raft.Command: Unregistered command type: %s", name)
 	}
 
+	if current := commandVersions[name]; version > current {
+		return nil, fmt.Errorf("raft.Command: Unsupported version of command type %s: %d > %d", name, version, current)
+	} else if version < current {
+		upgrade := commandUpgraders[name]
+		if upgrade == nil {
+			return nil, fmt.Errorf("raft.Command: Unable to upgrade command type %s from version %d", name, version)
+		}
+		return upgrade(version, data)
+	}
+
 	// Make a copy of the command.
 	v := reflect.New(reflect.Indirect(reflect.ValueOf(command)).Type()).Interface()
 	copy, ok := v.(Command)
@@ -51,14 +143,8 @@ func newCommand(name string, data []byte) (Command, error) {
 
 	// If data for the command was passed in the decode it.
 	if data != nil {
-		if encoder, ok := copy.(CommandEncoder); ok {
-			if err := encoder.Decode(bytes.NewReader(data)); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := json.NewDecoder(bytes.NewReader(data)).Decode(copy); err != nil {
-				return nil, err
-			}
+		if err := commandCodec(copy).Decode(bytes.NewReader(data), copy); err != nil {
+			return nil, err
 		}
 	}
 
@@ -74,3 +160,94 @@ func RegisterCommand(command Command) {
 	}
 	commandTypes[command.CommandName()] = command
 }
+
+// Registers a command like RegisterCommand, encoding commands of its type in
+// log entries with codec instead of JSON.
+func RegisterCommandCodec(command Command, codec CommandCodec) {
+	RegisterCommand(command)
+	commandCodecs[command.CommandName()] = codec
+}
+
+// Registers a command like RegisterCommand at a version of its type, which is
+// recorded in the log entries of its commands. Commands from entries of an
+// older version are decoded with upgrade, which may be nil if there are none.
+// A command already registered, with a codec for example, is only given the
+// version. Versions start at 1, as entries written before a type had one are
+// at 0.
+func RegisterCommandVersion(command Command, version uint32, upgrade CommandUpgrader) {
+	if command == nil {
+		panic(fmt.Sprintf("raft: Cannot register nil"))
+	}
+	name := command.CommandName()
+	if version == 0 {
+		panic(fmt.Sprintf("raft: Invalid command version: %s", name))
+	} else if commandVersions[name] != 0 {
+		panic(fmt.Sprintf("raft: Duplicate version registration: %s", name))
+	}
+	if commandTypes[name] == nil {
+		RegisterCommand(command)
+	}
+	commandVersions[name] = version
+	commandUpgraders[name] = upgrade
+}
+
+// Registers the type of the results commands of a type are applied with, so
+// that the result of such a command forwarded to the leader is decoded as
+// that type, as it would be returned on the leader, rather than as the
+// generic value JSON decodes to. result is an instance of the type, such as
+// uint64(0) or &Account{}, and must encode to and decode from JSON.
+func RegisterCommandResult(command Command, result interface{}) {
+	if command == nil || result == nil {
+		panic(fmt.Sprintf("raft: Cannot register nil"))
+	}
+	name := command.CommandName()
+	if commandResults[name] != nil {
+		panic(fmt.Sprintf("raft: Duplicate result registration: %s", name))
+	}
+	commandResults[name] = reflect.TypeOf(result)
+}
+
+// Decodes the JSON result of a forwarded command as the type registered for
+// the command, or as a generic value (float64, string, bool, []interface{}
+// or map[string]interface{}) if there is none.
+func decodeCommandResult(command Command, data []byte) (interface{}, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	typ := commandResults[unwrapCondition(command).CommandName()]
+	if typ == nil {
+		var value interface{}
+		err := json.Unmarshal(data, &value)
+		return value, err
+	}
+	value := reflect.New(typ)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+// Registers a command like RegisterCommand with a numeric ID, which is
+// written in the log entries of its commands in place of its name to make
+// them smaller. The ID of a type must never change or be reused, since
+// entries are decoded by it. Every server must register the ID before any
+// of them writes entries with it. A command already registered, with a codec
+// or a version for example, is only given the ID. IDs start at 1.
+func RegisterCommandID(command Command, id uint32) {
+	if command == nil {
+		panic(fmt.Sprintf("raft: Cannot register nil"))
+	}
+	name := command.CommandName()
+	if id == 0 {
+		panic(fmt.Sprintf("raft: Invalid command ID: %s", name))
+	} else if commandIDs[name] != 0 {
+		panic(fmt.Sprintf("raft: Duplicate ID registration: %s", name))
+	} else if other, ok := commandIDNames[id]; ok {
+		panic(fmt.Sprintf("raft: Duplicate command ID: %d (%s, %s)", id, other, name))
+	}
+	if commandTypes[name] == nil {
+		RegisterCommand(command)
+	}
+	commandIDs[name] = id
+	commandIDNames[id] = name
+}
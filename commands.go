@@ -1,7 +1,9 @@
 package raft
 
 import (
+	"fmt"
 	"io"
+	"reflect"
 )
 
 // Join command interface
@@ -10,10 +12,52 @@ type JoinCommand interface {
 	NodeName() string
 }
 
-// Join command
+// Join command. Role is empty for voters and LearnerRole for peers that
+// should only replicate the log. Weight is the number of votes the peer
+// holds, one if unset. Metadata holds free-form tags, such as a zone or
+// version, that are replicated with the membership. ClusterID is set by a
+// server that already belongs to a cluster; the join is refused if it is
+// not this one.
 type DefaultJoinCommand struct {
-	Name             string `json:"name"`
-	ConnectionString string `json:"connectionString"`
+	Name             string            `json:"name"`
+	ConnectionString string            `json:"connectionString"`
+	Role             string            `json:"role,omitempty"`
+	Weight           int               `json:"weight,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	ClusterID        string            `json:"clusterID,omitempty"`
+}
+
+// A MemberJoinCommand is a join that describes the member it adds, so that
+// an application can join with a command of its own carrying extra fields,
+// such as credentials, while the leader still checks and admits the member
+// as it would a DefaultJoinCommand. JoinMember returns the member held by
+// the command, which the leader may change, to admit it as a learner for
+// example. A command embedding DefaultJoinCommand implements it, and only
+// needs a command name of its own.
+type MemberJoinCommand interface {
+	JoinCommand
+	JoinMember() *DefaultJoinCommand
+}
+
+// A JoinValidator lets the application refuse joins, for example to check
+// credentials or the version recorded in a join's metadata. The leader calls
+// it for every join and dry-run join with the member the join adds, which is
+// nil for a join that does not describe it, and with the command as it was
+// submitted, so that it can check the extra fields of the application's own
+// join commands. Other configuration changes are not validated.
+type JoinValidator interface {
+	ValidateJoin(member *DefaultJoinCommand, command JoinCommand) error
+}
+
+// JoinVerdict is the leader's answer to a dry-run join. Role is the role the
+// node would join with and Queued is set if the join would wait for room in
+// the cluster. Reason explains why a join would be refused.
+type JoinVerdict struct {
+	Accepted bool   `json:"accepted"`
+	Role     string `json:"role,omitempty"`
+	Queued   bool   `json:"queued,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	err      error
 }
 
 // Leave command interface
@@ -22,11 +66,64 @@ type LeaveCommand interface {
 	NodeName() string
 }
 
+// A MemberLeaveCommand is a leave that describes the member it removes, so
+// that the leader can tell it from a join, whose interface is the same. A
+// command embedding DefaultLeaveCommand implements it, and only needs a
+// command name of its own.
+type MemberLeaveCommand interface {
+	LeaveCommand
+	LeaveMember() *DefaultLeaveCommand
+}
+
 // Leave command
 type DefaultLeaveCommand struct {
 	Name string `json:"name"`
 }
 
+// Promote command. Changes a learner into a voter.
+type DefaultPromoteCommand struct {
+	Name string `json:"name"`
+}
+
+// Demote command. Changes a voter into a learner, shrinking the quorum. If
+// Remove is set the leader removes the learner once the demotion has been
+// applied, so the quorum never counts a member that is going away.
+type DefaultDemoteCommand struct {
+	Name   string `json:"name"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+// Change peer address command. Replaces the connection string of a member
+// without removing it from the configuration.
+type DefaultChangePeerAddressCommand struct {
+	Name             string `json:"name"`
+	ConnectionString string `json:"connectionString"`
+}
+
+// Bootstrap command. The first entry in the log of a new cluster, holding
+// its initial configuration.
+type DefaultBootstrapCommand struct {
+	ClusterID string  `json:"clusterID"`
+	Peers     []*Peer `json:"peers"`
+}
+
+// Membership change command. Starts a joint consensus change from the
+// current configuration to Peers.
+type DefaultMembershipChangeCommand struct {
+	Peers []*Peer `json:"peers"`
+}
+
+// Membership commit command. Finishes a joint consensus change. It is
+// submitted by the leader once the change command has been committed.
+type DefaultMembershipCommitCommand struct {
+}
+
+// Force new cluster command. Records in the log that a member which lost its
+// quorum for good was reset to a single-member cluster holding Name.
+type DefaultForceNewClusterCommand struct {
+	Name string `json:"name"`
+}
+
 // NOP command
 type NOPCommand struct {
 }
@@ -37,8 +134,18 @@ func (c *DefaultJoinCommand) CommandName() string {
 }
 
 func (c *DefaultJoinCommand) Apply(server Server) (interface{}, error) {
+	if id := server.ClusterID(); c.ClusterID != "" && id != "" && c.ClusterID != id {
+		return nil, fmt.Errorf("raft: %s belongs to cluster %s, not %s", c.Name, c.ClusterID, id)
+	}
+
 	debugln("server.AddPeer: ", c.Name)
-	err := server.AddPeer(c.Name, c.ConnectionString)
+	err := addPeer(server, &Peer{
+		Name:             c.Name,
+		ConnectionString: c.ConnectionString,
+		Role:             c.Role,
+		Weight:           c.Weight,
+		Metadata:         c.Metadata,
+	})
 
 	return []byte("join"), err
 }
@@ -47,6 +154,43 @@ func (c *DefaultJoinCommand) NodeName() string {
 	return c.Name
 }
 
+func (c *DefaultJoinCommand) JoinMember() *DefaultJoinCommand {
+	return c
+}
+
+// Checks whether a command is a join. Leaves and the other configuration
+// changes naming a member have the interface of joins, so a JoinCommand is
+// only a join if it is none of them.
+func isJoin(command Command) bool {
+	switch command.(type) {
+	case MemberJoinCommand:
+		return true
+	case MemberLeaveCommand, *DefaultPromoteCommand, *DefaultDemoteCommand, *DefaultChangePeerAddressCommand:
+		return false
+	}
+	_, ok := command.(JoinCommand)
+	return ok
+}
+
+// Retrieves the member a join adds, or nil if the join does not describe it.
+func joinMember(join JoinCommand) *DefaultJoinCommand {
+	if c, ok := join.(MemberJoinCommand); ok {
+		return c.JoinMember()
+	}
+	return nil
+}
+
+// Copies a join command, so that the member of the copy can be changed.
+func copyJoin(join MemberJoinCommand) MemberJoinCommand {
+	v := reflect.ValueOf(join)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return join
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface().(MemberJoinCommand)
+}
+
 // The name of the Leave command in the log
 func (c *DefaultLeaveCommand) CommandName() string {
 	return "raft:leave"
@@ -62,6 +206,146 @@ func (c *DefaultLeaveCommand) NodeName() string {
 	return c.Name
 }
 
+func (c *DefaultLeaveCommand) LeaveMember() *DefaultLeaveCommand {
+	return c
+}
+
+// The name of the Promote command in the log
+func (c *DefaultPromoteCommand) CommandName() string {
+	return "raft:promote"
+}
+
+func (c *DefaultPromoteCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.SetPeerRole: ", c.Name)
+	err := server.SetPeerRole(c.Name, VoterRole)
+
+	return []byte("promote"), err
+}
+
+func (c *DefaultPromoteCommand) NodeName() string {
+	return c.Name
+}
+
+// The name of the Demote command in the log
+func (c *DefaultDemoteCommand) CommandName() string {
+	return "raft:demote"
+}
+
+func (c *DefaultDemoteCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.DemotePeer: ", c.Name, c.Remove)
+	err := server.DemotePeer(c.Name, c.Remove)
+
+	return []byte("demote"), err
+}
+
+func (c *DefaultDemoteCommand) NodeName() string {
+	return c.Name
+}
+
+// The name of the Change peer address command in the log
+func (c *DefaultChangePeerAddressCommand) CommandName() string {
+	return "raft:changePeerAddress"
+}
+
+func (c *DefaultChangePeerAddressCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.SetPeerConnectionString: ", c.Name, c.ConnectionString)
+	err := server.SetPeerConnectionString(c.Name, c.ConnectionString)
+
+	return []byte("changePeerAddress"), err
+}
+
+func (c *DefaultChangePeerAddressCommand) NodeName() string {
+	return c.Name
+}
+
+// The name of the Bootstrap command in the log
+func (c *DefaultBootstrapCommand) CommandName() string {
+	return "raft:bootstrap"
+}
+
+func (c *DefaultBootstrapCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.Bootstrap: ", len(c.Peers))
+	if server.ClusterID() == "" {
+		server.SetClusterID(c.ClusterID)
+	}
+	for _, peer := range c.Peers {
+		if err := addPeer(server, peer); err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte("bootstrap"), nil
+}
+
+// The name of the Membership change command in the log
+func (c *DefaultMembershipChangeCommand) CommandName() string {
+	return "raft:membershipChange"
+}
+
+func (c *DefaultMembershipChangeCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.BeginMembershipChange: ", len(c.Peers))
+	err := server.BeginMembershipChange(c.Peers)
+
+	return []byte("membershipChange"), err
+}
+
+// The name of the Membership commit command in the log
+func (c *DefaultMembershipCommitCommand) CommandName() string {
+	return "raft:membershipCommit"
+}
+
+func (c *DefaultMembershipCommitCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.CommitMembershipChange")
+	err := server.CommitMembershipChange()
+
+	return []byte("membershipCommit"), err
+}
+
+// Adds a member to the configuration along with its role, weight and
+// metadata.
+func addPeer(server Server, peer *Peer) error {
+	if err := server.AddPeer(peer.Name, peer.ConnectionString); err != nil {
+		return err
+	}
+	if peer.Role != "" {
+		if err := server.SetPeerRole(peer.Name, peer.Role); err != nil {
+			return err
+		}
+	}
+	if peer.Weight != 0 {
+		if err := server.SetPeerWeight(peer.Name, peer.Weight); err != nil {
+			return err
+		}
+	}
+	if peer.Metadata != nil {
+		if err := server.SetPeerMetadata(peer.Name, peer.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The name of the Force new cluster command in the log
+func (c *DefaultForceNewClusterCommand) CommandName() string {
+	return "raft:forceNewCluster"
+}
+
+func (c *DefaultForceNewClusterCommand) Apply(server Server) (interface{}, error) {
+	debugln("server.ResetMembership: ", c.Name)
+	err := server.ResetMembership(c.Name)
+
+	return []byte("forceNewCluster"), err
+}
+
+// Determines whether a command changes the cluster configuration.
+func isConfigurationCommand(command Command) bool {
+	switch command.(type) {
+	case JoinCommand, LeaveCommand, *DefaultChangePeerAddressCommand, *DefaultBootstrapCommand, *DefaultMembershipChangeCommand, *DefaultMembershipCommitCommand, *DefaultForceNewClusterCommand:
+		return true
+	}
+	return false
+}
+
 // The name of the NOP command in the log
 func (c NOPCommand) CommandName() string {
 	return "raft:nop"
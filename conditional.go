@@ -0,0 +1,111 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ConditionFailedError is reported by errors.Is for conditional commands
+// whose condition did not hold when they were applied.
+var ConditionFailedError = errors.New("raft: Condition does not hold")
+
+// A ConditionChecker evaluates the condition of a ConditionalCommand against
+// the state machine as the command is applied, before its command is. It
+// returns an error, such as one naming the version found, if the condition
+// does not hold. It must be deterministic, as it is on every server.
+type ConditionChecker interface {
+	CheckCondition(context Context, condition string, command Command) error
+}
+
+// A ConflictError is returned for a conditional command whose condition did
+// not hold, wrapping the error of the ConditionChecker. errors.Is reports it
+// as ConditionFailedError. It is an outcome of the command rather than a
+// failure to apply it, so the apply error policy does not act on it.
+type ConflictError struct {
+	Condition string
+	Err       error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ConditionFailedError, e.Condition, e.Err)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ConditionFailedError
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// A ConditionalCommand applies its command only if its condition holds when
+// it is applied, as the application's ConditionChecker decides, so that an
+// optimistic update, such as one naming the version it expects to replace,
+// is refused by the log rather than by another round trip. The condition is
+// an opaque token to the server. The command is authorized and validated as
+// it would be on its own, is in the client session and has the idempotency
+// key it would have on its own, and cannot be a configuration change.
+type ConditionalCommand struct {
+	Condition string
+	Command   Command
+}
+
+// NewConditionalCommand creates a command applying command if condition holds.
+func NewConditionalCommand(condition string, command Command) *ConditionalCommand {
+	return &ConditionalCommand{Condition: condition, Command: command}
+}
+
+// The name of the conditional command in the log
+func (c *ConditionalCommand) CommandName() string {
+	return "raft:conditional"
+}
+
+// The encoding of a conditional command, which holds its command encoded as
+// it would be in a log entry of its own.
+type conditionalEncoding struct {
+	Condition string `json:"condition"`
+	Name      string `json:"name"`
+	Version   uint32 `json:"version,omitempty"`
+	Command   []byte `json:"command,omitempty"`
+}
+
+func (c *ConditionalCommand) Encode(w io.Writer) error {
+	if c.Command == nil {
+		return errors.New("raft: Conditional command has no command")
+	}
+	var buf bytes.Buffer
+	if err := commandCodec(c.Command).Encode(&buf, c.Command); err != nil {
+		return err
+	}
+	name := c.Command.CommandName()
+	return json.NewEncoder(w).Encode(&conditionalEncoding{
+		Condition: c.Condition,
+		Name:      name,
+		Version:   commandVersions[name],
+		Command:   buf.Bytes(),
+	})
+}
+
+func (c *ConditionalCommand) Decode(r io.Reader) error {
+	var encoding conditionalEncoding
+	if err := json.NewDecoder(r).Decode(&encoding); err != nil {
+		return err
+	}
+	command, err := newCommandVersion(encoding.Name, encoding.Version, encoding.Command)
+	if err != nil {
+		return err
+	}
+	c.Condition, c.Command = encoding.Condition, command
+	return nil
+}
+
+// Retrieves the command a conditional command applies, or the command itself.
+func unwrapCondition(command Command) Command {
+	if conditional, ok := command.(*ConditionalCommand); ok && conditional.Command != nil {
+		return conditional.Command
+	}
+	return command
+}
@@ -1,7 +1,129 @@
 package raft
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
 type Config struct {
-	CommitIndex uint64 `json:"commitIndex"`
+	CommitIndex        uint64 `json:"commitIndex"`
+	ConfigurationIndex uint64 `json:"configurationIndex,omitempty"`
+	ClusterID          string `json:"clusterID,omitempty"`
 	// TODO decide what we need to store in peer struct
 	Peers []*Peer `json:"peers"`
 }
+
+// Reads a static membership from a JSON file holding an array of peers, as
+// passed to SetStaticPeers.
+func ReadPeersFile(path string) ([]*Peer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []*Peer
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Re-stamps the data directory of a stopped server, such as a copy of another
+// member's directory, so that it can seed a new cluster independent of the
+// original. The conf file and the snapshots are given the new cluster ID, and
+// the snapshots' membership is reduced to the member oldName renamed to
+// newName. Snapshots must be in the "snapshot" directory under dataDir. The
+// membership recorded in the log is not rewritten, so the server must then
+// be started as newName with ForceNewCluster.
+func RestampDataDir(dataDir string, oldName string, newName string, clusterID string) error {
+	if newName == "" || clusterID == "" {
+		return errors.New("raft: Restamp needs a node name and a cluster ID")
+	}
+
+	conf := &Config{}
+	b, err := ioutil.ReadFile(path.Join(dataDir, "conf"))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(path.Join(dataDir, "log")); err != nil {
+			return fmt.Errorf("raft: %s is not a data directory: %s", dataDir, err)
+		}
+	} else if err != nil {
+		return err
+	} else if err := json.Unmarshal(b, conf); err != nil {
+		return err
+	}
+	if conf.ClusterID == clusterID {
+		return fmt.Errorf("raft: Data directory already belongs to cluster %s", clusterID)
+	}
+
+	// Check every snapshot before rewriting any of them.
+	snapshotDir := path.Join(dataDir, "snapshot")
+	filenames, err := ioutil.ReadDir(snapshotDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var snapshots []*Snapshot
+	for _, fi := range filenames {
+		if !strings.HasSuffix(fi.Name(), ".ss") {
+			continue
+		}
+		ss, _, err := readSnapshotFile(path.Join(snapshotDir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		var self *Peer
+		for _, peer := range ss.Peers {
+			if peer.Name == oldName {
+				self = peer
+			}
+		}
+		if self == nil {
+			return fmt.Errorf("raft: Snapshot %s does not include %s", fi.Name(), oldName)
+		}
+		self.Name = newName
+		ss.Peers = []*Peer{self}
+		if ss.Manifest != nil {
+			ss.Manifest.ClusterID = clusterID
+		}
+		snapshots = append(snapshots, ss)
+	}
+
+	for _, ss := range snapshots {
+		if err := ss.save(); err != nil {
+			return err
+		}
+	}
+
+	conf.ClusterID = clusterID
+	conf.Peers = nil
+	b, _ = json.Marshal(conf)
+	tmpConfPath := path.Join(dataDir, "conf.tmp")
+	if err := writeFileSynced(tmpConfPath, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpConfPath, path.Join(dataDir, "conf"))
+}
+
+// ConfigurationChangeEventInfo is the value attached to configuration change
+// events. The event's value holds the members after the change was applied
+// and its previous value the members before it. Index and Term identify the
+// log entry that made the change and Command is its command name.
+type ConfigurationChangeEventInfo struct {
+	Index   uint64  `json:"index"`
+	Term    uint64  `json:"term"`
+	Command string  `json:"command,omitempty"`
+	Peers   []*Peer `json:"peers"`
+}
+
+// Copies the configuration so that it can be handed out.
+func (c *ConfigurationChangeEventInfo) clone() *ConfigurationChangeEventInfo {
+	peers := make([]*Peer, len(c.Peers))
+	for i, peer := range c.Peers {
+		peers[i] = peer.clone()
+	}
+	return &ConfigurationChangeEventInfo{Index: c.Index, Term: c.Term, Command: c.Command, Peers: peers}
+}
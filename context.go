@@ -1,5 +1,10 @@
 package raft
 
+import (
+	"math/rand"
+	"time"
+)
+
 // Context represents the current state of the server. It is passed into
 // a command when the command is being applied since the server methods
 // are locked.
@@ -8,6 +13,13 @@ type Context interface {
 	CurrentTerm() uint64
 	CurrentIndex() uint64
 	CommitIndex() uint64
+	Epoch() uint64
+	Index() uint64
+	Term() uint64
+	IsLeader() bool
+	Time() time.Time
+	Rand() *rand.Rand
+	Abandoned() bool
 }
 
 // context is the concrete implementation of Context.
@@ -16,6 +28,13 @@ type context struct {
 	currentIndex uint64
 	currentTerm  uint64
 	commitIndex  uint64
+	epoch        uint64
+	index        uint64
+	isLeader     bool
+	time         time.Time
+	seed         int64
+	rand         *rand.Rand
+	abandoned    bool
 }
 
 // Server returns a reference to the server.
@@ -37,3 +56,53 @@ func (c *context) CurrentIndex() uint64 {
 func (c *context) CommitIndex() uint64 {
 	return c.commitIndex
 }
+
+// Epoch returns the leadership epoch of the command being applied: the term
+// of the leader that added it to the log. It never decreases from one
+// command to the next, so it can be used to fence external systems.
+func (c *context) Epoch() uint64 {
+	return c.epoch
+}
+
+// Index returns the index of the entry of the command being applied.
+func (c *context) Index() uint64 {
+	return c.index
+}
+
+// Term returns the term of the entry of the command being applied, which is
+// its epoch.
+func (c *context) Term() uint64 {
+	return c.epoch
+}
+
+// IsLeader reports whether the server was the leader when the command was
+// applied. Every server applies the command, so it must change the state
+// machine in the same way either way.
+func (c *context) IsLeader() bool {
+	return c.isLeader
+}
+
+// Time returns the time the leader added the command to its log. Commands
+// must use it rather than their own clock so that every server applies them
+// alike. It follows the clocks of successive leaders, so it may go backwards
+// when the leadership changes.
+func (c *context) Time() time.Time {
+	return c.time
+}
+
+// Rand returns a source of randomness seeded by the leader for the command,
+// which draws the same numbers on every server.
+func (c *context) Rand() *rand.Rand {
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(c.seed))
+	}
+	return c.rand
+}
+
+// Abandoned reports whether the caller that submitted the command to this
+// server has stopped waiting for its result. Only that server knows, so the
+// command must still change the state machine as it does elsewhere; the
+// application may skip any work done only for the caller.
+func (c *context) Abandoned() bool {
+	return c.abandoned
+}
@@ -4,14 +4,32 @@ const (
 	StateChangeEventType  = "stateChange"
 	LeaderChangeEventType = "leaderChange"
 	TermChangeEventType   = "termChange"
-	CommitEventType   = "commit"
+	CommitEventType       = "commit"
+	AbandonEventType      = "abandon"
+	ApplyErrorEventType   = "applyError"
+	ApplyPanicEventType   = "applyPanic"
 	AddPeerEventType      = "addPeer"
 	RemovePeerEventType   = "removePeer"
+	PromotePeerEventType  = "promotePeer"
+	DeadPeerEventType     = "deadPeer"
+
+	QuorumLostEventType     = "quorumLost"
+	QuorumRestoredEventType = "quorumRestored"
+
+	ClockJumpEventType = "clockJump"
+
+	ConfigurationChangeEventType = "configurationChange"
 
 	HeartbeatIntervalEventType        = "heartbeatInterval"
 	ElectionTimeoutThresholdEventType = "electionTimeoutThreshold"
 
 	HeartbeatEventType = "heartbeat"
+
+	SnapshotStartedEventType   = "snapshotStarted"
+	SnapshotCompletedEventType = "snapshotCompleted"
+	SnapshotFailedEventType    = "snapshotFailed"
+	SnapshotSentEventType      = "snapshotSent"
+	SnapshotInstalledEventType = "snapshotInstalled"
 )
 
 // Event represents an action that occurred within the Raft library.
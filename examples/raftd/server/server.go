@@ -93,10 +93,10 @@ func (s *Server) ListenAndServe(leader string) error {
 
 		log.Println("Initializing new cluster")
 
-		_, err := s.raftServer.Do(&raft.DefaultJoinCommand{
+		err := s.raftServer.Bootstrap([]*raft.Peer{{
 			Name:             s.raftServer.Name(),
 			ConnectionString: s.connectionString(),
-		})
+		}})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -133,6 +133,7 @@ func (s *Server) Join(leader, apiPath string) error {
 	command := &raft.DefaultJoinCommand{
 		Name:             s.raftServer.Name(),
 		ConnectionString: s.connectionString(),
+		ClusterID:        s.raftServer.ClusterID(),
 	}
 
 	var b bytes.Buffer
@@ -0,0 +1,96 @@
+package raft
+
+import (
+	gocontext "context"
+	"sync"
+	"sync/atomic"
+)
+
+// A Future is the pending result of a command executed with DoAsync. Its
+// methods may be called from any goroutine.
+type Future struct {
+	// The index and the term the command was appended at. They are accessed
+	// atomically.
+	index uint64
+	term  uint64
+
+	e       *ev
+	done    chan struct{}
+	stopped chan bool
+	once    sync.Once
+	err     error
+}
+
+// Creates a future for a command executed by a server that closes stopped
+// when it stops.
+func newFuture(command Command, stopped chan bool) *Future {
+	f := &Future{done: make(chan struct{}), stopped: stopped}
+	f.e = &ev{target: command, errChan: make(chan error, 1), future: f}
+	return f
+}
+
+// Done returns a channel that is closed once the command has been applied or
+// has failed. It is not closed if the server stops first.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Index returns the index the command was appended to the log at, or zero
+// if it has not been appended by this server.
+func (f *Future) Index() uint64 {
+	return atomic.LoadUint64(&f.index)
+}
+
+// Term returns the term the command was appended to the log in, or zero if
+// it has not been appended by this server.
+func (f *Future) Term() uint64 {
+	return atomic.LoadUint64(&f.term)
+}
+
+// Records the entry the command was appended as.
+func (f *Future) appended(entry *LogEntry) {
+	atomic.StoreUint64(&f.index, entry.Index())
+	atomic.StoreUint64(&f.term, entry.Term())
+}
+
+// Err waits for the command and returns the error it failed with, or
+// StopError if the server stops first.
+func (f *Future) Err() error {
+	if err := f.wait(gocontext.Background()); err != nil {
+		return err
+	}
+	return f.err
+}
+
+// Result waits for the command and returns the value and the error it was
+// applied with, as Do does.
+func (f *Future) Result() (interface{}, error) {
+	if err := f.wait(gocontext.Background()); err != nil {
+		return nil, err
+	}
+	return f.e.returnValue, f.err
+}
+
+// Waits until the command is done. It returns StopError if the server stops
+// first and ctx.Err() if ctx is done first.
+func (f *Future) wait(ctx gocontext.Context) error {
+	select {
+	case <-f.done:
+	case <-f.stopped:
+		select {
+		case <-f.done:
+		default:
+			return StopError
+		}
+	case <-ctx.Done():
+		select {
+		case <-f.done:
+		default:
+			return ctx.Err()
+		}
+	}
+	f.once.Do(func() {
+		f.err = <-f.e.errChan
+	})
+	return nil
+}
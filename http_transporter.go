@@ -2,13 +2,18 @@ package raft
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
+
+	"github.com/iproj/raft/protobuf"
 )
 
 // Parts from this transporter were heavily influenced by Peter Bougon's
@@ -30,8 +35,12 @@ type HTTPTransporter struct {
 	snapshotPath         string
 	snapshotRecoveryPath string
 	redirectPath         string
+	forwardPath          string
 	peerJoinPath         string
+	validateJoinPath     string
 	peerRemovePath       string
+	logPath              string
+	pingPath             string
 	httpClient           http.Client
 	Transport            *http.Transport
 }
@@ -56,8 +65,12 @@ func NewHTTPTransporter(prefix string, timeout time.Duration) *HTTPTransporter {
 		snapshotPath:         joinPath(prefix, "/snapshot"),
 		snapshotRecoveryPath: joinPath(prefix, "/snapshotRecovery"),
 		redirectPath:         joinPath(prefix, "/redirect"),
+		forwardPath:          joinPath(prefix, "/forward"),
 		peerJoinPath:         joinPath(prefix, "/join"),
+		validateJoinPath:     joinPath(prefix, "/validateJoin"),
 		peerRemovePath:       joinPath(prefix, "/remove"),
+		logPath:              joinPath(prefix, "/log"),
+		pingPath:             joinPath(prefix, "/ping"),
 		Transport:            &http.Transport{DisableKeepAlives: false},
 	}
 	t.httpClient.Transport = t.Transport
@@ -80,10 +93,20 @@ func (t *HTTPTransporter) RedirectPath() string {
 	return t.redirectPath
 }
 
+// Retrieves the path commands are forwarded to the leader on.
+func (t *HTTPTransporter) ForwardPath() string {
+	return t.forwardPath
+}
+
 func (t *HTTPTransporter) PeerJoinPath() string {
 	return t.peerJoinPath
 }
 
+// Retrieves the dry-run join path.
+func (t *HTTPTransporter) ValidateJoinPath() string {
+	return t.validateJoinPath
+}
+
 // Retrieves the AppendEntries path.
 func (t *HTTPTransporter) AppendEntriesPath() string {
 	return t.appendEntriesPath
@@ -104,6 +127,16 @@ func (t *HTTPTransporter) SnapshotRecoveryPath() string {
 	return t.snapshotRecoveryPath
 }
 
+// Retrieves the committed log path.
+func (t *HTTPTransporter) LogPath() string {
+	return t.logPath
+}
+
+// Retrieves the ping path.
+func (t *HTTPTransporter) PingPath() string {
+	return t.pingPath
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -121,7 +154,11 @@ func (t *HTTPTransporter) Install(server Server, mux HTTPMuxer) {
 	mux.HandleFunc(t.SnapshotPath(), t.snapshotHandler(server))
 	mux.HandleFunc(t.SnapshotRecoveryPath(), t.snapshotRecoveryHandler(server))
 	mux.HandleFunc(t.peerJoinPath, t.peerJoinHandler(server))
+	mux.HandleFunc(t.validateJoinPath, t.validateJoinHandler(server))
 	mux.HandleFunc(t.peerRemovePath, t.peerRemoveHandler(server))
+	mux.HandleFunc(t.LogPath(), t.logHandler(server))
+	mux.HandleFunc(t.PingPath(), t.pingHandler(server))
+	mux.HandleFunc(t.ForwardPath(), t.forwardHandler(server))
 }
 
 //--------------------------------------
@@ -174,6 +211,56 @@ func (t *HTTPTransporter) Redirect(server Server, command Command) error {
 	return nil
 }
 
+// Sends a command to the leader to be executed, and returns the result it
+// was applied with. The result is sent as JSON, and decoded as the type
+// registered for the command with RegisterCommandResult, or into a generic
+// value, such as a float64 for any number, if there is none. The token of the
+// identity ctx carries is sent as a bearer token, as the client sent it.
+func (t *HTTPTransporter) Forward(ctx gocontext.Context, server Server, leader *Peer, command Command) (interface{}, error) {
+	entry, err := newLogEntry(nil, nil, 0, 0, command)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if _, err := entry.Encode(&b); err != nil {
+		return nil, err
+	}
+
+	url := joinPath(leader.ConnectionString, t.ForwardPath())
+	traceln(server.Name(), "POST", url)
+
+	httpReq, err := http.NewRequest("POST", url, &b)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/protobuf")
+	if identity := IdentityFromContext(ctx); identity != nil && identity.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+identity.Token)
+	}
+	httpResp, err := t.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("Post %s failed: %v", url, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid http code: %d", httpResp.StatusCode)
+	}
+
+	// The result is kept raw until the type to decode it as is known.
+	resp := &struct {
+		forwardResponse
+		Value json.RawMessage `json:"value,omitempty"`
+	}{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+	value, err := decodeCommandResult(command, resp.Value)
+	if err != nil {
+		return nil, err
+	}
+	return value, resp.error()
+}
+
 // Sends a RequestVote RPC to a peer.
 func (t *HTTPTransporter) SendVoteRequest(server Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
 	var b bytes.Buffer
@@ -264,6 +351,80 @@ func (t *HTTPTransporter) SendSnapshotRecoveryRequest(server Server, peer *Peer,
 	return resp
 }
 
+// Checks whether a peer answers.
+func (t *HTTPTransporter) Ping(server Server, peer *Peer) bool {
+	url := joinPath(peer.ConnectionString, t.PingPath())
+	traceln(server.Name(), "GET", url)
+
+	httpResp, err := t.httpClient.Get(url)
+	if err != nil {
+		traceln("transporter.ping.response.error:", err)
+		return false
+	}
+	httpResp.Body.Close()
+	return httpResp.StatusCode == http.StatusOK
+}
+
+// Asks the leader at connectionString whether a join would be accepted,
+// before the join is proposed.
+func (t *HTTPTransporter) ValidateJoin(connectionString string, command *DefaultJoinCommand) (*JoinVerdict, error) {
+	bytez, _ := json.Marshal(command)
+	url := joinPath(connectionString, t.ValidateJoinPath())
+	traceln("POST", url)
+
+	httpResp, err := t.httpClient.Post(url, "application/json", bytes.NewReader(bytez))
+	if err != nil {
+		return nil, fmt.Errorf("Post %s failed: %v", url, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid http code: %d", httpResp.StatusCode)
+	}
+
+	verdict := &JoinVerdict{}
+	if err := json.NewDecoder(httpResp.Body).Decode(verdict); err != nil {
+		return nil, err
+	}
+	return verdict, nil
+}
+
+// Retrieves committed entries after index from a server for a process that
+// follows the log without being a member. Either the entries or, if they
+// have been compacted, a snapshot to restore from are returned. Both are
+// empty when the reader is up to date.
+func (t *HTTPTransporter) FetchCommittedEntries(connectionString string, index uint64) ([]*LogEntry, *Snapshot, error) {
+	url := fmt.Sprintf("%s?index=%d", joinPath(connectionString, t.LogPath()), index)
+	traceln("GET", url)
+
+	httpResp, err := t.httpClient.Get(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Get %s failed: %v", url, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Invalid http code: %d", httpResp.StatusCode)
+	}
+
+	if httpResp.Header.Get("Content-Type") == "application/json" {
+		snapshot := &Snapshot{}
+		if err := json.NewDecoder(httpResp.Body).Decode(snapshot); err != nil {
+			return nil, nil, err
+		}
+		return nil, snapshot, nil
+	}
+
+	var entries []*LogEntry
+	for {
+		entry := &LogEntry{pb: &protobuf.LogEntry{}}
+		if _, err := entry.Decode(httpResp.Body); err == io.EOF {
+			return entries, nil, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
 //--------------------------------------
 // Incoming
 //--------------------------------------
@@ -271,6 +432,10 @@ func (t *HTTPTransporter) SendSnapshotRecoveryRequest(server Server, peer *Peer,
 func (t *HTTPTransporter) peerRemoveHandler(server Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		debugln(server.Name(), "RECV /remove")
+		if server.StaticMembership() {
+			http.Error(w, StaticMembershipError.Error(), http.StatusForbidden)
+			return
+		}
 		command := &DefaultLeaveCommand{}
 		if err := json.NewDecoder(r.Body).Decode(command); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -281,7 +446,10 @@ func (t *HTTPTransporter) peerRemoveHandler(server Server) http.HandlerFunc {
 			http.Error(w, fmt.Sprintf("Invalid peer: %s", command.Name), http.StatusBadRequest)
 			return
 		}
-		if _, err := server.Do(command); err != nil {
+		if _, err := server.DoContext(WithIdentity(gocontext.Background(), requestIdentity(r)), command); errors.Is(err, UnauthorizedError) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -291,24 +459,208 @@ func (t *HTTPTransporter) peerRemoveHandler(server Server) http.HandlerFunc {
 func (t *HTTPTransporter) peerJoinHandler(server Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		debugln(server.Name(), "RECV /join")
+		if server.StaticMembership() {
+			http.Error(w, StaticMembershipError.Error(), http.StatusForbidden)
+			return
+		}
 		command := &DefaultJoinCommand{}
 		if err := json.NewDecoder(r.Body).Decode(command); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		_, ok := server.Peers()[command.Name]
-		if ok {
+		if id := server.ClusterID(); command.ClusterID != "" && id != "" && command.ClusterID != id {
+			http.Error(w, fmt.Sprintf("Cluster mismatch: %s", command.ClusterID), http.StatusForbidden)
+			return
+		}
+		// A member rejoining from a new address has its address changed.
+		if peer, ok := server.Peers()[command.Name]; ok && peer.ConnectionString == command.ConnectionString {
 			http.Error(w, fmt.Sprintf("Already exist: %s", command.Name), http.StatusAlreadyReported)
 			return
 		}
-		if len(server.Peers()) >= server.MaxPeerCount() {
+		if _, err := server.DoContext(WithIdentity(gocontext.Background(), requestIdentity(r)), command); err == ClusterFullError {
 			http.Error(w, "Can't be joined", http.StatusNotAcceptable)
 			return
+		} else if err == DeniedPeerError || errors.Is(err, UnauthorizedError) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Handles dry-run joins from prospective members.
+func (t *HTTPTransporter) validateJoinHandler(server Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		debugln(server.Name(), "RECV /validateJoin")
+		if server.StaticMembership() {
+			http.Error(w, StaticMembershipError.Error(), http.StatusForbidden)
+			return
+		}
+		command := &DefaultJoinCommand{}
+		if err := json.NewDecoder(r.Body).Decode(command); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		verdict, err := server.ValidateJoin(command)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
-		if _, err := server.Do(command); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(verdict)
+	}
+}
+
+// Handles incoming pings.
+func (t *HTTPTransporter) pingHandler(server Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceln(server.Name(), "RECV /ping")
+	}
+}
+
+// The result of a forwarded command. The leader is named if the command
+// failed because the server was not the leader.
+type forwardResponse struct {
+	Value            interface{} `json:"value,omitempty"`
+	Err              string      `json:"err,omitempty"`
+	Leader           string      `json:"leader,omitempty"`
+	ConnectionString string      `json:"connectionString,omitempty"`
+
+	// Set for an error that wraps Err, so that it is rebuilt as the type that
+	// errors.Is and errors.As expect, with the condition of a conflict.
+	Kind      string `json:"kind,omitempty"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// The kinds of forwarded errors that wrap another.
+const (
+	forwardedUnauthorized = "unauthorized"
+	forwardedConflict     = "conflict"
+)
+
+// The errors that keep their identity when a forwarded command fails.
+var forwardedErrors = []error{
+	NotLeaderError,
+	StopError,
+	CommandTimeoutError,
+	NoQuorumError,
+	ClusterFullError,
+	DeniedPeerError,
+	StaticMembershipError,
+	DuplicateCommandError,
+	CommandTooLargeError,
+	OverloadedError,
+	HaltedError,
+}
+
+// Records the error of a forwarded command.
+func (resp *forwardResponse) setError(err error) {
+	resp.Err = err.Error()
+	if hint, ok := err.(*LeaderHintError); ok {
+		resp.Err = NotLeaderError.Error()
+		resp.Leader = hint.Leader
+		resp.ConnectionString = hint.ConnectionString
+	}
+	switch e := err.(type) {
+	case *AuthorizationError:
+		resp.Err = e.Err.Error()
+		resp.Kind = forwardedUnauthorized
+	case *ConflictError:
+		resp.Err = e.Err.Error()
+		resp.Kind = forwardedConflict
+		resp.Condition = e.Condition
+	}
+}
+
+// Recovers the error of a forwarded command.
+func (resp *forwardResponse) error() error {
+	if resp.Err == "" {
+		return nil
+	}
+	if resp.Leader != "" {
+		return &LeaderHintError{Leader: resp.Leader, ConnectionString: resp.ConnectionString}
+	}
+	switch resp.Kind {
+	case forwardedUnauthorized:
+		return &AuthorizationError{Err: errors.New(resp.Err)}
+	case forwardedConflict:
+		return &ConflictError{Condition: resp.Condition, Err: errors.New(resp.Err)}
+	}
+	for _, err := range forwardedErrors {
+		if err.Error() == resp.Err {
+			return err
+		}
+	}
+	return errors.New(resp.Err)
+}
+
+// Handles commands forwarded by followers. They are only executed by the
+// leader, so that a command is never forwarded twice.
+func (t *HTTPTransporter) forwardHandler(server Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceln(server.Name(), "RECV /forward")
+
+		entry := &LogEntry{pb: &protobuf.LogEntry{}}
+		if _, err := entry.Decode(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := &forwardResponse{}
+		if max := server.MaxCommandSize(); max > 0 && len(entry.pb.Command) > max {
+			resp.setError(CommandTooLargeError)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		command, err := entry.decodeCommand()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if server.State() != Leader {
+			resp.setError(notLeaderError(server))
+		} else if value, err := server.DoContext(WithIdentity(gocontext.Background(), requestIdentity(r)), command); err != nil {
+			resp.setError(err)
+		} else {
+			resp.Value = value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Handles requests for committed entries from processes following the log.
+func (t *HTTPTransporter) logHandler(server Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceln(server.Name(), "RECV /log")
+
+		index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+
+		entries, snapshot, err := server.CommittedEntries(index, 0)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		if snapshot != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(snapshot)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/protobuf")
+		for _, entry := range entries {
+			if _, err := entry.Encode(w); err != nil {
+				return
+			}
+		}
 	}
 }
 
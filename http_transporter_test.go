@@ -1,9 +1,13 @@
 package raft
 
 import (
+	gocontext "context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -151,3 +155,253 @@ func send(c chan bool, s Server) {
 	}
 	c <- true
 }
+
+// Ensure that a process outside the cluster can fetch committed entries.
+func TestHTTPTransporterFetchCommittedEntries(t *testing.T) {
+	transporter := NewHTTPTransporter("/raft", testElectionTimeout)
+	server := newTestServer("1", &testTransporter{})
+	server.Start()
+	defer server.Stop()
+
+	if _, err := server.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := server.Do(&testCommand1{Val: "foo", I: 10}); err != nil {
+		t.Fatalf("Unable to apply command: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	transporter.Install(server, mux)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	entries, snapshot, err := transporter.FetchCommittedEntries(httpServer.URL, 1)
+	if err != nil {
+		t.Fatalf("Unable to fetch entries: %v", err)
+	}
+	if snapshot != nil || len(entries) != int(server.CommitIndex()-1) {
+		t.Fatalf("Invalid entries: %v %v", entries, snapshot)
+	}
+	if last := entries[len(entries)-1]; last.Index() != server.CommitIndex() {
+		t.Fatalf("Invalid last entry: %d", last.Index())
+	}
+	found := false
+	for _, entry := range entries {
+		found = found || entry.CommandName() == "cmd_1"
+	}
+	if !found {
+		t.Fatalf("Expected command entry in %v", entries)
+	}
+
+	entries, snapshot, err = transporter.FetchCommittedEntries(httpServer.URL, server.CommitIndex())
+	if err != nil || len(entries) != 0 || snapshot != nil {
+		t.Fatalf("Expected no entries when up to date: %v %v %v", entries, snapshot, err)
+	}
+}
+
+// Ensure that a peer can be pinged.
+func TestHTTPTransporterPing(t *testing.T) {
+	transporter := NewHTTPTransporter("/raft", testElectionTimeout)
+	server := newTestServer("1", &testTransporter{})
+
+	mux := http.NewServeMux()
+	transporter.Install(server, mux)
+	httpServer := httptest.NewServer(mux)
+
+	peer := &Peer{Name: "2", ConnectionString: httpServer.URL}
+	if !transporter.Ping(server, peer) {
+		t.Fatalf("Peer should answer")
+	}
+	httpServer.Close()
+	if transporter.Ping(server, peer) {
+		t.Fatalf("Closed peer should not answer")
+	}
+}
+
+// Ensure that commands are forwarded to the leader and return its result.
+func TestHTTPTransporterForward(t *testing.T) {
+	transporter := NewHTTPTransporter("/raft", testElectionTimeout)
+	server := newTestServer("1", &testTransporter{})
+	server.Start()
+	defer server.Stop()
+
+	mux := http.NewServeMux()
+	transporter.Install(server, mux)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	leader := &Peer{Name: "1", ConnectionString: httpServer.URL}
+	if _, err := transporter.Forward(gocontext.Background(), server, leader, &testEpochCommand{}); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+
+	if _, err := server.Do(&DefaultJoinCommand{Name: server.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	// Results without a registered type come back as generic JSON values.
+	value, err := transporter.Forward(gocontext.Background(), server, leader, &testEpochCommand{})
+	if err != nil || value != float64(server.Term()) {
+		t.Fatalf("Unexpected result: %v %v", value, err)
+	}
+	value, err = transporter.Forward(gocontext.Background(), server, leader, &testIdempotentCommand{})
+	if err != nil || value != server.CommitIndex() {
+		t.Fatalf("Expected the registered result type: %T %v %v", value, value, err)
+	}
+
+	// Conflicts come back with the condition that did not hold.
+	server.SetConditionChecker(versionChecker("v1"))
+	_, err = transporter.Forward(gocontext.Background(), server, leader, NewConditionalCommand("v0", &testEpochCommand{}))
+	if conflict := new(ConflictError); !errors.As(err, &conflict) || !errors.Is(err, ConditionFailedError) || conflict.Condition != "v0" || conflict.Err.Error() != "version is v1" {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+
+	server.SetMaxCommandSize(8)
+	if _, err := transporter.Forward(gocontext.Background(), server, leader, &testCommand1{Val: "foo"}); err != CommandTooLargeError {
+		t.Fatalf("Expected CommandTooLargeError, got %v", err)
+	}
+}
+
+// Ensure that the errors forwarded commands fail with keep their identity.
+func TestHTTPTransporterForwardedErrors(t *testing.T) {
+	for _, err := range forwardedErrors {
+		resp := &forwardResponse{}
+		resp.setError(err)
+		if resp.error() != err {
+			t.Fatalf("Expected %v, got %v", err, resp.error())
+		}
+	}
+}
+
+// Ensure that a follower forwarding a command to an overloaded leader can
+// tell that it is to be retried.
+func TestHTTPTransporterForwardOverloaded(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	peers := &testTransporter{}
+	peers.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	server := newTestServer("1", peers)
+	server.Start()
+	defer server.Stop()
+	if _, err := server.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := server.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	transporter := NewHTTPTransporter("/raft", testElectionTimeout)
+	mux := http.NewServeMux()
+	transporter.Install(server, mux)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	server.SetMaxPendingCommands(1)
+	server.DoAsync(&testCommand1{})
+
+	leader := &Peer{Name: "1", ConnectionString: httpServer.URL}
+	if _, err := transporter.Forward(gocontext.Background(), server, leader, &testCommand1{}); !errors.Is(err, OverloadedError) {
+		t.Fatalf("Expected OverloadedError, got %v", err)
+	}
+}
+
+// Ensure that a follower returns the result of the commands it forwards,
+// whether it waits for them or not.
+func TestHTTPTransporterForwardResult(t *testing.T) {
+	leader := newTestServer("1", &testTransporter{})
+	leader.Start()
+	defer leader.Stop()
+	if _, err := leader.Do(&DefaultJoinCommand{Name: leader.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewHTTPTransporter("/raft", testElectionTimeout).Install(leader, mux)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	follower := newTestServer("2", NewHTTPTransporter("/raft", testElectionTimeout))
+	follower.SetElectionTimeout(time.Hour)
+	follower.AddPeer("1", httpServer.URL)
+	follower.Start()
+	defer follower.Stop()
+	if resp := follower.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "1", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+
+	result, err := follower.DoResult(gocontext.Background(), &testIdempotentCommand{})
+	if err != nil || result.Value != leader.CommitIndex() {
+		t.Fatalf("Unexpected forwarded result: %v %v", result.Value, err)
+	}
+	value, err := follower.DoAsync(&testIdempotentCommand{}).Result()
+	if err != nil || value != leader.CommitIndex() {
+		t.Fatalf("Unexpected forwarded result: %v %v", value, err)
+	}
+}
+
+// Ensure that the transporter's handlers authorize commands with the identity
+// of the request.
+func TestHTTPTransporterAuthorization(t *testing.T) {
+	transporter := NewHTTPTransporter("/raft", testElectionTimeout)
+	server := newTestServer("1", &testTransporter{})
+	server.Start()
+	defer server.Stop()
+	if _, err := server.Do(&DefaultJoinCommand{Name: server.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	server.SetAuthorizer(authorizerFunc(func(identity *Identity, command Command) error {
+		if identity == nil || identity.Token != "admin" || identity.Addr == "" {
+			return errors.New("admin only")
+		}
+		return nil
+	}))
+
+	mux := http.NewServeMux()
+	transporter.Install(server, mux)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	join := func(token string) int {
+		req, _ := http.NewRequest("POST", httpServer.URL+transporter.PeerJoinPath(), strings.NewReader(`{"name":"2","connectionString":"http://2","role":"learner"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to join: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := join(""); code != http.StatusForbidden {
+		t.Fatalf("Expected the join to be forbidden, got %d", code)
+	}
+	if code := join("admin"); code != http.StatusOK {
+		t.Fatalf("Unable to join as admin: %d", code)
+	}
+
+	// The transporter forwards commands with the token they were submitted
+	// with.
+	leader := &Peer{Name: "1", ConnectionString: httpServer.URL}
+	if _, err := transporter.Forward(gocontext.Background(), server, leader, &testCommand1{Val: "foo"}); !errors.Is(err, UnauthorizedError) || errors.Unwrap(err).Error() != "admin only" {
+		t.Fatalf("Expected the forwarded command to be refused, got %v", err)
+	}
+	ctx := WithIdentity(gocontext.Background(), &Identity{Token: "admin"})
+	if _, err := transporter.Forward(ctx, server, leader, &testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to forward as admin: %v", err)
+	}
+}
+
+type authorizerFunc func(identity *Identity, command Command) error
+
+func (f authorizerFunc) Authorize(identity *Identity, command Command) error {
+	return f(identity, command)
+}
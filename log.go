@@ -2,12 +2,14 @@ package raft
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/iproj/raft/protobuf"
 )
 
@@ -20,6 +22,8 @@ import (
 // A log is a collection of log entries that are persisted to durable storage.
 type Log struct {
 	ApplyFunc   func(*LogEntry, Command) (interface{}, error)
+	BatchFunc   func(entries []*LogEntry, apply func())
+	ReadsFunc   func(entries []*LogEntry, commands []Command) ([]interface{}, []error)
 	file        *os.File
 	path        string
 	entries     []*LogEntry
@@ -30,6 +34,11 @@ type Log struct {
 	initialized bool
 }
 
+// Returned by ApplyFunc for an entry that is to be applied again later. The
+// commit index stops before the entry, so that it and the entries after it
+// are applied the next time the commit index is set.
+var errApplyLater = errors.New("raft: Entry is to be applied later")
+
 // The results of the applying a log entry.
 type logResult struct {
 	returnValue interface{}
@@ -178,11 +187,13 @@ func (l *Log) open(path string) error {
 			// Append entry.
 			l.entries = append(l.entries, entry)
 			if entry.Index() <= l.commitIndex {
-				command, err := newCommand(entry.CommandName(), entry.Command())
+				command, err := entry.decodeCommand()
 				if err != nil {
 					continue
 				}
-				l.ApplyFunc(entry, command)
+				if _, err := l.ApplyFunc(entry, command); err == errApplyLater {
+					l.commitIndex = entry.Index() - 1
+				}
 			}
 			debugln("open.log.append log index ", entry.Index())
 		}
@@ -262,7 +273,7 @@ func (l *Log) getEntriesAfter(index uint64, maxLogEntriesPerRequest uint64) ([]*
 		return l.entries, l.startTerm
 	}
 
-	traceln("log.entriesAfter.partial: ", index, " ", l.entries[len(l.entries)-1].Index)
+	traceln("log.entriesAfter.partial: ", index, " ", l.entries[len(l.entries)-1].Index())
 
 	entries := l.entries[index-l.startIndex:]
 	length := len(entries)
@@ -277,6 +288,23 @@ func (l *Log) getEntriesAfter(index uint64, maxLogEntriesPerRequest uint64) ([]*
 	}
 }
 
+// Retrieves the encoded size of the entries after the given index. Counting
+// stops once limit is reached so the cost is bounded for large logs.
+func (l *Log) sizeAfter(index uint64, limit int64) int64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if index < l.startIndex {
+		index = l.startIndex
+	}
+
+	var size int64
+	for i := index - l.startIndex; i < uint64(len(l.entries)) && size < limit; i++ {
+		size += int64(proto.Size(l.entries[i].pb))
+	}
+	return size
+}
+
 //--------------------------------------
 // Commit
 //--------------------------------------
@@ -285,6 +313,11 @@ func (l *Log) getEntriesAfter(index uint64, maxLogEntriesPerRequest uint64) ([]*
 func (l *Log) commitInfo() (index uint64, term uint64) {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
+	return l.internalCommitInfo()
+}
+
+// The last committed index and term, without the lock.
+func (l *Log) internalCommitInfo() (index uint64, term uint64) {
 	// If we don't have any committed entries then just return zeros.
 	if l.commitIndex == 0 {
 		return 0, 0
@@ -358,40 +391,165 @@ func (l *Log) setCommitIndex(index uint64) error {
 	}
 
 	// Find all entries whose index is between the previous index and the current index.
+	var batch, reads []*LogEntry
+	var commands, readCommands []Command
 	for i := l.commitIndex + 1; i <= index; i++ {
 		entryIndex := i - 1 - l.startIndex
 		entry := l.entries[entryIndex]
 
-		// Update commit index.
-		l.commitIndex = entry.Index()
-
 		// Decode the command.
-		command, err := newCommand(entry.CommandName(), entry.Command())
+		command, err := entry.decodeCommand()
 		if err != nil {
+			if l.applyReads(reads, readCommands) || l.applyBatch(batch, commands) {
+				return nil
+			}
+			l.commitIndex = entry.Index()
 			return err
 		}
 
+		// Consecutive read-only commands are applied together, concurrently.
+		if isReadOnly(entry, command) {
+			if l.applyBatch(batch, commands) {
+				return nil
+			}
+			batch, commands = nil, nil
+			reads = append(reads, entry)
+			readCommands = append(readCommands, command)
+			continue
+		}
+		if l.applyReads(reads, readCommands) {
+			return nil
+		}
+		reads, readCommands = nil, nil
+
+		// Commands are batched up to the next configuration change, which is
+		// applied on its own.
+		if l.BatchFunc != nil && !isConfigurationCommand(command) {
+			batch = append(batch, entry)
+			commands = append(commands, command)
+			continue
+		}
+		if l.applyBatch(batch, commands) {
+			return nil
+		}
+		batch, commands = nil, nil
+
 		// Apply the changes to the state machine and store the error code.
+		l.commitIndex = entry.Index()
 		returnValue, err := l.ApplyFunc(entry, command)
-
 		debugf("setCommitIndex.set.result index: %v, entries index: %v", i, entryIndex)
-		if entry.event != nil {
-			entry.event.returnValue = returnValue
-			entry.event.errChan <- err
+		if err == errApplyLater {
+			l.commitIndex = entry.Index() - 1
+			return nil
 		}
+		entry.applied(returnValue, err)
 
-		_, isJoinCommand := command.(JoinCommand)
-
-		// we can only commit up to the most recent join command
-		// if there is a join in this batch of commands.
+		// we can only commit up to the most recent configuration
+		// change if there is one in this batch of commands.
 		// after this commit, we need to recalculate the majority.
-		if isJoinCommand {
+		if isConfigurationCommand(command) {
 			return nil
 		}
 	}
+	if !l.applyReads(reads, readCommands) {
+		l.applyBatch(batch, commands)
+	}
 	return nil
 }
 
+// Checks whether the command of an entry can be applied concurrently with
+// other read-only commands.
+func isReadOnly(entry *LogEntry, command Command) bool {
+	c, ok := command.(ReadOnlyCommand)
+	return ok && c.ReadOnly() && entry.ClientID() == "" && entry.IdempotencyKey() == "" && !isConfigurationCommand(command)
+}
+
+// Applies consecutive read-only commands concurrently and replies to their
+// events once all of them have been applied. The commit index is that of the
+// last of them while they are applied. It returns whether one of them is to
+// be applied later, in which case the commit index is left before it and the
+// entries from it on are not replied to. The lock must be held.
+func (l *Log) applyReads(entries []*LogEntry, commands []Command) bool {
+	if len(entries) == 0 {
+		return false
+	}
+
+	l.commitIndex = entries[len(entries)-1].Index()
+	var returnValues []interface{}
+	var errs []error
+	if l.ReadsFunc != nil {
+		returnValues, errs = l.ReadsFunc(entries, commands)
+	} else {
+		returnValues = make([]interface{}, len(entries))
+		errs = make([]error, len(entries))
+		applyConcurrently(len(entries), func(i int) {
+			returnValues[i], errs[i] = l.ApplyFunc(entries[i], commands[i])
+		})
+	}
+
+	for i, entry := range entries {
+		if errs[i] == errApplyLater {
+			l.commitIndex = entry.Index() - 1
+			return true
+		}
+		entry.applied(returnValues[i], errs[i])
+	}
+	return false
+}
+
+// Calls apply with each index below n, concurrently, and returns once all of
+// the calls have.
+func applyConcurrently(n int, apply func(i int)) {
+	var wg sync.WaitGroup
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			apply(i)
+		}(i)
+	}
+	apply(0)
+	wg.Wait()
+}
+
+// Applies consecutive entries in one call to the batch function and replies
+// to their events once it has returned. It returns whether one of them is to
+// be applied later, in which case the entries after it are not applied, the
+// commit index is left before it and the entries from it on are not replied
+// to. The lock must be held.
+func (l *Log) applyBatch(entries []*LogEntry, commands []Command) bool {
+	if len(entries) == 0 {
+		return false
+	}
+
+	returnValues := make([]interface{}, len(entries))
+	errs := make([]error, len(entries))
+	applied := false
+	later := len(entries)
+	apply := func() {
+		if applied {
+			return
+		}
+		applied = true
+		for i, entry := range entries {
+			l.commitIndex = entry.Index()
+			returnValues[i], errs[i] = l.ApplyFunc(entry, commands[i])
+			if errs[i] == errApplyLater {
+				l.commitIndex = entry.Index() - 1
+				later = i
+				return
+			}
+		}
+	}
+	l.BatchFunc(entries, apply)
+	apply()
+
+	for i, entry := range entries[:later] {
+		entry.applied(returnValues[i], errs[i])
+	}
+	return later < len(entries)
+}
+
 // Set the commitIndex at the head of the log file to the current
 // commit Index. This should be called after obtained a log lock
 func (l *Log) flushCommitIndex() {
@@ -432,7 +590,7 @@ func (l *Log) truncate(index uint64, term uint64) error {
 		// notify clients if this node is the previous leader
 		for _, entry := range l.entries {
 			if entry.event != nil {
-				entry.event.errChan <- errors.New("command failed to be committed due to node failure")
+				entry.event.reply(errors.New("command failed to be committed due to node failure"))
 			}
 		}
 
@@ -456,7 +614,7 @@ func (l *Log) truncate(index uint64, term uint64) error {
 			for i := index - l.startIndex; i < uint64(len(l.entries)); i++ {
 				entry := l.entries[i]
 				if entry.event != nil {
-					entry.event.errChan <- errors.New("command failed to be committed due to node failure")
+					entry.event.reply(errors.New("command failed to be committed due to node failure"))
 				}
 			}
 
@@ -506,6 +664,44 @@ func (l *Log) appendEntries(entries []*protobuf.LogEntry) error {
 	return nil
 }
 
+// Creates entries for a series of commands and writes them to the end of the
+// log in a single write. No entry is appended if one cannot be encoded.
+func (l *Log) appendCommands(term uint64, commands []Command, events []*ev) ([]*LogEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil, errors.New("raft.Log: Log is not open")
+	}
+
+	index := l.internalCurrentIndex() + 1
+	position, _ := l.file.Seek(0, os.SEEK_CUR)
+
+	var buf bytes.Buffer
+	entries := make([]*LogEntry, len(commands))
+	for i, command := range commands {
+		entry, err := newLogEntry(l, events[i], index+uint64(i), term, command)
+		if err != nil {
+			return nil, err
+		}
+		entry.Position = position + int64(buf.Len())
+		if _, err := entry.Encode(&buf); err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+	}
+
+	// Write to storage.
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Append to entries list if stored on disk.
+	l.entries = append(l.entries, entries...)
+
+	return entries, nil
+}
+
 // Writes a single log entry to the end of the log.
 func (l *Log) appendEntry(entry *LogEntry) error {
 	l.mutex.Lock()
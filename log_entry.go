@@ -2,9 +2,10 @@ package raft
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/iproj/raft/protobuf"
@@ -24,22 +25,38 @@ func newLogEntry(log *Log, event *ev, index uint64, term uint64, command Command
 	var commandName string
 	if command != nil {
 		commandName = command.CommandName()
-		if encoder, ok := command.(CommandEncoder); ok {
-			if err := encoder.Encode(&buf); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := json.NewEncoder(&buf).Encode(command); err != nil {
-				return nil, err
-			}
+		if err := commandCodec(command).Encode(&buf, command); err != nil {
+			return nil, err
 		}
 	}
 
+	// Entries are only created by the leader, so every server applies the
+	// command with the leader's time and seed.
 	pb := &protobuf.LogEntry{
 		Index:       proto.Uint64(index),
 		Term:        proto.Uint64(term),
 		CommandName: proto.String(commandName),
 		Command:     buf.Bytes(),
+		Timestamp:   proto.Int64(time.Now().UnixNano()),
+		Seed:        proto.Int64(rand.Int63()),
+	}
+	if version := commandVersions[commandName]; version != 0 {
+		pb.CommandVersion = proto.Uint32(version)
+	}
+	if id := commandIDs[commandName]; id != 0 {
+		pb.CommandName = proto.String("")
+		pb.CommandID = proto.Uint32(id)
+	}
+
+	// A conditional command is in the session and has the idempotency key of
+	// the command it wraps.
+	inner := unwrapCondition(command)
+	if c, ok := inner.(ClientCommand); ok && c.ClientID() != "" {
+		pb.ClientID = proto.String(c.ClientID())
+		pb.Sequence = proto.Uint64(c.Sequence())
+	}
+	if c, ok := inner.(IdempotentCommand); ok && c.IdempotencyKey() != "" {
+		pb.IdempotencyKey = proto.String(c.IdempotencyKey())
 	}
 
 	e := &LogEntry{
@@ -51,6 +68,27 @@ func newLogEntry(log *Log, event *ev, index uint64, term uint64, command Command
 	return e, nil
 }
 
+// Replaces the payload of entries bound for a witness with a NOP. Only
+// configuration changes are sent in full, since a witness needs the index
+// and term of each entry to vote but has no state machine to apply to.
+func witnessEntries(entries []*LogEntry) []*LogEntry {
+	stripped := make([]*LogEntry, len(entries))
+	for i, entry := range entries {
+		if isConfigurationCommand(commandTypes[entry.CommandName()]) {
+			stripped[i] = entry
+			continue
+		}
+		stripped[i] = &LogEntry{
+			pb: &protobuf.LogEntry{
+				Index:       proto.Uint64(entry.Index()),
+				Term:        proto.Uint64(entry.Term()),
+				CommandName: proto.String(NOPCommand{}.CommandName()),
+			},
+		}
+	}
+	return stripped
+}
+
 func (e *LogEntry) Index() uint64 {
 	return e.pb.GetIndex()
 }
@@ -60,13 +98,85 @@ func (e *LogEntry) Term() uint64 {
 }
 
 func (e *LogEntry) CommandName() string {
+	if id := e.pb.GetCommandID(); id != 0 {
+		if name, ok := commandIDNames[id]; ok {
+			return name
+		}
+		return fmt.Sprintf("#%d", id)
+	}
 	return e.pb.GetCommandName()
 }
 
+// CommandID returns the numeric ID the entry's command type is written with,
+// or 0 if it is written by name.
+func (e *LogEntry) CommandID() uint32 {
+	return e.pb.GetCommandID()
+}
+
 func (e *LogEntry) Command() []byte {
 	return e.pb.GetCommand()
 }
 
+// IsNOP returns whether the entry holds a NOP, which servers append for
+// themselves, as a new leader does.
+func (e *LogEntry) IsNOP() bool {
+	return e.CommandName() == NOPCommand{}.CommandName()
+}
+
+// ClientID returns the client session of the command, if it has one.
+func (e *LogEntry) ClientID() string {
+	return e.pb.GetClientID()
+}
+
+// Sequence returns the sequence of the command within its client session.
+func (e *LogEntry) Sequence() uint64 {
+	return e.pb.GetSequence()
+}
+
+// IdempotencyKey returns the key identifying the command, if it has one.
+func (e *LogEntry) IdempotencyKey() string {
+	return e.pb.GetIdempotencyKey()
+}
+
+// Hands the result the entry was applied with to the command waiting for it.
+func (e *LogEntry) applied(returnValue interface{}, err error) {
+	if e.event == nil {
+		return
+	}
+	// Nobody reads the result of an abandoned command.
+	if !e.event.isAbandoned() {
+		e.event.returnValue = returnValue
+	}
+	e.event.reply(err)
+	e.event = nil
+}
+
+// Timestamp returns the time the leader added the entry to its log, or the
+// zero time for entries written before entries were stamped.
+func (e *LogEntry) Timestamp() time.Time {
+	if ts := e.pb.GetTimestamp(); ts != 0 {
+		return time.Unix(0, ts)
+	}
+	return time.Time{}
+}
+
+// Seed returns the seed the leader drew for the entry's command.
+func (e *LogEntry) Seed() int64 {
+	return e.pb.GetSeed()
+}
+
+// CommandVersion returns the version of its command type the command was
+// encoded with.
+func (e *LogEntry) CommandVersion() uint32 {
+	return e.pb.GetCommandVersion()
+}
+
+// Decodes the entry's command, upgrading it if it was encoded with an older
+// version of its type.
+func (e *LogEntry) decodeCommand() (Command, error) {
+	return newCommandVersion(e.CommandName(), e.CommandVersion(), e.Command())
+}
+
 // Encodes the log entry to a buffer. Returns the number of bytes
 // written and any error that may have occurred.
 func (e *LogEntry) Encode(w io.Writer) (int, error) {
@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 //------------------------------------------------------------------------------
@@ -230,3 +232,113 @@ func TestLogTruncate(t *testing.T) {
 		t.Fatalf("Unexpected entry[2]: %v", log.entries[2])
 	}
 }
+
+//--------------------------------------
+// Commit
+//--------------------------------------
+
+// Ensure that consecutive commands are applied in batches that end at a
+// configuration change.
+func TestLogBatch(t *testing.T) {
+	path := getLogPath()
+	log := newLog()
+	var applied []string
+	log.ApplyFunc = func(e *LogEntry, c Command) (interface{}, error) {
+		applied = append(applied, c.CommandName())
+		return e.Index(), nil
+	}
+	log.BatchFunc = func(entries []*LogEntry, apply func()) {
+		applied = append(applied, "begin")
+		apply()
+		applied = append(applied, "commit")
+	}
+	if err := log.open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.close()
+	defer os.Remove(path)
+
+	commands := []Command{&testCommand1{Val: "foo"}, &testCommand2{X: 1}, &DefaultJoinCommand{Name: "1"}, &testCommand1{Val: "bar"}}
+	for i, command := range commands {
+		e, _ := newLogEntry(log, nil, uint64(i+1), 1, command)
+		if err := log.appendEntry(e); err != nil {
+			t.Fatalf("Unable to append: %v", err)
+		}
+	}
+
+	if err := log.setCommitIndex(4); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if index := log.CommitIndex(); index != 3 {
+		t.Fatalf("Expected to commit up to the configuration change, got %d", index)
+	}
+	if err := log.setCommitIndex(4); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	expected := []string{"begin", "cmd_1", "cmd_2", "commit", "raft:join", "begin", "cmd_1", "commit"}
+	if !reflect.DeepEqual(applied, expected) {
+		t.Fatalf("Unexpected order of application: %v", applied)
+	}
+}
+
+// Ensure that consecutive read-only commands are applied concurrently and
+// writes on their own.
+func TestLogReadOnly(t *testing.T) {
+	path := getLogPath()
+	log := newLog()
+	var mutex sync.Mutex
+	running, maxRunning := 0, map[bool]int{}
+	reads := make(chan struct{})
+	log.ApplyFunc = func(e *LogEntry, c Command) (interface{}, error) {
+		read := isReadOnly(e, c)
+		mutex.Lock()
+		running++
+		if running > maxRunning[read] {
+			maxRunning[read] = running
+		}
+		mutex.Unlock()
+
+		// Reads applied together meet each other, while a read applied on
+		// its own gives up waiting.
+		if read {
+			select {
+			case reads <- struct{}{}:
+			case <-reads:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return e.Index(), nil
+	}
+	if err := log.open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.close()
+	defer os.Remove(path)
+
+	commands := []Command{&testReadCommand{Write: true}, &testReadCommand{}, &testReadCommand{}, &testCommand1{}, &testReadCommand{}}
+	events := make([]*ev, len(commands))
+	for i, command := range commands {
+		events[i] = &ev{target: command, errChan: make(chan error, 1)}
+		e, _ := newLogEntry(log, events[i], uint64(i+1), 1, command)
+		if err := log.appendEntry(e); err != nil {
+			t.Fatalf("Unable to append: %v", err)
+		}
+	}
+	if err := log.setCommitIndex(5); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if index := log.CommitIndex(); index != 5 {
+		t.Fatalf("Unexpected commit index: %d", index)
+	}
+	if maxRunning[true] != 2 || maxRunning[false] != 1 {
+		t.Fatalf("Unexpected concurrency: %v", maxRunning)
+	}
+	for i, e := range events {
+		if err := <-e.errChan; err != nil || e.returnValue != uint64(i+1) {
+			t.Fatalf("%d. Unexpected result: %v %v", i, e.returnValue, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"time"
+)
+
+// The upper bounds of the election duration histogram buckets.
+var electionDurationBounds = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// A Histogram counts observed durations in buckets. Counts[i] holds the
+// durations up to Bounds[i] that are above the previous bound, and the last
+// count holds the durations above the last bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Creates a histogram with the given bucket bounds.
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{
+		Bounds: bounds,
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Records a duration.
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Copies the histogram.
+func (h *Histogram) clone() Histogram {
+	c := *h
+	c.Counts = append([]uint64(nil), h.Counts...)
+	return c
+}
+
+// ElectionMetrics counts the elections this server has taken part in as a
+// candidate. Started counts election rounds, each in a new term; a round is
+// won when the server becomes leader and lost when it times out or steps
+// down. Duration holds the time from the start of each round to its end.
+// DisruptiveVotesRejected counts the vote requests the server ignored
+// because a leader was in contact or the candidate had been removed.
+type ElectionMetrics struct {
+	Started                 uint64
+	Won                     uint64
+	Lost                    uint64
+	DisruptiveVotesRejected uint64
+	Duration                Histogram
+}
+
+// Copies the metrics.
+func (m *ElectionMetrics) clone() ElectionMetrics {
+	c := *m
+	c.Duration = m.Duration.clone()
+	return c
+}
@@ -1,6 +1,8 @@
 package raft
 
 import (
+	"errors"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,13 +15,22 @@ import (
 
 // A peer is a reference to another server involved in the consensus protocol.
 type Peer struct {
-	server            *server
-	Name              string `json:"name"`
-	ConnectionString  string `json:"connectionString"`
-	prevLogIndex      uint64
-	stopChan          chan bool
-	heartbeatInterval time.Duration
-	lastActivity      time.Time
+	server           *server
+	Name             string            `json:"name"`
+	ConnectionString string            `json:"connectionString"`
+	Role             string            `json:"role,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	Weight           int               `json:"weight,omitempty"`
+	prevLogIndex     uint64
+	stopChan         chan bool
+	flushChan        chan bool
+	heartbeatChan    chan bool
+	lastActivity     time.Time
+	lastAck          time.Time
+	ackIndex         uint64
+	sendingSnapshot  bool
+	removing         bool
+	pinging          bool
 	sync.RWMutex
 
 	heartbeatFailedCount int
@@ -27,6 +38,60 @@ type Peer struct {
 
 const MAX_HEARTBEAT_FAILED_COUNT = 5
 
+// PeerStatus describes the replication state of a peer as seen by the
+// leader. MatchIndex is the last entry the peer is known to store and
+// NextIndex the next one it will be sent. LagEntries and LagBytes estimate
+// how far the peer is behind the leader's log.
+type PeerStatus struct {
+	Name            string
+	MatchIndex      uint64
+	NextIndex       uint64
+	LastContact     time.Time
+	SendingSnapshot bool
+	LagEntries      uint64
+	LagBytes        int64
+}
+
+// Kinds of peer change passed to peer observers.
+const (
+	PeerAdded          = "added"
+	PeerRemoved        = "removed"
+	PeerRoleChanged    = "roleChanged"
+	PeerAddressChanged = "addressChanged"
+)
+
+// PeerChange describes a change to a member of the cluster. It holds the
+// member's name and, after the change, its connection string and role.
+type PeerChange struct {
+	Type             string
+	Name             string
+	ConnectionString string
+	Role             string
+}
+
+// Peer roles. A peer without a role is a voter.
+const (
+	// VoterRole peers vote in elections and count towards the quorum.
+	VoterRole = "voter"
+	// LearnerRole peers receive log entries and snapshots but do not vote
+	// and are not counted towards the quorum.
+	LearnerRole = "learner"
+	// WitnessRole peers vote and count towards the quorum but never become
+	// leader. They store the index and term of each entry without its
+	// payload and run no state machine.
+	WitnessRole = "witness"
+)
+
+// The metadata key holding the zone, such as an availability zone or rack,
+// that a member runs in.
+const ZoneMetadataKey = "zone"
+
+// The metadata key holding the election priority of a member, a
+// non-negative integer. Members with a lower priority than the highest in
+// the cluster wait longer before they stand for election, so that, all else
+// being equal, the members with the highest priority become leader.
+const PriorityMetadataKey = "priority"
+
 //------------------------------------------------------------------------------
 //
 // Constructor
@@ -34,12 +99,13 @@ const MAX_HEARTBEAT_FAILED_COUNT = 5
 //------------------------------------------------------------------------------
 
 // Creates a new peer.
-func newPeer(server *server, name string, connectionString string, heartbeatInterval time.Duration) *Peer {
+func newPeer(server *server, name string, connectionString string) *Peer {
 	return &Peer{
-		server:            server,
-		Name:              name,
-		ConnectionString:  connectionString,
-		heartbeatInterval: heartbeatInterval,
+		server:           server,
+		Name:             name,
+		ConnectionString: connectionString,
+		flushChan:        make(chan bool, 1),
+		heartbeatChan:    make(chan bool, 1),
 	}
 }
 
@@ -49,9 +115,16 @@ func newPeer(server *server, name string, connectionString string, heartbeatInte
 //
 //------------------------------------------------------------------------------
 
-// Sets the heartbeat timeout.
-func (p *Peer) setHeartbeatInterval(duration time.Duration) {
-	p.heartbeatInterval = duration
+// Voting returns whether the peer takes part in elections and commitment.
+func (p *Peer) Voting() bool {
+	return isVotingRole(p.getRole())
+}
+
+// Retrieves the role of the peer.
+func (p *Peer) getRole() string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.Role
 }
 
 //--------------------------------------
@@ -78,18 +151,91 @@ func (p *Peer) setLastActivity(now time.Time) {
 	p.lastActivity = now
 }
 
+// Retrieves the time the last AppendEntries request the peer answered in the
+// leader's term was sent.
+func (p *Peer) getLastAck() time.Time {
+	p.RLock()
+	defer p.RUnlock()
+	return p.lastAck
+}
+
+func (p *Peer) setLastAck(sent time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.lastAck = sent
+}
+
+// Retrieves the last log index the peer reported in its latest answer in the
+// leader's term.
+func (p *Peer) getAckIndex() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+	return p.ackIndex
+}
+
+func (p *Peer) setAckIndex(index uint64) {
+	p.Lock()
+	defer p.Unlock()
+	p.ackIndex = index
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
 //
 //------------------------------------------------------------------------------
 
+// Copies peer metadata so callers cannot modify the replicated copy.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
+
+// Zone returns the zone recorded in the peer's metadata, if any.
+func (p *Peer) Zone() string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.Metadata[ZoneMetadataKey]
+}
+
+// Priority returns the election priority recorded in the peer's metadata, or
+// zero if it has none.
+func (p *Peer) Priority() int {
+	p.RLock()
+	defer p.RUnlock()
+	return metadataPriority(p.Metadata)
+}
+
+// Parses the election priority recorded in metadata.
+func metadataPriority(metadata map[string]string) int {
+	priority, err := strconv.Atoi(metadata[PriorityMetadataKey])
+	if err != nil || priority < 0 {
+		return 0
+	}
+	return priority
+}
+
+// Determines whether a role takes part in elections and commitment.
+func isVotingRole(role string) bool {
+	return role != LearnerRole
+}
+
 //--------------------------------------
 // Heartbeat
 //--------------------------------------
 
-// Starts the peer heartbeat.
+// Starts the peer heartbeat. It is a no-op if the heartbeat is already
+// running, as it is for peers added by the entry that makes a server leader.
 func (p *Peer) startHeartbeat() {
+	if p.stopChan != nil {
+		return
+	}
 	p.stopChan = make(chan bool)
 	c := make(chan bool)
 
@@ -103,11 +249,16 @@ func (p *Peer) startHeartbeat() {
 	<-c
 }
 
-// Stops the peer heartbeat.
+// Stops the peer heartbeat. It is a no-op if the heartbeat is not running.
 func (p *Peer) stopHeartbeat(flush bool) {
 	p.setLastActivity(time.Time{})
 
-	p.stopChan <- flush
+	stopChan := p.stopChan
+	if stopChan == nil {
+		return
+	}
+	p.stopChan = nil
+	stopChan <- flush
 }
 
 // LastActivity returns the last time any response was received from the peer.
@@ -129,6 +280,9 @@ func (p *Peer) clone() *Peer {
 	return &Peer{
 		Name:             p.Name,
 		ConnectionString: p.ConnectionString,
+		Role:             p.Role,
+		Metadata:         copyMetadata(p.Metadata),
+		Weight:           p.Weight,
 		prevLogIndex:     p.prevLogIndex,
 		lastActivity:     p.lastActivity,
 	}
@@ -138,15 +292,14 @@ func (p *Peer) clone() *Peer {
 // Heartbeat
 //--------------------------------------
 
-// Listens to the heartbeat timeout and flushes an AppendEntries RPC.
+// Waits for the leader's heartbeats, and for new entries, and flushes an
+// AppendEntries RPC.
 func (p *Peer) heartbeat(c chan bool) {
 	stopChan := p.stopChan
 
 	c <- true
 
-	ticker := time.Tick(p.heartbeatInterval)
-
-	debugln("peer.heartbeat: ", p.Name, p.heartbeatInterval)
+	debugln("peer.heartbeat: ", p.Name)
 
 	for {
 		select {
@@ -162,15 +315,36 @@ func (p *Peer) heartbeat(c chan bool) {
 				return
 			}
 
-		case <-ticker:
+		case <-p.heartbeatChan:
 			start := time.Now()
 			p.flush()
 			duration := time.Now().Sub(start)
 			p.server.DispatchEvent(newEvent(HeartbeatEventType, duration, nil))
+
+		case <-p.flushChan:
+			p.flush()
 		}
 	}
 }
 
+// Asks the heartbeat to send a heartbeat. The leader calls it for every peer
+// at each heartbeat interval; a peer still busy with the previous heartbeat
+// skips this one.
+func (p *Peer) tick() {
+	select {
+	case p.heartbeatChan <- true:
+	default:
+	}
+}
+
+// Asks the heartbeat to flush new entries without waiting for the next tick.
+func (p *Peer) notify() {
+	select {
+	case p.flushChan <- true:
+	default:
+	}
+}
+
 func (p *Peer) flush() {
 
 	if p.heartbeatFailedCount > MAX_HEARTBEAT_FAILED_COUNT {
@@ -182,16 +356,109 @@ func (p *Peer) flush() {
 		return
 	}
 	debugln("peer.heartbeat.flush: ", p.Name)
+	// A peer whose heartbeat is stopping, as it is removed, has no activity.
+	if timeout := p.server.DeadPeerTimeout(); timeout > 0 {
+		if last := p.LastActivity(); !last.IsZero() && time.Now().Sub(last) > timeout {
+			p.remove()
+		}
+	}
 	prevLogIndex := p.getPrevLogIndex()
 	term := p.server.currentTerm
 
+	// Peers that are far behind catch up faster from a snapshot.
+	if p.server.shouldSendSnapshot(prevLogIndex) {
+		p.sendSnapshot()
+		return
+	}
+
 	entries, prevLogTerm := p.server.log.getEntriesAfter(prevLogIndex, p.server.maxLogEntriesPerRequest)
+	if entries != nil && p.getRole() == WitnessRole {
+		entries = witnessEntries(entries)
+	}
 
 	if entries != nil {
 		p.sendAppendEntriesRequest(newAppendEntriesRequest(term, prevLogIndex, prevLogTerm, p.server.log.CommitIndex(), p.server.name, entries))
 	} else {
-		p.sendSnapshotRequest(newSnapshotRequest(p.server.name, p.server.snapshot))
+		p.sendSnapshot()
+	}
+}
+
+// Sends the peer the entries it is missing and asks it to start an election
+// straight away. The peer ignores the request unless its log then matches.
+func (p *Peer) sendTimeoutNow() {
+	prevLogIndex := p.getPrevLogIndex()
+	entries, prevLogTerm := p.server.log.getEntriesAfter(prevLogIndex, p.server.maxLogEntriesPerRequest)
+	if entries == nil {
+		return
+	}
+
+	req := newAppendEntriesRequest(p.server.currentTerm, prevLogIndex, prevLogTerm, p.server.log.CommitIndex(), p.server.name, entries)
+	req.TimeoutNow = true
+	p.sendAppendEntriesRequest(req)
+}
+
+// Proposes the removal of a peer that has been unreachable for longer than
+// the dead peer timeout. Only one removal is proposed per peer.
+func (p *Peer) remove() {
+	p.Lock()
+	if p.removing {
+		p.Unlock()
+		return
 	}
+	p.removing = true
+	p.Unlock()
+
+	debugln("peer.dead: ", p.Name)
+	p.server.DispatchEvent(newEvent(DeadPeerEventType, p.Name, nil))
+
+	p.server.routineGroup.Add(1)
+	go func() {
+		defer p.server.routineGroup.Done()
+		if _, err := p.server.do(&DefaultLeaveCommand{Name: p.Name}); err != nil {
+			debugln("peer.dead.remove.failed: ", p.Name, err)
+			p.Lock()
+			p.removing = false
+			p.Unlock()
+		}
+	}()
+}
+
+//--------------------------------------
+// Snapshot
+//--------------------------------------
+
+// Sends the current snapshot to the peer in the background so the heartbeat
+// is not blocked by a large transfer. Snapshots to several lagging peers are
+// sent in parallel and share a single read of the snapshot from disk. Only
+// one snapshot is in flight to a peer at a time.
+func (p *Peer) sendSnapshot() {
+	p.Lock()
+	if p.sendingSnapshot {
+		p.Unlock()
+		return
+	}
+	p.sendingSnapshot = true
+	p.Unlock()
+
+	p.server.routineGroup.Add(1)
+	go func() {
+		defer p.server.routineGroup.Done()
+		defer func() {
+			p.Lock()
+			p.sendingSnapshot = false
+			p.Unlock()
+		}()
+
+		snapshot, err := p.server.acquireSnapshot()
+		if err != nil {
+			debugln("peer.snap.acquire.failed: ", p.Name, err)
+			p.server.dispatchSnapshotFailed(0, 0, p.Name, err)
+			return
+		}
+		defer p.server.releaseSnapshot(snapshot)
+
+		p.sendSnapshotRequest(snapshot.Snapshot)
+	}()
 }
 
 //--------------------------------------
@@ -203,6 +470,9 @@ func (p *Peer) sendAppendEntriesRequest(req *AppendEntriesRequest) {
 	tracef("peer.append.send: %s->%s [prevLog:%v length: %v]\n",
 		p.server.Name(), p.Name, req.PrevLogIndex, len(req.Entries))
 
+	req.ClusterID = p.server.ClusterID()
+	req.Quiesce = p.server.quiesceRemaining()
+	sent := time.Now()
 	resp := p.server.Transporter().SendAppendEntriesRequest(p.server, p, req)
 	if resp == nil {
 		p.server.DispatchEvent(newEvent(HeartbeatIntervalEventType, p, nil))
@@ -213,6 +483,12 @@ func (p *Peer) sendAppendEntriesRequest(req *AppendEntriesRequest) {
 	traceln("peer.append.resp: ", p.server.Name(), "<-", p.Name)
 
 	p.setLastActivity(time.Now())
+	if resp.Term() == req.Term {
+		// The index is recorded first, so that it is never older than the
+		// acknowledgement it is read with.
+		p.setAckIndex(resp.Index())
+		p.setLastAck(sent)
+	}
 	// If successful then update the previous log index.
 	p.Lock()
 	if resp.Success() {
@@ -269,9 +545,12 @@ func (p *Peer) sendAppendEntriesRequest(req *AppendEntriesRequest) {
 }
 
 // Sends an Snapshot request to the peer through the transport.
-func (p *Peer) sendSnapshotRequest(req *SnapshotRequest) {
+func (p *Peer) sendSnapshotRequest(snapshot *Snapshot) {
 	debugln("peer.snap.send: ", p.Name)
 
+	req := newSnapshotRequest(p.server.name, snapshot)
+	req.ClusterID = p.server.ClusterID()
+
 	resp := p.server.Transporter().SendSnapshotRequest(p.server, p, req)
 	if resp == nil {
 		debugln("peer.snap.timeout: ", p.Name)
@@ -285,7 +564,7 @@ func (p *Peer) sendSnapshotRequest(req *SnapshotRequest) {
 	p.setLastActivity(time.Now())
 
 	if resp.Success {
-		p.sendSnapshotRecoveryRequest()
+		p.sendSnapshotRecoveryRequest(snapshot)
 	} else {
 		debugln("peer.snap.failed: ", p.Name)
 		return
@@ -294,27 +573,75 @@ func (p *Peer) sendSnapshotRequest(req *SnapshotRequest) {
 }
 
 // Sends an Snapshot Recovery request to the peer through the transport.
-func (p *Peer) sendSnapshotRecoveryRequest() {
-	req := newSnapshotRecoveryRequest(p.server.name, p.server.snapshot)
+func (p *Peer) sendSnapshotRecoveryRequest(snapshot *Snapshot) {
+	req := newSnapshotRecoveryRequest(p.server.name, snapshot)
+	req.ClusterID = p.server.ClusterID()
+	if p.getRole() == WitnessRole {
+		req.State = nil
+	}
 	debugln("peer.snap.recovery.send: ", p.Name)
+	start := time.Now()
 	resp := p.server.Transporter().SendSnapshotRecoveryRequest(p.server, p, req)
 
 	if resp == nil {
 		debugln("peer.snap.recovery.timeout: ", p.Name)
+		p.server.dispatchSnapshotFailed(req.LastIndex, req.LastTerm, p.Name, errors.New("snapshot recovery request timed out"))
 		return
 	}
 
 	p.setLastActivity(time.Now())
 	if resp.Success {
-		p.prevLogIndex = req.LastIndex
+		p.setPrevLogIndex(req.LastIndex)
 	} else {
 		debugln("peer.snap.recovery.failed: ", p.Name)
+		p.server.dispatchSnapshotFailed(req.LastIndex, req.LastTerm, p.Name, errors.New("snapshot recovery rejected by peer"))
 		return
 	}
 
+	p.server.DispatchEvent(newEvent(SnapshotSentEventType, &SnapshotEventInfo{
+		LastIndex: req.LastIndex,
+		LastTerm:  req.LastTerm,
+		Size:      int64(len(req.State)),
+		Duration:  time.Now().Sub(start),
+		Peer:      p.Name,
+	}, nil))
+
 	p.server.sendAsync(resp)
 }
 
+//--------------------------------------
+// Pings
+//--------------------------------------
+
+// Pings the peer in the background and sends its name to c if it answers,
+// unless c is full. Only one ping is in flight to a peer at a time.
+func (p *Peer) sendPing(pinger Pinger, c chan<- string) {
+	p.Lock()
+	if p.pinging {
+		p.Unlock()
+		return
+	}
+	p.pinging = true
+	p.Unlock()
+
+	p.server.routineGroup.Add(1)
+	go func() {
+		defer p.server.routineGroup.Done()
+		ok := pinger.Ping(p.server, p)
+		p.Lock()
+		p.pinging = false
+		p.Unlock()
+		if !ok {
+			debugln("peer.ping.failed: ", p.server.Name(), "->", p.Name)
+			return
+		}
+		select {
+		case c <- p.Name:
+		default:
+		}
+	}()
+}
+
 //--------------------------------------
 // Vote Requests
 //--------------------------------------
@@ -323,6 +650,7 @@ func (p *Peer) sendSnapshotRecoveryRequest() {
 func (p *Peer) sendVoteRequest(req *RequestVoteRequest, c chan *RequestVoteResponse) {
 	debugln("peer.vote: ", p.server.Name(), "->", p.Name)
 	req.peer = p
+	req.ClusterID = p.server.ClusterID()
 	if resp := p.server.Transporter().SendVoteRequest(p.server, p, req); resp != nil {
 		debugln("peer.vote.recv: ", p.server.Name(), "<-", p.Name)
 		p.setLastActivity(time.Now())
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// A Profile is a named set of election and failure detection settings that
+// are chosen to work together, for use with ApplyProfile. Elections are
+// always guarded against disruptive candidates: votes are not granted while
+// a leader is in contact, much as a pre-vote round would refuse them.
+type Profile struct {
+	Name              string
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	ElectionJitter    float64
+	CheckQuorum       bool
+
+	// Seeds the election timeouts from the server name, so that the same
+	// servers draw the same timeouts on every run.
+	NameSeed bool
+}
+
+var (
+	// LANFastProfile fails over quickly on a low latency network, such as
+	// within a data center.
+	LANFastProfile = Profile{
+		Name:              "lan-fast",
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		ElectionJitter:    1.0,
+		CheckQuorum:       true,
+	}
+
+	// WANStableProfile tolerates the latency and the short outages of links
+	// between regions, at the cost of slower failover.
+	WANStableProfile = Profile{
+		Name:              "wan-stable",
+		ElectionTimeout:   2 * time.Second,
+		HeartbeatInterval: 250 * time.Millisecond,
+		ElectionJitter:    1.0,
+		CheckQuorum:       true,
+	}
+
+	// TestDeterministicProfile makes elections repeat from run to run, for
+	// tests of a cluster in a single process.
+	TestDeterministicProfile = Profile{
+		Name:              "test-deterministic",
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		ElectionJitter:    1.0,
+		NameSeed:          true,
+	}
+)
+
+// The profiles that can be looked up by name.
+var profiles = []Profile{LANFastProfile, WANStableProfile, TestDeterministicProfile}
+
+// Retrieves the predefined profile with the given name.
+func ProfileByName(name string) (Profile, error) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Profile{}, UnknownProfileError
+}
+
+// Derives an election seed from a server name.
+func nameSeed(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
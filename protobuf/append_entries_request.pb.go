@@ -37,6 +37,9 @@ type AppendEntriesRequest struct {
 	CommitIndex      *uint64     `protobuf:"varint,4,req" json:"CommitIndex,omitempty"`
 	LeaderName       *string     `protobuf:"bytes,5,req" json:"LeaderName,omitempty"`
 	Entries          []*LogEntry `protobuf:"bytes,6,rep" json:"Entries,omitempty"`
+	ClusterID        *string     `protobuf:"bytes,7,opt" json:"ClusterID,omitempty"`
+	TimeoutNow       *bool       `protobuf:"varint,8,opt" json:"TimeoutNow,omitempty"`
+	Quiesce          *uint64     `protobuf:"varint,9,opt" json:"Quiesce,omitempty"`
 	XXX_unrecognized []byte      `json:"-"`
 }
 
@@ -86,5 +89,26 @@ func (m *AppendEntriesRequest) GetEntries() []*LogEntry {
 	return nil
 }
 
+func (m *AppendEntriesRequest) GetClusterID() string {
+	if m != nil && m.ClusterID != nil {
+		return *m.ClusterID
+	}
+	return ""
+}
+
+func (m *AppendEntriesRequest) GetTimeoutNow() bool {
+	if m != nil && m.TimeoutNow != nil {
+		return *m.TimeoutNow
+	}
+	return false
+}
+
+func (m *AppendEntriesRequest) GetQuiesce() uint64 {
+	if m != nil && m.Quiesce != nil {
+		return *m.Quiesce
+	}
+	return 0
+}
+
 func init() {
 }
@@ -18,6 +18,13 @@ type LogEntry struct {
 	Term             *uint64 `protobuf:"varint,2,req" json:"Term,omitempty"`
 	CommandName      *string `protobuf:"bytes,3,req" json:"CommandName,omitempty"`
 	Command          []byte  `protobuf:"bytes,4,opt" json:"Command,omitempty"`
+	ClientID         *string `protobuf:"bytes,5,opt" json:"ClientID,omitempty"`
+	Sequence         *uint64 `protobuf:"varint,6,opt" json:"Sequence,omitempty"`
+	IdempotencyKey   *string `protobuf:"bytes,7,opt" json:"IdempotencyKey,omitempty"`
+	Timestamp        *int64  `protobuf:"varint,8,opt" json:"Timestamp,omitempty"`
+	Seed             *int64  `protobuf:"varint,9,opt" json:"Seed,omitempty"`
+	CommandVersion   *uint32 `protobuf:"varint,10,opt" json:"CommandVersion,omitempty"`
+	CommandID        *uint32 `protobuf:"varint,11,opt" json:"CommandID,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -53,5 +60,54 @@ func (m *LogEntry) GetCommand() []byte {
 	return nil
 }
 
+func (m *LogEntry) GetClientID() string {
+	if m != nil && m.ClientID != nil {
+		return *m.ClientID
+	}
+	return ""
+}
+
+func (m *LogEntry) GetSequence() uint64 {
+	if m != nil && m.Sequence != nil {
+		return *m.Sequence
+	}
+	return 0
+}
+
+func (m *LogEntry) GetIdempotencyKey() string {
+	if m != nil && m.IdempotencyKey != nil {
+		return *m.IdempotencyKey
+	}
+	return ""
+}
+
+func (m *LogEntry) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *LogEntry) GetSeed() int64 {
+	if m != nil && m.Seed != nil {
+		return *m.Seed
+	}
+	return 0
+}
+
+func (m *LogEntry) GetCommandVersion() uint32 {
+	if m != nil && m.CommandVersion != nil {
+		return *m.CommandVersion
+	}
+	return 0
+}
+
+func (m *LogEntry) GetCommandID() uint32 {
+	if m != nil && m.CommandID != nil {
+		return *m.CommandID
+	}
+	return 0
+}
+
 func init() {
 }
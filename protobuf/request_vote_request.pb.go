@@ -18,6 +18,8 @@ type RequestVoteRequest struct {
 	LastLogIndex     *uint64 `protobuf:"varint,2,req" json:"LastLogIndex,omitempty"`
 	LastLogTerm      *uint64 `protobuf:"varint,3,req" json:"LastLogTerm,omitempty"`
 	CandidateName    *string `protobuf:"bytes,4,req" json:"CandidateName,omitempty"`
+	ClusterID        *string `protobuf:"bytes,5,opt" json:"ClusterID,omitempty"`
+	Transfer         *bool   `protobuf:"varint,6,opt" json:"Transfer,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -53,5 +55,19 @@ func (m *RequestVoteRequest) GetCandidateName() string {
 	return ""
 }
 
+func (m *RequestVoteRequest) GetClusterID() string {
+	if m != nil && m.ClusterID != nil {
+		return *m.ClusterID
+	}
+	return ""
+}
+
+func (m *RequestVoteRequest) GetTransfer() bool {
+	if m != nil && m.Transfer != nil {
+		return *m.Transfer
+	}
+	return false
+}
+
 func init() {
 }
@@ -14,12 +14,17 @@ var _ = proto.Marshal
 var _ = math.Inf
 
 type SnapshotRecoveryRequest struct {
-	LeaderName       *string                         `protobuf:"bytes,1,req" json:"LeaderName,omitempty"`
-	LastIndex        *uint64                         `protobuf:"varint,2,req" json:"LastIndex,omitempty"`
-	LastTerm         *uint64                         `protobuf:"varint,3,req" json:"LastTerm,omitempty"`
-	Peers            []*SnapshotRecoveryRequest_Peer `protobuf:"bytes,4,rep" json:"Peers,omitempty"`
-	State            []byte                          `protobuf:"bytes,5,req" json:"State,omitempty"`
-	XXX_unrecognized []byte                          `json:"-"`
+	LeaderName       *string                           `protobuf:"bytes,1,req" json:"LeaderName,omitempty"`
+	LastIndex        *uint64                           `protobuf:"varint,2,req" json:"LastIndex,omitempty"`
+	LastTerm         *uint64                           `protobuf:"varint,3,req" json:"LastTerm,omitempty"`
+	Peers            []*SnapshotRecoveryRequest_Peer   `protobuf:"bytes,4,rep" json:"Peers,omitempty"`
+	State            []byte                            `protobuf:"bytes,5,req" json:"State,omitempty"`
+	Manifest         *SnapshotRecoveryRequest_Manifest `protobuf:"bytes,6,opt" json:"Manifest,omitempty"`
+	ClusterID        *string                           `protobuf:"bytes,7,opt" json:"ClusterID,omitempty"`
+	Sessions         map[string]uint64                 `protobuf:"bytes,8,rep" json:"Sessions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	IdempotencyKeys  []string                          `protobuf:"bytes,9,rep" json:"IdempotencyKeys,omitempty"`
+	SessionOrder     []string                          `protobuf:"bytes,10,rep" json:"SessionOrder,omitempty"`
+	XXX_unrecognized []byte                            `json:"-"`
 }
 
 func (m *SnapshotRecoveryRequest) Reset()         { *m = SnapshotRecoveryRequest{} }
@@ -61,10 +66,48 @@ func (m *SnapshotRecoveryRequest) GetState() []byte {
 	return nil
 }
 
+func (m *SnapshotRecoveryRequest) GetManifest() *SnapshotRecoveryRequest_Manifest {
+	if m != nil {
+		return m.Manifest
+	}
+	return nil
+}
+
+func (m *SnapshotRecoveryRequest) GetClusterID() string {
+	if m != nil && m.ClusterID != nil {
+		return *m.ClusterID
+	}
+	return ""
+}
+
+func (m *SnapshotRecoveryRequest) GetSessions() map[string]uint64 {
+	if m != nil {
+		return m.Sessions
+	}
+	return nil
+}
+
+func (m *SnapshotRecoveryRequest) GetIdempotencyKeys() []string {
+	if m != nil {
+		return m.IdempotencyKeys
+	}
+	return nil
+}
+
+func (m *SnapshotRecoveryRequest) GetSessionOrder() []string {
+	if m != nil {
+		return m.SessionOrder
+	}
+	return nil
+}
+
 type SnapshotRecoveryRequest_Peer struct {
-	Name             *string `protobuf:"bytes,1,req" json:"Name,omitempty"`
-	ConnectionString *string `protobuf:"bytes,2,req" json:"ConnectionString,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Name             *string           `protobuf:"bytes,1,req" json:"Name,omitempty"`
+	ConnectionString *string           `protobuf:"bytes,2,req" json:"ConnectionString,omitempty"`
+	Role             *string           `protobuf:"bytes,3,opt" json:"Role,omitempty"`
+	Metadata         map[string]string `protobuf:"bytes,4,rep" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Weight           *int64            `protobuf:"varint,5,opt" json:"Weight,omitempty"`
+	XXX_unrecognized []byte            `json:"-"`
 }
 
 func (m *SnapshotRecoveryRequest_Peer) Reset()         { *m = SnapshotRecoveryRequest_Peer{} }
@@ -85,5 +128,74 @@ func (m *SnapshotRecoveryRequest_Peer) GetConnectionString() string {
 	return ""
 }
 
+func (m *SnapshotRecoveryRequest_Peer) GetRole() string {
+	if m != nil && m.Role != nil {
+		return *m.Role
+	}
+	return ""
+}
+
+func (m *SnapshotRecoveryRequest_Peer) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *SnapshotRecoveryRequest_Peer) GetWeight() int64 {
+	if m != nil && m.Weight != nil {
+		return *m.Weight
+	}
+	return 0
+}
+
+type SnapshotRecoveryRequest_Manifest struct {
+	ClusterID          *string `protobuf:"bytes,1,opt" json:"ClusterID,omitempty"`
+	ConfigurationIndex *uint64 `protobuf:"varint,2,opt" json:"ConfigurationIndex,omitempty"`
+	SchemaVersion      *string `protobuf:"bytes,3,opt" json:"SchemaVersion,omitempty"`
+	Host               *string `protobuf:"bytes,4,opt" json:"Host,omitempty"`
+	CreatedAt          *int64  `protobuf:"varint,5,opt" json:"CreatedAt,omitempty"`
+	XXX_unrecognized   []byte  `json:"-"`
+}
+
+func (m *SnapshotRecoveryRequest_Manifest) Reset()         { *m = SnapshotRecoveryRequest_Manifest{} }
+func (m *SnapshotRecoveryRequest_Manifest) String() string { return proto.CompactTextString(m) }
+func (*SnapshotRecoveryRequest_Manifest) ProtoMessage()    {}
+
+func (m *SnapshotRecoveryRequest_Manifest) GetClusterID() string {
+	if m != nil && m.ClusterID != nil {
+		return *m.ClusterID
+	}
+	return ""
+}
+
+func (m *SnapshotRecoveryRequest_Manifest) GetConfigurationIndex() uint64 {
+	if m != nil && m.ConfigurationIndex != nil {
+		return *m.ConfigurationIndex
+	}
+	return 0
+}
+
+func (m *SnapshotRecoveryRequest_Manifest) GetSchemaVersion() string {
+	if m != nil && m.SchemaVersion != nil {
+		return *m.SchemaVersion
+	}
+	return ""
+}
+
+func (m *SnapshotRecoveryRequest_Manifest) GetHost() string {
+	if m != nil && m.Host != nil {
+		return *m.Host
+	}
+	return ""
+}
+
+func (m *SnapshotRecoveryRequest_Manifest) GetCreatedAt() int64 {
+	if m != nil && m.CreatedAt != nil {
+		return *m.CreatedAt
+	}
+	return 0
+}
+
 func init() {
 }
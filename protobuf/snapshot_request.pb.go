@@ -17,6 +17,7 @@ type SnapshotRequest struct {
 	LeaderName       *string `protobuf:"bytes,1,req" json:"LeaderName,omitempty"`
 	LastIndex        *uint64 `protobuf:"varint,2,req" json:"LastIndex,omitempty"`
 	LastTerm         *uint64 `protobuf:"varint,3,req" json:"LastTerm,omitempty"`
+	ClusterID        *string `protobuf:"bytes,4,opt" json:"ClusterID,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -45,5 +46,12 @@ func (m *SnapshotRequest) GetLastTerm() uint64 {
 	return 0
 }
 
+func (m *SnapshotRequest) GetClusterID() string {
+	if m != nil && m.ClusterID != nil {
+		return *m.ClusterID
+	}
+	return ""
+}
+
 func init() {
 }
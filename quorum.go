@@ -0,0 +1,119 @@
+package raft
+
+import (
+	"sort"
+)
+
+// A jointConfiguration holds the voting weights of the old and the new
+// configuration while a membership change is in progress. Elections and
+// commitment need a majority of both sets until the change is committed.
+type jointConfiguration struct {
+	old map[string]int
+	new map[string]int
+}
+
+// Retrieves the voting weight of a member. Members without a weight have a
+// weight of one.
+func voteWeight(weight int) int {
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}
+
+// Retrieves the total weight of a set of voters.
+func totalWeight(voters map[string]int) int {
+	total := 0
+	for _, weight := range voters {
+		total += weight
+	}
+	return total
+}
+
+// A QuorumPolicy decides which sets of voters are large enough to elect a
+// leader or to commit a log entry. Voters maps each voting member to its
+// weight and acks holds the members that granted their vote or stored the
+// entry. During a membership change the policy must be satisfied by both the
+// old and the new configuration.
+//
+// Any election quorum must intersect every commit quorum, otherwise a new
+// leader could be elected without a committed entry.
+type QuorumPolicy interface {
+	ElectionQuorum(voters map[string]int, acks map[string]bool) bool
+	CommitQuorum(voters map[string]int, acks map[string]bool) bool
+}
+
+// MajorityQuorumPolicy is the default policy. Both elections and commitment
+// need more than half of the voting weight.
+type MajorityQuorumPolicy struct{}
+
+// Determines whether the votes granted hold more than half of the weight.
+func (MajorityQuorumPolicy) ElectionQuorum(voters map[string]int, acks map[string]bool) bool {
+	return majority(voters, acks)
+}
+
+// Determines whether the members storing an entry hold more than half of the
+// weight.
+func (MajorityQuorumPolicy) CommitQuorum(voters map[string]int, acks map[string]bool) bool {
+	return majority(voters, acks)
+}
+
+// Determines whether acks holds more than half of the voting weight.
+func majority(voters map[string]int, acks map[string]bool) bool {
+	weight := 0
+	for name, w := range voters {
+		if acks[name] {
+			weight += w
+		}
+	}
+	return weight > totalWeight(voters)/2
+}
+
+// Retrieves the number of voters, added heaviest first, that the policy
+// accepts as a commit quorum, or the number of voters if it accepts none.
+func quorumSize(policy QuorumPolicy, voters map[string]int) int {
+	names := make([]string, 0, len(voters))
+	for name := range voters {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if voters[names[i]] != voters[names[j]] {
+			return voters[names[i]] > voters[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	acks := make(map[string]bool, len(voters))
+	for i, name := range names {
+		acks[name] = true
+		if policy.CommitQuorum(voters, acks) {
+			return i + 1
+		}
+	}
+	return len(voters)
+}
+
+// Retrieves the highest log index stored by a commit quorum of voters.
+func quorumIndex(policy QuorumPolicy, voters map[string]int, index func(name string) uint64) uint64 {
+	indices := make(map[string]uint64, len(voters))
+	candidates := make([]uint64, 0, len(voters))
+	for name := range voters {
+		indices[name] = index(name)
+		candidates = append(candidates, indices[name])
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] > candidates[j] })
+
+	for i, candidate := range candidates {
+		if i > 0 && candidate == candidates[i-1] {
+			continue
+		}
+		acks := make(map[string]bool, len(voters))
+		for name, stored := range indices {
+			acks[name] = stored >= candidate
+		}
+		if policy.CommitQuorum(voters, acks) {
+			return candidate
+		}
+	}
+	return 0
+}
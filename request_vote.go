@@ -15,6 +15,21 @@ type RequestVoteRequest struct {
 	LastLogIndex  uint64
 	LastLogTerm   uint64
 	CandidateName string
+	ClusterID     string
+
+	// Set when the candidate was handed leadership by the current leader, so
+	// voters that are still in contact with that leader may vote for it.
+	Transfer bool
+}
+
+// A VotePolicy lets the application refuse votes that Raft would grant, for
+// example to candidates outside the voter's region. Candidate is a copy of
+// the candidate's member entry, or nil if the voter does not know it. A
+// policy can only prevent votes, so it cannot break the safety of elections,
+// but a policy that refuses too many votes leaves the cluster without a
+// leader.
+type VotePolicy interface {
+	AllowVote(candidate *Peer, req *RequestVoteRequest) bool
 }
 
 // The response returned from a server after a vote for a candidate to become a leader.
@@ -42,6 +57,8 @@ func (req *RequestVoteRequest) Encode(w io.Writer) (int, error) {
 		LastLogIndex:  proto.Uint64(req.LastLogIndex),
 		LastLogTerm:   proto.Uint64(req.LastLogTerm),
 		CandidateName: proto.String(req.CandidateName),
+		ClusterID:     proto.String(req.ClusterID),
+		Transfer:      proto.Bool(req.Transfer),
 	}
 	p, err := proto.Marshal(pb)
 	if err != nil {
@@ -71,6 +88,8 @@ func (req *RequestVoteRequest) Decode(r io.Reader) (int, error) {
 	req.LastLogIndex = pb.GetLastLogIndex()
 	req.LastLogTerm = pb.GetLastLogTerm()
 	req.CandidateName = pb.GetCandidateName()
+	req.ClusterID = pb.GetClusterID()
+	req.Transfer = pb.GetTransfer()
 
 	return totalBytes, nil
 }
@@ -1,15 +1,23 @@
 package raft
 
 import (
+	"bytes"
+	gocontext "context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path"
+	godebug "runtime/debug"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,6 +48,111 @@ const (
 	// 1:3
 	DefaultElectionTimeout = 150 * time.Millisecond
 	DefaultMaxPeerCount    = 10 // 10 follower
+	// DefaultLeaseMargin is taken off the leader lease to allow for clocks
+	// drifting apart.
+	DefaultLeaseMargin = 15 * time.Millisecond
+	// DefaultElectionJitter is the spread, as a fraction of the election
+	// timeout, over which election timeouts are randomized.
+	DefaultElectionJitter = 1.0
+	// DefaultSecondaryZoneMultiplier is how many times longer followers in
+	// secondary zones wait before they stand for election.
+	DefaultSecondaryZoneMultiplier = 5.0
+	// DefaultClockJumpThreshold is how far the wall clock may move against
+	// the monotonic clock between two heartbeats before the leader considers
+	// its clock to have jumped.
+	DefaultClockJumpThreshold = 200 * time.Millisecond
+	// MaxQuiesceElectionTimeouts is how many election timeouts a quiesce
+	// may last at most.
+	MaxQuiesceElectionTimeouts = 100
+	// DefaultMaxElectionBackoff is the longest a candidate waits for an
+	// election round once its rounds keep failing.
+	DefaultMaxElectionBackoff = 2 * time.Second
+	// DefaultMaxIdempotencyKeys is how many of the most recently applied
+	// idempotency keys are remembered.
+	DefaultMaxIdempotencyKeys = 10000
+	// DefaultMaxSessions is how many of the most recently used client
+	// sessions are remembered.
+	DefaultMaxSessions = 10000
+)
+
+// Join policies. They decide what the leader does with a join once
+// MaxPeerCount voting peers are members.
+const (
+	// RejectJoinPolicy joins fail with ClusterFullError.
+	RejectJoinPolicy = "reject"
+	// QueueJoinPolicy joins wait until a member leaves or the limit is
+	// raised.
+	QueueJoinPolicy = "queue"
+	// LearnerJoinPolicy joins are admitted as learners.
+	LearnerJoinPolicy = "learner"
+)
+
+// Apply error policies. They decide what a server does when a command's Apply
+// returns an error. Every server applies the same entries, so a command that
+// fails deterministically fails on each of them.
+const (
+	// SkipApplyErrorPolicy commands are skipped. The error is returned to
+	// the caller and recorded in ApplyFailures.
+	SkipApplyErrorPolicy = "skip"
+	// RetryApplyErrorPolicy commands are applied again when the commit index
+	// is next set, every heartbeat on the leader and on each AppendEntries
+	// on followers, until they succeed. The server keeps replicating and
+	// taking part in elections meanwhile, but its commit index stops before
+	// the command: neither it nor any entry after it is applied, their
+	// callers keep waiting, and reads that wait for the commit index block.
+	// A command that fails on every server stalls the state machines of the
+	// whole cluster until it succeeds, and commit events and apply hooks are
+	// repeated for each attempt.
+	RetryApplyErrorPolicy = "retry"
+	// HaltApplyErrorPolicy servers stop without applying any further entry,
+	// so that the state machine does not diverge from servers on which the
+	// command succeeded, and refuse to start again.
+	HaltApplyErrorPolicy = "halt"
+)
+
+// Apply panic policies. They decide what a server does when a command's Apply
+// panics.
+const (
+	// CrashPanicPolicy panics are raised again, crashing the process.
+	CrashPanicPolicy = "crash"
+	// StepDownPanicPolicy panics fail the command with an *ApplyPanic, which
+	// the apply error policy then handles, and make a leader step down.
+	StepDownPanicPolicy = "stepDown"
+	// UnhealthyPanicPolicy panics are handled as with StepDownPanicPolicy
+	// and also mark the server unhealthy. An unhealthy server does not stand
+	// for election until it is restarted.
+	UnhealthyPanicPolicy = "unhealthy"
+)
+
+// NOP policies. They decide when a new leader appends a NOP, which commits
+// the entries of earlier terms in its log, as only an entry of the leader's
+// own term can, and tells the leader that its commit index is current.
+// Until then ReadIndex returns LeaderNotReadyError and the leader holds no
+// lease.
+const (
+	// ElectionNOPPolicy leaders append a NOP whenever they are elected.
+	ElectionNOPPolicy = "election"
+	// UncommittedNOPPolicy leaders only append a NOP if their log holds
+	// entries that they do not know to be committed. A leader whose entries
+	// are all committed needs no NOP to know its commit index is current.
+	UncommittedNOPPolicy = "uncommitted"
+	// NeverNOPPolicy leaders do not append NOPs. Entries of earlier terms
+	// wait for the next command to be committed.
+	NeverNOPPolicy = "never"
+)
+
+// Read modes. They decide how Read makes sure that the leader is current.
+const (
+	// ReadIndexReadMode reads confirm the leadership with a round of
+	// heartbeats, as ReadIndex does.
+	ReadIndexReadMode = "readIndex"
+	// LeaseReadMode reads rely on the leader lease while it is valid and
+	// fall back to ReadIndexReadMode otherwise.
+	LeaseReadMode = "lease"
+	// QuorumReadMode reads wait for a quorum to attest how far its logs
+	// reach and for the leader to apply up to there. They do not rely on
+	// clocks and are served straight after an election.
+	QuorumReadMode = "quorum"
 )
 
 // ElectionTimeoutThresholdPercent specifies the threshold at which the server
@@ -57,6 +170,28 @@ var NotLeaderError = errors.New("raft.Server: Not current leader")
 var DuplicatePeerError = errors.New("raft.Server: Duplicate peer")
 var CommandTimeoutError = errors.New("raft: Command timeout")
 var StopError = errors.New("raft: Has been stopped")
+var AlreadyBootstrappedError = errors.New("raft: Server is already bootstrapped")
+var ClusterFullError = errors.New("raft: Cluster is full")
+var DeniedPeerError = errors.New("raft: Peer is denied")
+var DemoteLeaderError = errors.New("raft: Leader cannot be demoted")
+var StaticMembershipError = errors.New("raft: Membership is static")
+var NoQuorumError = errors.New("raft: Leader has lost contact with a quorum")
+var LeaseExpiredError = errors.New("raft: Leader lease has expired")
+var QuiesceTooLongError = errors.New("raft: Quiesce cannot last longer than MaxQuiesceElectionTimeouts election timeouts")
+var InvalidTimeoutsError = errors.New("raft: Heartbeat interval must be positive and at most a third of the election timeout")
+var NotPromotableError = errors.New("raft: Server cannot stand for election")
+var InvalidElectionJitterError = errors.New("raft: Election jitter cannot be negative")
+var InvalidSecondaryZoneMultiplierError = errors.New("raft: Secondary zone multiplier must be at least 1")
+var UnknownProfileError = errors.New("raft: Unknown profile")
+var LeaderNotReadyError = errors.New("raft: Leader has not committed an entry in its term")
+var InvalidReadModeError = errors.New("raft: Invalid read mode")
+var DuplicateCommandError = errors.New("raft: Command has already been applied")
+var ConfigurationBatchError = errors.New("raft: Configuration commands cannot be batched")
+var OverloadedError = errors.New("raft: Too many commands are pending")
+var CompactedError = errors.New("raft: Entries have been compacted")
+var HaltedError = errors.New("raft: Server halted after a command failed to apply")
+var DryRunUnsupportedError = errors.New("raft: Command cannot be dry run")
+var CommandTooLargeError = errors.New("raft: Command is too large")
 
 //------------------------------------------------------------------------------
 //
@@ -68,20 +203,33 @@ var StopError = errors.New("raft: Has been stopped")
 // candidate or a leader.
 type Server interface {
 	Name() string
+	Role() string
+	Metadata() map[string]string
+	Weight() int
+	ClusterID() string
+	ConfigurationIndex() uint64
+	SetClusterID(id string)
 	Context() interface{}
 	StateMachine() StateMachine
 	Leader() string
 	State() string
 	Path() string
 	LogPath() string
+	SnapshotDir() string
+	SetSnapshotDir(dir string)
 	SnapshotPath(lastIndex uint64, lastTerm uint64) string
 	Term() uint64
+	Epoch() uint64
 	CommitIndex() uint64
+	WaitApplied(ctx gocontext.Context, index uint64) error
 	VotedFor() string
 	MemberCount() int
 	QuorumSize() int
 	IsLogEmpty() bool
 	LogEntries() []*LogEntry
+	CommittedEntries(index uint64, max uint64) ([]*LogEntry, *Snapshot, error)
+	Subscribe(ctx gocontext.Context, fromIndex uint64) *Subscription
+	SubscribeFiltered(ctx gocontext.Context, fromIndex uint64, filter func(*LogEntry) bool) *Subscription
 	LastCommandName() string
 	GetState() string
 	ElectionTimeout() time.Duration
@@ -89,42 +237,314 @@ type Server interface {
 	HeartbeatInterval() time.Duration
 	MaxPeerCount() int
 	SetMaxPeerCount(count int)
+	JoinPolicy() string
+	SetJoinPolicy(policy string) error
+	ApplyErrorPolicy() string
+	SetApplyErrorPolicy(policy string) error
+	ApplyFailures() []*ApplyFailure
+	ApplyPanicPolicy() string
+	SetApplyPanicPolicy(policy string) error
+	NOPPolicy() string
+	SetNOPPolicy(policy string) error
+	Healthy() bool
+	JoinValidator() JoinValidator
+	SetJoinValidator(validator JoinValidator)
+	CommandValidator() CommandValidator
+	SetCommandValidator(validator CommandValidator)
+	Authorizer() Authorizer
+	SetAuthorizer(authorizer Authorizer)
+	Simulator() Simulator
+	SetSimulator(simulator Simulator)
+	ConditionChecker() ConditionChecker
+	SetConditionChecker(checker ConditionChecker)
+	VotePolicy() VotePolicy
+	SetVotePolicy(policy VotePolicy)
+	ValidateJoin(command *DefaultJoinCommand) (*JoinVerdict, error)
+	AddMember(ctx gocontext.Context, command *DefaultJoinCommand) error
+	SnapshotCatchUpEntries() uint64
+	SetSnapshotCatchUpEntries(entries uint64)
+	SnapshotCatchUpBytes() int64
+	SetSnapshotCatchUpBytes(bytes int64)
+	LearnerPromotionDistance() uint64
+	SetLearnerPromotionDistance(distance uint64)
+	DeadPeerTimeout() time.Duration
+	SetDeadPeerTimeout(timeout time.Duration)
+	QuorumLossTimeout() time.Duration
+	SetQuorumLossTimeout(timeout time.Duration)
+	RejectWritesOnQuorumLoss() bool
+	SetRejectWritesOnQuorumLoss(reject bool)
+	MaxPendingCommands() int
+	SetMaxPendingCommands(max int)
+	MaxCommandSize() int
+	SetMaxCommandSize(size int)
+	MaxIdempotencyKeys() int
+	SetMaxIdempotencyKeys(max int)
+	MaxSessions() int
+	SetMaxSessions(max int)
+	QuorumLost() bool
+	CheckQuorum() bool
+	SetCheckQuorum(enabled bool)
+	LeaseMargin() time.Duration
+	SetLeaseMargin(margin time.Duration)
+	LeaseValidUntil() time.Time
+	ClockJumpThreshold() time.Duration
+	SetClockJumpThreshold(threshold time.Duration)
+	StepDownOnClockJump() bool
+	SetStepDownOnClockJump(stepDown bool)
+	ReadUnderLease(read func() (interface{}, error)) (interface{}, error)
+	Read(ctx gocontext.Context, mode string, read func() (interface{}, error)) (interface{}, error)
+	ReadStale(bound Staleness, read func() (interface{}, error)) (interface{}, error)
+	ReadAfter(ctx gocontext.Context, token SessionToken, read func() (interface{}, error)) (interface{}, error)
+	Campaign() error
+	StepDown() error
+	TransferOnStop() bool
+	SetTransferOnStop(transfer bool)
+	VerifyLeader() error
+	ReadIndex(ctx gocontext.Context) (uint64, error)
+	Quiesce(duration time.Duration) error
+	QuiescedUntil() time.Time
+	ElectionMetrics() ElectionMetrics
+	QuorumPolicy() QuorumPolicy
+	SetQuorumPolicy(policy QuorumPolicy)
+	SnapshotSource() SnapshotSource
+	SetSnapshotSource(source SnapshotSource)
 	SetHeartbeatInterval(duration time.Duration)
+	SetTimeouts(electionTimeout time.Duration, heartbeatInterval time.Duration) error
+	ApplyProfile(profile Profile) error
+	ElectionJitter() float64
+	SetElectionJitter(spread float64) error
+	ElectionSeed() int64
+	SetElectionSeed(seed int64)
+	SecondaryZones() []string
+	SetSecondaryZones(zones []string)
+	SecondaryZoneMultiplier() float64
+	SetSecondaryZoneMultiplier(multiplier float64) error
+	MaxElectionBackoff() time.Duration
+	SetMaxElectionBackoff(backoff time.Duration)
+	ReachabilityCheck() bool
+	SetReachabilityCheck(enabled bool)
+	ReachablePeers() []string
 	Transporter() Transporter
 	SetTransporter(t Transporter)
 	AppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse
 	RequestVote(req *RequestVoteRequest) *RequestVoteResponse
 	RequestSnapshot(req *SnapshotRequest) *SnapshotResponse
 	SnapshotRecoveryRequest(req *SnapshotRecoveryRequest) *SnapshotRecoveryResponse
+	Bootstrap(peers []*Peer) error
+	SetStaticPeers(peers []*Peer) error
+	ForceNewCluster() error
+	ResetMembership(name string) error
+	StaticMembership() bool
 	AddPeer(name string, connectiongString string) error
 	RemovePeer(name string) error
+	DenyPeer(nameOrAddress string) error
+	AllowPeer(nameOrAddress string) error
+	DeniedPeers() []string
+	ConfigurationHistory() []*ConfigurationChangeEventInfo
+	ConfigurationAt(index uint64) []*Peer
+	SetPeerRole(name string, role string) error
+	DemotePeer(name string, remove bool) error
+	SetPeerMetadata(name string, metadata map[string]string) error
+	SetPeerConnectionString(name string, connectionString string) error
+	SetPeerWeight(name string, weight int) error
+	BeginMembershipChange(peers []*Peer) error
+	CommitMembershipChange() error
 	Peers() map[string]*Peer
+	PeerStatus(name string) (*PeerStatus, error)
 	Init() error
 	Start() error
 	Stop()
 	Running() bool
 	Do(command Command) (interface{}, error)
+	DoContext(ctx gocontext.Context, command Command) (interface{}, error)
+	DoAsync(command Command) *Future
+	DoResult(ctx gocontext.Context, command Command) (CommandResult, error)
+	DoBatch(commands []Command) ([]interface{}, []error)
+	DoBatchContext(ctx gocontext.Context, commands []Command) ([]interface{}, []error)
+	DryRun(command Command) (interface{}, error)
+	Barrier(ctx gocontext.Context) error
 	TakeSnapshot() error
 	LoadSnapshot() error
 	AddEventListener(string, EventListener)
+	RegisterPeerObserver(observer func(PeerChange))
+	RegisterStateObserver(observer func(StateChange))
+	RegisterTermObserver(observer func(TermChange))
+	RegisterLeaderObserver(observer func(LeaderChange))
+	RegisterRecoveryObserver(observer func(RecoveryProgress))
+	RegisterApplyHook(before func(*LogEntry), after func(*LogEntry, interface{}, error))
 	FlushCommitIndex()
 }
 
+// StateChange describes a transition of the server between states, such as
+// from follower to candidate or from candidate to leader, and the term in
+// which it happened.
+type StateChange struct {
+	State     string
+	PrevState string
+	Term      uint64
+}
+
+// TermChange describes a change of the server's current term.
+type TermChange struct {
+	Term     uint64
+	PrevTerm uint64
+}
+
+// Staleness bounds how far behind the leader ReadStale may read. Entries is
+// the most entries the leader has committed that the server may not have
+// applied, and Duration the longest since the server last heard the leader's
+// commit index. A zero Duration leaves the time unbounded.
+type Staleness struct {
+	Entries  uint64
+	Duration time.Duration
+}
+
+// CommandResult is the outcome of a command executed with DoResult. Index
+// and Term identify the entry the command was appended as, and are zero for
+// commands that were redirected to the leader. Token lets the client read
+// the write from any server with ReadAfter.
+type CommandResult struct {
+	Value interface{}
+	Index uint64
+	Term  uint64
+	Token SessionToken
+}
+
+// A SessionToken is the index of the last write a client has seen. Given the
+// token, ReadAfter waits until the server has applied that write, so that the
+// client reads its own writes from any server.
+type SessionToken uint64
+
+// Returns the later of two tokens, for a client that has seen both writes.
+func (t SessionToken) Merge(other SessionToken) SessionToken {
+	if other > t {
+		return other
+	}
+	return t
+}
+
+func (t SessionToken) String() string {
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+// Parses a token formatted with String.
+func ParseSessionToken(s string) (SessionToken, error) {
+	index, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("raft: Invalid session token: %s", s)
+	}
+	return SessionToken(index), nil
+}
+
+// A StaleReadError is returned by ReadStale when the server is further behind
+// the leader than the bound allows. LagDuration is the largest duration if
+// the server has not heard from a leader.
+type StaleReadError struct {
+	LagEntries  uint64
+	LagDuration time.Duration
+}
+
+func (e *StaleReadError) Error() string {
+	return fmt.Sprintf("raft: Server is %d entries and %v behind the leader", e.LagEntries, e.LagDuration)
+}
+
+// A LeaderHintError is returned in place of NotLeaderError by a server that
+// knows which server is the leader, so that clients can retry against it.
+// errors.Is reports it as NotLeaderError, so callers that compared the error
+// of Do, DoContext or StepDown with NotLeaderError using == must use
+// errors.Is(err, NotLeaderError) instead.
+type LeaderHintError struct {
+	Leader           string
+	ConnectionString string
+}
+
+func (e *LeaderHintError) Error() string {
+	return fmt.Sprintf("%v: %s (%s) is the leader", NotLeaderError, e.Leader, e.ConnectionString)
+}
+
+func (e *LeaderHintError) Is(target error) bool {
+	return target == NotLeaderError
+}
+
+// The number of apply failures each server remembers.
+const maxApplyFailures = 100
+
+// ApplyFailure is the value of an apply error event and describes a command
+// whose Apply returned Err.
+type ApplyFailure struct {
+	Index       uint64
+	Term        uint64
+	CommandName string
+	Err         error
+}
+
+// An ApplyPanic is the value of an apply panic event and describes a command
+// whose Apply panicked with Value. Stack is the stack of the panic. It is
+// returned as the error of the command unless the process crashes.
+type ApplyPanic struct {
+	Index       uint64
+	Term        uint64
+	CommandName string
+	Value       interface{}
+	Stack       []byte
+}
+
+func (p *ApplyPanic) Error() string {
+	return fmt.Sprintf("raft: Command %s at index %d panicked: %v", p.CommandName, p.Index, p.Value)
+}
+
+// ClockJump is the value of a clock jump event. Monotonic and Wall are how
+// far the monotonic and the wall clock moved between two heartbeats of the
+// leader, and Reason explains why the leader considers its clock to have
+// jumped.
+type ClockJump struct {
+	Reason    string
+	Monotonic time.Duration
+	Wall      time.Duration
+}
+
+// LeaderChange describes a change of the leader known to the server, and
+// the term of the new leader. Leader is empty while no leader is known.
+type LeaderChange struct {
+	Leader     string
+	PrevLeader string
+	Term       uint64
+}
+
+// RecoveryProgress describes how far the state machine has got recovering
+// from the snapshot at Index and Term: Read of the Total bytes of its state
+// have been read.
+type RecoveryProgress struct {
+	Index uint64
+	Term  uint64
+	Read  int64
+	Total int64
+}
+
 type server struct {
 	*eventDispatcher
 
 	name        string
 	path        string
+	snapshotDir string
 	state       string
 	transporter Transporter
 	context     interface{}
 	currentTerm uint64
+	epoch       uint64
 
 	votedFor     string
 	log          *Log
 	leader       string
+	role         string
+	metadata     map[string]string
+	weight       int
 	peers        map[string]*Peer
+	joint        *jointConfiguration
 	maxPeerCount int
+	joinPolicy   string
+	queuedJoins  []*ev
+	joining      map[string]bool
 	mutex        sync.RWMutex
 	syncedPeer   map[string]bool
 
@@ -133,6 +553,31 @@ type server struct {
 	electionTimeout   time.Duration
 	heartbeatInterval time.Duration
 
+	// Signalled when the heartbeat interval changes.
+	intervalChanged chan bool
+
+	// Election timeouts are drawn from the server's own generator, seeded
+	// with electionSeed, over electionJitter election timeouts.
+	electionJitter float64
+	electionSeed   int64
+	electionRand   *rand.Rand
+
+	electionMetrics ElectionMetrics
+
+	// Followers in secondary zones wait secondaryZoneMultiplier times longer
+	// before they stand for election.
+	secondaryZones          map[string]bool
+	secondaryZoneMultiplier float64
+
+	// A candidate doubles its election timeout with each round it loses in
+	// a row, up to maxElectionBackoff.
+	maxElectionBackoff time.Duration
+
+	// When reachabilityCheck is set, followers ping their peers while the
+	// leader is quiet and record in reachable when each last answered.
+	reachabilityCheck bool
+	reachable         map[string]time.Time
+
 	snapshot *Snapshot
 
 	// PendingSnapshot is an unfinished snapshot.
@@ -141,11 +586,165 @@ type server struct {
 	// set to nil.
 	pendingSnapshot *Snapshot
 
+	// sharedSnapshot holds the state of the current snapshot while it is
+	// being sent to one or more peers.
+	sharedSnapshot *sharedSnapshot
+	snapshotMutex  sync.Mutex
+	snapshotSource SnapshotSource
+
 	stateMachine            StateMachine
 	maxLogEntriesPerRequest uint64
 
+	// The number of entries or bytes a peer can fall behind before the
+	// leader sends it a snapshot instead of replaying the log. Zero
+	// disables the threshold.
+	snapshotCatchUpEntries uint64
+	snapshotCatchUpBytes   int64
+
+	// The distance from the commit index within which a learner is
+	// automatically promoted to a voter. Zero disables promotion.
+	learnerPromotionDistance uint64
+	promotingPeer            map[string]bool
+
+	// The time a peer can be unreachable before the leader proposes its
+	// removal. Zero disables removal.
+	deadPeerTimeout time.Duration
+
+	// The time a leader can go without hearing from a quorum before it
+	// considers the quorum lost. Zero disables detection.
+	quorumLossTimeout        time.Duration
+	rejectWritesOnQuorumLoss bool
+	quorumLost               bool
+	checkQuorumEnabled       bool
+
+	// The most commands the leader holds that are not yet committed, or are
+	// queued. Zero disables the limit.
+	maxPendingCommands int
+
+	// The most bytes a command may be encoded as. Zero disables the limit.
+	maxCommandSize int
+
+	// What is done when a command fails to apply, the most recent failures,
+	// and whether the server has halted on one.
+	applyErrorPolicy string
+	applyFailures    []*ApplyFailure
+	halted           bool
+
+	// What is done when a command panics, and whether the server has been
+	// marked unhealthy by a panic.
+	applyPanicPolicy string
+	unhealthy        bool
+
+	// When a new leader appends a NOP.
+	nopPolicy string
+
+	// The leader lease. Reads may be served locally until it expires. Acks
+	// from before the timeouts last changed do not count towards it.
+	leaseMargin time.Duration
+	leaseExpiry time.Time
+	leaseReset  time.Time
+
+	// Clock jumps larger than the threshold invalidate the lease, and make
+	// the leader step down if stepDownOnClockJump is set. Zero disables
+	// detection.
+	clockJumpThreshold  time.Duration
+	stepDownOnClockJump bool
+
+	// The last time a leader's AppendEntries was accepted, and the members
+	// removed from the configuration. Vote requests from removed members, or
+	// received while a leader is in contact, are ignored.
+	lastLeaderContact time.Time
+	removedPeers      map[string]bool
+
+	// When this server last became leader. A leader that checks the quorum
+	// also ignores vote requests while it is in contact with one.
+	leaderSince time.Time
+
+	// The leader's commit index as last heard from it, and when.
+	leaderCommitIndex uint64
+	leaderCommitTime  time.Time
+
+	// Set when the leader has handed leadership to this server, until its
+	// vote requests are sent.
+	transfer bool
+
+	// Set once the leader has applied its own removal, or has been asked to
+	// step down. It refuses new commands while it hands leadership to a peer.
+	leaving bool
+
+	// Set when a leader steps down before it stops.
+	transferOnStop bool
+
+	// StepDown calls waiting for the leader's entries to be committed, and
+	// the time after which the leader steps down regardless.
+	stepDowns        []*ev
+	stepDownDeadline time.Time
+
+	// VerifyLeader calls waiting for a quorum to answer a heartbeat.
+	verifications []*verification
+
+	// Elections are held off until then. Set by Quiesce on the leader, and
+	// from the leader's AppendEntries on followers.
+	quiesceUntil time.Time
+
+	quorumPolicy  QuorumPolicy
+	joinValidator JoinValidator
+	votePolicy    VotePolicy
+	deniedPeers   map[string]bool
+
+	// Held while the denylist is changed and written, so that the file is
+	// written in the same order as the changes.
+	deniedMutex sync.Mutex
+
+	commandValidator CommandValidator
+	authorizer       Authorizer
+	simulator        Simulator
+	conditionChecker ConditionChecker
+
+	// The configurations applied by this server, oldest first, and the lock
+	// held while they are changed and written.
+	configurations      []*ConfigurationChangeEventInfo
+	configurationsMutex sync.Mutex
+
+	peerObservers   observerList
+	stateObservers  observerList
+	termObservers   observerList
+	leaderObservers observerList
+	applyHooks      []applyHook
+
+	// Called as the state machine recovers from a snapshot.
+	recoveryObservers observerList
+
+	// The last command applied for each client session, for the most
+	// recently used sessions up to maxSessions.
+	sessions    map[string]*clientSession
+	maxSessions int
+
+	// The most recently applied idempotency keys, remembered in keyOrder
+	// oldest first, up to maxIdempotencyKeys.
+	idempotencyKeys    map[string]*appliedKey
+	keyOrder           []string
+	maxIdempotencyKeys int
+
+	// Closed and replaced whenever entries are applied, to wake WaitApplied
+	// calls.
+	applied chan struct{}
+
+	// The fixed membership, if it is static.
+	staticPeers []*Peer
+
+	// Set by ForceNewCluster until the server starts, and then until it has
+	// become leader and logged the new cluster.
+	forceNewCluster  bool
+	forcedNewCluster bool
+
 	connectionString string
 
+	clusterID string
+
+	// The index of the last applied configuration change.
+	configurationIndex uint64
+
 	routineGroup sync.WaitGroup
 }
 
@@ -154,6 +753,30 @@ type ev struct {
 	target      interface{}
 	returnValue interface{}
 	errChan     chan error
+
+	// Set for commands executed with DoAsync.
+	future *Future
+
+	// Set atomically once the caller stops waiting for the result.
+	abandoned int32
+}
+
+// Records that the caller has stopped waiting for the result.
+func (e *ev) abandon() {
+	atomic.StoreInt32(&e.abandoned, 1)
+}
+
+// Checks whether the caller has stopped waiting for the result.
+func (e *ev) isAbandoned() bool {
+	return atomic.LoadInt32(&e.abandoned) == 1
+}
+
+// Delivers the result of an event to its caller.
+func (e *ev) reply(err error) {
+	e.errChan <- err
+	if e.future != nil {
+		close(e.future.done)
+	}
 }
 
 //------------------------------------------------------------------------------
@@ -183,40 +806,307 @@ func NewServer(name string, path string, transporter Transporter, stateMachine S
 		context:                 ctx,
 		state:                   Stopped,
 		peers:                   make(map[string]*Peer),
+		sessions:                make(map[string]*clientSession),
+		idempotencyKeys:         make(map[string]*appliedKey),
+		maxIdempotencyKeys:      DefaultMaxIdempotencyKeys,
+		maxSessions:             DefaultMaxSessions,
+		applied:                 make(chan struct{}),
 		maxPeerCount:            DefaultMaxPeerCount,
+		joinPolicy:              RejectJoinPolicy,
+		applyErrorPolicy:        SkipApplyErrorPolicy,
+		applyPanicPolicy:        CrashPanicPolicy,
+		nopPolicy:               ElectionNOPPolicy,
 		log:                     newLog(),
 		evChan:                  make(chan *ev, 256),
 		electionTimeout:         DefaultElectionTimeout,
 		heartbeatInterval:       DefaultHeartbeatInterval,
+		intervalChanged:         make(chan bool, 1),
 		maxLogEntriesPerRequest: MaxLogEntriesPerRequest,
 		connectionString:        connectionString,
+		quorumPolicy:            MajorityQuorumPolicy{},
+		leaseMargin:             DefaultLeaseMargin,
+		clockJumpThreshold:      DefaultClockJumpThreshold,
+		electionJitter:          DefaultElectionJitter,
+		secondaryZoneMultiplier: DefaultSecondaryZoneMultiplier,
+		maxElectionBackoff:      DefaultMaxElectionBackoff,
+		transferOnStop:          true,
+		electionMetrics:         ElectionMetrics{Duration: newHistogram(electionDurationBounds)},
 	}
+	s.SetElectionSeed(newSeed())
 	s.eventDispatcher = newEventDispatcher(s)
 
 	// Setup apply function.
 	s.log.ApplyFunc = func(e *LogEntry, c Command) (interface{}, error) {
 		// Dispatch commit event.
 		s.DispatchEvent(newEvent(CommitEventType, e, nil))
+		defer s.notifyApplied()
 
-		// Apply command to the state machine.
-		switch c := c.(type) {
-		case CommandApply:
-			return c.Apply(&context{
-				server:       s,
-				currentTerm:  s.currentTerm,
-				currentIndex: s.log.internalCurrentIndex(),
-				commitIndex:  s.log.commitIndex,
-			})
-		case deprecatedCommandApply:
-			return c.Apply(s)
-		default:
-			return nil, fmt.Errorf("Command does not implement Apply()")
+		if s.isHalted() {
+			return nil, HaltedError
 		}
+
+		hooks := s.getApplyHooks()
+		hooks.before(e)
+		result, err := s.applyEntry(e, c)
+		hooks.after(e, result, err)
+		return result, err
+	}
+	s.log.ReadsFunc = s.applyReads
+	if batcher, ok := stateMachine.(BatchApplier); ok {
+		s.log.BatchFunc = batcher.ApplyBatch
+	}
+	if validator, ok := stateMachine.(CommandValidator); ok {
+		s.commandValidator = validator
+	}
+	if simulator, ok := stateMachine.(Simulator); ok {
+		s.simulator = simulator
+	}
+	if checker, ok := stateMachine.(ConditionChecker); ok {
+		s.conditionChecker = checker
 	}
 
 	return s, nil
 }
 
+// Applies consecutive read-only entries concurrently. Their commit events are
+// dispatched and their apply hooks called serially, in the order of the log,
+// before and after all of them are applied.
+func (s *server) applyReads(entries []*LogEntry, commands []Command) ([]interface{}, []error) {
+	results := make([]interface{}, len(entries))
+	errs := make([]error, len(entries))
+	for _, e := range entries {
+		s.DispatchEvent(newEvent(CommitEventType, e, nil))
+	}
+	defer s.notifyApplied()
+
+	if s.isHalted() {
+		for i := range errs {
+			errs[i] = HaltedError
+		}
+		return results, errs
+	}
+
+	hooks := s.getApplyHooks()
+	for _, e := range entries {
+		hooks.before(e)
+	}
+	applyConcurrently(len(entries), func(i int) {
+		results[i], errs[i] = s.applyEntry(entries[i], commands[i])
+	})
+	for i, e := range entries {
+		hooks.after(e, results[i], errs[i])
+	}
+	return results, errs
+}
+
+// Applies the command of a committed entry, keeping the configuration up to
+// date for configuration changes.
+func (s *server) applyEntry(e *LogEntry, c Command) (interface{}, error) {
+	if !isConfigurationCommand(c) {
+		return s.applyOnce(e, c)
+	}
+	if isJoin(c) {
+		delete(s.joining, c.(JoinCommand).NodeName())
+	}
+
+	s.setConfigurationIndex(e.Index())
+	before := s.configuration()
+	result, err := s.apply(e, c)
+	if err == nil {
+		s.recordConfiguration(&ConfigurationChangeEventInfo{
+			Index:   e.Index(),
+			Term:    e.Term(),
+			Command: c.CommandName(),
+			Peers:   s.configuration(),
+		})
+		s.DispatchEvent(newEvent(ConfigurationChangeEventType, &ConfigurationChangeEventInfo{
+			Index:   e.Index(),
+			Term:    e.Term(),
+			Command: c.CommandName(),
+			Peers:   s.configuration(),
+		}, &ConfigurationChangeEventInfo{
+			Index: e.Index(),
+			Term:  e.Term(),
+			Peers: before,
+		}))
+	}
+	return result, err
+}
+
+// The last command applied for a client, and the index of its entry. The
+// result is not cached for sessions restored from a snapshot.
+type clientSession struct {
+	sequence uint64
+	index    uint64
+	result   interface{}
+	err      error
+	cached   bool
+}
+
+// The result an idempotency key was applied with. It is not cached for keys
+// restored from a snapshot.
+type appliedKey struct {
+	result interface{}
+	err    error
+	cached bool
+}
+
+// Applies a command to the state machine at most once per idempotency key
+// that is still remembered. A repeat returns the result the key was applied
+// with, or DuplicateCommandError if the result is not known.
+func (s *server) applyOnce(e *LogEntry, c Command) (interface{}, error) {
+	key := e.IdempotencyKey()
+	if key == "" {
+		return s.applySession(e, c)
+	}
+
+	s.mutex.RLock()
+	applied := s.idempotencyKeys[key]
+	s.mutex.RUnlock()
+	if applied != nil {
+		if applied.cached {
+			return applied.result, applied.err
+		}
+		return nil, DuplicateCommandError
+	}
+
+	result, err := s.applySession(e, c)
+	if err == errApplyLater {
+		return result, err
+	}
+	s.mutex.Lock()
+	s.rememberKey(key, &appliedKey{result: result, err: err, cached: true})
+	s.mutex.Unlock()
+	return result, err
+}
+
+// Remembers an applied key, forgetting the oldest keys past the limit. The
+// lock must be held.
+func (s *server) rememberKey(key string, applied *appliedKey) {
+	s.idempotencyKeys[key] = applied
+	s.keyOrder = append(s.keyOrder, key)
+	for len(s.keyOrder) > s.maxIdempotencyKeys {
+		delete(s.idempotencyKeys, s.keyOrder[0])
+		s.keyOrder = s.keyOrder[1:]
+	}
+}
+
+// Applies a command to the state machine at most once per client session. A
+// retry of the last command applied for a client returns the result it had
+// the first time and older commands return DuplicateCommandError.
+func (s *server) applySession(e *LogEntry, c Command) (interface{}, error) {
+	id := e.ClientID()
+	if id == "" {
+		return s.applyCommand(e, c)
+	}
+
+	s.mutex.RLock()
+	session := s.sessions[id]
+	s.mutex.RUnlock()
+	if session != nil && e.Sequence() <= session.sequence {
+		if e.Sequence() == session.sequence && session.cached {
+			return session.result, session.err
+		}
+		return nil, DuplicateCommandError
+	}
+
+	result, err := s.applyCommand(e, c)
+	if err == errApplyLater {
+		return result, err
+	}
+	s.mutex.Lock()
+	s.rememberSession(id, &clientSession{sequence: e.Sequence(), index: e.Index(), result: result, err: err, cached: true})
+	s.mutex.Unlock()
+	return result, err
+}
+
+// Remembers a client session, forgetting the least recently used sessions
+// past the limit. Sessions are used in log order, so every server forgets
+// the same ones. The lock must be held.
+func (s *server) rememberSession(id string, session *clientSession) {
+	s.sessions[id] = session
+	for len(s.sessions) > s.maxSessions {
+		var oldest string
+		for id, session := range s.sessions {
+			if oldest == "" || session.index < s.sessions[oldest].index {
+				oldest = id
+			}
+		}
+		delete(s.sessions, oldest)
+	}
+}
+
+// Applies a command to the state machine, handling a failure as the apply
+// error policy decides. This runs under the log lock, so a command to be
+// retried is left for the log to apply again later rather than waited on.
+func (s *server) applyCommand(e *LogEntry, c Command) (interface{}, error) {
+	result, err := s.apply(e, c)
+	if err == nil {
+		return result, nil
+	}
+	if _, ok := err.(*ConflictError); ok {
+		return result, err
+	}
+
+	failure := &ApplyFailure{Index: e.Index(), Term: e.Term(), CommandName: e.CommandName(), Err: err}
+	s.recordApplyFailure(failure)
+	s.DispatchEvent(newEvent(ApplyErrorEventType, failure, nil))
+
+	switch s.ApplyErrorPolicy() {
+	case RetryApplyErrorPolicy:
+		return nil, errApplyLater
+	case HaltApplyErrorPolicy:
+		s.halt()
+	}
+	return result, err
+}
+
+// Applies a command to the state machine.
+func (s *server) apply(e *LogEntry, c Command) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, s.recoverApply(e, r)
+		}
+	}()
+
+	abandoned := e.event != nil && e.event.isAbandoned()
+	if abandoned {
+		s.DispatchEvent(newEvent(AbandonEventType, e, nil))
+	}
+
+	ctx := &context{
+		server:       s,
+		currentTerm:  s.currentTerm,
+		currentIndex: s.log.internalCurrentIndex(),
+		commitIndex:  s.log.commitIndex,
+		epoch:        e.Term(),
+		index:        e.Index(),
+		isLeader:     s.State() == Leader,
+		time:         e.Timestamp(),
+		seed:         e.Seed(),
+		abandoned:    abandoned,
+	}
+	if conditional, ok := c.(*ConditionalCommand); ok {
+		checker := s.ConditionChecker()
+		if checker == nil {
+			return nil, errors.New("raft: Conditional command without a condition checker")
+		}
+		if err := checker.CheckCondition(ctx, conditional.Condition, conditional.Command); err != nil {
+			return nil, &ConflictError{Condition: conditional.Condition, Err: err}
+		}
+		c = conditional.Command
+	}
+
+	switch c := c.(type) {
+	case CommandApply:
+		return c.Apply(ctx)
+	case deprecatedCommandApply:
+		return c.Apply(s)
+	default:
+		return nil, fmt.Errorf("Command does not implement Apply()")
+	}
+}
+
 //------------------------------------------------------------------------------
 //
 // Accessors
@@ -232,6 +1122,61 @@ func (s *server) Name() string {
 	return s.name
 }
 
+// Retrieves the identifier of the cluster the server belongs to.
+func (s *server) ClusterID() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.clusterID
+}
+
+// Sets the identifier of the cluster the server belongs to. It is sent with
+// every RPC and recorded in snapshot manifests; requests and snapshots from
+// other clusters are rejected. A new cluster generates an ID when it is
+// bootstrapped and members that have none adopt the leader's.
+func (s *server) SetClusterID(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clusterID = id
+}
+
+// Retrieves the index of the log entry at which the current configuration
+// took effect. Entries after it are governed by the current configuration.
+// It is zero if the configuration predates the log, and it is restored from
+// the manifest of a snapshot.
+func (s *server) ConfigurationIndex() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.configurationIndex
+}
+
+func (s *server) setConfigurationIndex(index uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.configurationIndex = index
+}
+
+// Checks the cluster ID carried by a request. A server without an ID adopts
+// the one it is sent, which is how new members learn it. Requests without an
+// ID come from servers that predate cluster IDs and are accepted.
+func (s *server) acceptClusterID(id string) bool {
+	if id == "" {
+		return true
+	}
+
+	s.mutex.Lock()
+	local := s.clusterID
+	if local == "" {
+		s.clusterID = id
+	}
+	s.mutex.Unlock()
+
+	if local == "" {
+		s.writeConf()
+		return true
+	}
+	return local == id
+}
+
 // Retrieves the storage path for the server.
 func (s *server) Path() string {
 	return s.path
@@ -239,6 +1184,8 @@ func (s *server) Path() string {
 
 // The name of the current leader.
 func (s *server) Leader() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.leader
 }
 
@@ -254,6 +1201,38 @@ func (s *server) Peers() map[string]*Peer {
 	return peers
 }
 
+// Retrieves the replication state of a peer. It is only known by the leader,
+// so that operators can check a new member has caught up before removing an
+// old one.
+func (s *server) PeerStatus(name string) (*PeerStatus, error) {
+	if s.State() != Leader {
+		return nil, NotLeaderError
+	}
+
+	s.mutex.RLock()
+	peer := s.peers[name]
+	s.mutex.RUnlock()
+	if peer == nil {
+		return nil, fmt.Errorf("raft: Peer not found: %s", name)
+	}
+
+	peer.RLock()
+	status := &PeerStatus{
+		Name:            peer.Name,
+		MatchIndex:      peer.prevLogIndex,
+		NextIndex:       peer.prevLogIndex + 1,
+		LastContact:     peer.lastActivity,
+		SendingSnapshot: peer.sendingSnapshot,
+	}
+	peer.RUnlock()
+
+	if currentIndex := s.log.currentIndex(); currentIndex > status.MatchIndex {
+		status.LagEntries = currentIndex - status.MatchIndex
+		status.LagBytes = s.log.sizeAfter(status.MatchIndex, math.MaxInt64)
+	}
+	return status, nil
+}
+
 // Retrieves the object that transports requests.
 func (s *server) Transporter() Transporter {
 	s.mutex.RLock()
@@ -282,6 +1261,42 @@ func (s *server) LogPath() string {
 	return path.Join(s.path, "log")
 }
 
+// Retrieves the directory that snapshots are stored in. Unless changed with
+// SetSnapshotDir() this is the "snapshot" directory under the server path.
+func (s *server) SnapshotDir() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.snapshotDir != "" {
+		return s.snapshotDir
+	}
+	return path.Join(s.path, "snapshot")
+}
+
+// Sets the directory that snapshots are stored in. This allows snapshots to
+// live on a different volume than the log. It must be called before the
+// server is initialized.
+func (s *server) SetSnapshotDir(dir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshotDir = dir
+}
+
+// Retrieves the source used to read snapshot state when sending snapshots to
+// followers. A nil source means the snapshot file is read.
+func (s *server) SnapshotSource() SnapshotSource {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshotSource
+}
+
+// Sets the source used to read snapshot state when sending snapshots to
+// followers.
+func (s *server) SetSnapshotSource(source SnapshotSource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshotSource = source
+}
+
 // Retrieves the current state of the server.
 func (s *server) State() string {
 	s.mutex.RLock()
@@ -292,7 +1307,6 @@ func (s *server) State() string {
 // Sets the state of the server.
 func (s *server) setState(state string) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 
 	// Temporarily store previous values.
 	prevState := s.state
@@ -302,7 +1316,11 @@ func (s *server) setState(state string) {
 	s.state = state
 	if state == Leader {
 		s.leader = s.Name()
+		s.epoch = s.currentTerm
 		s.syncedPeer = make(map[string]bool)
+		s.promotingPeer = make(map[string]bool)
+		s.joining = make(map[string]bool)
+		s.leaving = false
 	}
 
 	// Dispatch state and leader change events.
@@ -311,6 +1329,16 @@ func (s *server) setState(state string) {
 	if prevLeader != s.leader {
 		s.DispatchEvent(newEvent(LeaderChangeEventType, s.leader, prevLeader))
 	}
+	change := StateChange{State: state, PrevState: prevState, Term: s.currentTerm}
+	leader := s.leader
+	s.mutex.Unlock()
+
+	if prevState != state {
+		s.notifyStateObservers(change)
+	}
+	if prevLeader != leader {
+		s.notifyLeaderObservers(LeaderChange{Leader: leader, PrevLeader: prevLeader, Term: change.Term})
+	}
 }
 
 // Retrieves the current term of the server.
@@ -320,6 +1348,16 @@ func (s *server) Term() uint64 {
 	return s.currentTerm
 }
 
+// Retrieves the leadership epoch: the term of the latest leader this server
+// has known, which may be itself. Unlike the current term, it only moves
+// forward once a leader has been established in a term, and it never
+// decreases, so a leader can fence external systems with it.
+func (s *server) Epoch() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.epoch
+}
+
 // Retrieves the current commit index of the server.
 func (s *server) CommitIndex() uint64 {
 	s.log.mutex.RLock()
@@ -327,6 +1365,38 @@ func (s *server) CommitIndex() uint64 {
 	return s.log.commitIndex
 }
 
+// Waits until the state machine has applied the entry at index, for example
+// to read a write made through another server once its index is known. It
+// returns ctx.Err() if ctx is done first and StopError if the server stops.
+func (s *server) WaitApplied(ctx gocontext.Context, index uint64) error {
+	s.mutex.RLock()
+	stopped := s.stopped
+	s.mutex.RUnlock()
+	for {
+		s.mutex.RLock()
+		applied := s.applied
+		s.mutex.RUnlock()
+		if s.CommitIndex() >= index {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-stopped:
+			return StopError
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Wakes the WaitApplied calls after entries have been applied.
+func (s *server) notifyApplied() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.applied)
+	s.applied = make(chan struct{})
+}
+
 // Retrieves the name of the candidate this server voted for in this term.
 func (s *server) VotedFor() string {
 	return s.votedFor
@@ -344,40 +1414,287 @@ func (s *server) LogEntries() []*LogEntry {
 	return s.log.entries
 }
 
-// A reference to the command name of the last entry.
-func (s *server) LastCommandName() string {
-	return s.log.lastCommandName()
-}
-
-// Get the state of the server for debugging
-func (s *server) GetState() string {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return fmt.Sprintf("Name: %s, State: %s, Term: %v, CommitedIndex: %v ", s.name, s.state, s.currentTerm, s.log.commitIndex)
-}
+// Retrieves up to max committed entries after index so that a process
+// outside the cluster, such as a read-only replica, can follow the log. Any
+// server can be read from and readers are not counted towards the quorum. If
+// the entries after index have been compacted, the current snapshot is
+// returned instead and the reader continues from its last index. The entries
+// and snapshot are shared and must not be modified.
+func (s *server) CommittedEntries(index uint64, max uint64) ([]*LogEntry, *Snapshot, error) {
+	if max == 0 {
+		max = s.maxLogEntriesPerRequest
+	}
 
-// Check if the server is promotable
-func (s *server) promotable() bool {
-	return s.log.currentIndex() > 0
-}
+	commitIndex := s.log.CommitIndex()
+	if index >= commitIndex {
+		return nil, nil, nil
+	}
 
-//--------------------------------------
-// Membership
-//--------------------------------------
+	entries, _ := s.log.getEntriesAfter(index, max)
+	if entries == nil {
+		shared, err := s.acquireSnapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer s.releaseSnapshot(shared)
+		return nil, shared.Snapshot, nil
+	}
 
-// Retrieves the number of member servers in the consensus.
-func (s *server) MemberCount() int {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return len(s.peers) + 1
+	if n := commitIndex - index; uint64(len(entries)) > n {
+		entries = entries[:n]
+	}
+	if uint64(len(entries)) > max {
+		entries = entries[:max]
+	}
+	return entries, nil, nil
 }
 
-// Retrieves the number of servers required to make a quorum.
-func (s *server) QuorumSize() int {
-	return (s.MemberCount() / 2) + 1
+// Delivers the committed entries from fromIndex on, so that applications can
+// build change feeds or replicate to external systems. Entries already in the
+// log are delivered first and then each entry as it is committed. The
+// subscription ends when ctx is done, when the server stops, or with
+// CompactedError when the entries are compacted before they are delivered;
+// CommittedEntries then returns the snapshot to continue from. The entries
+// are shared and must not be modified.
+func (s *server) Subscribe(ctx gocontext.Context, fromIndex uint64) *Subscription {
+	return s.SubscribeFiltered(ctx, fromIndex, nil)
 }
 
-//--------------------------------------
+// Subscribes to committed entries like Subscribe, delivering only the entries
+// for which filter returns true, such as those that are not NOPs:
+//
+//	s.SubscribeFiltered(ctx, 1, func(e *LogEntry) bool { return !e.IsNOP() })
+//
+// A nil filter delivers every entry.
+func (s *server) SubscribeFiltered(ctx gocontext.Context, fromIndex uint64, filter func(*LogEntry) bool) *Subscription {
+	sub := newSubscription(int(s.maxLogEntriesPerRequest))
+	if !s.Running() {
+		sub.end(StopError)
+		return sub
+	}
+
+	index := uint64(0)
+	if fromIndex > 0 {
+		index = fromIndex - 1
+	}
+	s.mutex.RLock()
+	stopped := s.stopped
+	s.mutex.RUnlock()
+	s.routineGroup.Add(1)
+	go func() {
+		defer s.routineGroup.Done()
+		sub.end(s.deliver(ctx, sub, index, filter, stopped))
+	}()
+	return sub
+}
+
+// Sends the committed entries after index to a subscriber until ctx is done,
+// the server stops or the entries are compacted.
+func (s *server) deliver(ctx gocontext.Context, sub *Subscription, index uint64, filter func(*LogEntry) bool, stopped chan bool) error {
+	for {
+		if err := s.WaitApplied(ctx, index+1); err != nil {
+			return err
+		}
+		entries, snapshot, err := s.CommittedEntries(index, 0)
+		if err != nil {
+			return err
+		}
+		if snapshot != nil {
+			return CompactedError
+		}
+		for _, entry := range entries {
+			if filter != nil && !filter(entry) {
+				index = entry.Index()
+				continue
+			}
+			select {
+			case sub.c <- entry:
+			case <-stopped:
+				return StopError
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			index = entry.Index()
+		}
+	}
+}
+
+// A reference to the command name of the last entry.
+func (s *server) LastCommandName() string {
+	return s.log.lastCommandName()
+}
+
+// Get the state of the server for debugging
+func (s *server) GetState() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return fmt.Sprintf("Name: %s, State: %s, Term: %v, CommitedIndex: %v ", s.name, s.state, s.currentTerm, s.log.commitIndex)
+}
+
+// Check if the server is promotable. Learners and witnesses never become
+// candidates.
+func (s *server) promotable() bool {
+	return (s.log.currentIndex() > 0 || s.StaticMembership()) && s.Role() == VoterRole && s.Healthy()
+}
+
+// Retrieves the role of this server in the cluster.
+func (s *server) Role() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.role == "" {
+		return VoterRole
+	}
+	return s.role
+}
+
+// Retrieves the metadata this server was given when it joined the cluster.
+func (s *server) Metadata() map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyMetadata(s.metadata)
+}
+
+// Retrieves the voting weight of this server.
+func (s *server) Weight() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return voteWeight(s.weight)
+}
+
+//--------------------------------------
+// Membership
+//--------------------------------------
+
+// Retrieves the number of member servers in the consensus.
+func (s *server) MemberCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.peers) + 1
+}
+
+// Retrieves the number of voting members, including this server if it votes.
+func (s *server) voterCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	count := 0
+	if isVotingRole(s.role) {
+		count++
+	}
+	for _, peer := range s.peers {
+		if peer.Voting() {
+			count++
+		}
+	}
+	return count
+}
+
+// Retrieves the number of voting peers, whether or not this server votes.
+func (s *server) votingPeerCount() int {
+	count := 0
+	for _, peer := range s.peers {
+		if peer.Voting() {
+			count++
+		}
+	}
+	return count
+}
+
+// Retrieves the number of servers required to make a commit quorum under the
+// quorum policy and the voting weights, counting the heaviest voters first.
+// With the default policy and equal weights it is a majority of the voters.
+// A policy may also accept other sets, so it is only a guide for weighted or
+// custom quorums. Learners are not counted.
+func (s *server) QuorumSize() int {
+	s.mutex.RLock()
+	voters := s.voters()
+	s.mutex.RUnlock()
+	return quorumSize(s.QuorumPolicy(), voters)
+}
+
+// Retrieves the voting weight of each voting member, including this server
+// if it votes.
+func (s *server) voters() map[string]int {
+	voters := make(map[string]int)
+	if isVotingRole(s.role) {
+		voters[s.name] = voteWeight(s.weight)
+	}
+	for name, peer := range s.peers {
+		if peer.Voting() {
+			voters[name] = voteWeight(peer.Weight)
+		}
+	}
+	return voters
+}
+
+// Retrieves how much longer than the election timeout this server waits
+// before it stands for election. It is in proportion to how far its priority
+// is below the highest priority of the members that can become leader, up to
+// one election timeout.
+func (s *server) electionDelay() time.Duration {
+	s.mutex.RLock()
+	priority := metadataPriority(s.metadata)
+	highest := priority
+	for _, peer := range s.peers {
+		if role := peer.getRole(); isVotingRole(role) && role != WitnessRole {
+			if p := peer.Priority(); p > highest {
+				highest = p
+			}
+		}
+	}
+	electionTimeout := s.electionTimeout
+	s.mutex.RUnlock()
+
+	if highest == 0 {
+		return 0
+	}
+	return electionTimeout * time.Duration(highest-priority) / time.Duration(highest)
+}
+
+// Determines whether votes contains an election quorum of the current
+// configuration, or of both configurations during a membership change.
+func (s *server) hasElectionQuorum(votes map[string]bool) bool {
+	policy := s.QuorumPolicy()
+	if s.joint != nil {
+		return policy.ElectionQuorum(s.joint.old, votes) && policy.ElectionQuorum(s.joint.new, votes)
+	}
+	return policy.ElectionQuorum(s.voters(), votes)
+}
+
+// Determines whether acks contains a commit quorum of the current
+// configuration, or of both configurations during a membership change.
+func (s *server) hasCommitQuorum(acks map[string]bool) bool {
+	policy := s.QuorumPolicy()
+	if s.joint != nil {
+		return policy.CommitQuorum(s.joint.old, acks) && policy.CommitQuorum(s.joint.new, acks)
+	}
+	return policy.CommitQuorum(s.voters(), acks)
+}
+
+// Retrieves the highest log index that has been stored by a quorum.
+func (s *server) quorumIndex() uint64 {
+	index := func(name string) uint64 {
+		if name == s.name {
+			return s.log.currentIndex()
+		}
+		if peer := s.peers[name]; peer != nil {
+			return peer.getPrevLogIndex()
+		}
+		return 0
+	}
+
+	policy := s.QuorumPolicy()
+	if s.joint != nil {
+		oldIndex, newIndex := quorumIndex(policy, s.joint.old, index), quorumIndex(policy, s.joint.new, index)
+		if oldIndex < newIndex {
+			return oldIndex
+		}
+		return newIndex
+	}
+	return quorumIndex(policy, s.voters(), index)
+}
+
+//--------------------------------------
 // Election timeout
 //--------------------------------------
 
@@ -393,6 +1710,7 @@ func (s *server) SetElectionTimeout(duration time.Duration) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.electionTimeout = duration
+	s.resetLease()
 }
 
 //--------------------------------------
@@ -412,797 +1730,3873 @@ func (s *server) SetHeartbeatInterval(duration time.Duration) {
 	defer s.mutex.Unlock()
 
 	s.heartbeatInterval = duration
-	for _, peer := range s.peers {
-		peer.setHeartbeatInterval(duration)
-	}
+	s.notifyHeartbeatInterval()
 }
 
-func (s *server) MaxPeerCount() int {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return s.maxPeerCount
-}
+// Sets the election timeout and heartbeat interval together, which may be
+// done while the server is running. The heartbeat interval must be positive
+// and at most a third of the election timeout so that a follower hears from
+// the leader several times before it stands for election. A running leader
+// switches to the new interval straight away, and drops its lease until a
+// quorum has acknowledged heartbeats sent since.
+func (s *server) SetTimeouts(electionTimeout time.Duration, heartbeatInterval time.Duration) error {
+	if heartbeatInterval <= 0 || heartbeatInterval > electionTimeout/3 {
+		return InvalidTimeoutsError
+	}
 
-func (s *server) SetMaxPeerCount(count int) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.maxPeerCount = count
-}
-
-//------------------------------------------------------------------------------
-//
-// Methods
-//
-//------------------------------------------------------------------------------
-
-//--------------------------------------
-// Initialization
-//--------------------------------------
 
-// Reg the NOPCommand
-func init() {
-	RegisterCommand(&NOPCommand{})
-	RegisterCommand(&DefaultJoinCommand{})
-	RegisterCommand(&DefaultLeaveCommand{})
+	s.electionTimeout = electionTimeout
+	s.heartbeatInterval = heartbeatInterval
+	s.resetLease()
+	s.notifyHeartbeatInterval()
+	return nil
 }
 
-// Start the raft server
-// If log entries exist then allow promotion to candidate if no AEs received.
-// If no log entries exist then wait for AEs from another node.
-// If no log entries exist and a self-join command is issued then
-// immediately become leader and commit entry.
-func (s *server) Start() error {
-	// Exit if the server is already running.
-	if s.Running() {
-		return fmt.Errorf("raft.Server: Server already running[%v]", s.state)
+// Wakes the leader so that it sends heartbeats at the new interval.
+func (s *server) notifyHeartbeatInterval() {
+	select {
+	case s.intervalChanged <- true:
+	default:
 	}
+}
 
-	if err := s.Init(); err != nil {
+// Applies the settings of a profile, such as one of the predefined ones, in
+// place of tuning the timeouts, the jitter and the quorum check one by one.
+// Nothing is changed if the profile is invalid.
+func (s *server) ApplyProfile(profile Profile) error {
+	if profile.ElectionJitter < 0 {
+		return InvalidElectionJitterError
+	}
+	if err := s.SetTimeouts(profile.ElectionTimeout, profile.HeartbeatInterval); err != nil {
 		return err
 	}
-
-	// stopped needs to be allocated each time server starts
-	// because it is closed at `Stop`.
-	s.stopped = make(chan bool)
-	s.setState(Follower)
-
-	// If no log entries exist then
-	// 1. wait for AEs from another node
-	// 2. wait for self-join command
-	// to set itself promotable
-	if !s.promotable() {
-		s.debugln("start as a new raft server")
-
-		// If log entries exist then allow promotion to candidate
-		// if no AEs received.
-	} else {
-		s.debugln("start from previous saved state")
+	s.SetElectionJitter(profile.ElectionJitter)
+	s.SetCheckQuorum(profile.CheckQuorum)
+	if profile.NameSeed {
+		s.SetElectionSeed(nameSeed(s.name))
 	}
+	return nil
+}
 
-	debugln(s.GetState())
+//--------------------------------------
+// Election jitter
+//--------------------------------------
 
-	s.routineGroup.Add(1)
-	go func() {
-		defer s.routineGroup.Done()
-		s.loop()
-	}()
+// Retrieves the spread over which election timeouts are randomized, as a
+// fraction of the election timeout.
+func (s *server) ElectionJitter() float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.electionJitter
+}
 
+// Sets the spread over which election timeouts are randomized. Each election
+// timeout is drawn between the election timeout and 1+spread times it. A
+// wider spread makes split votes less likely at the cost of slower elections.
+func (s *server) SetElectionJitter(spread float64) error {
+	if spread < 0 {
+		return InvalidElectionJitterError
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.electionJitter = spread
 	return nil
 }
 
-// Init initializes the raft server.
-// If there is no previous log file under the given path, Init() will create an empty log file.
-// Otherwise, Init() will load in the log entries from the log file.
-func (s *server) Init() error {
-	if s.Running() {
-		return fmt.Errorf("raft.Server: Server already running[%v]", s.state)
-	}
+// Retrieves the seed of the generator election timeouts are drawn from.
+func (s *server) ElectionSeed() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.electionSeed
+}
 
-	// Server has been initialized or server was stopped after initialized
-	// If log has been initialized, we know that the server was stopped after
-	// running.
-	if s.state == Initialized || s.log.initialized {
-		s.state = Initialized
-		return nil
-	}
+// Reseeds the generator election timeouts are drawn from. Servers are seeded
+// randomly; a fixed seed makes the timeouts repeat from one run to the next.
+func (s *server) SetElectionSeed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.electionSeed = seed
+	s.electionRand = rand.New(rand.NewSource(seed))
+}
 
-	// Create snapshot directory if it does not exist
-	err := os.Mkdir(path.Join(s.path, "snapshot"), 0700)
-	if err != nil && !os.IsExist(err) {
-		s.debugln("raft: Snapshot dir error: ", err)
-		return fmt.Errorf("raft: Initialization error: %s", err)
-	}
+//--------------------------------------
+// Secondary zones
+//--------------------------------------
 
-	if err := s.readConf(); err != nil {
-		s.debugln("raft: Conf file error: ", err)
-		return fmt.Errorf("raft: Initialization error: %s", err)
+// Retrieves the zones whose followers are reluctant to stand for election.
+func (s *server) SecondaryZones() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	zones := make([]string, 0, len(s.secondaryZones))
+	for zone := range s.secondaryZones {
+		zones = append(zones, zone)
 	}
+	sort.Strings(zones)
+	return zones
+}
 
-	// Initialize the log and load it up.
-	if err := s.log.open(s.LogPath()); err != nil {
-		s.debugln("raft: Log error: ", err)
-		return fmt.Errorf("raft: Initialization error: %s", err)
+// Sets the zones, as held under ZoneMetadataKey, whose followers wait the
+// secondary zone multiplier times longer before they stand for election, so
+// that a brief loss of contact across a wide area network does not move
+// leadership out of the primary zones. Candidates in secondary zones retry
+// at the usual timeout.
+func (s *server) SetSecondaryZones(zones []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.secondaryZones = make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		s.secondaryZones[zone] = true
 	}
+}
 
-	// Update the term to the last term in the log.
-	_, s.currentTerm = s.log.lastInfo()
-
-	s.state = Initialized
-	return nil
+// Retrieves how many times longer followers in secondary zones wait before
+// they stand for election.
+func (s *server) SecondaryZoneMultiplier() float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.secondaryZoneMultiplier
 }
 
-// Shuts down the server.
-func (s *server) Stop() {
-	if s.State() == Stopped {
-		return
+// Sets how many times longer followers in secondary zones wait before they
+// stand for election. It must be at least 1.
+func (s *server) SetSecondaryZoneMultiplier(multiplier float64) error {
+	if multiplier < 1 {
+		return InvalidSecondaryZoneMultiplierError
 	}
-
-	close(s.stopped)
-
-	// make sure all goroutines have stopped before we close the log
-	s.routineGroup.Wait()
-
-	s.log.close()
-	s.setState(Stopped)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.secondaryZoneMultiplier = multiplier
+	return nil
 }
 
-// Checks if the server is currently running.
-func (s *server) Running() bool {
+// Draws a random election timeout for a follower, which is longer in
+// secondary zones.
+func (s *server) followerElectionTimeout() time.Duration {
+	timeout := s.randomElectionTimeout()
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return (s.state != Stopped && s.state != Initialized)
+	if s.secondaryZones[s.metadata[ZoneMetadataKey]] {
+		timeout = time.Duration(float64(timeout) * s.secondaryZoneMultiplier)
+	}
+	return timeout
+}
+
+// Draws a random election timeout.
+func (s *server) randomElectionTimeout() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	max := s.electionTimeout + time.Duration(float64(s.electionTimeout)*s.electionJitter)
+	return randomBetween(s.electionRand, s.electionTimeout, max)
 }
 
 //--------------------------------------
-// Term
+// Election backoff
 //--------------------------------------
 
-// updates the current term for the server. This is only used when a larger
-// external term is found.
-func (s *server) updateCurrentTerm(term uint64, leaderName string) {
-	_assert(term > s.currentTerm,
-		"upadteCurrentTerm: update is called when term is not larger than currentTerm")
+// Retrieves the longest a candidate waits for an election round.
+func (s *server) MaxElectionBackoff() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maxElectionBackoff
+}
 
-	// Store previous values temporarily.
-	prevTerm := s.currentTerm
-	prevLeader := s.leader
+// Sets the longest a candidate waits for an election round. A candidate
+// that cannot win, such as one cut off with a minority of the cluster,
+// doubles its election timeout with every round it loses in a row, so that
+// it sends fewer vote requests and moves to fewer new terms. A backoff no
+// longer than the election timeout disables it.
+func (s *server) SetMaxElectionBackoff(backoff time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxElectionBackoff = backoff
+}
 
-	// set currentTerm = T, convert to follower (§5.1)
-	// stop heartbeats before step-down
-	if s.state == Leader {
-		for _, peer := range s.peers {
-			peer.stopHeartbeat(false)
+// Draws a random election timeout for a candidate that has lost the given
+// number of rounds in a row.
+func (s *server) candidateElectionTimeout(lost int) time.Duration {
+	base := s.randomElectionTimeout()
+	max := s.MaxElectionBackoff()
+	timeout := base
+	for i := 0; i < lost && timeout < max; i++ {
+		timeout *= 2
+	}
+	if timeout > max {
+		timeout = max
+	}
+	if timeout < base {
+		timeout = base
+	}
+	return timeout
+}
+
+//--------------------------------------
+// Reachability
+//--------------------------------------
+
+// Retrieves whether followers check that they can reach a quorum before they
+// stand for election.
+func (s *server) ReachabilityCheck() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.reachabilityCheck
+}
+
+// Sets whether followers check that they can reach a quorum before they
+// stand for election. A follower that has not heard from the leader for a
+// heartbeat interval pings its peers through the transporter, which must
+// implement Pinger, and does not stand for election until a quorum has
+// answered within an election timeout. This keeps a server cut off from the
+// cluster from moving to ever higher terms and disrupting the cluster when
+// it is reconnected. The check is skipped if the transporter cannot ping.
+func (s *server) SetReachabilityCheck(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reachabilityCheck = enabled
+}
+
+// Retrieves the sorted names of the peers that answered a ping, or sent
+// entries as the leader, within the last election timeout.
+func (s *server) ReachablePeers() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var names []string
+	for name, at := range s.reachable {
+		if time.Now().Sub(at) < s.electionTimeout {
+			names = append(names, name)
 		}
 	}
-	// update the term and clear vote for
-	if s.state != Follower {
-		s.setState(Follower)
+	sort.Strings(names)
+	return names
+}
+
+// Records that a peer has just been heard from.
+func (s *server) markReachable(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reachable == nil {
+		s.reachable = make(map[string]time.Time)
+	}
+	s.reachable[name] = time.Now()
+}
+
+// Retrieves the transporter if reachability is checked and it can ping.
+func (s *server) pinger() Pinger {
+	if !s.ReachabilityCheck() {
+		return nil
+	}
+	pinger, _ := s.Transporter().(Pinger)
+	return pinger
+}
+
+// Checks whether the follower can reach enough voters to win an election. It
+// is always true when reachability is not checked.
+func (s *server) reachesQuorum() bool {
+	if s.pinger() == nil {
+		return true
+	}
+	reachable := map[string]bool{s.name: true}
+	for _, name := range s.ReachablePeers() {
+		reachable[name] = true
 	}
+	return s.hasElectionQuorum(reachable)
+}
+
+func (s *server) MaxPeerCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maxPeerCount
+}
 
+// Sets the maximum number of voting peers. It can be changed while the
+// server is running; raising it admits queued joins.
+func (s *server) SetMaxPeerCount(count int) {
 	s.mutex.Lock()
-	s.currentTerm = term
-	s.leader = leaderName
-	s.votedFor = ""
-	s.mutex.Unlock()
+	defer s.mutex.Unlock()
+	s.maxPeerCount = count
+}
 
-	// Dispatch change events.
-	s.DispatchEvent(newEvent(TermChangeEventType, s.currentTerm, prevTerm))
+// Retrieves the policy for joins once the cluster is full.
+func (s *server) JoinPolicy() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.joinPolicy
+}
 
-	if prevLeader != s.leader {
-		s.DispatchEvent(newEvent(LeaderChangeEventType, s.leader, prevLeader))
+// Sets the policy for joins once the cluster is full.
+func (s *server) SetJoinPolicy(policy string) error {
+	switch policy {
+	case RejectJoinPolicy, QueueJoinPolicy, LearnerJoinPolicy:
+	default:
+		return fmt.Errorf("raft: Invalid join policy: %s", policy)
 	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.joinPolicy = policy
+	return nil
 }
 
 //--------------------------------------
-// Event Loop
+// Apply errors
 //--------------------------------------
 
-//               ________
-//            --|Snapshot|                 timeout
-//            |  --------                  ______
-// recover    |       ^                   |      |
-// snapshot / |       |snapshot           |      |
-// higher     |       |                   v      |     recv majority votes
-// term       |    --------    timeout    -----------                        -----------
-//            |-> |Follower| ----------> | Candidate |--------------------> |  Leader   |
-//                 --------               -----------                        -----------
-//                    ^          higher term/ |                         higher term |
-//                    |            new leader |                                     |
-//                    |_______________________|____________________________________ |
-// The main event loop for the server
-func (s *server) loop() {
-	defer s.debugln("server.loop.end")
+// Retrieves the policy for commands that fail to apply.
+func (s *server) ApplyErrorPolicy() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.applyErrorPolicy
+}
 
-	state := s.State()
+// Sets the policy for commands that fail to apply. All servers should use the
+// same policy, since each applies the entries on its own.
+func (s *server) SetApplyErrorPolicy(policy string) error {
+	switch policy {
+	case SkipApplyErrorPolicy, RetryApplyErrorPolicy, HaltApplyErrorPolicy:
+	default:
+		return fmt.Errorf("raft: Invalid apply error policy: %s", policy)
+	}
 
-	for state != Stopped {
-		s.debugln("server.loop.run ", state)
-		switch state {
-		case Follower:
-			s.followerLoop()
-		case Candidate:
-			s.candidateLoop()
-		case Leader:
-			s.leaderLoop()
-		case Snapshotting:
-			s.snapshotLoop()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.applyErrorPolicy = policy
+	return nil
+}
+
+// Retrieves the most recent commands that failed to apply on this server,
+// oldest first.
+func (s *server) ApplyFailures() []*ApplyFailure {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]*ApplyFailure(nil), s.applyFailures...)
+}
+
+// Records a command that failed to apply, keeping the most recent failures.
+func (s *server) recordApplyFailure(failure *ApplyFailure) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.applyFailures = append(s.applyFailures, failure)
+	if n := len(s.applyFailures); n > maxApplyFailures {
+		s.applyFailures = s.applyFailures[n-maxApplyFailures:]
+	}
+}
+
+//--------------------------------------
+// Apply panics
+//--------------------------------------
+
+// Retrieves the policy for commands that panic.
+func (s *server) ApplyPanicPolicy() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.applyPanicPolicy
+}
+
+// Sets the policy for commands that panic.
+func (s *server) SetApplyPanicPolicy(policy string) error {
+	switch policy {
+	case CrashPanicPolicy, StepDownPanicPolicy, UnhealthyPanicPolicy:
+	default:
+		return fmt.Errorf("raft: Invalid apply panic policy: %s", policy)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.applyPanicPolicy = policy
+	return nil
+}
+
+// Retrieves when a new leader appends a NOP.
+func (s *server) NOPPolicy() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.nopPolicy
+}
+
+// Sets when a new leader appends a NOP.
+func (s *server) SetNOPPolicy(policy string) error {
+	switch policy {
+	case ElectionNOPPolicy, UncommittedNOPPolicy, NeverNOPPolicy:
+	default:
+		return fmt.Errorf("raft: Invalid NOP policy: %s", policy)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nopPolicy = policy
+	return nil
+}
+
+// Checks whether a new leader appends a NOP.
+func (s *server) needsNOP() bool {
+	switch s.NOPPolicy() {
+	case UncommittedNOPPolicy:
+		return s.log.currentIndex() > s.log.CommitIndex()
+	case NeverNOPPolicy:
+		return false
+	}
+	return true
+}
+
+// Checks whether the leader's commit index is known to be current, which it
+// is once an entry of its term has been committed, or once every entry of
+// its log has, since the log holds every committed entry.
+func (s *server) commitIndexCurrent() bool {
+	commitIndex, term := s.log.commitInfo()
+	return term == s.currentTerm || commitIndex == s.log.currentIndex()
+}
+
+// Retrieves whether the server is healthy. It is marked unhealthy when a
+// command panics under UnhealthyPanicPolicy.
+func (s *server) Healthy() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return !s.unhealthy
+}
+
+// Handles a panic raised by the command of an entry as the apply panic
+// policy decides, returning the error the command fails with.
+func (s *server) recoverApply(e *LogEntry, r interface{}) error {
+	p := &ApplyPanic{Index: e.Index(), Term: e.Term(), CommandName: e.CommandName(), Value: r, Stack: godebug.Stack()}
+	s.DispatchEvent(newEvent(ApplyPanicEventType, p, nil))
+
+	policy := s.ApplyPanicPolicy()
+	if policy == CrashPanicPolicy {
+		panic(r)
+	}
+	warnln("raft:", p)
+
+	if policy == UnhealthyPanicPolicy {
+		s.mutex.Lock()
+		s.unhealthy = true
+		s.mutex.Unlock()
+	}
+	// The panic may be raised while the leader applies entries in its event
+	// loop, which StepDown waits for.
+	if s.State() == Leader {
+		s.routineGroup.Add(1)
+		go func() {
+			defer s.routineGroup.Done()
+			s.StepDown()
+		}()
+	}
+	return p
+}
+
+// Retrieves whether the server has halted on a command that failed to apply.
+func (s *server) isHalted() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.halted
+}
+
+// Stops the server after a command failed to apply. It is called from the
+// event loop, which stop waits for, so a running server is stopped from
+// another goroutine.
+func (s *server) halt() {
+	s.mutex.Lock()
+	s.halted = true
+	running := s.state != Stopped && s.state != Initialized
+	s.mutex.Unlock()
+
+	warnln("raft: Halting", s.name, "after a command failed to apply")
+	if running {
+		go s.stop()
+	}
+}
+
+// Retrieves the application's join validator.
+func (s *server) JoinValidator() JoinValidator {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.joinValidator
+}
+
+// Sets the application's join validator. A nil validator accepts every join.
+func (s *server) SetJoinValidator(validator JoinValidator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.joinValidator = validator
+}
+
+// Retrieves the application's command validator.
+func (s *server) CommandValidator() CommandValidator {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.commandValidator
+}
+
+// Sets the application's command validator. A nil validator accepts every
+// command. A state machine that is a CommandValidator is set by NewServer.
+func (s *server) SetCommandValidator(validator CommandValidator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commandValidator = validator
+}
+
+// Retrieves the application's authorizer.
+func (s *server) Authorizer() Authorizer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.authorizer
+}
+
+// Sets the application's authorizer. A nil authorizer accepts every command.
+func (s *server) SetAuthorizer(authorizer Authorizer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.authorizer = authorizer
+}
+
+// Retrieves the application's simulator.
+func (s *server) Simulator() Simulator {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.simulator
+}
+
+// Sets the application's simulator. A state machine that is a Simulator is
+// set by NewServer.
+func (s *server) SetSimulator(simulator Simulator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.simulator = simulator
+}
+
+// Retrieves the application's condition checker.
+func (s *server) ConditionChecker() ConditionChecker {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.conditionChecker
+}
+
+// Sets the application's condition checker, which ConditionalCommands are
+// refused without. A state machine that is a ConditionChecker is set by
+// NewServer.
+func (s *server) SetConditionChecker(checker ConditionChecker) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conditionChecker = checker
+}
+
+// Authorizes a command with the identity ctx carries. A conditional command
+// is authorized as its command.
+func (s *server) authorize(ctx gocontext.Context, command Command) error {
+	if authorizer := s.Authorizer(); authorizer != nil {
+		if err := authorizer.Authorize(IdentityFromContext(ctx), unwrapCondition(command)); err != nil {
+			return &AuthorizationError{Err: err}
 		}
-		state = s.State()
 	}
+	return nil
+}
+
+// Validates a command with the application's command validator. A
+// conditional command is validated as its command.
+func (s *server) validateCommand(command Command) error {
+	if conditional, ok := command.(*ConditionalCommand); ok {
+		if conditional.Command == nil || isConfigurationCommand(conditional.Command) {
+			return errors.New("raft: Conditional command must hold a command that is not a configuration change")
+		} else if s.ConditionChecker() == nil {
+			return errors.New("raft: Conditional command without a condition checker")
+		}
+		command = conditional.Command
+	}
+	if command.CommandName() == (NOPCommand{}).CommandName() || isConfigurationCommand(command) {
+		return nil
+	}
+	if validator := s.CommandValidator(); validator != nil {
+		return validator.Validate(command)
+	}
+	return nil
+}
+
+// Retrieves the application's vote policy.
+func (s *server) VotePolicy() VotePolicy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.votePolicy
+}
+
+// Sets the application's vote policy. It is consulted after the Raft checks
+// would grant a vote. A nil policy grants every such vote.
+func (s *server) SetVotePolicy(policy VotePolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.votePolicy = policy
+}
+
+//--------------------------------------
+// Snapshot catch-up threshold
+//--------------------------------------
+
+// Retrieves the number of entries a peer can fall behind before it is sent
+// a snapshot instead of log entries. Zero means snapshots are only sent when
+// the entries have been compacted away.
+func (s *server) SnapshotCatchUpEntries() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshotCatchUpEntries
+}
+
+// Sets the number of entries a peer can fall behind before it is sent a
+// snapshot instead of log entries.
+func (s *server) SetSnapshotCatchUpEntries(entries uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshotCatchUpEntries = entries
+}
+
+// Retrieves the number of log bytes a peer can fall behind before it is sent
+// a snapshot instead of log entries. Zero disables the byte threshold.
+func (s *server) SnapshotCatchUpBytes() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshotCatchUpBytes
+}
+
+// Sets the number of log bytes a peer can fall behind before it is sent a
+// snapshot instead of log entries.
+func (s *server) SetSnapshotCatchUpBytes(bytes int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshotCatchUpBytes = bytes
+}
+
+//--------------------------------------
+// Learner promotion
+//--------------------------------------
+
+// Retrieves the distance from the commit index within which a learner's
+// match index must be before the leader promotes it to a voter. Zero means
+// learners are never promoted automatically.
+func (s *server) LearnerPromotionDistance() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.learnerPromotionDistance
+}
+
+// Sets the distance from the commit index within which a learner is
+// automatically promoted to a voter.
+func (s *server) SetLearnerPromotionDistance(distance uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.learnerPromotionDistance = distance
+}
+
+//--------------------------------------
+// Dead peer removal
+//--------------------------------------
+
+// Retrieves the time a peer can go without responding before the leader
+// proposes its removal from the cluster. Zero means peers are never removed
+// automatically.
+func (s *server) DeadPeerTimeout() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.deadPeerTimeout
+}
+
+// Sets the time a peer can go without responding before the leader proposes
+// its removal from the cluster.
+func (s *server) SetDeadPeerTimeout(timeout time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deadPeerTimeout = timeout
+}
+
+//--------------------------------------
+// Quorum loss
+//--------------------------------------
+
+// Retrieves the time the leader can go without hearing from a quorum before
+// it considers the quorum lost. Zero means quorum loss is not detected.
+func (s *server) QuorumLossTimeout() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.quorumLossTimeout
+}
+
+// Sets the time the leader can go without hearing from a quorum before it
+// considers the quorum lost. It takes effect the next time the server
+// becomes leader.
+func (s *server) SetQuorumLossTimeout(timeout time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.quorumLossTimeout = timeout
+}
+
+// Retrieves whether the leader refuses commands while the quorum is lost.
+func (s *server) RejectWritesOnQuorumLoss() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.rejectWritesOnQuorumLoss
+}
+
+// Sets whether the leader refuses commands with NoQuorumError while the
+// quorum is lost, rather than letting each of them time out.
+func (s *server) SetRejectWritesOnQuorumLoss(reject bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rejectWritesOnQuorumLoss = reject
+}
+
+// Retrieves the most commands the leader holds before it refuses more.
+func (s *server) MaxPendingCommands() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maxPendingCommands
+}
+
+// Sets the most commands the leader holds that are not yet committed, or are
+// queued, before it refuses new commands with OverloadedError. Configuration
+// changes and NOPs are always accepted. Zero disables the limit.
+func (s *server) SetMaxPendingCommands(max int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxPendingCommands = max
+}
+
+// Retrieves the most bytes a command may be encoded as.
+func (s *server) MaxCommandSize() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maxCommandSize
+}
+
+// Sets the most bytes a command may be encoded as, so that a command larger
+// than a peer or the transport accepts is refused with CommandTooLargeError
+// by Do and its variants rather than being appended and failing to replicate
+// forever. It should be set alike on every server, as a follower checks the
+// commands it forwards. Zero disables the limit.
+func (s *server) SetMaxCommandSize(size int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxCommandSize = size
+}
+
+// Counts the bytes written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Checks that a command is encoded within the maximum command size.
+func (s *server) checkCommandSize(command Command) error {
+	max := s.MaxCommandSize()
+	if max <= 0 {
+		return nil
+	}
+	var size byteCounter
+	if err := commandCodec(command).Encode(&size, command); err != nil {
+		return err
+	}
+	if int(size) > max {
+		return CommandTooLargeError
+	}
+	return nil
+}
+
+// Retrieves how many applied idempotency keys are remembered.
+func (s *server) MaxIdempotencyKeys() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maxIdempotencyKeys
+}
+
+// Sets how many of the most recently applied idempotency keys are
+// remembered. A command sent again after its key is forgotten is applied
+// again, so zero, or less, turns idempotency keys off. All servers must use
+// the same limit, since each forgets keys as it applies commands.
+func (s *server) SetMaxIdempotencyKeys(max int) {
+	if max < 0 {
+		max = 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxIdempotencyKeys = max
+}
+
+// Retrieves how many client sessions are remembered.
+func (s *server) MaxSessions() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maxSessions
+}
+
+// Sets how many of the most recently used client sessions are remembered. A
+// retry from a client whose session is forgotten is applied again, so zero,
+// or less, turns sessions off. All servers must use the same limit, since
+// each forgets sessions as it applies commands.
+func (s *server) SetMaxSessions(max int) {
+	if max < 0 {
+		max = 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxSessions = max
+}
+
+// Checks whether the leader can accept n more commands.
+func (s *server) overloaded(n int) bool {
+	max := s.MaxPendingCommands()
+	if max <= 0 {
+		return false
+	}
+	pending := int(s.log.currentIndex()-s.log.CommitIndex()) + len(s.queuedJoins)
+	return pending+n > max
+}
+
+// Checks whether the leader has lost contact with a quorum. Writes cannot
+// commit until it is restored, but the application may keep serving reads
+// from its state machine, knowing they may be stale.
+func (s *server) QuorumLost() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.quorumLost
+}
+
+// Checks whether the leader has heard from a quorum within the quorum loss
+// timeout and dispatches an event when that changes. Peers are assumed to
+// have been in contact when the leadership began.
+func (s *server) checkQuorum(since time.Time) {
+	lost := !s.inContactWithQuorum(since, s.QuorumLossTimeout())
+
+	s.mutex.Lock()
+	changed := lost != s.quorumLost
+	s.quorumLost = lost
+	s.mutex.Unlock()
+
+	if changed && lost {
+		s.debugln("server.quorum.lost")
+		s.DispatchEvent(newEvent(QuorumLostEventType, s.Name(), nil))
+	} else if changed {
+		s.debugln("server.quorum.restored")
+		s.DispatchEvent(newEvent(QuorumRestoredEventType, s.Name(), nil))
+	}
+}
+
+// Checks whether the leader has heard from a quorum within timeout. Peers
+// are assumed to have been in contact at since.
+func (s *server) inContactWithQuorum(since time.Time, timeout time.Duration) bool {
+	acks := map[string]bool{s.Name(): true}
+	for name, peer := range s.peers {
+		contact := peer.LastActivity()
+		if contact.Before(since) {
+			contact = since
+		}
+		if time.Now().Sub(contact) < timeout {
+			acks[name] = true
+		}
+	}
+	return s.hasCommitQuorum(acks)
+}
+
+// Retrieves whether the leader steps down when it is isolated.
+func (s *server) CheckQuorum() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.checkQuorumEnabled
+}
+
+// Sets whether the leader steps down to follower when it has not heard from
+// a quorum within an election timeout, so that a partitioned leader stops
+// accepting writes that cannot commit.
+func (s *server) SetCheckQuorum(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkQuorumEnabled = enabled
+}
+
+// Steps down from leader to follower.
+func (s *server) stepDown() {
+	for _, peer := range s.peers {
+		peer.stopHeartbeat(false)
+	}
+	s.setState(Follower)
+
+	s.mutex.Lock()
+	prevLeader := s.leader
+	s.leader = ""
+	s.mutex.Unlock()
+	s.DispatchEvent(newEvent(LeaderChangeEventType, "", prevLeader))
+	s.notifyLeaderObservers(LeaderChange{PrevLeader: prevLeader, Term: s.currentTerm})
+}
+
+//--------------------------------------
+// Elections
+//--------------------------------------
+
+// An election started by Campaign.
+type campaign struct{}
+
+// A request to the leader to step down.
+type stepDownRequest struct{}
+
+// Starts an election immediately instead of waiting for the election
+// timeout, for example to fail over from a leader known to be degraded. The
+// election follows the usual rules, so voters still in contact with a leader
+// turn it down. A candidate starts a new election in the next term. It
+// returns once the server is a candidate, or at once if it is already the
+// leader, and NotPromotableError if the server cannot stand for election.
+func (s *server) Campaign() error {
+	_, err := s.send(&campaign{})
+	return err
+}
+
+// Makes the leader revert to follower without changing the membership, for
+// example before maintenance. The leader refuses new commands at once, waits
+// up to an election timeout for the entries already in its log to be
+// committed, and then hands leadership to the most up-to-date peer that can
+// lead. It returns once the server is a follower, or an error that errors.Is
+// reports as NotLeaderError if it is not the leader.
+func (s *server) StepDown() error {
+	_, err := s.send(&stepDownRequest{})
+	return err
+}
+
+// Retrieves whether a leader hands off leadership before it stops.
+func (s *server) TransferOnStop() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.transferOnStop
+}
+
+// Sets whether a leader steps down, as StepDown does, before it stops, so
+// that a planned restart hands leadership to a caught-up peer rather than
+// leaving the cluster without a leader until an election timeout. Stop then
+// waits up to an election timeout for the leader's entries to be committed.
+func (s *server) SetTransferOnStop(transfer bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transferOnStop = transfer
+}
+
+// A VerifyLeader call waiting for a quorum to answer a heartbeat sent after
+// start.
+type verification struct {
+	e        *ev
+	start    time.Time
+	deadline time.Time
+
+	// Replies with the attested index once a quorum has answered, for a
+	// quorum read.
+	attest bool
+}
+
+// A request to the leader to confirm its leadership.
+type verifyLeaderRequest struct{}
+
+// Confirms that the server is still the leader by sending a round of
+// heartbeats and waiting for a quorum to answer them, so that an action
+// taken afterwards, such as on an external system, cannot be taken by a
+// deposed leader. It returns NotLeaderError if the server is not the leader,
+// or NoQuorumError if a quorum does not answer within an election timeout.
+func (s *server) VerifyLeader() error {
+	_, err := s.send(&verifyLeaderRequest{})
+	return err
+}
+
+// A request to the leader for an index that reads can wait for.
+type readIndexRequest struct{}
+
+// Runs the read index protocol, so that reads can be served without adding
+// an entry to the log for each. The leader takes its commit index, confirms
+// its leadership as VerifyLeader does, and returns the index. Entries are
+// applied as they are committed, so a read from the leader's state machine
+// after ReadIndex returns sees every write committed before it was called.
+// It returns LeaderNotReadyError if the leader has not yet committed an entry
+// in its term, and ctx.Err() if ctx is done first.
+func (s *server) ReadIndex(ctx gocontext.Context) (uint64, error) {
+	index, err := s.sendContext(ctx, &readIndexRequest{})
+	if err != nil {
+		return 0, err
+	}
+	return index.(uint64), nil
+}
+
+// A request to the leader for an index attested by a quorum.
+type quorumReadRequest struct{}
+
+// Retrieves the highest index that can have been committed by the time every
+// peer in acks answered a heartbeat. Each of them attests the last index it
+// stores and the others are assumed to store as much as the leader, which
+// holds every committed entry. Unlike the commit index this is known straight
+// after an election.
+func (s *server) attestedIndex(acks map[string]bool) uint64 {
+	lastIndex := s.log.currentIndex()
+	index := func(name string) uint64 {
+		if peer := s.peers[name]; peer != nil && name != s.name && acks[name] {
+			if ackIndex := peer.getAckIndex(); ackIndex < lastIndex {
+				return ackIndex
+			}
+		}
+		return lastIndex
+	}
+
+	policy := s.QuorumPolicy()
+	if s.joint != nil {
+		// Entries committed before the change only needed a quorum of the
+		// old configuration, so the larger index is taken.
+		oldIndex, newIndex := quorumIndex(policy, s.joint.old, index), quorumIndex(policy, s.joint.new, index)
+		if oldIndex > newIndex {
+			return oldIndex
+		}
+		return newIndex
+	}
+	return quorumIndex(policy, s.voters(), index)
+}
+
+// A request to the leader to hold off elections.
+type quiesceRequest struct {
+	duration time.Duration
+}
+
+// Holds off elections across the cluster for duration, so that planned
+// maintenance lasting a few seconds, such as restarting a switch, does not
+// make the followers depose the leader and elect another. The leader sends
+// the remaining time with every heartbeat, the first straight away, and
+// followers that miss heartbeats while quiesced wait for it to run out
+// before standing for election. The leader does not step down for want of
+// a quorum either. A zero duration ends the quiesce. A quiesce lasts at most
+// MaxQuiesceElectionTimeouts election timeouts, so that a cluster cannot be
+// left without elections for good: QuiesceTooLongError is returned for a
+// longer one, and followers cut a longer one short at that many of their own
+// election timeouts. It returns NotLeaderError if the server is not the
+// leader.
+func (s *server) Quiesce(duration time.Duration) error {
+	if duration > MaxQuiesceElectionTimeouts*s.ElectionTimeout() {
+		return QuiesceTooLongError
+	}
+	_, err := s.send(&quiesceRequest{duration: duration})
+	return err
+}
+
+// Retrieves the time until which elections are held off. It is zero, or in
+// the past, when the cluster is not quiesced.
+func (s *server) QuiescedUntil() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.quiesceUntil
+}
+
+// Sets the time until which elections are held off, duration from now, up to
+// MaxQuiesceElectionTimeouts election timeouts.
+func (s *server) setQuiesce(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if max := MaxQuiesceElectionTimeouts * s.electionTimeout; duration > max {
+		duration = max
+	}
+	if duration > 0 {
+		s.quiesceUntil = time.Now().Add(duration)
+	} else {
+		s.quiesceUntil = time.Time{}
+	}
+}
+
+// Retrieves how much longer elections are held off.
+func (s *server) quiesceRemaining() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if remaining := s.quiesceUntil.Sub(time.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Retrieves a copy of the election metrics.
+func (s *server) ElectionMetrics() ElectionMetrics {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.electionMetrics.clone()
+}
+
+// Records the end of an election round that started at start.
+func (s *server) endElection(start time.Time, won bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if won {
+		s.electionMetrics.Won++
+	} else {
+		s.electionMetrics.Lost++
+	}
+	s.electionMetrics.Duration.observe(time.Now().Sub(start))
+}
+
+// Counts a vote request ignored so that it could not disrupt the cluster.
+func (s *server) rejectDisruptiveVote() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.electionMetrics.DisruptiveVotesRejected++
+}
+
+// Completes pending VerifyLeader calls that a quorum has answered, or whose
+// deadline has passed.
+func (s *server) checkVerifications() {
+	pending := s.verifications[:0]
+	for _, v := range s.verifications {
+		acks := map[string]bool{s.name: true}
+		for name, peer := range s.peers {
+			if !peer.getLastAck().Before(v.start) {
+				acks[name] = true
+			}
+		}
+		if s.hasCommitQuorum(acks) {
+			if v.attest {
+				v.e.returnValue = s.attestedIndex(acks)
+			}
+			v.e.reply(nil)
+		} else if !time.Now().Before(v.deadline) {
+			v.e.reply(NoQuorumError)
+		} else {
+			pending = append(pending, v)
+		}
+	}
+	s.verifications = pending
+}
+
+// Completes pending StepDown calls once the leader's entries are committed
+// or the deadline has passed.
+func (s *server) checkStepDown() {
+	if len(s.stepDowns) == 0 {
+		return
+	}
+	if commitIndex, _ := s.log.commitInfo(); commitIndex < s.log.currentIndex() && time.Now().Before(s.stepDownDeadline) {
+		return
+	}
+
+	successor := s.successor()
+	s.debugln("server.leader.step.down")
+	s.stepDown()
+	if successor != nil {
+		s.routineGroup.Add(1)
+		go func() {
+			defer s.routineGroup.Done()
+			successor.sendTimeoutNow()
+		}()
+	}
+}
+
+//--------------------------------------
+// Leader lease
+//--------------------------------------
+
+// Retrieves the time taken off the leader lease to allow for clock drift.
+func (s *server) LeaseMargin() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.leaseMargin
+}
+
+// Sets the time taken off the leader lease to allow for clock drift. It
+// should cover how far the clocks of the leader and a follower can drift
+// apart over an election timeout.
+func (s *server) SetLeaseMargin(margin time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.leaseMargin = margin
+}
+
+// Retrieves the time until which the leader holds its lease. Followers do not
+// vote for a new leader until an election timeout after they last heard from
+// this one, so no other leader can be elected before then. The lease runs for
+// the leader's own election timeout, so it is only safe if the election
+// timeout of every voter is at least the leader's. Do not rely on the lease
+// while lowering the timeouts of a cluster until every server has the new
+// ones. It is zero if the server is not a leader or does not hold a lease.
+func (s *server) LeaseValidUntil() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.state != Leader {
+		return time.Time{}
+	}
+	return s.leaseExpiry
+}
+
+// Calls read if the leader holds its lease, so that it can be served from the
+// local state machine without a round trip to the followers. It returns
+// LeaseExpiredError if the lease does not hold until read has returned.
+func (s *server) ReadUnderLease(read func() (interface{}, error)) (interface{}, error) {
+	if s.State() != Leader {
+		return nil, NotLeaderError
+	}
+	if !time.Now().Before(s.LeaseValidUntil()) {
+		return nil, LeaseExpiredError
+	}
+
+	value, err := read()
+	if !time.Now().Before(s.LeaseValidUntil()) {
+		return nil, LeaseExpiredError
+	}
+	return value, err
+}
+
+// Runs read, which must not have side effects, on the leader once it is known
+// to be current, as decided by the read mode. In LeaseReadMode the heartbeat
+// round is skipped while the lease is valid, so read may run a second time
+// if the lease expires while it runs. In QuorumReadMode read runs once the
+// leader has applied every entry that a quorum attests may be committed. It
+// returns NotLeaderError on other servers, and ctx.Err() if ctx is done
+// before the leadership is confirmed.
+func (s *server) Read(ctx gocontext.Context, mode string, read func() (interface{}, error)) (interface{}, error) {
+	switch mode {
+	case LeaseReadMode:
+		if value, err := s.ReadUnderLease(read); err != LeaseExpiredError {
+			return value, err
+		}
+	case ReadIndexReadMode:
+	case QuorumReadMode:
+		index, err := s.sendContext(ctx, &quorumReadRequest{})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.WaitApplied(ctx, index.(uint64)); err != nil {
+			return nil, err
+		}
+		return read()
+	default:
+		return nil, InvalidReadModeError
+	}
+
+	if _, err := s.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return read()
+}
+
+// Runs read, which must not have side effects, if the server is no further
+// behind the leader than bound, so that followers can serve reads that may
+// be slightly stale. It returns a *StaleReadError holding the current lag
+// otherwise. The leader is never behind.
+func (s *server) ReadStale(bound Staleness, read func() (interface{}, error)) (interface{}, error) {
+	if lag := s.lag(); lag.LagEntries > bound.Entries || (bound.Duration > 0 && lag.LagDuration > bound.Duration) {
+		return nil, lag
+	}
+	return read()
+}
+
+// Runs read, which must not have side effects, once the server has applied
+// the write recorded by token. It returns ctx.Err() if ctx is done first.
+func (s *server) ReadAfter(ctx gocontext.Context, token SessionToken, read func() (interface{}, error)) (interface{}, error) {
+	if err := s.WaitApplied(ctx, uint64(token)); err != nil {
+		return nil, err
+	}
+	return read()
+}
+
+// Measures how far the server is behind the leader.
+func (s *server) lag() *StaleReadError {
+	if s.State() == Leader {
+		return &StaleReadError{}
+	}
+
+	commitIndex := s.CommitIndex()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	lag := &StaleReadError{LagDuration: math.MaxInt64}
+	if !s.leaderCommitTime.IsZero() {
+		lag.LagDuration = time.Now().Sub(s.leaderCommitTime)
+	}
+	if s.leaderCommitIndex > commitIndex {
+		lag.LagEntries = s.leaderCommitIndex - commitIndex
+	}
+	return lag
+}
+
+// Renews the lease from the heartbeats acknowledged by the voters. The lease
+// runs for an election timeout, less the margin, from the time the latest
+// heartbeat acknowledged by a quorum was sent. A leader only holds a lease
+// once its commit index is current, and not while it hands off leadership.
+func (s *server) updateLease() {
+	s.mutex.RLock()
+	reset := s.leaseReset
+	s.mutex.RUnlock()
+
+	var expiry time.Time
+	if s.commitIndexCurrent() && !s.leaving {
+		acks := map[string]time.Time{s.name: time.Now()}
+		var times []time.Time
+		for name, peer := range s.peers {
+			if ack := peer.getLastAck(); !ack.IsZero() && !ack.Before(reset) {
+				acks[name] = ack
+				times = append(times, ack)
+			}
+		}
+		times = append(times, acks[s.name])
+		sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+
+		for _, t := range times {
+			quorum := make(map[string]bool)
+			for name, ack := range acks {
+				if !ack.Before(t) {
+					quorum[name] = true
+				}
+			}
+			if s.hasCommitQuorum(quorum) {
+				expiry = t.Add(s.ElectionTimeout() - s.LeaseMargin())
+				break
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	s.leaseExpiry = expiry
+	s.mutex.Unlock()
+}
+
+// Drops the lease once the timeouts change, as the acks it rests on were
+// given under the previous ones. The caller must hold s.mutex.
+func (s *server) resetLease() {
+	s.leaseExpiry = time.Time{}
+	s.leaseReset = time.Now()
+}
+
+//--------------------------------------
+// Clock jumps
+//--------------------------------------
+
+// Retrieves how far the clocks may jump before the leader reacts.
+func (s *server) ClockJumpThreshold() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.clockJumpThreshold
+}
+
+// Sets how far the wall clock may move against the monotonic clock between
+// two heartbeats before the leader considers its clock to have jumped. Such a
+// jump, for example an NTP correction or a virtual machine resumed with a
+// stale clock, invalidates the assumptions of the lease. A heartbeat that is
+// merely late, because the event loop was busy, is not a jump: the lease is
+// measured on the monotonic clock, so it still expires in time. Zero disables
+// detection.
+func (s *server) SetClockJumpThreshold(threshold time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clockJumpThreshold = threshold
+}
+
+// Retrieves whether the leader steps down when its clock jumps.
+func (s *server) StepDownOnClockJump() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.stepDownOnClockJump
+}
+
+// Sets whether the leader steps down to follower when its clock jumps, in
+// addition to giving up its lease.
+func (s *server) SetStepDownOnClockJump(stepDown bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stepDownOnClockJump = stepDown
+}
+
+// Checks the clocks between two heartbeats, over which the monotonic clock
+// moved by monotonic and the wall clock by wall. If the clocks disagree, the
+// acknowledgements the lease rests on are discarded, a clock jump event is
+// dispatched, and the leader steps down if it is set to. It returns whether
+// the clock jumped.
+func (s *server) checkClock(monotonic time.Duration, wall time.Duration) bool {
+	threshold := s.ClockJumpThreshold()
+	if threshold <= 0 {
+		return false
+	}
+
+	skew := wall - monotonic
+	if skew <= threshold && -skew <= threshold {
+		return false
+	}
+	reason := fmt.Sprintf("wall clock moved %v against the monotonic clock", skew)
+
+	s.debugln("server.leader.clock.jump: ", reason)
+	for _, peer := range s.peers {
+		peer.setLastAck(time.Time{})
+	}
+	s.updateLease()
+	s.DispatchEvent(newEvent(ClockJumpEventType, &ClockJump{Reason: reason, Monotonic: monotonic, Wall: wall}, nil))
+
+	if s.StepDownOnClockJump() {
+		s.debugln("server.leader.clock.jump: step down")
+		s.stepDown()
+	}
+	return true
+}
+
+//--------------------------------------
+// Quorum policy
+//--------------------------------------
+
+// Retrieves the policy that decides election and commit quorums.
+func (s *server) QuorumPolicy() QuorumPolicy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.quorumPolicy
+}
+
+// Sets the policy that decides election and commit quorums. Every member of
+// the cluster must use the same policy. A nil policy restores the default
+// majority policy.
+func (s *server) SetQuorumPolicy(policy QuorumPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if policy == nil {
+		policy = MajorityQuorumPolicy{}
+	}
+	s.quorumPolicy = policy
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Initialization
+//--------------------------------------
+
+// Reg the NOPCommand
+func init() {
+	RegisterCommand(&NOPCommand{})
+	RegisterCommand(&DefaultJoinCommand{})
+	RegisterCommand(&DefaultLeaveCommand{})
+	RegisterCommand(&DefaultPromoteCommand{})
+	RegisterCommand(&DefaultDemoteCommand{})
+	RegisterCommand(&DefaultChangePeerAddressCommand{})
+	RegisterCommand(&DefaultMembershipChangeCommand{})
+	RegisterCommand(&DefaultMembershipCommitCommand{})
+	RegisterCommand(&DefaultBootstrapCommand{})
+	RegisterCommand(&DefaultForceNewClusterCommand{})
+	RegisterCommand(&ConditionalCommand{})
+}
+
+// Start the raft server
+// If log entries exist then allow promotion to candidate if no AEs received.
+// If no log entries exist then wait for AEs from another node.
+// If no log entries exist and a self-join command is issued then
+// immediately become leader and commit entry.
+func (s *server) Start() error {
+	// Exit if the server is already running.
+	if s.Running() {
+		return fmt.Errorf("raft.Server: Server already running[%v]", s.state)
+	}
+
+	if err := s.Init(); err != nil {
+		return err
+	}
+	if s.isHalted() {
+		return HaltedError
+	}
+
+	if s.forceNewCluster {
+		warnln("raft: Forcing a new cluster of", s.name, "alone; every other member is removed")
+		if err := s.ResetMembership(s.name); err != nil {
+			return err
+		}
+		s.forceNewCluster = false
+		s.forcedNewCluster = true
+	}
+
+	// stopped needs to be allocated each time server starts
+	// because it is closed at `Stop`.
+	s.stopped = make(chan bool)
+	s.setState(Follower)
+
+	// If no log entries exist then
+	// 1. wait for AEs from another node
+	// 2. wait for self-join command
+	// to set itself promotable
+	if !s.promotable() {
+		s.debugln("start as a new raft server")
+
+		// If log entries exist then allow promotion to candidate
+		// if no AEs received.
+	} else {
+		s.debugln("start from previous saved state")
+	}
+
+	debugln(s.GetState())
+
+	s.routineGroup.Add(1)
+	go func() {
+		defer s.routineGroup.Done()
+		s.loop()
+	}()
+
+	return nil
+}
+
+// Init initializes the raft server.
+// If there is no previous log file under the given path, Init() will create an empty log file.
+// Otherwise, Init() will load in the log entries from the log file.
+func (s *server) Init() error {
+	if s.Running() {
+		return fmt.Errorf("raft.Server: Server already running[%v]", s.state)
+	}
+
+	// Server has been initialized or server was stopped after initialized
+	// If log has been initialized, we know that the server was stopped after
+	// running.
+	if s.state == Initialized || s.log.initialized {
+		s.state = Initialized
+		return nil
+	}
+
+	// Create snapshot directory if it does not exist
+	err := os.MkdirAll(s.SnapshotDir(), 0700)
+	if err != nil && !os.IsExist(err) {
+		s.debugln("raft: Snapshot dir error: ", err)
+		return fmt.Errorf("raft: Initialization error: %s", err)
+	}
+
+	if err := s.readConf(); err != nil {
+		s.debugln("raft: Conf file error: ", err)
+		return fmt.Errorf("raft: Initialization error: %s", err)
+	}
+
+	if err := s.readDeniedPeers(); err != nil {
+		s.debugln("raft: Denied peers file error: ", err)
+		return fmt.Errorf("raft: Initialization error: %s", err)
+	}
+
+	if err := s.readConfigurations(); err != nil {
+		s.debugln("raft: Configurations file error: ", err)
+		return fmt.Errorf("raft: Initialization error: %s", err)
+	}
+
+	// Initialize the log and load it up.
+	if err := s.log.open(s.LogPath()); err != nil {
+		s.debugln("raft: Log error: ", err)
+		return fmt.Errorf("raft: Initialization error: %s", err)
+	}
+
+	// Update the term to the last term in the log.
+	_, s.currentTerm = s.log.lastInfo()
+	s.epoch = s.currentTerm
+
+	// Restore the vote cast before the server last stopped.
+	if err := s.readVote(); err != nil {
+		s.debugln("raft: Vote file error: ", err)
+		return fmt.Errorf("raft: Initialization error: %s", err)
+	}
+
+	// A static membership is configured directly rather than through the log.
+	for _, peer := range s.staticPeers {
+		if err := addPeer(s, peer); err != nil {
+			s.debugln("raft: Static peer error: ", err)
+			return fmt.Errorf("raft: Initialization error: %s", err)
+		}
+	}
+
+	s.state = Initialized
+	return nil
+}
+
+// Shuts down the server. A leader first hands off leadership unless
+// TransferOnStop is disabled.
+func (s *server) Stop() {
+	if s.State() == Leader && s.TransferOnStop() {
+		if err := s.StepDown(); err != nil {
+			s.debugln("server.stop.step.down.error: ", err)
+		}
+	}
+	s.stop()
+}
+
+// Shuts down the server without handing off leadership.
+func (s *server) stop() {
+	if s.State() == Stopped {
+		return
+	}
+
+	// A halting server may be stopping already.
+	s.mutex.Lock()
+	select {
+	case <-s.stopped:
+		s.mutex.Unlock()
+		return
+	default:
+		close(s.stopped)
+	}
+	s.mutex.Unlock()
+
+	// make sure all goroutines have stopped before we close the log
+	s.routineGroup.Wait()
+
+	s.log.close()
+	s.setState(Stopped)
+}
+
+// Checks if the server is currently running.
+func (s *server) Running() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return (s.state != Stopped && s.state != Initialized)
+}
+
+//--------------------------------------
+// Term
+//--------------------------------------
+
+// updates the current term for the server. This is only used when a larger
+// external term is found.
+func (s *server) updateCurrentTerm(term uint64, leaderName string) {
+	_assert(term > s.currentTerm,
+		"upadteCurrentTerm: update is called when term is not larger than currentTerm")
+
+	// Store previous values temporarily.
+	prevTerm := s.currentTerm
+	prevLeader := s.leader
+
+	// set currentTerm = T, convert to follower (§5.1)
+	// stop heartbeats before step-down
+	if s.state == Leader {
+		for _, peer := range s.peers {
+			peer.stopHeartbeat(false)
+		}
+	}
+	// update the term and clear vote for
+	if s.state != Follower {
+		s.setState(Follower)
+	}
+
+	s.mutex.Lock()
+	s.currentTerm = term
+	s.leader = leaderName
+	s.votedFor = ""
+	s.mutex.Unlock()
+
+	// Dispatch change events.
+	s.DispatchEvent(newEvent(TermChangeEventType, s.currentTerm, prevTerm))
+	s.notifyTermObservers(TermChange{Term: term, PrevTerm: prevTerm})
+
+	if prevLeader != s.leader {
+		s.DispatchEvent(newEvent(LeaderChangeEventType, s.leader, prevLeader))
+		s.notifyLeaderObservers(LeaderChange{Leader: leaderName, PrevLeader: prevLeader, Term: term})
+	}
+}
+
+//--------------------------------------
+// Event Loop
+//--------------------------------------
+
+//               ________
+//            --|Snapshot|                 timeout
+//            |  --------                  ______
+// recover    |       ^                   |      |
+// snapshot / |       |snapshot           |      |
+// higher     |       |                   v      |     recv majority votes
+// term       |    --------    timeout    -----------                        -----------
+//            |-> |Follower| ----------> | Candidate |--------------------> |  Leader   |
+//                 --------               -----------                        -----------
+//                    ^          higher term/ |                         higher term |
+//                    |            new leader |                                     |
+//                    |_______________________|____________________________________ |
+// The main event loop for the server
+func (s *server) loop() {
+	defer s.debugln("server.loop.end")
+
+	state := s.State()
+
+	for state != Stopped {
+		s.debugln("server.loop.run ", state)
+		switch state {
+		case Follower:
+			s.followerLoop()
+		case Candidate:
+			s.candidateLoop()
+		case Leader:
+			s.leaderLoop()
+		case Snapshotting:
+			s.snapshotLoop()
+		}
+		state = s.State()
+	}
+}
+
+// Returns a *LeaderHintError naming the leader known to a server, or
+// NotLeaderError if it does not know another leader.
+func notLeaderError(s Server) error {
+	leader := s.Leader()
+	if leader == "" || leader == s.Name() {
+		return NotLeaderError
+	}
+	hint := &LeaderHintError{Leader: leader}
+	if peer, ok := s.Peers()[leader]; ok {
+		hint.ConnectionString = peer.ConnectionString
+	}
+	return hint
+}
+
+// Sends an event to the event loop to be processed. The function will wait
+// until the event is actually processed before returning.
+func (s *server) send(value interface{}) (interface{}, error) {
+	return s.sendContext(gocontext.Background(), value)
+}
+
+// Sends a value to the event loop and waits for its result, or returns
+// ctx.Err() if ctx is done first. The event loop still processes the value.
+func (s *server) sendContext(ctx gocontext.Context, value interface{}) (interface{}, error) {
+	if !s.Running() {
+		return nil, StopError
+	}
+
+	event := &ev{target: value, errChan: make(chan error, 1)}
+	select {
+	case s.evChan <- event:
+	case <-s.stopped:
+		return nil, StopError
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case <-s.stopped:
+		return nil, StopError
+	case <-ctx.Done():
+		event.abandon()
+		return nil, ctx.Err()
+	case err := <-event.errChan:
+		if err == NotLeaderError {
+			err = notLeaderError(s)
+		}
+		return event.returnValue, err
+	}
+}
+
+func (s *server) sendAsync(value interface{}) {
+	if !s.Running() {
+		return
+	}
+
+	event := &ev{target: value, errChan: make(chan error, 1)}
+	// try a non-blocking send first
+	// in most cases, this should not be blocking
+	// avoid create unnecessary go routines
+	select {
+	case s.evChan <- event:
+		return
+	default:
+	}
+
+	s.routineGroup.Add(1)
+	go func() {
+		defer s.routineGroup.Done()
+		select {
+		case s.evChan <- event:
+		case <-s.stopped:
+		}
+	}()
+}
+
+// The event loop that is run when the server is in a Follower state.
+// Responds to RPCs from candidates and leaders.
+// Converts to candidate if election timeout elapses without either:
+//   1.Receiving valid AppendEntries RPC, or
+//   2.Granting vote to candidate
+func (s *server) followerLoop() {
+	since := time.Now()
+	electionTimeout := s.ElectionTimeout()
+	delay := s.electionDelay()
+	timeoutChan := time.After(s.followerElectionTimeout() + delay)
+
+	// Peers are pinged while the leader is quiet if reachability is checked.
+	var pingChan <-chan time.Time
+	pongs := make(chan string, len(s.peers))
+	if s.pinger() != nil {
+		ticker := time.NewTicker(s.HeartbeatInterval())
+		defer ticker.Stop()
+		pingChan = ticker.C
+	}
+
+	for s.State() == Follower {
+		var err error
+		update := false
+		select {
+		case <-s.stopped:
+			s.setState(Stopped)
+			return
+
+		case e := <-s.evChan:
+			switch req := e.target.(type) {
+			case JoinCommand:
+				//If no log entries exist and a self-join command is issued
+				//then immediately become leader and commit entry.
+				if s.log.currentIndex() == 0 && req.NodeName() == s.Name() {
+					s.debugln("selfjoin and promote to leader")
+					if s.ClusterID() == "" {
+						s.SetClusterID(newClusterID())
+					}
+					s.setState(Leader)
+					s.processCommand(req, e)
+				} else {
+					err = NotLeaderError
+				}
+			case *DefaultBootstrapCommand:
+				// The initial configuration is the first entry of the log.
+				if s.log.currentIndex() == 0 {
+					s.debugln("bootstrap and promote to leader")
+					s.setState(Leader)
+					s.processCommand(req, e)
+				} else {
+					err = AlreadyBootstrappedError
+				}
+			case *AppendEntriesRequest:
+				// If heartbeats get too close to the election timeout then send an event.
+				elapsedTime := time.Now().Sub(since)
+				if elapsedTime > time.Duration(float64(electionTimeout)*ElectionTimeoutThresholdPercent) {
+					s.DispatchEvent(newEvent(ElectionTimeoutThresholdEventType, elapsedTime, nil))
+				}
+				var resp *AppendEntriesResponse
+				resp, update = s.processAppendEntriesRequest(req)
+				e.returnValue = resp
+
+				if pingChan != nil && resp.Success() {
+					s.markReachable(req.LeaderName)
+				}
+
+				// The leader is handing leadership over to this server.
+				if req.TimeoutNow && resp.Success() && s.promotable() {
+					s.debugln("server.handoff.received: ", req.LeaderName)
+					s.transfer = true
+					s.setState(Candidate)
+				}
+			case *RequestVoteRequest:
+				e.returnValue, update = s.processRequestVoteRequest(req)
+			case *SnapshotRequest:
+				e.returnValue = s.processSnapshotRequest(req)
+			case *campaign:
+				if s.promotable() {
+					s.debugln("server.campaign")
+					s.setState(Candidate)
+				} else {
+					err = NotPromotableError
+				}
+			default:
+				err = NotLeaderError
+			}
+			// Callback to event.
+			e.reply(err)
+
+		case <-timeoutChan:
+			// only allow synced follower to promote to candidate
+			if s.quiesceRemaining() > 0 {
+				s.debugln("server.follower.quiesced")
+				update = true
+			} else if !s.reachesQuorum() {
+				s.debugln("server.follower.quorum.unreachable")
+				update = true
+			} else if s.promotable() {
+				s.setState(Candidate)
+			} else {
+				update = true
+			}
+
+		case <-pingChan:
+			if pinger := s.pinger(); pinger != nil && time.Now().Sub(s.lastLeaderContact) > s.HeartbeatInterval() {
+				for _, peer := range s.peers {
+					if peer.Voting() {
+						peer.sendPing(pinger, pongs)
+					}
+				}
+			}
+
+		case name := <-pongs:
+			s.markReachable(name)
+		}
+
+		// Converts to candidate if election timeout elapses without either:
+		//   1.Receiving valid AppendEntries RPC, or
+		//   2.Granting vote to candidate
+		if update {
+			since = time.Now()
+			delay = s.electionDelay()
+			timeoutChan = time.After(s.followerElectionTimeout() + delay)
+		}
+	}
+}
+
+// The event loop that is run when the server is in a Candidate state.
+func (s *server) candidateLoop() {
+	// Clear leader value.
+	s.mutex.Lock()
+	prevLeader := s.leader
+	s.leader = ""
+	s.mutex.Unlock()
+	if prevLeader != s.leader {
+		s.DispatchEvent(newEvent(LeaderChangeEventType, s.leader, prevLeader))
+		s.notifyLeaderObservers(LeaderChange{PrevLeader: prevLeader, Term: s.currentTerm})
+	}
+
+	lastLogIndex, lastLogTerm := s.log.lastInfo()
+	doVote := true
+	var votesGranted map[string]bool
+	var timeoutChan <-chan time.Time
+	var respChan chan *RequestVoteResponse
+
+	// The start of the current election round, and how many rounds in a row
+	// have timed out.
+	var roundStart time.Time
+	lost := 0
+	defer func() {
+		if state := s.State(); state != Stopped && !roundStart.IsZero() {
+			s.endElection(roundStart, state == Leader)
+		}
+	}()
+
+	for s.State() == Candidate {
+		if doVote {
+			if !roundStart.IsZero() {
+				s.endElection(roundStart, false)
+				roundStart = time.Time{}
+			}
+
+			// Increment current term, vote for self.
+			s.mutex.Lock()
+			s.currentTerm++
+			s.votedFor = s.name
+			s.mutex.Unlock()
+			if err := s.writeVote(); err != nil {
+				s.debugln("server.candidate.vote.persist.error: ", err)
+				s.setState(Follower)
+				return
+			}
+			s.DispatchEvent(newEvent(TermChangeEventType, s.currentTerm, s.currentTerm-1))
+			s.notifyTermObservers(TermChange{Term: s.currentTerm, PrevTerm: s.currentTerm - 1})
+			roundStart = time.Now()
+			s.mutex.Lock()
+			s.electionMetrics.Started++
+			s.mutex.Unlock()
+
+			// Send RequestVote RPCs to all other servers.
+			respChan = make(chan *RequestVoteResponse, len(s.peers))
+			transfer := s.transfer
+			s.transfer = false
+			for _, peer := range s.peers {
+				if !peer.Voting() {
+					continue
+				}
+				req := newRequestVoteRequest(s.currentTerm, s.name, lastLogIndex, lastLogTerm)
+				req.Transfer = transfer
+				s.routineGroup.Add(1)
+				go func(peer *Peer) {
+					defer s.routineGroup.Done()
+					peer.sendVoteRequest(req, respChan)
+				}(peer)
+			}
+
+			// Wait for either:
+			//   * Votes received from majority of servers: become leader
+			//   * AppendEntries RPC received from new leader: step down.
+			//   * Election timeout elapses without election resolution: increment term, start new election
+			//   * Discover higher term: step down (§5.1)
+			votesGranted = map[string]bool{s.name: true}
+			timeoutChan = time.After(s.candidateElectionTimeout(lost))
+			doVote = false
+		}
+
+		// If we received enough votes then stop waiting for more votes.
+		// And return from the candidate loop
+		if s.hasElectionQuorum(votesGranted) {
+			s.debugln("server.candidate.recv.enough.votes")
+			s.setState(Leader)
+			return
+		}
+
+		// Collect votes from peers.
+		select {
+		case <-s.stopped:
+			s.setState(Stopped)
+			return
+
+		case resp := <-respChan:
+			if success := s.processVoteResponse(resp); success {
+				votesGranted[resp.peer.Name] = true
+				s.debugln("server.candidate.vote.granted: ", len(votesGranted))
+			}
+
+		case e := <-s.evChan:
+			var err error
+			switch req := e.target.(type) {
+			case Command:
+				err = NotLeaderError
+			case *AppendEntriesRequest:
+				e.returnValue, _ = s.processAppendEntriesRequest(req)
+			case *RequestVoteRequest:
+				e.returnValue, _ = s.processRequestVoteRequest(req)
+			case *campaign:
+				doVote = true
+			case *stepDownRequest, *verifyLeaderRequest, *readIndexRequest, *quorumReadRequest, *quiesceRequest, *batchRequest, *joinValidation:
+				err = NotLeaderError
+			}
+
+			// Callback to event.
+			e.reply(err)
+
+		case <-timeoutChan:
+			lost++
+			doVote = true
+		}
+	}
+}
+
+// The event loop that is run when the server is in a Leader state.
+func (s *server) leaderLoop() {
+	logIndex, _ := s.log.lastInfo()
+
+	// Update the peers prevLogIndex to leader's lastLogIndex and start heartbeat.
+	s.debugln("leaderLoop.set.PrevIndex to ", logIndex)
+	for _, peer := range s.peers {
+		peer.setPrevLogIndex(logIndex)
+		peer.setLastAck(time.Time{})
+		peer.startHeartbeat()
+	}
+
+	// Commit a NOP after the server becomes leader. From the Raft paper:
+	// "Upon election: send initial empty AppendEntries RPCs (heartbeat) to
+	// each server; repeat during idle periods to prevent election timeouts
+	// (§5.2)". The heartbeats started above do the "idle" period work.
+	if s.needsNOP() {
+		s.routineGroup.Add(1)
+		go func() {
+			defer s.routineGroup.Done()
+			s.do(NOPCommand{})
+		}()
+	}
+
+	// Finish any membership change left behind by the previous leader.
+	if s.joint != nil {
+		s.commitMembershipChange()
+	}
+
+	// Record a forced new cluster so that the log agrees with it.
+	if s.forcedNewCluster {
+		s.forcedNewCluster = false
+		s.routineGroup.Add(1)
+		go func() {
+			defer s.routineGroup.Done()
+			s.do(&DefaultForceNewClusterCommand{Name: s.name})
+		}()
+	}
+
+	// Send heartbeats to all peers in one pass, renew the lease, and check
+	// for quorum loss and isolation if they are enabled, at every heartbeat.
+	heartbeatInterval := s.HeartbeatInterval()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer func() { ticker.Stop() }()
+	since := time.Now()
+	lastTick := since
+	var verifyTimeout, stepDownTimeout <-chan time.Time
+	s.mutex.Lock()
+	s.quorumLost = false
+	s.leaderSince = since
+	s.mutex.Unlock()
+
+	// Begin to collect response from followers
+	for s.State() == Leader {
+		var err error
+		select {
+		case <-s.stopped:
+			// Stop all peers before stop
+			for _, peer := range s.peers {
+				peer.stopHeartbeat(false)
+			}
+			s.stepDowns = nil
+			s.verifications = nil
+			s.setState(Stopped)
+			return
+
+		case <-verifyTimeout:
+			verifyTimeout = nil
+			s.checkVerifications()
+			if len(s.verifications) > 0 {
+				verifyTimeout = time.After(time.Until(s.verifications[0].deadline))
+			}
+
+		case <-stepDownTimeout:
+			stepDownTimeout = nil
+
+		case <-s.intervalChanged:
+			if interval := s.HeartbeatInterval(); interval != heartbeatInterval {
+				heartbeatInterval = interval
+				ticker.Stop()
+				ticker = time.NewTicker(heartbeatInterval)
+				lastTick = time.Now()
+			}
+
+		case <-ticker.C:
+			now := time.Now()
+			jumped := s.checkClock(now.Sub(lastTick), now.Round(0).Sub(lastTick.Round(0)))
+			lastTick = now
+			if jumped && s.State() != Leader {
+				break
+			}
+
+			for _, peer := range s.peers {
+				peer.tick()
+			}
+			s.advanceCommitIndex()
+			s.updateLease()
+			if s.QuorumLossTimeout() > 0 {
+				s.checkQuorum(since)
+			}
+			if s.CheckQuorum() && s.quiesceRemaining() == 0 && !s.inContactWithQuorum(since, s.ElectionTimeout()) {
+				s.debugln("server.leader.isolated: step down")
+				s.stepDown()
+			}
+
+		case e := <-s.evChan:
+			switch req := e.target.(type) {
+			case Command:
+				s.processCommand(req, e)
+				continue
+			case *batchRequest:
+				s.processBatch(req, e)
+				continue
+			case *joinValidation:
+				e.returnValue = s.joinVerdict(req.command)
+			case *AppendEntriesRequest:
+				e.returnValue, _ = s.processAppendEntriesRequest(req)
+			case *AppendEntriesResponse:
+				s.processAppendEntriesResponse(req)
+				s.processQueuedJoins()
+				s.updateLease()
+				s.checkVerifications()
+			case *RequestVoteRequest:
+				e.returnValue, _ = s.processRequestVoteRequest(req)
+			case *verifyLeaderRequest, *readIndexRequest, *quorumReadRequest:
+				if s.leaving {
+					err = NotLeaderError
+					break
+				}
+				if _, ok := req.(*readIndexRequest); ok {
+					if !s.commitIndexCurrent() {
+						err = LeaderNotReadyError
+						break
+					}
+					e.returnValue = s.log.CommitIndex()
+				}
+				_, attest := req.(*quorumReadRequest)
+				now := time.Now()
+				s.verifications = append(s.verifications, &verification{e: e, start: now, deadline: now.Add(s.ElectionTimeout()), attest: attest})
+				for _, peer := range s.peers {
+					peer.notify()
+				}
+				s.checkVerifications()
+				if verifyTimeout == nil && len(s.verifications) > 0 {
+					verifyTimeout = time.After(s.ElectionTimeout())
+				}
+				continue
+			case *quiesceRequest:
+				if s.leaving {
+					err = NotLeaderError
+					break
+				}
+				s.setQuiesce(req.duration)
+				for _, peer := range s.peers {
+					peer.notify()
+				}
+			case *stepDownRequest:
+				if len(s.stepDowns) == 0 {
+					s.leaving = true
+					s.updateLease()
+					s.stepDownDeadline = time.Now().Add(s.ElectionTimeout())
+					stepDownTimeout = time.After(s.ElectionTimeout())
+				}
+				s.stepDowns = append(s.stepDowns, e)
+				s.checkStepDown()
+				continue
+			}
+
+			// Callback to event.
+			e.reply(err)
+		}
+
+		s.checkStepDown()
+	}
+
+	for _, e := range s.queuedJoins {
+		e.reply(NotLeaderError)
+	}
+	s.queuedJoins = nil
+	for _, e := range s.stepDowns {
+		e.reply(nil)
+	}
+	s.stepDowns = nil
+	for _, v := range s.verifications {
+		v.e.reply(NotLeaderError)
+	}
+	s.verifications = nil
+	s.mutex.Lock()
+	s.quorumLost = false
+	s.mutex.Unlock()
+	s.joining = nil
+	s.syncedPeer = nil
+	s.promotingPeer = nil
+}
+
+func (s *server) snapshotLoop() {
+	for s.State() == Snapshotting {
+		var err error
+		select {
+		case <-s.stopped:
+			s.setState(Stopped)
+			return
+
+		case e := <-s.evChan:
+			switch req := e.target.(type) {
+			case Command:
+				err = NotLeaderError
+			case *AppendEntriesRequest:
+				e.returnValue, _ = s.processAppendEntriesRequest(req)
+			case *RequestVoteRequest:
+				e.returnValue, _ = s.processRequestVoteRequest(req)
+			case *SnapshotRecoveryRequest:
+				e.returnValue = s.processSnapshotRecoveryRequest(req)
+			case *campaign:
+				err = NotPromotableError
+			case *stepDownRequest, *verifyLeaderRequest, *readIndexRequest, *quorumReadRequest, *quiesceRequest, *batchRequest, *joinValidation:
+				err = NotLeaderError
+			}
+			// Callback to event.
+			e.reply(err)
+		}
+	}
+}
+
+//--------------------------------------
+// Commands
+//--------------------------------------
+
+// Attempts to execute a command and replicate it. The function will return
+// when the command has been successfully committed or an error has occurred.
+// A server that is not the leader returns NotLeaderError, or a
+// *LeaderHintError that errors.Is reports as NotLeaderError if it knows the
+// leader. A follower whose transporter is a Forwarder returns the result as
+// the transporter decoded it, which for the HTTPTransporter is the type
+// registered with RegisterCommandResult, or a generic JSON value otherwise.
+func (s *server) Do(command Command) (interface{}, error) {
+	return s.DoContext(gocontext.Background(), command)
+}
+
+// Executes a command like Do, but stops waiting and returns ctx.Err() once
+// ctx is done. The command may still be committed afterwards. Commands that
+// are redirected to the leader are not cancelled once they have been sent.
+// Commands that are forwarded to the leader carry the identity ctx carries.
+func (s *server) DoContext(ctx gocontext.Context, command Command) (interface{}, error) {
+	if err := s.authorize(ctx, command); err != nil {
+		return nil, err
+	}
+	if err := s.checkCommandSize(command); err != nil {
+		return nil, err
+	}
+	return s.doContext(ctx, command)
+}
+
+// Executes a command the server submits itself, which is not authorized.
+func (s *server) do(command Command) (interface{}, error) {
+	return s.doContext(gocontext.Background(), command)
+}
+
+func (s *server) doContext(ctx gocontext.Context, command Command) (interface{}, error) {
+	if s.Leader() == "" || s.Leader() == s.Name() {
+		return s.sendContext(ctx, command)
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	} else {
+		return s.redirect(ctx, command)
+	}
+}
+
+// Executes a command without waiting for it, so that a caller can have many
+// commands in flight. Commands are forwarded to another leader by one
+// goroutine each.
+func (s *server) DoAsync(command Command) *Future {
+	return s.doAsync(gocontext.Background(), command)
+}
+
+// Executes a command without waiting for it, authorized with the identity
+// ctx carries.
+func (s *server) doAsync(ctx gocontext.Context, command Command) *Future {
+	f := newFuture(command, s.stopped)
+	if !s.Running() {
+		f.e.reply(StopError)
+		return f
+	}
+	if err := s.authorize(ctx, command); err != nil {
+		f.e.reply(err)
+		return f
+	}
+	if err := s.checkCommandSize(command); err != nil {
+		f.e.reply(err)
+		return f
+	}
+
+	if s.Leader() != "" && s.Leader() != s.Name() {
+		s.routineGroup.Add(1)
+		go func() {
+			defer s.routineGroup.Done()
+			value, err := s.redirect(ctx, command)
+			f.e.returnValue = value
+			f.e.reply(err)
+		}()
+		return f
+	}
+
+	select {
+	case s.evChan <- f.e:
+	case <-s.stopped:
+		f.e.reply(StopError)
+	}
+	return f
+}
+
+// Appends a NOP to the log and waits until it has been applied, and so every
+// command appended before it. Only the leader can append a barrier; other
+// servers return NotLeaderError.
+func (s *server) Barrier(ctx gocontext.Context) error {
+	_, err := s.sendContext(ctx, NOPCommand{})
+	return err
+}
+
+// Executes a command like DoContext, and also returns the index and the term
+// of the entry it was appended as.
+func (s *server) DoResult(ctx gocontext.Context, command Command) (CommandResult, error) {
+	f := s.doAsync(ctx, command)
+	if err := f.wait(ctx); err != nil {
+		f.e.abandon()
+		return CommandResult{Index: f.Index(), Term: f.Term()}, err
+	}
+	return CommandResult{Value: f.e.returnValue, Index: f.Index(), Term: f.Term(), Token: SessionToken(f.Index())}, f.err
+}
+
+// Evaluates a command without appending it, so that a client can find out
+// whether an expensive command would succeed before it is replicated. The
+// command is authorized and validated as Do would, and then evaluated by its
+// DryRun method or else by the application's Simulator, against this
+// server's state, which on a follower may lag the leader's. The context is
+// that of an entry appended next. DryRunUnsupportedError is returned if
+// there is nothing to evaluate the command with.
+func (s *server) DryRun(command Command) (interface{}, error) {
+	if !s.Running() {
+		return nil, StopError
+	}
+	if err := s.authorize(gocontext.Background(), command); err != nil {
+		return nil, err
+	}
+	if err := s.validateCommand(command); err != nil {
+		return nil, err
+	}
+
+	term := s.Term()
+	currentIndex := s.log.currentIndex()
+	c := &context{
+		server:       s,
+		currentTerm:  term,
+		currentIndex: currentIndex,
+		commitIndex:  s.CommitIndex(),
+		epoch:        term,
+		index:        currentIndex + 1,
+		isLeader:     s.State() == Leader,
+		time:         time.Now(),
+		seed:         rand.Int63(),
+	}
+	if runner, ok := command.(DryRunner); ok {
+		return runner.DryRun(c)
+	}
+	if simulator := s.Simulator(); simulator != nil {
+		return simulator.Simulate(c, command)
+	}
+	return nil, DryRunUnsupportedError
+}
+
+// A request to the leader to append a series of commands at once. Each
+// command has its own event, which receives its result.
+type batchRequest struct {
+	commands []Command
+	events   []*ev
+}
+
+// Executes a series of commands, appending them to the log as consecutive
+// entries with a single write. It waits for all of them and returns the
+// result and the error of each. Configuration commands cannot be batched.
+func (s *server) DoBatch(commands []Command) ([]interface{}, []error) {
+	return s.DoBatchContext(gocontext.Background(), commands)
+}
+
+// Executes a series of commands like DoBatch, authorized with the identity
+// ctx carries, but stops waiting once ctx is done and returns ctx.Err() for
+// the commands that have no result yet.
+func (s *server) DoBatchContext(ctx gocontext.Context, commands []Command) ([]interface{}, []error) {
+	values := make([]interface{}, len(commands))
+	errs := make([]error, len(commands))
+	fail := func(err error) ([]interface{}, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return values, errs
+	}
+
+	for _, command := range commands {
+		if isConfigurationCommand(command) {
+			return fail(ConfigurationBatchError)
+		}
+	}
+	for _, command := range commands {
+		if err := s.authorize(ctx, command); err != nil {
+			return fail(err)
+		}
+		if err := s.checkCommandSize(command); err != nil {
+			return fail(err)
+		}
+	}
+
+	if s.Leader() != "" && s.Leader() != s.Name() {
+		for i, command := range commands {
+			values[i], errs[i] = s.redirect(ctx, command)
+		}
+		return values, errs
+	}
+
+	req := &batchRequest{commands: commands, events: make([]*ev, len(commands))}
+	for i, command := range commands {
+		req.events[i] = &ev{target: command, errChan: make(chan error, 1)}
+	}
+	stopped := s.stopped
+	if _, err := s.sendContext(ctx, req); err != nil {
+		return fail(err)
+	}
+	for i, e := range req.events {
+		select {
+		case errs[i] = <-e.errChan:
+			values[i] = e.returnValue
+		case <-stopped:
+			errs[i] = StopError
+		case <-ctx.Done():
+			e.abandon()
+			errs[i] = ctx.Err()
+		}
+	}
+	return values, errs
+}
+
+// Appends a batch of commands to the log.
+func (s *server) processBatch(req *batchRequest, e *ev) {
+	s.debugln("server.batch.process")
+
+	if s.leaving {
+		e.reply(NotLeaderError)
+		return
+	}
+
+	if s.QuorumLost() && s.RejectWritesOnQuorumLoss() {
+		e.reply(NoQuorumError)
+		return
+	}
+
+	if s.overloaded(len(req.commands)) {
+		e.reply(OverloadedError)
+		return
+	}
+
+	// The batch is appended whole or not at all.
+	for _, command := range req.commands {
+		if err := s.validateCommand(command); err != nil {
+			e.reply(err)
+			return
+		}
+	}
+
+	if len(req.commands) == 0 {
+		e.reply(nil)
+		return
+	}
+
+	if _, err := s.log.appendCommands(s.currentTerm, req.commands, req.events); err != nil {
+		s.debugln("server.batch.log.error:", err)
+		e.reply(err)
+		return
+	}
+	e.reply(nil)
+	s.notifyZonePeers()
+
+	s.syncedPeer[s.Name()] = true
+	if s.hasCommitQuorum(map[string]bool{s.Name(): true}) {
+		commitIndex := s.log.currentIndex()
+		s.log.setCommitIndex(commitIndex)
+		s.debugln("commit index ", commitIndex)
+	}
+}
+
+func (s *server) redirect(ctx gocontext.Context, command Command) (interface{}, error) {
+	if !s.Running() {
+		return nil, StopError
+	}
+	if forwarder, ok := s.Transporter().(Forwarder); ok {
+		leader, ok := s.Peers()[s.Leader()]
+		if !ok {
+			return nil, notLeaderError(s)
+		}
+		return forwarder.Forward(ctx, s, leader, command)
+	}
+	err := s.Transporter().Redirect(s, command)
+	if err != nil {
+		s.debugln("redirect failed: ", err)
+	}
+	return nil, err
+}
+
+// Processes a command.
+func (s *server) processCommand(command Command, e *ev) {
+	s.debugln("server.command.process")
+
+	if s.leaving {
+		e.reply(NotLeaderError)
+		return
+	}
+
+	if s.QuorumLost() && s.RejectWritesOnQuorumLoss() {
+		e.reply(NoQuorumError)
+		return
+	}
+
+	if command.CommandName() != (NOPCommand{}).CommandName() && !isConfigurationCommand(command) && s.overloaded(1) {
+		e.reply(OverloadedError)
+		return
+	}
+
+	if s.StaticMembership() && isConfigurationCommand(command) {
+		e.reply(StaticMembershipError)
+		return
+	}
+
+	if c, ok := command.(*DefaultDemoteCommand); ok && c.Name == s.name {
+		e.reply(DemoteLeaderError)
+		return
+	}
+
+	if err := s.validateCommand(command); err != nil {
+		s.debugln("server.command.invalid:", err)
+		e.reply(err)
+		return
+	}
+
+	command, ok := s.admitJoin(command, e)
+	if !ok {
+		return
+	}
+
+	// Create an entry for the command in the log.
+	entry, err := s.log.createEntry(s.currentTerm, command, e)
+
+	if err != nil {
+		s.debugln("server.command.log.entry.error:", err)
+		e.reply(err)
+		return
+	}
+
+	if err := s.log.appendEntry(entry); err != nil {
+		s.debugln("server.command.log.error:", err)
+		e.reply(err)
+		return
+	}
+	if e.future != nil {
+		e.future.appended(entry)
+	}
+	s.notifyZonePeers()
+
+	s.syncedPeer[s.Name()] = true
+	if s.hasCommitQuorum(map[string]bool{s.Name(): true}) {
+		commitIndex := s.log.currentIndex()
+		s.log.setCommitIndex(commitIndex)
+		s.debugln("commit index ", commitIndex)
+	}
+}
+
+//--------------------------------------
+// Append Entries
+//--------------------------------------
+
+// Appends zero or more log entry from the leader to this server.
+func (s *server) AppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	ret, _ := s.send(req)
+	resp, _ := ret.(*AppendEntriesResponse)
+	return resp
+}
+
+// Processes the "append entries" request.
+func (s *server) processAppendEntriesRequest(req *AppendEntriesRequest) (*AppendEntriesResponse, bool) {
+	s.traceln("server.ae.process")
+
+	if !s.acceptClusterID(req.ClusterID) {
+		s.debugln("server.ae.error: cluster id mismatch: ", req.ClusterID)
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), false
+	}
+
+	if s.denied(req.LeaderName, "") {
+		s.debugln("server.ae.error: denied peer: ", req.LeaderName)
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), false
+	}
+
+	if req.Term < s.currentTerm {
+		s.debugln("server.ae.error: stale term")
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), false
+	}
+
+	if req.Term == s.currentTerm {
+		_assert(s.State() != Leader, "leader.elected.at.same.term.%d\n", s.currentTerm)
+
+		// step-down to follower when it is a candidate
+		if s.state == Candidate {
+			// change state to follower
+			s.setState(Follower)
+		}
+
+		// discover new leader when candidate
+		// save leader name when follower
+		if prevLeader := s.leader; prevLeader != req.LeaderName {
+			s.mutex.Lock()
+			s.leader = req.LeaderName
+			s.mutex.Unlock()
+			s.DispatchEvent(newEvent(LeaderChangeEventType, s.leader, prevLeader))
+			s.notifyLeaderObservers(LeaderChange{Leader: s.leader, PrevLeader: prevLeader, Term: s.currentTerm})
+		}
+	} else {
+		// Update term and leader.
+		s.updateCurrentTerm(req.Term, req.LeaderName)
+	}
+
+	s.lastLeaderContact = time.Now()
+	s.mutex.Lock()
+	s.epoch = req.Term
+	s.leaderCommitIndex = req.CommitIndex
+	s.leaderCommitTime = s.lastLeaderContact
+	s.mutex.Unlock()
+	s.setQuiesce(req.Quiesce)
+
+	// Reject if log doesn't contain a matching previous entry.
+	if err := s.log.truncate(req.PrevLogIndex, req.PrevLogTerm); err != nil {
+		s.debugln("server.ae.truncate.error: ", err)
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), true
+	}
+
+	// Append entries to the log.
+	if err := s.log.appendEntries(req.Entries); err != nil {
+		s.debugln("server.ae.append.error: ", err)
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), true
+	}
+
+	// Commit up to the commit index.
+	if err := s.log.setCommitIndex(req.CommitIndex); err != nil {
+		s.debugln("server.ae.commit.error: ", err)
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), true
+	}
+
+	// once the server appended and committed all the log entries from the leader
+
+	return newAppendEntriesResponse(s.currentTerm, true, s.log.currentIndex(), s.log.CommitIndex()), true
+}
+
+// A dry-run join submitted to the leader's event loop.
+type joinValidation struct {
+	command *DefaultJoinCommand
+}
+
+// Asks the leader whether a join would be accepted, without proposing it.
+// The prospective node can check its name, the cluster's capacity and the
+// application's JoinValidator before it joins.
+func (s *server) ValidateJoin(command *DefaultJoinCommand) (*JoinVerdict, error) {
+	if s.State() != Leader {
+		return nil, NotLeaderError
+	}
+	value, err := s.send(&joinValidation{command: command})
+	if err != nil {
+		return nil, err
+	}
+	verdict, ok := value.(*JoinVerdict)
+	if !ok {
+		return nil, NotLeaderError
+	}
+	return verdict, nil
+}
+
+// Joins a member and waits until it has caught up, that is until its match
+// index has reached the commit index of the join, so orchestration can tell
+// when it is safe to move on. It returns ctx.Err() if ctx is done first.
+func (s *server) AddMember(ctx gocontext.Context, command *DefaultJoinCommand) error {
+	if _, err := s.Do(command); err != nil {
+		return err
+	}
+	if command.Name == s.Name() {
+		return nil
+	}
+	commitIndex := s.CommitIndex()
+
+	ticker := time.NewTicker(s.HeartbeatInterval())
+	defer ticker.Stop()
+	for {
+		status, err := s.PeerStatus(command.Name)
+		if err != nil {
+			return err
+		}
+		if status.MatchIndex >= commitIndex {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return StopError
+		case <-ticker.C:
+		}
+	}
+}
+
+// Decides how the leader would handle a join. Joins that would take the
+// number of voting peers past MaxPeerCount follow the join policy; joins in
+// the log that have not been applied yet count towards the limit.
+func (s *server) joinVerdict(join JoinCommand) *JoinVerdict {
+	name := join.NodeName()
+	refuse := func(err error) *JoinVerdict {
+		return &JoinVerdict{Reason: err.Error(), err: err}
+	}
+
+	var role string
+	if c := joinMember(join); c != nil {
+		if id := s.ClusterID(); c.ClusterID != "" && id != "" && c.ClusterID != id {
+			return refuse(fmt.Errorf("raft: %s belongs to cluster %s, not %s", name, c.ClusterID, id))
+		}
+		if s.denied(name, c.ConnectionString) {
+			return refuse(DeniedPeerError)
+		}
+		role = c.Role
+	}
+	if validator := s.JoinValidator(); validator != nil {
+		if err := validator.ValidateJoin(joinMember(join), join); err != nil {
+			return refuse(err)
+		}
+	}
+
+	if name == s.name || s.peers[name] != nil || s.joining[name] || !isVotingRole(role) {
+		return &JoinVerdict{Accepted: true, Role: role}
+	}
+	if s.votingPeerCount()+len(s.joining) < s.MaxPeerCount() {
+		return &JoinVerdict{Accepted: true, Role: role}
+	}
+
+	switch s.JoinPolicy() {
+	case LearnerJoinPolicy:
+		if joinMember(join) != nil {
+			return &JoinVerdict{Accepted: true, Role: LearnerRole}
+		}
+	case QueueJoinPolicy:
+		return &JoinVerdict{Accepted: true, Role: role, Queued: true}
+	}
+	return refuse(ClusterFullError)
+}
+
+// Applies the join verdict to a join. Other commands, including the
+// configuration changes that name a server, are appended as they are and not
+// counted towards MaxPeerCount. It returns the command to append, or false
+// if the join has been refused or queued. A member rejoining from a
+// new address, as a restarted node may, has its address changed instead, and
+// a join into a full cluster becomes a learner join under LearnerJoinPolicy.
+func (s *server) admitJoin(command Command, e *ev) (Command, bool) {
+	if !isJoin(command) {
+		return command, true
+	}
+	join := command.(JoinCommand)
+
+	verdict := s.joinVerdict(join)
+	switch {
+	case !verdict.Accepted:
+		e.reply(verdict.err)
+		return nil, false
+	case verdict.Queued:
+		s.debugln("server.join.queued: ", join.NodeName())
+		s.queuedJoins = append(s.queuedJoins, e)
+		return nil, false
+	}
+
+	name := join.NodeName()
+	c := joinMember(join)
+	if peer := s.peers[name]; peer != nil {
+		if c != nil && c.ConnectionString != peer.ConnectionString {
+			s.debugln("server.join.address: ", name, c.ConnectionString)
+			return &DefaultChangePeerAddressCommand{Name: name, ConnectionString: c.ConnectionString}, true
+		}
+	} else if c != nil && c.Role != verdict.Role {
+		learner := copyJoin(join.(MemberJoinCommand))
+		learner.JoinMember().Role = verdict.Role
+		command = learner
+	} else if isVotingRole(verdict.Role) && name != s.name {
+		s.joining[name] = true
+	}
+	return command, true
+}
+
+// Submits queued joins while there is room for them.
+func (s *server) processQueuedJoins() {
+	for len(s.queuedJoins) > 0 && s.votingPeerCount()+len(s.joining) < s.MaxPeerCount() {
+		e := s.queuedJoins[0]
+		s.queuedJoins = s.queuedJoins[1:]
+		s.processCommand(e.target.(Command), e)
+	}
+}
+
+// Sends new entries straight away to the peers in the leader's zone, which
+// can often form a quorum on their own. Peers in other zones receive them
+// with their next heartbeat, in fewer and larger requests.
+func (s *server) notifyZonePeers() {
+	zone := s.Metadata()[ZoneMetadataKey]
+	if zone == "" {
+		return
+	}
+	for _, peer := range s.peers {
+		if peer.Zone() == zone {
+			peer.notify()
+		}
+	}
+}
+
+// Processes the "append entries" response from the peer. This is only
+// processed when the server is a leader. Responses received during other
+// states are dropped.
+func (s *server) processAppendEntriesResponse(resp *AppendEntriesResponse) {
+	// If we find a higher term then change to a follower and exit.
+	if resp.Term() > s.Term() {
+		s.updateCurrentTerm(resp.Term(), "")
+		return
+	}
+
+	// panic response if it's not successful.
+	if !resp.Success() {
+		return
+	}
+
+	s.promoteLearner(resp.peer)
+
+	// if one peer successfully append a log from the leader term,
+	// we add it to the synced list. Learners do not count towards the quorum.
+	if peer := s.peers[resp.peer]; resp.append == true && peer != nil && peer.Voting() {
+		s.syncedPeer[resp.peer] = true
+	}
+
+	s.advanceCommitIndex()
+}
+
+// Commits up to the index that a quorum has appended, once a quorum has
+// appended an entry of the leader's term. It also applies entries again that
+// are to be applied later.
+func (s *server) advanceCommitIndex() {
+	// Make sure we have a quorum before committing.
+	if !s.hasCommitQuorum(s.syncedPeer) {
+		return
+	}
+
+	// We can commit up to the index which the majority of the members have appended.
+	commitIndex := s.quorumIndex()
+	committedIndex := s.log.commitIndex
+
+	if commitIndex > committedIndex {
+		// leader needs to do a fsync before committing log entries
+		s.log.sync()
+		s.log.setCommitIndex(commitIndex)
+		s.debugln("processAppendEntriesResponse commit index ", commitIndex)
+	}
+}
+
+// Promotes a learner to a voter once it has caught up to within the
+// configured distance of the commit index. The promotion is replicated
+// through the log so every member sees the same configuration.
+func (s *server) promoteLearner(name string) {
+	distance := s.LearnerPromotionDistance()
+	peer := s.peers[name]
+	if distance == 0 || peer == nil || peer.Voting() || s.promotingPeer[name] {
+		return
+	}
+	if peer.getPrevLogIndex()+distance < s.log.commitIndex {
+		return
+	}
+	if s.votingPeerCount() >= s.MaxPeerCount() {
+		return
+	}
+
+	s.debugln("server.learner.promote: ", name)
+	s.promotingPeer[name] = true
+	s.routineGroup.Add(1)
+	go func() {
+		defer s.routineGroup.Done()
+		s.do(&DefaultPromoteCommand{Name: name})
+	}()
+}
+
+// processVoteReponse processes a vote request:
+// 1. if the vote is granted for the current term of the candidate, return true
+// 2. if the vote is denied due to smaller term, update the term of this server
+//    which will also cause the candidate to step-down, and return false.
+// 3. if the vote is for a smaller term, ignore it and return false.
+func (s *server) processVoteResponse(resp *RequestVoteResponse) bool {
+	if resp.VoteGranted && resp.Term == s.currentTerm {
+		return true
+	}
+
+	if resp.Term > s.currentTerm {
+		s.debugln("server.candidate.vote.failed")
+		s.updateCurrentTerm(resp.Term, "")
+	} else {
+		s.debugln("server.candidate.vote: denied")
+	}
+	return false
+}
+
+//--------------------------------------
+// Request Vote
+//--------------------------------------
+
+// Requests a vote from a server. A vote can be obtained if the vote's term is
+// at the server's current term and the server has not made a vote yet. A vote
+// can also be obtained if the term is greater than the server's current term.
+func (s *server) RequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	ret, _ := s.send(req)
+	resp, _ := ret.(*RequestVoteResponse)
+	return resp
+}
+
+// Determines whether this server is a follower that has heard from the
+// leader within the election timeout, or a leader that checks the quorum and
+// has heard from one within the election timeout.
+func (s *server) leaderInContact() bool {
+	switch s.State() {
+	case Follower:
+		return s.leader != "" && time.Now().Sub(s.lastLeaderContact) < s.ElectionTimeout()
+	case Leader:
+		s.mutex.RLock()
+		since := s.leaderSince
+		s.mutex.RUnlock()
+		return s.CheckQuorum() && s.inContactWithQuorum(since, s.ElectionTimeout())
+	}
+	return false
+}
+
+// Processes a "request vote" request.
+func (s *server) processRequestVoteRequest(req *RequestVoteRequest) (*RequestVoteResponse, bool) {
+	// Ignore candidates from other clusters.
+	if !s.acceptClusterID(req.ClusterID) {
+		s.debugln("server.rv.deny.vote: cause cluster id mismatch: ", req.ClusterID)
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	if s.denied(req.CandidateName, "") {
+		s.debugln("server.rv.deny.vote: cause denied peer: ", req.CandidateName)
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	// Ignore candidates that have been removed from the configuration, and
+	// candidates that start an election while the leader is still in contact,
+	// so that they cannot disrupt the cluster by bumping the term.
+	if s.removedPeers[req.CandidateName] {
+		s.debugln("server.rv.deny.vote: cause removed peer: ", req.CandidateName)
+		s.rejectDisruptiveVote()
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+	if !req.Transfer && s.leaderInContact() {
+		s.debugln("server.rv.deny.vote: cause leader in contact: ", s.leader)
+		s.rejectDisruptiveVote()
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	// If the request is coming from an old term then reject it.
+	if req.Term < s.Term() {
+		s.debugln("server.rv.deny.vote: cause stale term")
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	// If the term of the request peer is larger than this node, update the term
+	// If the term is equal and we've already voted for a different candidate then
+	// don't vote for this candidate.
+	if req.Term > s.Term() {
+		s.updateCurrentTerm(req.Term, "")
+	} else if s.votedFor != "" && s.votedFor != req.CandidateName {
+		s.debugln("server.deny.vote: cause duplicate vote: ", req.CandidateName,
+			" already vote for ", s.votedFor)
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	// Learners do not take part in elections.
+	if !isVotingRole(s.Role()) {
+		s.debugln("server.deny.vote: cause learner")
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	// If the candidate's log is not at least as up-to-date as our last log then don't vote.
+	lastIndex, lastTerm := s.log.lastInfo()
+	if lastIndex > req.LastLogIndex || lastTerm > req.LastLogTerm {
+		s.debugln("server.deny.vote: cause out of date log: ", req.CandidateName,
+			"Index :[", lastIndex, "]", " [", req.LastLogIndex, "]",
+			"Term :[", lastTerm, "]", " [", req.LastLogTerm, "]")
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	// Let the application refuse the vote.
+	if policy := s.VotePolicy(); policy != nil {
+		var candidate *Peer
+		if peer := s.peers[req.CandidateName]; peer != nil {
+			candidate = peer.clone()
+		}
+		if !policy.AllowVote(candidate, req) {
+			s.debugln("server.deny.vote: cause vote policy: ", req.CandidateName)
+			return newRequestVoteResponse(s.currentTerm, false), false
+		}
+	}
+
+	// If we made it this far then cast a vote and reset our election time out.
+	// The vote reaches the disk before it is granted, so that the server
+	// cannot vote twice in a term across a crash.
+	s.debugln("server.rv.vote: ", s.name, " votes for", req.CandidateName, "at term", req.Term)
+	prevVotedFor := s.votedFor
+	s.votedFor = req.CandidateName
+	if err := s.writeVote(); err != nil {
+		s.debugln("server.deny.vote: cause vote not persisted: ", err)
+		s.votedFor = prevVotedFor
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
+	return newRequestVoteResponse(s.currentTerm, true), true
+}
+
+//--------------------------------------
+// Membership
+//--------------------------------------
+
+// Adds a peer to the server.
+func (s *server) AddPeer(name string, connectiongString string) error {
+	s.debugln("server.peer.add: ", name, len(s.peers))
+
+	// Do not allow peers to be added twice.
+	if s.peers[name] != nil {
+		return nil
+	}
+
+	// Skip the Peer if it has the same name as the Server
+	if s.name != name {
+		peer := newPeer(s, name, connectiongString)
+
+		if s.State() == Leader {
+			peer.startHeartbeat()
+		}
+
+		s.peers[peer.Name] = peer
+		delete(s.removedPeers, name)
+
+		s.DispatchEvent(newEvent(AddPeerEventType, name, nil))
+		s.notifyPeerObservers(PeerChange{Type: PeerAdded, Name: name, ConnectionString: connectiongString, Role: peer.Role})
+	}
+
+	// Write the configuration to file.
+	s.writeConf()
+
+	return nil
+}
+
+// Removes a peer from the server.
+func (s *server) RemovePeer(name string) error {
+	s.debugln("server.peer.remove: ", name, s.peers)
+
+	// Skip the Peer if it has the same name as the Server
+	if name != s.Name() {
+		// Return error if peer doesn't exist.
+		peer := s.peers[name]
+		if peer == nil {
+			return fmt.Errorf("raft: Peer not found: %s", name)
+		}
+
+		// Stop peer and remove it.
+		if s.State() == Leader {
+			// We create a go routine here to avoid potential deadlock.
+			// We are holding log write lock when reach this line of code.
+			// Peer.stopHeartbeat can be blocked without go routine, if the
+			// target go routine (which we want to stop) is calling
+			// log.getEntriesAfter and waiting for log read lock.
+			// So we might be holding log lock and waiting for log lock,
+			// which lead to a deadlock.
+			// TODO(xiangli) refactor log lock
+			s.routineGroup.Add(1)
+			go func() {
+				defer s.routineGroup.Done()
+				peer.stopHeartbeat(true)
+			}()
+		}
+
+		delete(s.peers, name)
+		if s.removedPeers == nil {
+			s.removedPeers = make(map[string]bool)
+		}
+		s.removedPeers[name] = true
+
+		s.DispatchEvent(newEvent(RemovePeerEventType, name, nil))
+		s.notifyPeerObservers(PeerChange{Type: PeerRemoved, Name: name, ConnectionString: peer.ConnectionString, Role: peer.Role})
+	} else if s.State() == Leader {
+		s.debugln("Hand off leadership: ", s.Name())
+		s.handOff()
+	} else {
+		s.debugln("Stop peer: ", s.Name())
+		s.Stop()
+	}
+
+	// Write the configuration to file.
+	s.writeConf()
+
+	return nil
+}
+
+// Sets the role of a member. Learners receive log entries and snapshots but
+// do not vote and are not counted towards the quorum. This is normally
+// called while applying a replicated configuration change.
+func (s *server) SetPeerRole(name string, role string) error {
+	if role != VoterRole && role != LearnerRole && role != WitnessRole {
+		return fmt.Errorf("raft: Invalid peer role: %s", role)
+	}
+
+	var prevRole, connectionString string
+	if name == s.Name() {
+		s.mutex.Lock()
+		prevRole = s.role
+		s.role = role
+		connectionString = s.connectionString
+		s.mutex.Unlock()
+	} else {
+		peer := s.peers[name]
+		if peer == nil {
+			return fmt.Errorf("raft: Peer not found: %s", name)
+		}
+		peer.Lock()
+		prevRole = peer.Role
+		peer.Role = role
+		connectionString = peer.ConnectionString
+		peer.Unlock()
+	}
+
+	// Write the configuration to file.
+	s.writeConf()
+
+	if prevRole != role {
+		s.notifyPeerObservers(PeerChange{Type: PeerRoleChanged, Name: name, ConnectionString: connectionString, Role: role})
+	}
+
+	if prevRole == LearnerRole && role == VoterRole {
+		s.DispatchEvent(newEvent(PromotePeerEventType, name, nil))
+	}
+
+	return nil
 }
 
-// Sends an event to the event loop to be processed. The function will wait
-// until the event is actually processed before returning.
-func (s *server) send(value interface{}) (interface{}, error) {
-	if !s.Running() {
-		return nil, StopError
+// Demotes a voter to a learner. If remove is set the leader then submits the
+// removal of the learner. If leadership changes in between, the member stays
+// on as a learner and the removal must be submitted again. This is normally
+// called while applying a replicated demotion.
+func (s *server) DemotePeer(name string, remove bool) error {
+	if err := s.SetPeerRole(name, LearnerRole); err != nil {
+		return err
 	}
 
-	event := &ev{target: value, errChan: make(chan error, 1)}
-	select {
-	case s.evChan <- event:
-	case <-s.stopped:
-		return nil, StopError
-	}
-	select {
-	case <-s.stopped:
-		return nil, StopError
-	case err := <-event.errChan:
-		return event.returnValue, err
+	if remove && s.State() == Leader {
+		s.debugln("server.peer.demoted.remove: ", name)
+		s.routineGroup.Add(1)
+		go func() {
+			defer s.routineGroup.Done()
+			s.do(&DefaultLeaveCommand{Name: name})
+		}()
 	}
+
+	return nil
 }
 
-func (s *server) sendAsync(value interface{}) {
-	if !s.Running() {
-		return
+// Creates a new cluster with this server as its first leader. peers is the
+// initial configuration and must include this server. The configuration is
+// written as the first log entry and replicated to the other peers once they
+// are started. Bootstrap must be called on exactly one server, after Start,
+// and only when its log is empty.
+func (s *server) Bootstrap(peers []*Peer) error {
+	if !s.IsLogEmpty() {
+		return AlreadyBootstrappedError
 	}
 
-	event := &ev{target: value, errChan: make(chan error, 1)}
-	// try a non-blocking send first
-	// in most cases, this should not be blocking
-	// avoid create unnecessary go routines
-	select {
-	case s.evChan <- event:
-		return
-	default:
+	command := &DefaultBootstrapCommand{ClusterID: s.ClusterID()}
+	if command.ClusterID == "" {
+		command.ClusterID = newClusterID()
 	}
 
-	s.routineGroup.Add(1)
-	go func() {
-		defer s.routineGroup.Done()
-		select {
-		case s.evChan <- event:
-		case <-s.stopped:
+	found := false
+	for _, peer := range peers {
+		if peer.Name == s.Name() {
+			found = true
 		}
-	}()
-}
-
-// The event loop that is run when the server is in a Follower state.
-// Responds to RPCs from candidates and leaders.
-// Converts to candidate if election timeout elapses without either:
-//   1.Receiving valid AppendEntries RPC, or
-//   2.Granting vote to candidate
-func (s *server) followerLoop() {
-	since := time.Now()
-	electionTimeout := s.ElectionTimeout()
-	timeoutChan := afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
+		command.Peers = append(command.Peers, &Peer{
+			Name:             peer.Name,
+			ConnectionString: peer.ConnectionString,
+			Role:             peer.Role,
+			Weight:           peer.Weight,
+			Metadata:         copyMetadata(peer.Metadata),
+		})
+	}
+	if !found {
+		return fmt.Errorf("raft: Bootstrap configuration does not include %s", s.Name())
+	}
 
-	for s.State() == Follower {
-		var err error
-		update := false
-		select {
-		case <-s.stopped:
-			s.setState(Stopped)
-			return
+	_, err := s.send(command)
+	return err
+}
 
-		case e := <-s.evChan:
-			switch req := e.target.(type) {
-			case JoinCommand:
-				//If no log entries exist and a self-join command is issued
-				//then immediately become leader and commit entry.
-				if s.log.currentIndex() == 0 && req.NodeName() == s.Name() {
-					s.debugln("selfjoin and promote to leader")
-					s.setState(Leader)
-					s.processCommand(req, e)
-				} else {
-					err = NotLeaderError
-				}
-			case *AppendEntriesRequest:
-				// If heartbeats get too close to the election timeout then send an event.
-				elapsedTime := time.Now().Sub(since)
-				if elapsedTime > time.Duration(float64(electionTimeout)*ElectionTimeoutThresholdPercent) {
-					s.DispatchEvent(newEvent(ElectionTimeoutThresholdEventType, elapsedTime, nil))
-				}
-				e.returnValue, update = s.processAppendEntriesRequest(req)
-			case *RequestVoteRequest:
-				e.returnValue, update = s.processRequestVoteRequest(req)
-			case *SnapshotRequest:
-				e.returnValue = s.processSnapshotRequest(req)
-			default:
-				err = NotLeaderError
-			}
-			// Callback to event.
-			e.errChan <- err
+// Fixes the membership of the cluster to peers, which must include this
+// server, for deployments with a fixed topology. Every server must be given
+// the same peers before it is started. The peers are configured on start
+// without going through the log, a cluster with an empty log can elect a
+// leader straight away, and membership commands are refused with
+// StaticMembershipError.
+func (s *server) SetStaticPeers(peers []*Peer) error {
+	if s.Running() {
+		return fmt.Errorf("raft.Server: Server already running[%v]", s.state)
+	}
 
-		case <-timeoutChan:
-			// only allow synced follower to promote to candidate
-			if s.promotable() {
-				s.setState(Candidate)
-			} else {
-				update = true
-			}
+	found := false
+	staticPeers := make([]*Peer, len(peers))
+	for i, peer := range peers {
+		if peer.Name == s.Name() {
+			found = true
 		}
-
-		// Converts to candidate if election timeout elapses without either:
-		//   1.Receiving valid AppendEntries RPC, or
-		//   2.Granting vote to candidate
-		if update {
-			since = time.Now()
-			timeoutChan = afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
+		staticPeers[i] = &Peer{
+			Name:             peer.Name,
+			ConnectionString: peer.ConnectionString,
+			Role:             peer.Role,
+			Weight:           peer.Weight,
+			Metadata:         copyMetadata(peer.Metadata),
 		}
 	}
+	if !found {
+		return fmt.Errorf("raft: Static peers do not include %s", s.Name())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.staticPeers = staticPeers
+	return nil
 }
 
-// The event loop that is run when the server is in a Candidate state.
-func (s *server) candidateLoop() {
-	// Clear leader value.
-	prevLeader := s.leader
-	s.leader = ""
-	if prevLeader != s.leader {
-		s.DispatchEvent(newEvent(LeaderChangeEventType, s.leader, prevLeader))
+// Resets the cluster to a single member holding this server, to recover from
+// the permanent loss of a quorum. The log and state are kept. It must be
+// called before Start; the server then elects itself and records the reset in
+// its log. This discards every other member, and anything they committed
+// that this server does not have, so they must not be restarted with their
+// old data.
+func (s *server) ForceNewCluster() error {
+	if s.Running() {
+		return fmt.Errorf("raft.Server: Server already running[%v]", s.state)
 	}
 
-	lastLogIndex, lastLogTerm := s.log.lastInfo()
-	doVote := true
-	votesGranted := 0
-	var timeoutChan <-chan time.Time
-	var respChan chan *RequestVoteResponse
-
-	for s.State() == Candidate {
-		if doVote {
-			// Increment current term, vote for self.
-			s.currentTerm++
-			s.votedFor = s.name
+	warnln("raft: Forcing", s.name, "into a new cluster on start")
+	s.forceNewCluster = true
+	return nil
+}
 
-			// Send RequestVote RPCs to all other servers.
-			respChan = make(chan *RequestVoteResponse, len(s.peers))
-			for _, peer := range s.peers {
-				s.routineGroup.Add(1)
-				go func(peer *Peer) {
-					defer s.routineGroup.Done()
-					peer.sendVoteRequest(newRequestVoteRequest(s.currentTerm, s.name, lastLogIndex, lastLogTerm), respChan)
-				}(peer)
+// Removes every member but name, which becomes a voter if it is this server,
+// and abandons any membership change in progress. This is normally called
+// while applying a forced new cluster.
+func (s *server) ResetMembership(name string) error {
+	s.joint = nil
+	for peerName := range s.peers {
+		if peerName != name {
+			if err := s.RemovePeer(peerName); err != nil {
+				return err
 			}
-
-			// Wait for either:
-			//   * Votes received from majority of servers: become leader
-			//   * AppendEntries RPC received from new leader: step down.
-			//   * Election timeout elapses without election resolution: increment term, start new election
-			//   * Discover higher term: step down (§5.1)
-			votesGranted = 1
-			timeoutChan = afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
-			doVote = false
-		}
-
-		// If we received enough votes then stop waiting for more votes.
-		// And return from the candidate loop
-		if votesGranted == s.QuorumSize() {
-			s.debugln("server.candidate.recv.enough.votes")
-			s.setState(Leader)
-			return
 		}
+	}
 
-		// Collect votes from peers.
-		select {
-		case <-s.stopped:
-			s.setState(Stopped)
-			return
+	if name == s.Name() {
+		return s.SetPeerRole(name, VoterRole)
+	}
+	return nil
+}
 
-		case resp := <-respChan:
-			if success := s.processVoteResponse(resp); success {
-				s.debugln("server.candidate.vote.granted: ", votesGranted)
-				votesGranted++
-			}
+// A list of observers, which are called in the order they were registered
+// with each change. Observers are called synchronously, from the goroutine
+// making the change, and must not block.
+type observerList struct {
+	sync.RWMutex
+	observers []interface{}
+}
 
-		case e := <-s.evChan:
-			var err error
-			switch req := e.target.(type) {
-			case Command:
-				err = NotLeaderError
-			case *AppendEntriesRequest:
-				e.returnValue, _ = s.processAppendEntriesRequest(req)
-			case *RequestVoteRequest:
-				e.returnValue, _ = s.processRequestVoteRequest(req)
-			}
+// Adds an observer to the list.
+func (l *observerList) register(observer interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.observers = append(l.observers, observer)
+}
 
-			// Callback to event.
-			e.errChan <- err
+// Calls notify with each observer in the list.
+func (l *observerList) each(notify func(observer interface{})) {
+	l.RLock()
+	observers := l.observers
+	l.RUnlock()
 
-		case <-timeoutChan:
-			doVote = true
-		}
+	for _, observer := range observers {
+		notify(observer)
 	}
 }
 
-// The event loop that is run when the server is in a Leader state.
-func (s *server) leaderLoop() {
-	logIndex, _ := s.log.lastInfo()
+// Registers a function that is called from the event loop whenever a member
+// is added, removed, changes role or changes address, including while the
+// log is replayed on start, so that connection pools or service discovery
+// can follow the membership.
+func (s *server) RegisterPeerObserver(observer func(PeerChange)) {
+	s.peerObservers.register(observer)
+}
 
-	// Update the peers prevLogIndex to leader's lastLogIndex and start heartbeat.
-	s.debugln("leaderLoop.set.PrevIndex to ", logIndex)
-	for _, peer := range s.peers {
-		peer.setPrevLogIndex(logIndex)
-		peer.startHeartbeat()
+// Calls the registered peer observers.
+func (s *server) notifyPeerObservers(change PeerChange) {
+	if change.Role == "" {
+		change.Role = VoterRole
 	}
+	s.peerObservers.each(func(observer interface{}) { observer.(func(PeerChange))(change) })
+}
 
-	// Commit a NOP after the server becomes leader. From the Raft paper:
-	// "Upon election: send initial empty AppendEntries RPCs (heartbeat) to
-	// each server; repeat during idle periods to prevent election timeouts
-	// (§5.2)". The heartbeats started above do the "idle" period work.
-	s.routineGroup.Add(1)
-	go func() {
-		defer s.routineGroup.Done()
-		s.Do(NOPCommand{})
-	}()
+// Registers a function that is called from the event loop whenever the
+// server changes state, for example to start background jobs when it
+// becomes leader and stop them when it no longer is.
+func (s *server) RegisterStateObserver(observer func(StateChange)) {
+	s.stateObservers.register(observer)
+}
 
-	// Begin to collect response from followers
-	for s.State() == Leader {
-		var err error
-		select {
-		case <-s.stopped:
-			// Stop all peers before stop
-			for _, peer := range s.peers {
-				peer.stopHeartbeat(false)
-			}
-			s.setState(Stopped)
-			return
+// Calls the registered state observers.
+func (s *server) notifyStateObservers(change StateChange) {
+	s.stateObservers.each(func(observer interface{}) { observer.(func(StateChange))(change) })
+}
 
-		case e := <-s.evChan:
-			switch req := e.target.(type) {
-			case Command:
-				s.processCommand(req, e)
-				continue
-			case *AppendEntriesRequest:
-				e.returnValue, _ = s.processAppendEntriesRequest(req)
-			case *AppendEntriesResponse:
-				s.processAppendEntriesResponse(req)
-			case *RequestVoteRequest:
-				e.returnValue, _ = s.processRequestVoteRequest(req)
-			}
+// Registers a function that is called from the event loop whenever the
+// server's current term changes.
+func (s *server) RegisterTermObserver(observer func(TermChange)) {
+	s.termObservers.register(observer)
+}
 
-			// Callback to event.
-			e.errChan <- err
-		}
-	}
+// Calls the registered term observers.
+func (s *server) notifyTermObservers(change TermChange) {
+	s.termObservers.each(func(observer interface{}) { observer.(func(TermChange))(change) })
+}
 
-	s.syncedPeer = nil
+// Registers a function that is called from the event loop whenever the
+// leader known to the server changes, so that applications can follow
+// failovers without polling Leader.
+func (s *server) RegisterLeaderObserver(observer func(LeaderChange)) {
+	s.leaderObservers.register(observer)
 }
 
-func (s *server) snapshotLoop() {
-	for s.State() == Snapshotting {
-		var err error
-		select {
-		case <-s.stopped:
-			s.setState(Stopped)
-			return
+// Calls the registered leader observers.
+func (s *server) notifyLeaderObservers(change LeaderChange) {
+	s.leaderObservers.each(func(observer interface{}) { observer.(func(LeaderChange))(change) })
+}
 
-		case e := <-s.evChan:
-			switch req := e.target.(type) {
-			case Command:
-				err = NotLeaderError
-			case *AppendEntriesRequest:
-				e.returnValue, _ = s.processAppendEntriesRequest(req)
-			case *RequestVoteRequest:
-				e.returnValue, _ = s.processRequestVoteRequest(req)
-			case *SnapshotRecoveryRequest:
-				e.returnValue = s.processSnapshotRecoveryRequest(req)
-			}
-			// Callback to event.
-			e.errChan <- err
-		}
-	}
+// Registers a function that is called from the goroutine recovering the
+// state machine from a snapshot, when it starts, as its state is read and
+// when it is done, so that operators can follow a large restore. The state
+// is only reported as it is read if the state machine is a StreamRecoverer,
+// in steps of a hundredth of it.
+func (s *server) RegisterRecoveryObserver(observer func(RecoveryProgress)) {
+	s.recoveryObservers.register(observer)
+}
+
+// Calls the registered recovery observers.
+func (s *server) notifyRecoveryObservers(progress RecoveryProgress) {
+	s.recoveryObservers.each(func(observer interface{}) { observer.(func(RecoveryProgress))(progress) })
+}
+
+// A pair of functions called around the application of each entry.
+type applyHook struct {
+	before func(*LogEntry)
+	after  func(*LogEntry, interface{}, error)
+}
+
+// The apply hooks that are registered, in the order they are called.
+type applyHooks []applyHook
+
+// Registers functions that are called before and after each committed entry
+// is applied, with the result and the error it was applied with, so that
+// metrics, invariant checks or secondary indexes can follow every entry
+// without wrapping each command. Either may be nil. Hooks are called while
+// the log is locked, including while it is replayed on start, so they must
+// not block or call server methods that read the log. They are never called
+// concurrently: consecutive read-only commands, which are applied
+// concurrently, are all preceded by their before hooks and followed by their
+// after hooks.
+func (s *server) RegisterApplyHook(before func(*LogEntry), after func(*LogEntry, interface{}, error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.applyHooks = append(s.applyHooks, applyHook{before: before, after: after})
 }
 
-//--------------------------------------
-// Commands
-//--------------------------------------
-
-// Attempts to execute a command and replicate it. The function will return
-// when the command has been successfully committed or an error has occurred.
+// Retrieves the registered apply hooks.
+func (s *server) getApplyHooks() applyHooks {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.applyHooks
+}
 
-func (s *server) Do(command Command) (interface{}, error) {
-	if s.Leader() == "" || s.Leader() == s.Name() {
-		return s.send(command)
-	} else {
-		return s.redirect(command)
+// Calls the before hooks for an entry.
+func (hooks applyHooks) before(e *LogEntry) {
+	for _, hook := range hooks {
+		if hook.before != nil {
+			hook.before(e)
+		}
 	}
 }
 
-func (s *server) redirect(command Command) (interface{}, error) {
-	if !s.Running() {
-		return nil, StopError
-	}
-	err := s.Transporter().Redirect(s, command)
-	if err != nil {
-		s.debugln("redirect failed: ", err)
+// Calls the after hooks for an entry.
+func (hooks applyHooks) after(e *LogEntry, result interface{}, err error) {
+	for _, hook := range hooks {
+		if hook.after != nil {
+			hook.after(e, result, err)
+		}
 	}
-	return nil, err
 }
 
-// Processes a command.
-func (s *server) processCommand(command Command, e *ev) {
-	s.debugln("server.command.process")
-
-	// Create an entry for the command in the log.
-	entry, err := s.log.createEntry(s.currentTerm, command, e)
+// Checks whether the membership is static.
+func (s *server) StaticMembership() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.staticPeers != nil
+}
 
-	if err != nil {
-		s.debugln("server.command.log.entry.error:", err)
-		e.errChan <- err
-		return
+// Starts a joint consensus membership change to the given configuration.
+// Peers that are not yet members are added immediately; until the change is
+// committed, elections and commitment need a majority of both the old and
+// the new voters. The leader finishes the change once this entry commits.
+func (s *server) BeginMembershipChange(peers []*Peer) error {
+	if s.joint != nil {
+		return errors.New("raft: Membership change already in progress")
 	}
 
-	if err := s.log.appendEntry(entry); err != nil {
-		s.debugln("server.command.log.error:", err)
-		e.errChan <- err
-		return
+	joint := &jointConfiguration{old: s.voters(), new: make(map[string]int)}
+	for _, peer := range peers {
+		if isVotingRole(peer.Role) {
+			joint.new[peer.Name] = voteWeight(peer.Weight)
+		}
+	}
+	if len(joint.new) == 0 {
+		return errors.New("raft: Membership change has no voters")
 	}
 
-	s.syncedPeer[s.Name()] = true
-	if len(s.peers) == 0 {
-		commitIndex := s.log.currentIndex()
-		s.log.setCommitIndex(commitIndex)
-		s.debugln("commit index ", commitIndex)
+	for _, peer := range peers {
+		if err := addPeer(s, peer); err != nil {
+			return err
+		}
 	}
-}
+	s.joint = joint
 
-//--------------------------------------
-// Append Entries
-//--------------------------------------
+	if s.State() == Leader {
+		s.commitMembershipChange()
+	}
 
-// Appends zero or more log entry from the leader to this server.
-func (s *server) AppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
-	ret, _ := s.send(req)
-	resp, _ := ret.(*AppendEntriesResponse)
-	return resp
+	return nil
 }
 
-// Processes the "append entries" request.
-func (s *server) processAppendEntriesRequest(req *AppendEntriesRequest) (*AppendEntriesResponse, bool) {
-	s.traceln("server.ae.process")
+// Completes a membership change by removing the members that are not part
+// of the new configuration. A server that is not in the new configuration
+// stops voting and steps down if it is the leader.
+func (s *server) CommitMembershipChange() error {
+	if s.joint == nil {
+		return nil
+	}
 
-	if req.Term < s.currentTerm {
-		s.debugln("server.ae.error: stale term")
-		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), false
+	members := make(map[string]bool)
+	for name := range s.joint.new {
+		members[name] = true
+	}
+	for name, peer := range s.peers {
+		if !peer.Voting() {
+			members[name] = true
+		}
 	}
 
-	if req.Term == s.currentTerm {
-		_assert(s.State() != Leader, "leader.elected.at.same.term.%d\n", s.currentTerm)
+	for name := range s.peers {
+		if !members[name] {
+			if err := s.RemovePeer(name); err != nil {
+				return err
+			}
+		}
+	}
 
-		// step-down to follower when it is a candidate
-		if s.state == Candidate {
-			// change state to follower
+	_, member := s.joint.new[s.name]
+	removed := !member
+	s.joint = nil
+	if removed {
+		s.mutex.Lock()
+		s.role = LearnerRole
+		s.mutex.Unlock()
+		s.writeConf()
+		s.DispatchEvent(newEvent(RemovePeerEventType, s.name, nil))
+		if s.State() == Leader {
+			// Stop heartbeats in the background; see RemovePeer.
+			for _, peer := range s.peers {
+				s.routineGroup.Add(1)
+				go func(peer *Peer) {
+					defer s.routineGroup.Done()
+					peer.stopHeartbeat(false)
+				}(peer)
+			}
 			s.setState(Follower)
 		}
+	}
 
-		// discover new leader when candidate
-		// save leader name when follower
-		s.leader = req.LeaderName
+	return nil
+}
+
+// Submits the entry that finishes the current membership change.
+func (s *server) commitMembershipChange() {
+	s.routineGroup.Add(1)
+	go func() {
+		defer s.routineGroup.Done()
+		s.do(&DefaultMembershipCommitCommand{})
+	}()
+}
+
+// Sets the connection string of a member. It is normally called while
+// applying a replicated address change so every member, and every snapshot,
+// agrees on the new address.
+func (s *server) SetPeerConnectionString(name string, connectionString string) error {
+	var prevConnectionString, role string
+	if name == s.Name() {
+		s.mutex.Lock()
+		prevConnectionString = s.connectionString
+		s.connectionString = connectionString
+		role = s.role
+		s.mutex.Unlock()
 	} else {
-		// Update term and leader.
-		s.updateCurrentTerm(req.Term, req.LeaderName)
+		peer := s.peers[name]
+		if peer == nil {
+			return fmt.Errorf("raft: Peer not found: %s", name)
+		}
+		peer.Lock()
+		prevConnectionString = peer.ConnectionString
+		peer.ConnectionString = connectionString
+		role = peer.Role
+		peer.Unlock()
 	}
 
-	// Reject if log doesn't contain a matching previous entry.
-	if err := s.log.truncate(req.PrevLogIndex, req.PrevLogTerm); err != nil {
-		s.debugln("server.ae.truncate.error: ", err)
-		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), true
-	}
+	// Write the configuration to file.
+	s.writeConf()
 
-	// Append entries to the log.
-	if err := s.log.appendEntries(req.Entries); err != nil {
-		s.debugln("server.ae.append.error: ", err)
-		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), true
+	if prevConnectionString != connectionString {
+		s.notifyPeerObservers(PeerChange{Type: PeerAddressChanged, Name: name, ConnectionString: connectionString, Role: role})
 	}
 
-	// Commit up to the commit index.
-	if err := s.log.setCommitIndex(req.CommitIndex); err != nil {
-		s.debugln("server.ae.commit.error: ", err)
-		return newAppendEntriesResponse(s.currentTerm, false, s.log.currentIndex(), s.log.CommitIndex()), true
+	return nil
+}
+
+// Sets the metadata of a member. Like roles, metadata is normally set while
+// applying a replicated configuration change so every member sees the same
+// values.
+func (s *server) SetPeerMetadata(name string, metadata map[string]string) error {
+	metadata = copyMetadata(metadata)
+
+	if name == s.Name() {
+		s.mutex.Lock()
+		s.metadata = metadata
+		s.mutex.Unlock()
+	} else {
+		peer := s.peers[name]
+		if peer == nil {
+			return fmt.Errorf("raft: Peer not found: %s", name)
+		}
+		peer.Lock()
+		peer.Metadata = metadata
+		peer.Unlock()
 	}
 
-	// once the server appended and committed all the log entries from the leader
+	// Write the configuration to file.
+	s.writeConf()
 
-	return newAppendEntriesResponse(s.currentTerm, true, s.log.currentIndex(), s.log.CommitIndex()), true
+	return nil
 }
 
-// Processes the "append entries" response from the peer. This is only
-// processed when the server is a leader. Responses received during other
-// states are dropped.
-func (s *server) processAppendEntriesResponse(resp *AppendEntriesResponse) {
-	// If we find a higher term then change to a follower and exit.
-	if resp.Term() > s.Term() {
-		s.updateCurrentTerm(resp.Term(), "")
-		return
+// Sets the voting weight of a member. Elections and commitment need more
+// than half of the total weight of the voters. A weight of zero resets the
+// member to a single vote.
+func (s *server) SetPeerWeight(name string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("raft: Invalid peer weight: %d", weight)
 	}
 
-	// panic response if it's not successful.
-	if !resp.Success() {
-		return
+	if name == s.Name() {
+		s.mutex.Lock()
+		s.weight = weight
+		s.mutex.Unlock()
+	} else {
+		peer := s.peers[name]
+		if peer == nil {
+			return fmt.Errorf("raft: Peer not found: %s", name)
+		}
+		peer.Lock()
+		peer.Weight = weight
+		peer.Unlock()
 	}
 
-	// if one peer successfully append a log from the leader term,
-	// we add it to the synced list
-	if resp.append == true {
-		s.syncedPeer[resp.peer] = true
-	}
+	// Write the configuration to file.
+	s.writeConf()
 
-	// Increment the commit count to make sure we have a quorum before committing.
-	if len(s.syncedPeer) < s.QuorumSize() {
-		return
-	}
+	return nil
+}
 
-	// Determine the committed index that a majority has.
-	var indices []uint64
-	indices = append(indices, s.log.currentIndex())
-	for _, peer := range s.peers {
-		indices = append(indices, peer.getPrevLogIndex())
+// Retrieves every configuration this server has applied, oldest first. The
+// history is kept across restarts, but each snapshot drops the changes made
+// before the configuration it holds, and a server that was started from a
+// snapshot only knows the changes applied since.
+func (s *server) ConfigurationHistory() []*ConfigurationChangeEventInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	history := make([]*ConfigurationChangeEventInfo, len(s.configurations))
+	for i, c := range s.configurations {
+		history[i] = c.clone()
 	}
-	sort.Sort(sort.Reverse(uint64Slice(indices)))
+	return history
+}
 
-	// We can commit up to the index which the majority of the members have appended.
-	commitIndex := indices[s.QuorumSize()-1]
-	committedIndex := s.log.commitIndex
+// Retrieves the members of the cluster as of a log index, or nil if the
+// index precedes the known history.
+func (s *server) ConfigurationAt(index uint64) []*Peer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	if commitIndex > committedIndex {
-		// leader needs to do a fsync before committing log entries
-		s.log.sync()
-		s.log.setCommitIndex(commitIndex)
-		s.debugln("processAppendEntriesResponse commit index ", commitIndex)
+	i := sort.Search(len(s.configurations), func(i int) bool {
+		return s.configurations[i].Index > index
+	})
+	if i == 0 {
+		return nil
 	}
+	return s.configurations[i-1].clone().Peers
 }
 
-// processVoteReponse processes a vote request:
-// 1. if the vote is granted for the current term of the candidate, return true
-// 2. if the vote is denied due to smaller term, update the term of this server
-//    which will also cause the candidate to step-down, and return false.
-// 3. if the vote is for a smaller term, ignore it and return false.
-func (s *server) processVoteResponse(resp *RequestVoteResponse) bool {
-	if resp.VoteGranted && resp.Term == s.currentTerm {
-		return true
+// Appends an applied configuration to the history. Configurations replayed
+// from the log after a restart are already recorded and are skipped.
+func (s *server) recordConfiguration(c *ConfigurationChangeEventInfo) {
+	s.configurationsMutex.Lock()
+	defer s.configurationsMutex.Unlock()
+
+	s.mutex.Lock()
+	if n := len(s.configurations); n > 0 && s.configurations[n-1].Index >= c.Index {
+		s.mutex.Unlock()
+		return
 	}
+	s.configurations = append(s.configurations, c)
+	s.mutex.Unlock()
 
-	if resp.Term > s.currentTerm {
-		s.debugln("server.candidate.vote.failed")
-		s.updateCurrentTerm(resp.Term, "")
-	} else {
-		s.debugln("server.candidate.vote: denied")
+	if err := s.writeConfiguration(c); err != nil {
+		s.debugln("raft: Configurations file error: ", err)
 	}
-	return false
 }
 
-//--------------------------------------
-// Request Vote
-//--------------------------------------
+// Appends a configuration to the configurations file.
+func (s *server) writeConfiguration(c *ConfigurationChangeEventInfo) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
 
-// Requests a vote from a server. A vote can be obtained if the vote's term is
-// at the server's current term and the server has not made a vote yet. A vote
-// can also be obtained if the term is greater than the server's current term.
-func (s *server) RequestVote(req *RequestVoteRequest) *RequestVoteResponse {
-	ret, _ := s.send(req)
-	resp, _ := ret.(*RequestVoteResponse)
-	return resp
+	f, err := os.OpenFile(path.Join(s.path, "configurations"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
 }
 
-// Processes a "request vote" request.
-func (s *server) processRequestVoteRequest(req *RequestVoteRequest) (*RequestVoteResponse, bool) {
+// Drops the configurations made before the one in effect at index, as of a
+// snapshot, and rewrites the configurations file to match.
+func (s *server) truncateConfigurations(index uint64) {
+	s.configurationsMutex.Lock()
+	defer s.configurationsMutex.Unlock()
 
-	// If the request is coming from an old term then reject it.
-	if req.Term < s.Term() {
-		s.debugln("server.rv.deny.vote: cause stale term")
-		return newRequestVoteResponse(s.currentTerm, false), false
+	s.mutex.Lock()
+	i := sort.Search(len(s.configurations), func(i int) bool {
+		return s.configurations[i].Index > index
+	})
+	if i <= 1 {
+		s.mutex.Unlock()
+		return
 	}
+	s.configurations = append([]*ConfigurationChangeEventInfo(nil), s.configurations[i-1:]...)
+	configurations := s.configurations
+	s.mutex.Unlock()
 
-	// If the term of the request peer is larger than this node, update the term
-	// If the term is equal and we've already voted for a different candidate then
-	// don't vote for this candidate.
-	if req.Term > s.Term() {
-		s.updateCurrentTerm(req.Term, "")
-	} else if s.votedFor != "" && s.votedFor != req.CandidateName {
-		s.debugln("server.deny.vote: cause duplicate vote: ", req.CandidateName,
-			" already vote for ", s.votedFor)
-		return newRequestVoteResponse(s.currentTerm, false), false
+	var buf bytes.Buffer
+	for _, c := range configurations {
+		b, err := json.Marshal(c)
+		if err != nil {
+			s.debugln("raft: Configurations file error: ", err)
+			return
+		}
+		buf.Write(append(b, '\n'))
 	}
+	configurationsPath := path.Join(s.path, "configurations")
+	tmpConfigurationsPath := path.Join(s.path, "configurations.tmp")
+	if err := writeFileSynced(tmpConfigurationsPath, buf.Bytes(), 0600); err != nil {
+		s.debugln("raft: Configurations file error: ", err)
+		return
+	}
+	if err := os.Rename(tmpConfigurationsPath, configurationsPath); err != nil {
+		s.debugln("raft: Configurations file error: ", err)
+	}
+}
 
-	// If the candidate's log is not at least as up-to-date as our last log then don't vote.
-	lastIndex, lastTerm := s.log.lastInfo()
-	if lastIndex > req.LastLogIndex || lastTerm > req.LastLogTerm {
-		s.debugln("server.deny.vote: cause out of date log: ", req.CandidateName,
-			"Index :[", lastIndex, "]", " [", req.LastLogIndex, "]",
-			"Term :[", lastTerm, "]", " [", req.LastLogTerm, "]")
-		return newRequestVoteResponse(s.currentTerm, false), false
+// Reads the configuration history from file.
+func (s *server) readConfigurations() error {
+	f, err := os.Open(path.Join(s.path, "configurations"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var configurations []*ConfigurationChangeEventInfo
+	decoder := json.NewDecoder(f)
+	for {
+		c := &ConfigurationChangeEventInfo{}
+		if err := decoder.Decode(c); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		configurations = append(configurations, c)
 	}
 
-	// If we made it this far then cast a vote and reset our election time out.
-	s.debugln("server.rv.vote: ", s.name, " votes for", req.CandidateName, "at term", req.Term)
-	s.votedFor = req.CandidateName
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.configurations = configurations
+	return nil
+}
 
-	return newRequestVoteResponse(s.currentTerm, true), true
+// Adds a peer name or address to the denylist, for example to keep a
+// decommissioned node that keeps coming back out of the cluster. RPCs from a
+// denied peer are rejected and the leader refuses its joins. A denied member
+// is not removed from the configuration; remove it with a leave command.
+// Each server keeps its own denylist, which is saved alongside its
+// configuration.
+func (s *server) DenyPeer(nameOrAddress string) error {
+	s.deniedMutex.Lock()
+	defer s.deniedMutex.Unlock()
+
+	s.mutex.Lock()
+	if s.deniedPeers == nil {
+		s.deniedPeers = make(map[string]bool)
+	}
+	s.deniedPeers[nameOrAddress] = true
+	s.mutex.Unlock()
+
+	return s.writeDeniedPeers()
 }
 
-//--------------------------------------
-// Membership
-//--------------------------------------
+// Removes a peer name or address from the denylist.
+func (s *server) AllowPeer(nameOrAddress string) error {
+	s.deniedMutex.Lock()
+	defer s.deniedMutex.Unlock()
+
+	s.mutex.Lock()
+	delete(s.deniedPeers, nameOrAddress)
+	s.mutex.Unlock()
 
-// Adds a peer to the server.
-func (s *server) AddPeer(name string, connectiongString string) error {
-	s.debugln("server.peer.add: ", name, len(s.peers))
+	return s.writeDeniedPeers()
+}
 
-	// Do not allow peers to be added twice.
-	if s.peers[name] != nil {
-		return nil
+// Retrieves the denied peer names and addresses.
+func (s *server) DeniedPeers() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	denied := make([]string, 0, len(s.deniedPeers))
+	for nameOrAddress := range s.deniedPeers {
+		denied = append(denied, nameOrAddress)
 	}
+	sort.Strings(denied)
+	return denied
+}
 
-	// Skip the Peer if it has the same name as the Server
-	if s.name != name {
-		peer := newPeer(s, name, connectiongString, s.heartbeatInterval)
-
-		if s.State() == Leader {
-			peer.startHeartbeat()
+// Determines whether a peer is denied by name, by the given address or by the
+// address of the member with that name.
+func (s *server) denied(name string, address string) bool {
+	if address == "" {
+		if peer := s.peers[name]; peer != nil {
+			address = peer.ConnectionString
 		}
+	}
 
-		s.peers[peer.Name] = peer
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.deniedPeers[name] || (address != "" && s.deniedPeers[address])
+}
 
-		s.DispatchEvent(newEvent(AddPeerEventType, name, nil))
+// Retrieves a copy of every member of the configuration, this server last.
+func (s *server) configuration() []*Peer {
+	peers := make([]*Peer, 0, len(s.peers)+1)
+	for _, peer := range s.peers {
+		peers = append(peers, peer.clone())
 	}
 
-	// Write the configuration to file.
-	s.writeConf()
+	s.mutex.RLock()
+	self := &Peer{Name: s.name, ConnectionString: s.connectionString, Role: s.role, Weight: s.weight, Metadata: copyMetadata(s.metadata)}
+	s.mutex.RUnlock()
 
-	return nil
+	return append(peers, self)
 }
 
-// Removes a peer from the server.
-func (s *server) RemovePeer(name string) error {
-	s.debugln("server.peer.remove: ", name, s.peers)
+// Restores the cluster configuration, including roles, weights and
+// metadata, from a snapshot.
+func (s *server) restorePeers(peers []*Peer) {
+	for _, peer := range peers {
+		addPeer(s, peer)
+	}
+}
 
-	// Skip the Peer if it has the same name as the Server
-	if name != s.Name() {
-		// Return error if peer doesn't exist.
-		peer := s.peers[name]
-		if peer == nil {
-			return fmt.Errorf("raft: Peer not found: %s", name)
-		}
+// Hands leadership to the most up-to-date peer that can lead and then stops
+// the server. It is called once the leader has applied its own removal, so
+// the successor learns of the removal with the same request and the cluster
+// does not have to wait for an election timeout. No further commands are
+// accepted.
+func (s *server) handOff() {
+	// This runs while the log applies the removal, so the lease is dropped
+	// without updateLease, which reads the log's commit info.
+	s.leaving = true
+	s.mutex.Lock()
+	s.leaseExpiry = time.Time{}
+	s.mutex.Unlock()
+	successor := s.successor()
 
-		// Stop peer and remove it.
-		if s.State() == Leader {
-			// We create a go routine here to avoid potential deadlock.
-			// We are holding log write lock when reach this line of code.
-			// Peer.stopHeartbeat can be blocked without go routine, if the
-			// target go routine (which we want to stop) is calling
-			// log.getEntriesAfter and waiting for log read lock.
-			// So we might be holding log lock and waiting for log lock,
-			// which lead to a deadlock.
-			// TODO(xiangli) refactor log lock
-			s.routineGroup.Add(1)
-			go func() {
-				defer s.routineGroup.Done()
-				peer.stopHeartbeat(true)
-			}()
+	// Stop waits for the server's goroutines, so this one is not tracked.
+	go func() {
+		if successor != nil {
+			s.debugln("server.handoff: ", successor.Name)
+			successor.sendTimeoutNow()
 		}
+		s.stop()
+	}()
+}
 
-		delete(s.peers, name)
-
-		s.DispatchEvent(newEvent(RemovePeerEventType, name, nil))
-	} else {
-		s.debugln("Stop peer: ", s.Name())
-		s.Stop()
+// Returns the most up-to-date peer that can lead, or nil if there is none.
+func (s *server) successor() *Peer {
+	var successor *Peer
+	for _, peer := range s.peers {
+		if !peer.Voting() || peer.Role == WitnessRole {
+			continue
+		}
+		if successor == nil || peer.getPrevLogIndex() > successor.getPrevLogIndex() {
+			successor = peer
+		}
 	}
-
-	// Write the configuration to file.
-	s.writeConf()
-
-	return nil
+	return successor
 }
 
 //--------------------------------------
@@ -1220,11 +5614,16 @@ func (s *server) TakeSnapshot() error {
 		return errors.New("Snapshot: Last snapshot is not finished.")
 	}
 
+	// Snapshots do not record the joint configuration.
+	if s.joint != nil {
+		return errors.New("Snapshot: Cannot create snapshot during a membership change.")
+	}
+
 	// TODO: acquire the lock and no more committed is allowed
 	// This will be done after finishing refactoring heartbeat
 	s.debugln("take.snapshot")
 
-	lastIndex, lastTerm := s.log.commitInfo()
+	lastIndex, lastTerm, sessions, order, keys := s.snapshotPoint()
 
 	// check if there is log has been committed since the
 	// last snapshot.
@@ -1232,26 +5631,39 @@ func (s *server) TakeSnapshot() error {
 		return nil
 	}
 
+	start := time.Now()
+	s.DispatchEvent(newEvent(SnapshotStartedEventType, &SnapshotEventInfo{LastIndex: lastIndex, LastTerm: lastTerm}, nil))
+
 	path := s.SnapshotPath(lastIndex, lastTerm)
 	// Attach snapshot to pending snapshot and save it to disk.
-	s.pendingSnapshot = &Snapshot{lastIndex, lastTerm, nil, nil, path}
+	s.pendingSnapshot = &Snapshot{LastIndex: lastIndex, LastTerm: lastTerm, Path: path, Manifest: s.newSnapshotManifest()}
 
 	state, err := s.stateMachine.Save()
 	if err != nil {
+		s.pendingSnapshot = nil
+		s.dispatchSnapshotFailed(lastIndex, lastTerm, "", err)
 		return err
 	}
 
-	// Clone the list of peers.
-	peers := make([]*Peer, 0, len(s.peers)+1)
-	for _, peer := range s.peers {
-		peers = append(peers, peer.clone())
-	}
-	peers = append(peers, &Peer{Name: s.Name(), ConnectionString: s.connectionString})
-
 	// Attach snapshot to pending snapshot and save it to disk.
-	s.pendingSnapshot.Peers = peers
+	s.pendingSnapshot.Peers = s.configuration()
 	s.pendingSnapshot.State = state
-	s.saveSnapshot()
+	s.pendingSnapshot.Sessions = sessions
+	s.pendingSnapshot.SessionOrder = order
+	s.pendingSnapshot.IdempotencyKeys = keys
+	if err := s.saveSnapshot(); err != nil {
+		s.pendingSnapshot = nil
+		s.dispatchSnapshotFailed(lastIndex, lastTerm, "", err)
+		return err
+	}
+
+	s.DispatchEvent(newEvent(SnapshotCompletedEventType, &SnapshotEventInfo{
+		LastIndex: lastIndex,
+		LastTerm:  lastTerm,
+		Size:      s.snapshot.fileSize(),
+		Duration:  time.Now().Sub(start),
+	}, nil))
+	s.truncateConfigurations(s.snapshot.Manifest.ConfigurationIndex)
 
 	// We keep some log entries after the snapshot.
 	// We do not want to send the whole snapshot to the slightly slow machines
@@ -1264,6 +5676,97 @@ func (s *server) TakeSnapshot() error {
 	return nil
 }
 
+// Retrieves the last committed index and term along with the client sessions,
+// their order and the idempotency keys as they were when that entry was
+// applied. Entries are applied under the log lock, so none can change in
+// between.
+func (s *server) snapshotPoint() (uint64, uint64, map[string]uint64, []string, []string) {
+	s.log.mutex.RLock()
+	defer s.log.mutex.RUnlock()
+	index, term := s.log.internalCommitInfo()
+	s.mutex.RLock()
+	keys := append([]string(nil), s.keyOrder...)
+	s.mutex.RUnlock()
+	return index, term, s.sessionSequences(), s.sessionOrder(), keys
+}
+
+// Retrieves the last sequence applied for each client session.
+func (s *server) sessionSequences() map[string]uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.sessions) == 0 {
+		return nil
+	}
+	sequences := make(map[string]uint64, len(s.sessions))
+	for id, session := range s.sessions {
+		sequences[id] = session.sequence
+	}
+	return sequences
+}
+
+// Retrieves the client sessions from the least to the most recently used.
+func (s *server) sessionOrder() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.sessions) == 0 {
+		return nil
+	}
+	order := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		order = append(order, id)
+	}
+	sort.Slice(order, func(i, j int) bool { return s.sessions[order[i]].index < s.sessions[order[j]].index })
+	return order
+}
+
+// Replaces the client sessions with those recorded in a snapshot, used in
+// the order given. Sessions missing from the order, as in snapshots taken
+// before it was recorded, are taken to be older, in the order of their IDs.
+// Restored sessions are numbered from one in place of their indices, which
+// keeps them in order and older than any entry after the snapshot.
+func (s *server) restoreSessions(sequences map[string]uint64, order []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ids []string
+	for id := range sequences {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ordered := make(map[string]bool, len(order))
+	for _, id := range order {
+		ordered[id] = true
+	}
+	var all []string
+	for _, id := range ids {
+		if !ordered[id] {
+			all = append(all, id)
+		}
+	}
+	for _, id := range order {
+		if _, ok := sequences[id]; ok {
+			all = append(all, id)
+		}
+	}
+
+	s.sessions = make(map[string]*clientSession, len(sequences))
+	for i, id := range all {
+		s.rememberSession(id, &clientSession{sequence: sequences[id], index: uint64(i + 1)})
+	}
+}
+
+// Replaces the remembered idempotency keys with those recorded in a
+// snapshot.
+func (s *server) restoreIdempotencyKeys(keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.idempotencyKeys = make(map[string]*appliedKey, len(keys))
+	s.keyOrder = nil
+	for _, key := range keys {
+		s.rememberKey(key, &appliedKey{})
+	}
+}
+
 // Retrieves the log path for the server.
 func (s *server) saveSnapshot() error {
 	if s.pendingSnapshot == nil {
@@ -1275,9 +5778,11 @@ func (s *server) saveSnapshot() error {
 		return err
 	}
 
-	// Swap the current and last snapshots.
+	// Swap the current and last snapshots. The state stays on disk and is
+	// only read back when the snapshot has to be sent to a peer.
 	tmp := s.snapshot
 	s.snapshot = s.pendingSnapshot
+	s.snapshot.State = nil
 
 	// Delete the previous snapshot if there is any change
 	if tmp != nil && !(tmp.LastIndex == s.snapshot.LastIndex && tmp.LastTerm == s.snapshot.LastTerm) {
@@ -1288,9 +5793,126 @@ func (s *server) saveSnapshot() error {
 	return nil
 }
 
+// Determines whether a peer whose log ends at prevLogIndex is far enough
+// behind that sending the current snapshot is cheaper than replaying the log.
+func (s *server) shouldSendSnapshot(prevLogIndex uint64) bool {
+	entries, bytes := s.SnapshotCatchUpEntries(), s.SnapshotCatchUpBytes()
+	if entries == 0 && bytes == 0 {
+		return false
+	}
+
+	// The snapshot only helps if it covers entries the peer is missing.
+	snapshot := s.snapshot
+	if snapshot == nil || snapshot.LastIndex <= prevLogIndex {
+		return false
+	}
+
+	currentIndex := s.log.currentIndex()
+	if currentIndex <= prevLogIndex {
+		return false
+	}
+	if entries > 0 && currentIndex-prevLogIndex >= entries {
+		return true
+	}
+	return bytes > 0 && s.log.sizeAfter(prevLogIndex, bytes) >= bytes
+}
+
+// Retrieves the current snapshot with its state loaded so it can be sent to
+// a peer. Peers receiving the same snapshot concurrently share a single read
+// of the snapshot file. Each call must be paired with releaseSnapshot().
+func (s *server) acquireSnapshot() (*sharedSnapshot, error) {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	current := s.snapshot
+	if current == nil {
+		return nil, errors.New("raft: No snapshot available")
+	}
+
+	if shared := s.sharedSnapshot; shared != nil && shared.LastIndex == current.LastIndex && shared.LastTerm == current.LastTerm {
+		shared.refs++
+		return shared, nil
+	}
+
+	ss := current
+	if source := s.SnapshotSource(); source != nil {
+		state, err := readSnapshotSource(source, current)
+		if err != nil {
+			return nil, err
+		}
+		ss = &Snapshot{}
+		*ss = *current
+		ss.State = state
+	} else if ss.State == nil {
+		var err error
+		if ss, _, err = readSnapshotFile(current.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	s.sharedSnapshot = &sharedSnapshot{Snapshot: ss, refs: 1}
+	return s.sharedSnapshot, nil
+}
+
+// Releases a snapshot retrieved with acquireSnapshot(). The snapshot state is
+// dropped from memory once the last peer has finished with it.
+func (s *server) releaseSnapshot(shared *sharedSnapshot) {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	shared.refs--
+	if shared.refs == 0 && s.sharedSnapshot == shared {
+		s.sharedSnapshot = nil
+	}
+}
+
+// Creates the manifest recorded with a new snapshot.
+func (s *server) newSnapshotManifest() *SnapshotManifest {
+	m := &SnapshotManifest{
+		ClusterID:          s.ClusterID(),
+		ConfigurationIndex: s.ConfigurationIndex(),
+		CreatedAt:          time.Now(),
+	}
+	m.Host, _ = os.Hostname()
+	if v, ok := s.stateMachine.(SchemaVersioner); ok {
+		m.SchemaVersion = v.SchemaVersion()
+	}
+	return m
+}
+
+// Checks that a snapshot is compatible with this server before its state is
+// loaded. Snapshots without a manifest are accepted.
+func (s *server) validateSnapshotManifest(m *SnapshotManifest) error {
+	if m == nil {
+		return nil
+	}
+
+	if clusterID := s.ClusterID(); m.ClusterID != "" && clusterID != "" && m.ClusterID != clusterID {
+		return fmt.Errorf("raft: Snapshot belongs to cluster %s, not %s", m.ClusterID, clusterID)
+	}
+
+	if v, ok := s.stateMachine.(ManifestValidator); ok {
+		return v.ValidateManifest(m)
+	}
+	if v, ok := s.stateMachine.(SchemaVersioner); ok && m.SchemaVersion != v.SchemaVersion() {
+		return fmt.Errorf("raft: Snapshot schema version %q is not compatible with %q", m.SchemaVersion, v.SchemaVersion())
+	}
+	return nil
+}
+
+// Dispatches a snapshot failure event. peer is empty for local snapshots.
+func (s *server) dispatchSnapshotFailed(lastIndex uint64, lastTerm uint64, peer string, err error) {
+	s.DispatchEvent(newEvent(SnapshotFailedEventType, &SnapshotEventInfo{
+		LastIndex: lastIndex,
+		LastTerm:  lastTerm,
+		Peer:      peer,
+		Err:       err,
+	}, nil))
+}
+
 // Retrieves the log path for the server.
 func (s *server) SnapshotPath(lastIndex uint64, lastTerm uint64) string {
-	return path.Join(s.path, "snapshot", fmt.Sprintf("%v_%v.ss", lastTerm, lastIndex))
+	return path.Join(s.SnapshotDir(), fmt.Sprintf("%v_%v.ss", lastTerm, lastIndex))
 }
 
 func (s *server) RequestSnapshot(req *SnapshotRequest) *SnapshotResponse {
@@ -1300,6 +5922,16 @@ func (s *server) RequestSnapshot(req *SnapshotRequest) *SnapshotResponse {
 }
 
 func (s *server) processSnapshotRequest(req *SnapshotRequest) *SnapshotResponse {
+	if !s.acceptClusterID(req.ClusterID) {
+		s.debugln("server.snapshot.error: cluster id mismatch: ", req.ClusterID)
+		return newSnapshotResponse(false)
+	}
+
+	if s.denied(req.LeaderName, "") {
+		s.debugln("server.snapshot.error: denied peer: ", req.LeaderName)
+		return newSnapshotResponse(false)
+	}
+
 	// If the follower’s log contains an entry at the snapshot’s last index with a term
 	// that matches the snapshot’s last term, then the follower already has all the
 	// information found in the snapshot and can reply false.
@@ -1321,28 +5953,126 @@ func (s *server) SnapshotRecoveryRequest(req *SnapshotRecoveryRequest) *Snapshot
 	return resp
 }
 
+// Recovers the state machine from the state of the snapshot at index and
+// term, reporting progress to the recovery observers.
+func (s *server) recoverState(index uint64, term uint64, state []byte) error {
+	progress := RecoveryProgress{Index: index, Term: term, Total: int64(len(state))}
+	s.notifyRecoveryObservers(progress)
+
+	recoverer, ok := s.stateMachine.(StreamRecoverer)
+	if !ok {
+		if err := s.stateMachine.Recovery(state); err != nil {
+			return err
+		}
+		progress.Read = progress.Total
+		s.notifyRecoveryObservers(progress)
+		return nil
+	}
+
+	step := progress.Total / 100
+	if step == 0 {
+		step = 1
+	}
+	r := &progressReader{r: bytes.NewReader(state), step: step, report: func(read int64) {
+		progress.Read = read
+		s.notifyRecoveryObservers(progress)
+	}}
+	if err := recoverer.RecoverFrom(r, progress.Total); err != nil {
+		return err
+	}
+	if progress.Read != progress.Total {
+		progress.Read = progress.Total
+		s.notifyRecoveryObservers(progress)
+	}
+	return nil
+}
+
+// A reader that reports how much has been read from it, every step bytes
+// and once it has been read to the end.
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	reported int64
+	step     int64
+	report   func(read int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.read-r.reported >= r.step || (err == io.EOF && r.read != r.reported) {
+		r.reported = r.read
+		r.report(r.read)
+	}
+	return n, err
+}
+
 func (s *server) processSnapshotRecoveryRequest(req *SnapshotRecoveryRequest) *SnapshotRecoveryResponse {
-	// Recover state sent from request.
-	if err := s.stateMachine.Recovery(req.State); err != nil {
-		panic("cannot recover from previous state")
+	start := time.Now()
+
+	// Refuse snapshots that are not compatible with this server.
+	err := s.validateSnapshotManifest(req.Manifest)
+	if err == nil && !s.acceptClusterID(req.ClusterID) {
+		err = fmt.Errorf("raft: Snapshot belongs to cluster %s, not %s", req.ClusterID, s.ClusterID())
+	}
+	if err == nil && s.denied(req.LeaderName, "") {
+		err = DeniedPeerError
+	}
+	if err != nil {
+		s.debugln("server.snapshot.recovery.rejected: ", err)
+		s.dispatchSnapshotFailed(req.LastIndex, req.LastTerm, req.LeaderName, err)
+		s.setState(Follower)
+		return newSnapshotRecoveryResponse(s.currentTerm, false, s.log.CommitIndex())
+	}
+
+	// Recover state sent from request. Witnesses have no state machine.
+	if s.stateMachine != nil {
+		if err := s.recoverState(req.LastIndex, req.LastTerm, req.State); err != nil {
+			panic("cannot recover from previous state")
+		}
 	}
 
 	// Recover the cluster configuration.
 	s.peers = make(map[string]*Peer)
-	for _, peer := range req.Peers {
-		s.AddPeer(peer.Name, peer.ConnectionString)
+	s.restorePeers(req.Peers)
+	if req.Manifest != nil {
+		s.setConfigurationIndex(req.Manifest.ConfigurationIndex)
 	}
+	s.restoreSessions(req.Sessions, req.SessionOrder)
+	s.restoreIdempotencyKeys(req.IdempotencyKeys)
 
 	// Update log state.
 	s.currentTerm = req.LastTerm
 	s.log.updateCommitIndex(req.LastIndex)
+	s.notifyApplied()
 
 	// Create local snapshot.
-	s.pendingSnapshot = &Snapshot{req.LastIndex, req.LastTerm, req.Peers, req.State, s.SnapshotPath(req.LastIndex, req.LastTerm)}
+	s.pendingSnapshot = &Snapshot{
+		LastIndex: req.LastIndex,
+		LastTerm:  req.LastTerm,
+		Peers:     req.Peers,
+		State:     req.State,
+		Path:      s.SnapshotPath(req.LastIndex, req.LastTerm),
+		Manifest:  req.Manifest,
+		Sessions:  req.Sessions,
+	}
+	s.pendingSnapshot.SessionOrder = req.SessionOrder
+	s.pendingSnapshot.IdempotencyKeys = req.IdempotencyKeys
 	s.saveSnapshot()
 
 	// Clear the previous log entries.
 	s.log.compact(req.LastIndex, req.LastTerm)
+	if req.Manifest != nil {
+		s.truncateConfigurations(req.Manifest.ConfigurationIndex)
+	}
+
+	s.DispatchEvent(newEvent(SnapshotInstalledEventType, &SnapshotEventInfo{
+		LastIndex: req.LastIndex,
+		LastTerm:  req.LastTerm,
+		Size:      int64(len(req.State)),
+		Duration:  time.Now().Sub(start),
+		Peer:      req.LeaderName,
+	}, nil))
 
 	return newSnapshotRecoveryResponse(req.LastTerm, true, req.LastIndex)
 }
@@ -1350,7 +6080,7 @@ func (s *server) processSnapshotRecoveryRequest(req *SnapshotRecoveryRequest) *S
 // Load a snapshot at restart
 func (s *server) LoadSnapshot() error {
 	// Open snapshot/ directory.
-	dir, err := os.OpenFile(path.Join(s.path, "snapshot"), os.O_RDONLY, 0)
+	dir, err := os.OpenFile(s.SnapshotDir(), os.O_RDONLY, 0)
 	if err != nil {
 		s.debugln("cannot.open.snapshot: ", err)
 		return err
@@ -1364,6 +6094,19 @@ func (s *server) LoadSnapshot() error {
 	}
 	dir.Close()
 
+	// Only consider completed snapshots. Temporary files are left behind by a
+	// crash in the middle of a snapshot and are removed.
+	snapshots := filenames[:0]
+	for _, filename := range filenames {
+		if strings.HasSuffix(filename, snapshotTmpSuffix) {
+			s.debugln("remove.incomplete.snapshot: ", filename)
+			os.Remove(path.Join(s.SnapshotDir(), filename))
+		} else if strings.HasSuffix(filename, ".ss") {
+			snapshots = append(snapshots, filename)
+		}
+	}
+	filenames = snapshots
+
 	if len(filenames) == 0 {
 		s.debugln("no.snapshot.to.load")
 		return nil
@@ -1371,58 +6114,41 @@ func (s *server) LoadSnapshot() error {
 
 	// Grab the latest snapshot.
 	sort.Strings(filenames)
-	snapshotPath := path.Join(s.path, "snapshot", filenames[len(filenames)-1])
-
-	// Read snapshot data.
-	file, err := os.OpenFile(snapshotPath, os.O_RDONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Check checksum.
-	var checksum uint32
-	n, err := fmt.Fscanf(file, "%08x\n", &checksum)
-	if err != nil {
-		return err
-	} else if n != 1 {
-		return errors.New("checksum.err: bad.snapshot.file")
-	}
+	snapshotPath := path.Join(s.SnapshotDir(), filenames[len(filenames)-1])
 
-	// Load remaining snapshot contents.
-	b, err := ioutil.ReadAll(file)
+	// Read and decode snapshot data.
+	s.snapshot, _, err = readSnapshotFile(snapshotPath)
 	if err != nil {
+		s.debugln("read.snapshot.error: ", err)
 		return err
 	}
 
-	// Generate checksum.
-	byteChecksum := crc32.ChecksumIEEE(b)
-	if uint32(checksum) != byteChecksum {
-		s.debugln(checksum, " ", byteChecksum)
-		return errors.New("bad snapshot file")
-	}
-
-	// Decode snapshot.
-	if err = json.Unmarshal(b, &s.snapshot); err != nil {
-		s.debugln("unmarshal.snapshot.error: ", err)
+	if err = s.validateSnapshotManifest(s.snapshot.Manifest); err != nil {
+		s.debugln("validate.snapshot.error: ", err)
+		s.snapshot = nil
 		return err
 	}
 
 	// Recover snapshot into state machine.
-	if err = s.stateMachine.Recovery(s.snapshot.State); err != nil {
+	if err = s.recoverState(s.snapshot.LastIndex, s.snapshot.LastTerm, s.snapshot.State); err != nil {
 		s.debugln("recovery.snapshot.error: ", err)
 		return err
 	}
+	s.snapshot.State = nil
 
 	// Recover cluster configuration.
-	for _, peer := range s.snapshot.Peers {
-		s.AddPeer(peer.Name, peer.ConnectionString)
+	s.restorePeers(s.snapshot.Peers)
+	if s.snapshot.Manifest != nil {
+		s.setConfigurationIndex(s.snapshot.Manifest.ConfigurationIndex)
 	}
+	s.restoreSessions(s.snapshot.Sessions, s.snapshot.SessionOrder)
+	s.restoreIdempotencyKeys(s.snapshot.IdempotencyKeys)
 
 	// Update log state.
 	s.log.startTerm = s.snapshot.LastTerm
 	s.log.startIndex = s.snapshot.LastIndex
 	s.log.updateCommitIndex(s.snapshot.LastIndex)
+	s.notifyApplied()
 
 	return err
 }
@@ -1450,8 +6176,10 @@ func (s *server) writeConf() {
 	}
 
 	r := &Config{
-		CommitIndex: s.log.commitIndex,
-		Peers:       peers,
+		CommitIndex:        s.log.commitIndex,
+		ConfigurationIndex: s.ConfigurationIndex(),
+		ClusterID:          s.ClusterID(),
+		Peers:              peers,
 	}
 
 	b, _ := json.Marshal(r)
@@ -1487,7 +6215,95 @@ func (s *server) readConf() error {
 	}
 
 	s.log.updateCommitIndex(conf.CommitIndex)
+	s.setConfigurationIndex(conf.ConfigurationIndex)
+	if conf.ClusterID != "" {
+		s.SetClusterID(conf.ClusterID)
+	}
+
+	return nil
+}
+
+// Writes the denylist to file. The caller must hold deniedMutex.
+func (s *server) writeDeniedPeers() error {
+	b, _ := json.Marshal(s.DeniedPeers())
+
+	deniedPath := path.Join(s.path, "denied")
+	tmpDeniedPath := path.Join(s.path, "denied.tmp")
+	if err := writeFileSynced(tmpDeniedPath, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpDeniedPath, deniedPath)
+}
+
+// Reads the denylist from file.
+func (s *server) readDeniedPeers() error {
+	b, err := ioutil.ReadFile(path.Join(s.path, "denied"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var denied []string
+	if err := json.Unmarshal(b, &denied); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deniedPeers = make(map[string]bool, len(denied))
+	for _, nameOrAddress := range denied {
+		s.deniedPeers[nameOrAddress] = true
+	}
+	return nil
+}
+
+// The last vote cast by the server.
+type vote struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// Writes the current term and vote to file and syncs it.
+func (s *server) writeVote() error {
+	s.mutex.RLock()
+	b, _ := json.Marshal(&vote{Term: s.currentTerm, VotedFor: s.votedFor})
+	s.mutex.RUnlock()
+
+	votePath := path.Join(s.path, "vote")
+	tmpVotePath := path.Join(s.path, "vote.tmp")
+	if err := writeFileSynced(tmpVotePath, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpVotePath, votePath); err != nil {
+		return err
+	}
+	return syncDir(s.path)
+}
+
+// Reads the last vote from file. A vote in a later term than the log's takes
+// the server to that term.
+func (s *server) readVote() error {
+	b, err := ioutil.ReadFile(path.Join(s.path, "vote"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	v := &vote{}
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v.Term > s.currentTerm {
+		s.currentTerm = v.Term
+	}
+	if v.Term == s.currentTerm {
+		s.votedFor = v.VotedFor
+	}
 	return nil
 }
 
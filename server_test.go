@@ -2,10 +2,18 @@ package raft
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -102,6 +110,174 @@ func TestServerRequestVoteApprovedIfAlreadyVotedInOlderTerm(t *testing.T) {
 	}
 }
 
+// Ensure that a granted vote survives a crash, so that the server does not
+// vote for another candidate in the same term after it restarts.
+func TestServerRequestVoteIsDurable(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	if resp := s.RequestVote(newRequestVoteRequest(2, "foo", 0, 0)); !resp.VoteGranted {
+		t.Fatalf("First vote should not have been denied")
+	}
+
+	// Start a second server on the same path without stopping the first, as
+	// if the first had crashed straight after replying.
+	restarted, _ := NewServer("1", s.Path(), &testTransporter{}, nil, nil, "")
+	if err := restarted.Init(); err != nil {
+		t.Fatalf("Unable to init: %v", err)
+	}
+	s.Stop()
+	if restarted.Term() != 2 || restarted.VotedFor() != "foo" {
+		t.Fatalf("Vote should have been restored: %d %s", restarted.Term(), restarted.VotedFor())
+	}
+
+	restarted.Start()
+	defer restarted.Stop()
+	if resp := restarted.RequestVote(newRequestVoteRequest(2, "bar", 0, 0)); resp.VoteGranted {
+		t.Fatalf("Second vote in the same term should have been denied")
+	}
+}
+
+// A vote policy that only votes for candidates in one zone.
+type zoneVotePolicy struct {
+	zone string
+}
+
+func (p *zoneVotePolicy) AllowVote(candidate *Peer, req *RequestVoteRequest) bool {
+	return candidate != nil && candidate.Metadata[ZoneMetadataKey] == p.zone
+}
+
+// Ensure that the vote policy can refuse votes Raft would grant.
+func TestServerRequestVoteDeniedByPolicy(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetElectionTimeout(time.Hour)
+	s.AddPeer("2", "")
+	s.SetPeerMetadata("2", map[string]string{ZoneMetadataKey: "b"})
+	s.AddPeer("3", "")
+	s.SetPeerMetadata("3", map[string]string{ZoneMetadataKey: "a"})
+	s.SetVotePolicy(&zoneVotePolicy{zone: "a"})
+	s.Start()
+	defer s.Stop()
+
+	if resp := s.RequestVote(newRequestVoteRequest(2, "foo", 0, 0)); resp.VoteGranted {
+		t.Fatalf("Vote for an unknown candidate should have been denied")
+	}
+	if resp := s.RequestVote(newRequestVoteRequest(2, "2", 0, 0)); resp.VoteGranted {
+		t.Fatalf("Vote for a candidate in another zone should have been denied")
+	}
+	if resp := s.RequestVote(newRequestVoteRequest(2, "3", 0, 0)); !resp.VoteGranted || s.VotedFor() != "3" {
+		t.Fatalf("Vote for a candidate in the zone should have been granted")
+	}
+}
+
+// Ensure that a vote that cannot be persisted is denied without forgetting
+// the vote already cast in the term.
+func TestServerRequestVoteNotPersisted(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetElectionTimeout(time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	if resp := s.RequestVote(newRequestVoteRequest(2, "foo", 0, 0)); !resp.VoteGranted {
+		t.Fatalf("Vote should have been granted")
+	}
+
+	// A directory in place of the temporary vote file makes writes fail.
+	tmpVotePath := path.Join(s.Path(), "vote.tmp")
+	if err := os.Mkdir(tmpVotePath, 0700); err != nil {
+		t.Fatalf("Unable to block the vote file: %v", err)
+	}
+	if resp := s.RequestVote(newRequestVoteRequest(2, "foo", 0, 0)); resp.VoteGranted {
+		t.Fatalf("Vote should be denied when it cannot be persisted")
+	}
+	if s.VotedFor() != "foo" {
+		t.Fatalf("Previous vote should be kept: %q", s.VotedFor())
+	}
+
+	os.Remove(tmpVotePath)
+	if resp := s.RequestVote(newRequestVoteRequest(2, "bar", 0, 0)); resp.VoteGranted {
+		t.Fatalf("Second vote in the term should have been denied")
+	}
+}
+
+// Ensure that a follower in contact with its leader ignores vote requests.
+func TestServerRequestVoteDeniedIfLeaderInContact(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	resp := s.RequestVote(newRequestVoteRequest(2, "foo", 0, 0))
+	if resp.VoteGranted || s.Term() != 1 {
+		t.Fatalf("Vote should be denied while the leader is in contact: %v %d", resp.VoteGranted, s.Term())
+	}
+
+	req := newRequestVoteRequest(2, "foo", 0, 0)
+	req.Transfer = true
+	if resp := s.RequestVote(req); !resp.VoteGranted {
+		t.Fatalf("Vote should be granted to a candidate the leader handed over to")
+	}
+}
+
+// Ensure that a leader checking the quorum ignores vote requests while it is
+// in contact with one.
+func TestServerRequestVoteDeniedIfLeaderHasQuorum(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetCheckQuorum(true)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	term := s.Term()
+	resp := s.RequestVote(newRequestVoteRequest(term+1, "2", 100, term))
+	if resp.VoteGranted || s.Term() != term || s.State() != Leader {
+		t.Fatalf("Vote should be denied while the leader has a quorum: %v %d %s", resp.VoteGranted, s.Term(), s.State())
+	}
+
+	s.SetCheckQuorum(false)
+	if resp := s.RequestVote(newRequestVoteRequest(term+1, "2", 100, term)); !resp.VoteGranted || s.Term() != term+1 {
+		t.Fatalf("Vote should be granted without the quorum check: %v %d", resp.VoteGranted, s.Term())
+	}
+}
+
+// Ensure that vote requests from removed peers are ignored.
+func TestServerRequestVoteDeniedIfRemoved(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if _, err := s.Do(&DefaultLeaveCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to remove peer: %v", err)
+	}
+
+	term := s.Term()
+	resp := s.RequestVote(newRequestVoteRequest(term+1, "2", 100, term))
+	if resp.VoteGranted || s.Term() != term || s.State() != Leader {
+		t.Fatalf("Removed peer should not disrupt the leader: %v %d %s", resp.VoteGranted, s.Term(), s.State())
+	}
+}
+
 // Ensure that a vote request is denied if the log is out of date.
 func TestServerRequestVoteDenyIfCandidateLogIsBehind(t *testing.T) {
 	tmpLog := newLog()
@@ -180,10 +356,187 @@ func TestProcessVoteResponse(t *testing.T) {
 
 }
 
+// Ensure that requests from another cluster are rejected and that a server
+// without a cluster ID adopts the first one it is sent.
+func TestServerClusterID(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Server %s unable to join: %v", s.Name(), err)
+	}
+	id := s.ClusterID()
+	if id == "" {
+		t.Fatalf("Bootstrapped server should have a cluster ID")
+	}
+
+	term := s.Term()
+	req := newRequestVoteRequest(term+1, "foo", 2, 1)
+	req.ClusterID = "other"
+	if resp := s.RequestVote(req); resp.VoteGranted || s.Term() != term {
+		t.Fatalf("Vote from another cluster should be ignored: %v/%v", resp.VoteGranted, s.Term())
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", ClusterID: "other"}); err == nil {
+		t.Fatalf("Join from another cluster should be refused")
+	}
+
+	follower := newTestServer("2", &testTransporter{})
+	follower.Start()
+	defer follower.Stop()
+	ae := newAppendEntriesRequest(1, 0, 0, 0, "1", nil)
+	ae.ClusterID = id
+	if resp := follower.AppendEntries(ae); !resp.Success() || follower.ClusterID() != id {
+		t.Fatalf("Follower should adopt the cluster ID: %v/%v", resp.Success(), follower.ClusterID())
+	}
+	ae = newAppendEntriesRequest(2, 0, 0, 0, "3", nil)
+	ae.ClusterID = "other"
+	if resp := follower.AppendEntries(ae); resp.Success() || follower.Term() != 1 {
+		t.Fatalf("Entries from another cluster should be rejected: %v/%v", resp.Success(), follower.Term())
+	}
+}
+
 // //--------------------------------------
 // // Promotion
 // //--------------------------------------
 
+// Ensure that bootstrapping writes the initial configuration on one server
+// and replicates it to the rest.
+func TestServerBootstrap(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return lookup[peer.Name].RequestVote(req)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	var servers []Server
+	for _, name := range []string{"1", "2", "3"} {
+		s := newTestServer(name, transporter)
+		s.SetHeartbeatInterval(testHeartbeatInterval)
+		s.SetElectionTimeout(testElectionTimeout)
+		s.Start()
+		defer s.Stop()
+		lookup[name] = s
+		servers = append(servers, s)
+	}
+
+	if err := servers[0].Bootstrap([]*Peer{{Name: "2"}, {Name: "3"}}); err == nil {
+		t.Fatalf("Bootstrap without the local server should fail")
+	}
+	if err := servers[0].Bootstrap([]*Peer{{Name: "1"}, {Name: "2"}, {Name: "3"}}); err != nil {
+		t.Fatalf("Unable to bootstrap: %v", err)
+	}
+	if err := servers[0].Bootstrap([]*Peer{{Name: "1"}}); err != AlreadyBootstrappedError {
+		t.Fatalf("Second bootstrap should fail: %v", err)
+	}
+
+	time.Sleep(5 * testHeartbeatInterval)
+
+	for _, s := range servers {
+		if len(s.Peers()) != 2 {
+			t.Fatalf("Server %s has invalid peers: %v", s.Name(), s.Peers())
+		}
+		if s.ClusterID() == "" || s.ClusterID() != servers[0].ClusterID() {
+			t.Fatalf("Server %s has invalid cluster ID: %s", s.Name(), s.ClusterID())
+		}
+	}
+	if servers[0].State() != Leader {
+		t.Fatalf("Bootstrapped server should lead: %v", servers[0].State())
+	}
+}
+
+// Ensure that the leader removes a peer that stays unreachable.
+func TestServerRemoveDeadPeer(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		if lookup[peer.Name] == nil {
+			return nil
+		}
+		return lookup[peer.Name].RequestVote(req)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		if lookup[peer.Name] == nil {
+			return nil
+		}
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	var servers []Server
+	for _, name := range []string{"1", "2"} {
+		s := newTestServer(name, transporter)
+		s.SetHeartbeatInterval(testHeartbeatInterval)
+		s.SetElectionTimeout(testElectionTimeout)
+		s.Start()
+		defer s.Stop()
+		lookup[name] = s
+		servers = append(servers, s)
+	}
+	leader := servers[0]
+	leader.SetDeadPeerTimeout(5 * testHeartbeatInterval)
+	dead := make(chan string, 1)
+	leader.AddEventListener(DeadPeerEventType, func(e Event) {
+		dead <- e.Value().(string)
+	})
+
+	if err := leader.Bootstrap([]*Peer{{Name: "1"}, {Name: "2"}, {Name: "3"}}); err != nil {
+		t.Fatalf("Unable to bootstrap: %v", err)
+	}
+
+	select {
+	case name := <-dead:
+		if name != "3" {
+			t.Fatalf("Unexpected dead peer: %s", name)
+		}
+	case <-time.After(20 * testHeartbeatInterval):
+		t.Fatalf("Dead peer was not detected")
+	}
+	time.Sleep(5 * testHeartbeatInterval)
+
+	for _, s := range servers {
+		if _, ok := s.Peers()["3"]; ok || len(s.Peers()) != 1 {
+			t.Fatalf("Server %s should have removed the dead peer: %v", s.Name(), s.Peers())
+		}
+	}
+}
+
+// Ensure that a peer that is removed is not also reported dead.
+func TestServerRemovePeerNotDead(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(testHeartbeatInterval)
+	s.SetDeadPeerTimeout(time.Hour)
+	dead := make(chan string, 1)
+	s.AddEventListener(DeadPeerEventType, func(e Event) {
+		select {
+		case dead <- e.Value().(string):
+		default:
+		}
+	})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	if _, err := s.Do(&DefaultLeaveCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to remove peer: %v", err)
+	}
+	select {
+	case name := <-dead:
+		t.Fatalf("Removed peer %s should not be reported dead", name)
+	case <-time.After(5 * testHeartbeatInterval):
+	}
+}
+
 // // Ensure that we can self-promote a server to candidate, obtain votes and become a fearless leader.
 func TestServerPromoteSelf(t *testing.T) {
 	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
@@ -226,6 +579,3302 @@ func TestServerPromote(t *testing.T) {
 	}
 }
 
+// Ensure that a learner never campaigns and never grants its vote.
+func TestServerLearnerDoesNotVote(t *testing.T) {
+	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
+	s := newTestServerWithLog("1", &testTransporter{}, []*LogEntry{e0})
+	if err := s.SetPeerRole(s.Name(), LearnerRole); err != nil {
+		t.Fatalf("Unable to set role: %v", err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	time.Sleep(2 * testElectionTimeout)
+
+	if s.State() != Follower {
+		t.Fatalf("Learner should not campaign: %v", s.State())
+	}
+	resp := s.RequestVote(newRequestVoteRequest(2, "foo", 1, 1))
+	if resp.VoteGranted {
+		t.Fatalf("Learner should not grant votes")
+	}
+}
+
+// Ensure that peer metadata is replicated with the join command.
+func TestServerPeerMetadata(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1", Metadata: map[string]string{"zone": "a"}}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", Metadata: map[string]string{"zone": "b"}}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if s.Metadata()["zone"] != "a" {
+		t.Fatalf("Invalid local metadata: %v", s.Metadata())
+	}
+	peers := s.Peers()
+	if peers["2"] == nil || peers["2"].Metadata["zone"] != "b" {
+		t.Fatalf("Invalid peer metadata: %v", peers["2"])
+	}
+
+	peers["2"].Metadata["zone"] = "c"
+	if s.Peers()["2"].Metadata["zone"] != "b" {
+		t.Fatalf("Peers should return a copy of the metadata")
+	}
+}
+
+// Ensure that a member's address can be changed through the log.
+func TestServerChangePeerAddress(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", ConnectionString: "http://old:4001", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if _, err := s.Do(&DefaultChangePeerAddressCommand{Name: "2", ConnectionString: "http://new:4001"}); err != nil {
+		t.Fatalf("Unable to change address: %v", err)
+	}
+	if peer := s.Peers()["2"]; peer == nil || peer.ConnectionString != "http://new:4001" {
+		t.Fatalf("Invalid peer address: %v", peer)
+	}
+
+	if _, err := s.Do(&DefaultChangePeerAddressCommand{Name: "3", ConnectionString: "http://new:4001"}); err == nil {
+		t.Fatalf("Expected error changing the address of an unknown peer")
+	}
+}
+
+// Ensure that a member rejoining from a new address has its address changed.
+func TestServerRejoinWithNewAddress(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", ConnectionString: "http://old:4001", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", ConnectionString: "http://new:4001", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to rejoin peer: %v", err)
+	}
+	peer := s.Peers()["2"]
+	if peer == nil || peer.ConnectionString != "http://new:4001" || peer.Role != LearnerRole {
+		t.Fatalf("Invalid peer after rejoin: %v", peer)
+	}
+}
+
+// Ensure that denied peers cannot send RPCs or join.
+func TestServerDenyPeer(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if err := s.DenyPeer("ldr"); err != nil {
+		t.Fatalf("Unable to deny peer: %v", err)
+	}
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", nil)); resp.Success() || s.Term() != 0 {
+		t.Fatalf("AppendEntries from a denied peer should be rejected")
+	}
+	if resp := s.RequestVote(newRequestVoteRequest(1, "ldr", 0, 0)); resp.VoteGranted {
+		t.Fatalf("Vote requests from a denied peer should be rejected")
+	}
+	s.AllowPeer("ldr")
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries from an allowed peer should succeed")
+	}
+
+	s = newTestServer("2", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	s.DenyPeer("http://bad:4001")
+	if _, err := s.Do(&DefaultJoinCommand{Name: "3", ConnectionString: "http://bad:4001"}); err != DeniedPeerError {
+		t.Fatalf("Expected DeniedPeerError, got %v", err)
+	}
+	if denied := s.DeniedPeers(); len(denied) != 1 || denied[0] != "http://bad:4001" {
+		t.Fatalf("Invalid denied peers: %v", denied)
+	}
+
+	// The denylist is kept across restarts.
+	s.Stop()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to restart: %v", err)
+	}
+	if len(s.DeniedPeers()) != 1 {
+		t.Fatalf("Denylist should be persisted: %v", s.DeniedPeers())
+	}
+
+	// Concurrent changes are all written.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.DenyPeer(fmt.Sprintf("peer%d", i))
+		}(i)
+	}
+	wg.Wait()
+	b, err := ioutil.ReadFile(path.Join(s.Path(), "denied"))
+	var denied []string
+	if err != nil || json.Unmarshal(b, &denied) != nil || len(denied) != 21 {
+		t.Fatalf("Invalid persisted denylist: %v %v", denied, err)
+	}
+}
+
+// Ensure that the server keeps a queryable history of configurations.
+func TestServerConfigurationHistory(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	history := s.ConfigurationHistory()
+	if len(history) != 2 || history[0].Command != "raft:join" || history[1].Index <= history[0].Index {
+		t.Fatalf("Invalid configuration history: %+v", history)
+	}
+	if peers := s.ConfigurationAt(history[0].Index); len(peers) != 1 || peers[0].Name != "1" {
+		t.Fatalf("Invalid configuration at %d: %v", history[0].Index, peers)
+	}
+	if peers := s.ConfigurationAt(history[1].Index + 1); len(peers) != 2 {
+		t.Fatalf("Invalid configuration at %d: %v", history[1].Index+1, peers)
+	}
+	if peers := s.ConfigurationAt(0); peers != nil {
+		t.Fatalf("Expected no configuration before the history: %v", peers)
+	}
+
+	// The history is kept across restarts without duplicating replayed entries.
+	s.Stop()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to restart: %v", err)
+	}
+	if restored := s.ConfigurationHistory(); len(restored) != 2 || restored[1].Index != history[1].Index {
+		t.Fatalf("Configuration history should be persisted: %+v", restored)
+	}
+}
+
+// Ensure that a demoted voter is removed once it has become a learner.
+func TestServerDemoteAndRemove(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+
+	for _, name := range []string{"1", "2", "3"} {
+		if _, err := s.Do(&DefaultJoinCommand{Name: name}); err != nil {
+			t.Fatalf("Unable to join %s: %v", name, err)
+		}
+	}
+
+	removed := make(chan bool, 1)
+	s.AddEventListener(ConfigurationChangeEventType, func(e Event) {
+		if e.Value().(*ConfigurationChangeEventInfo).Command == "raft:leave" {
+			removed <- true
+		}
+	})
+	if _, err := s.Do(&DefaultDemoteCommand{Name: "3", Remove: true}); err != nil {
+		t.Fatalf("Unable to demote peer: %v", err)
+	}
+	select {
+	case <-removed:
+		if _, ok := s.Peers()["3"]; ok {
+			t.Fatalf("Demoted peer should be removed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Demoted peer was not removed")
+	}
+
+	history := s.ConfigurationHistory()
+	if n := len(history); n < 2 || history[n-2].Command != "raft:demote" || history[n-1].Command != "raft:leave" {
+		t.Fatalf("Peer should be demoted before it is removed: %+v", history)
+	}
+
+	if _, err := s.Do(&DefaultDemoteCommand{Name: "1"}); err != DemoteLeaderError {
+		t.Fatalf("Expected DemoteLeaderError, got %v", err)
+	}
+}
+
+// Ensure that AddMember waits for the new member to catch up.
+func TestServerAddMember(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := false
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+
+	if err := s.AddMember(gocontext.Background(), &DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 5*testHeartbeatInterval)
+	defer cancel()
+	if err := s.AddMember(ctx, &DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected AddMember to time out, got %v", err)
+	}
+
+	mutex.Lock()
+	reachable = true
+	mutex.Unlock()
+	ctx, cancel = gocontext.WithTimeout(gocontext.Background(), time.Second)
+	defer cancel()
+	if err := s.AddMember(ctx, &DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to add member: %v", err)
+	}
+}
+
+// Ensure that a static membership is configured on start and cannot change.
+func TestServerStaticMembership(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	if err := s.SetStaticPeers([]*Peer{{Name: "2"}}); err == nil {
+		t.Fatalf("Static peers must include the server")
+	}
+	if err := s.SetStaticPeers([]*Peer{{Name: "1"}, {Name: "2", Role: LearnerRole}}); err != nil {
+		t.Fatalf("Unable to set static peers: %v", err)
+	}
+	s.Start()
+	defer s.Stop()
+
+	if peer := s.Peers()["2"]; peer == nil || peer.Voting() {
+		t.Fatalf("Static peers should be configured on start: %v", s.Peers())
+	}
+	for i := 0; s.State() != Leader; i++ {
+		if i == 20 {
+			t.Fatalf("Server with an empty log should elect itself: %s", s.State())
+		}
+		time.Sleep(testElectionTimeout)
+	}
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "3"}); err != StaticMembershipError {
+		t.Fatalf("Expected StaticMembershipError, got %v", err)
+	}
+	if _, err := s.Do(&DefaultLeaveCommand{Name: "2"}); err != StaticMembershipError {
+		t.Fatalf("Expected StaticMembershipError, got %v", err)
+	}
+	if _, err := s.Do(&testCommand1{}); err != nil {
+		t.Fatalf("Unable to apply command: %v", err)
+	}
+}
+
+// Ensure that the leader detects the loss of its quorum and can refuse writes
+// until it is restored.
+func TestServerQuorumLoss(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := false
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetQuorumLossTimeout(3 * testHeartbeatInterval)
+	s.SetRejectWritesOnQuorumLoss(true)
+	s.Start()
+	defer s.Stop()
+
+	events := make(chan string, 2)
+	s.AddEventListener(QuorumLostEventType, func(e Event) { events <- e.Type() })
+	s.AddEventListener(QuorumRestoredEventType, func(e Event) { events <- e.Type() })
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	select {
+	case typ := <-events:
+		if typ != QuorumLostEventType || !s.QuorumLost() {
+			t.Fatalf("Expected quorum loss, got %s", typ)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Quorum loss was not detected")
+	}
+	if _, err := s.Do(&testCommand1{}); err != NoQuorumError {
+		t.Fatalf("Expected NoQuorumError, got %v", err)
+	}
+
+	mutex.Lock()
+	reachable = true
+	mutex.Unlock()
+	select {
+	case typ := <-events:
+		if typ != QuorumRestoredEventType || s.QuorumLost() {
+			t.Fatalf("Expected quorum to be restored, got %s", typ)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Quorum was not restored")
+	}
+	if _, err := s.Do(&testCommand1{}); err != nil {
+		t.Fatalf("Unable to apply command: %v", err)
+	}
+}
+
+// Ensure that a server which lost its quorum can be forced into a new
+// cluster of its own, and that the reset is recorded in the log.
+func TestServerForceNewCluster(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return nil
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	for _, name := range []string{"1", "2"} {
+		if _, err := s.Do(&DefaultJoinCommand{Name: name}); err != nil {
+			t.Fatalf("Unable to join %s: %v", name, err)
+		}
+	}
+	s.Stop()
+
+	s, _ = NewServer("1", s.Path(), transporter, nil, nil, "")
+	recorded := make(chan bool, 1)
+	s.AddEventListener(ConfigurationChangeEventType, func(e Event) {
+		if e.Value().(*ConfigurationChangeEventInfo).Command == "raft:forceNewCluster" {
+			recorded <- true
+		}
+	})
+	if err := s.ForceNewCluster(); err != nil {
+		t.Fatalf("Unable to force a new cluster: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to restart: %v", err)
+	}
+	defer s.Stop()
+
+	if len(s.Peers()) != 0 {
+		t.Fatalf("Other members should be removed: %v", s.Peers())
+	}
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatalf("Forced new cluster was not recorded in the log")
+	}
+	if _, err := s.Do(&testCommand1{}); err != nil {
+		t.Fatalf("Unable to apply command: %v", err)
+	}
+}
+
+// Ensure that peer observers see every change to the membership.
+func TestServerPeerObserver(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	var mutex sync.Mutex
+	var changes []PeerChange
+	s.RegisterPeerObserver(func(change PeerChange) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if change.Name == "2" {
+			changes = append(changes, change)
+		}
+	})
+	s.Start()
+	defer s.Stop()
+
+	commands := []Command{
+		&DefaultJoinCommand{Name: "1"},
+		&DefaultJoinCommand{Name: "2", ConnectionString: "http://2:4001", Role: LearnerRole},
+		&DefaultPromoteCommand{Name: "2"},
+		&DefaultChangePeerAddressCommand{Name: "2", ConnectionString: "http://2:4002"},
+		&DefaultLeaveCommand{Name: "2"},
+	}
+	for _, command := range commands {
+		if _, err := s.Do(command); err != nil {
+			t.Fatalf("Unable to apply %s: %v", command.CommandName(), err)
+		}
+	}
+
+	expected := []PeerChange{
+		{Type: PeerAdded, Name: "2", ConnectionString: "http://2:4001", Role: VoterRole},
+		{Type: PeerRoleChanged, Name: "2", ConnectionString: "http://2:4001", Role: LearnerRole},
+		{Type: PeerRoleChanged, Name: "2", ConnectionString: "http://2:4001", Role: VoterRole},
+		{Type: PeerAddressChanged, Name: "2", ConnectionString: "http://2:4002", Role: VoterRole},
+		{Type: PeerRemoved, Name: "2", ConnectionString: "http://2:4002", Role: VoterRole},
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(changes) != len(expected) {
+		t.Fatalf("Invalid peer changes: %+v", changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("Invalid peer change %d: %+v", i, changes[i])
+		}
+	}
+}
+
+// Ensure that the leader holds a lease while a quorum acknowledges its
+// heartbeats, and loses it once they stop.
+func TestServerLeaderLease(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	time.Sleep(2 * testHeartbeatInterval)
+
+	if until := s.LeaseValidUntil(); !until.After(time.Now()) {
+		t.Fatalf("Leader should hold a lease: %v", until)
+	}
+	value, err := s.ReadUnderLease(func() (interface{}, error) { return "foo", nil })
+	if err != nil || value != "foo" {
+		t.Fatalf("Unable to read under lease: %v %v", value, err)
+	}
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	time.Sleep(s.ElectionTimeout() + 2*testHeartbeatInterval)
+
+	if _, err := s.ReadUnderLease(func() (interface{}, error) { return "foo", nil }); err != LeaseExpiredError {
+		t.Fatalf("Expected LeaseExpiredError, got %v", err)
+	}
+}
+
+// Ensure that the leader drops its lease when its timeouts change, and only
+// holds one again once heartbeats sent since have been acknowledged.
+func TestServerLeaderLeaseTimeoutsChanged(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	time.Sleep(2 * testHeartbeatInterval)
+	if until := s.LeaseValidUntil(); !until.After(time.Now()) {
+		t.Fatalf("Leader should hold a lease: %v", until)
+	}
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	if err := s.SetTimeouts(s.ElectionTimeout(), testHeartbeatInterval); err != nil {
+		t.Fatalf("Unable to set timeouts: %v", err)
+	}
+	time.Sleep(2 * testHeartbeatInterval)
+	if _, err := s.ReadUnderLease(func() (interface{}, error) { return "foo", nil }); err != LeaseExpiredError {
+		t.Fatalf("Expected LeaseExpiredError, got %v", err)
+	}
+
+	mutex.Lock()
+	reachable = true
+	mutex.Unlock()
+	time.Sleep(2 * testHeartbeatInterval)
+	if until := s.LeaseValidUntil(); !until.After(time.Now()) {
+		t.Fatalf("Leader should hold a lease again: %v", until)
+	}
+}
+
+// Ensure that an isolated leader steps down when CheckQuorum is enabled.
+func TestServerCheckQuorum(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return nil
+	}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return nil
+	}
+	s := newTestServer("1", transporter)
+	s.SetCheckQuorum(true)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	time.Sleep(s.ElectionTimeout() + 2*testHeartbeatInterval)
+	if state := s.State(); state == Leader {
+		t.Fatalf("Isolated leader should step down")
+	}
+	if leader := s.Leader(); leader == s.Name() {
+		t.Fatalf("Isolated leader should not believe it is leader")
+	}
+}
+
+// Ensure that members with a lower priority wait longer before they stand
+// for election.
+func TestServerElectionPriority(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+	if delay := s.electionDelay(); delay != 0 {
+		t.Fatalf("Members without priorities should not wait: %v", delay)
+	}
+
+	s.AddPeer("2", "")
+	s.SetPeerMetadata("2", map[string]string{PriorityMetadataKey: "10"})
+	s.SetPeerMetadata("1", map[string]string{PriorityMetadataKey: "5"})
+	if delay := s.electionDelay(); delay != s.ElectionTimeout()/2 {
+		t.Fatalf("Invalid election delay: %v", delay)
+	}
+
+	s.SetPeerRole("2", LearnerRole)
+	if delay := s.electionDelay(); delay != 0 {
+		t.Fatalf("Learners should not delay the highest priority member: %v", delay)
+	}
+}
+
+// Ensure that followers in secondary zones wait longer before they stand
+// for election.
+func TestServerSecondaryZones(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+	s.SetElectionJitter(0)
+	s.SetPeerMetadata("1", map[string]string{ZoneMetadataKey: "b"})
+	if timeout := s.followerElectionTimeout(); timeout != s.ElectionTimeout() {
+		t.Fatalf("Invalid election timeout: %v", timeout)
+	}
+
+	s.SetSecondaryZones([]string{"b", "c"})
+	if zones := s.SecondaryZones(); len(zones) != 2 || zones[0] != "b" || zones[1] != "c" {
+		t.Fatalf("Invalid secondary zones: %v", zones)
+	}
+	if timeout := s.followerElectionTimeout(); timeout != s.ElectionTimeout()*DefaultSecondaryZoneMultiplier {
+		t.Fatalf("Invalid election timeout in a secondary zone: %v", timeout)
+	}
+	if err := s.SetSecondaryZoneMultiplier(0.5); err != InvalidSecondaryZoneMultiplierError {
+		t.Fatalf("Expected InvalidSecondaryZoneMultiplierError, got %v", err)
+	}
+	if err := s.SetSecondaryZoneMultiplier(3); err != nil {
+		t.Fatalf("Unable to set multiplier: %v", err)
+	}
+	if timeout := s.followerElectionTimeout(); timeout != s.ElectionTimeout()*3 {
+		t.Fatalf("Invalid election timeout in a secondary zone: %v", timeout)
+	}
+
+	s.SetPeerMetadata("1", map[string]string{ZoneMetadataKey: "a"})
+	if timeout := s.followerElectionTimeout(); timeout != s.ElectionTimeout() {
+		t.Fatalf("Invalid election timeout in a primary zone: %v", timeout)
+	}
+}
+
+// Ensure that the timeouts can be changed on a running server and that
+// running peer heartbeats pick up the new interval.
+func TestServerSetTimeouts(t *testing.T) {
+	var mutex sync.Mutex
+	sent := 0
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		sent++
+		mutex.Unlock()
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	if err := s.SetTimeouts(testElectionTimeout, 0); err != InvalidTimeoutsError {
+		t.Fatalf("Expected InvalidTimeoutsError, got %v", err)
+	}
+	if err := s.SetTimeouts(testElectionTimeout, testElectionTimeout/2); err != InvalidTimeoutsError {
+		t.Fatalf("Expected InvalidTimeoutsError, got %v", err)
+	}
+	if s.HeartbeatInterval() != time.Hour {
+		t.Fatalf("Invalid timeouts should not be applied: %v", s.HeartbeatInterval())
+	}
+
+	time.Sleep(testHeartbeatInterval)
+	mutex.Lock()
+	sent = 0
+	mutex.Unlock()
+
+	if err := s.SetTimeouts(2*testElectionTimeout, 10*time.Millisecond); err != nil {
+		t.Fatalf("Unable to set timeouts: %v", err)
+	}
+	if s.ElectionTimeout() != 2*testElectionTimeout || s.HeartbeatInterval() != 10*time.Millisecond {
+		t.Fatalf("Unexpected timeouts: %v %v", s.ElectionTimeout(), s.HeartbeatInterval())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if sent < 3 {
+		t.Fatalf("Expected the peer heartbeat to use the new interval, got %d sends", sent)
+	}
+}
+
+// Ensure that Campaign starts an election without waiting for the election
+// timeout and that learners cannot campaign.
+func TestServerCampaign(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return newRequestVoteResponse(req.Term, true)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
+	s := newTestServerWithLog("1", transporter, []*LogEntry{e0})
+	s.SetElectionTimeout(time.Hour)
+	if err := s.AddPeer("2", ""); err != nil {
+		t.Fatalf("Unable to add peer: %v", err)
+	}
+	s.Start()
+	defer s.Stop()
+
+	if err := s.Campaign(); err != nil {
+		t.Fatalf("Unable to campaign: %v", err)
+	}
+	time.Sleep(testHeartbeatInterval)
+	if s.State() != Leader {
+		t.Fatalf("Server should have won the election: %v", s.State())
+	}
+	if err := s.Campaign(); err != nil {
+		t.Fatalf("Campaign on the leader should succeed: %v", err)
+	}
+
+	l := newTestServerWithLog("2", &testTransporter{}, []*LogEntry{e0})
+	if err := l.SetPeerRole(l.Name(), LearnerRole); err != nil {
+		t.Fatalf("Unable to set role: %v", err)
+	}
+	l.Start()
+	defer l.Stop()
+
+	if err := l.Campaign(); err != NotPromotableError {
+		t.Fatalf("Expected NotPromotableError, got %v", err)
+	}
+}
+
+// Ensure that a leader can step down without a membership change and hands
+// leadership to a peer.
+func TestServerStepDown(t *testing.T) {
+	var mutex sync.Mutex
+	timeoutNow := false
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if req.TimeoutNow {
+			timeoutNow = true
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return nil
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if _, err := s.Do(&testCommand1{Val: "foo", I: 10}); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	members := s.MemberCount()
+
+	if err := s.StepDown(); err != nil {
+		t.Fatalf("Unable to step down: %v", err)
+	}
+	if s.State() != Follower {
+		t.Fatalf("Server should be a follower: %v", s.State())
+	}
+	if s.MemberCount() != members {
+		t.Fatalf("Stepping down should not change the membership: %d", s.MemberCount())
+	}
+	if _, err := s.Do(&testCommand1{Val: "bar", I: 20}); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+	if err := s.StepDown(); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+
+	time.Sleep(testHeartbeatInterval)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !timeoutNow {
+		t.Fatalf("Leadership should have been handed to the peer")
+	}
+}
+
+// Ensure that election timeouts are drawn from a seeded generator within the
+// configured spread.
+func TestServerElectionJitter(t *testing.T) {
+	s1 := newTestServer("1", &testTransporter{}).(*server)
+	s2 := newTestServer("2", &testTransporter{}).(*server)
+	s1.SetElectionSeed(42)
+	s2.SetElectionSeed(42)
+	if s1.ElectionSeed() != 42 {
+		t.Fatalf("Invalid seed: %d", s1.ElectionSeed())
+	}
+	for i := 0; i < 10; i++ {
+		if d1, d2 := s1.randomElectionTimeout(), s2.randomElectionTimeout(); d1 != d2 {
+			t.Fatalf("Servers with the same seed should draw the same timeouts: %v %v", d1, d2)
+		}
+	}
+
+	if err := s1.SetElectionJitter(-1); err != InvalidElectionJitterError {
+		t.Fatalf("Expected InvalidElectionJitterError, got %v", err)
+	}
+	if err := s1.SetElectionJitter(0.5); err != nil {
+		t.Fatalf("Unable to set jitter: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if d := s1.randomElectionTimeout(); d < s1.ElectionTimeout() || d >= s1.ElectionTimeout()*3/2 {
+			t.Fatalf("Timeout out of range: %v", d)
+		}
+	}
+
+	s3 := newTestServer("3", &testTransporter{})
+	if s3.ElectionSeed() == s1.ElectionSeed() {
+		t.Fatalf("Servers should be seeded differently by default")
+	}
+}
+
+// Ensure that state and term observers are told of elections.
+func TestServerStateObserver(t *testing.T) {
+	var mutex sync.Mutex
+	var states []StateChange
+	var terms []TermChange
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return newRequestVoteResponse(req.Term, true)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
+	s := newTestServerWithLog("1", transporter, []*LogEntry{e0})
+	if err := s.AddPeer("2", ""); err != nil {
+		t.Fatalf("Unable to add peer: %v", err)
+	}
+	s.RegisterStateObserver(func(change StateChange) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states = append(states, change)
+	})
+	s.RegisterTermObserver(func(change TermChange) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		terms = append(terms, change)
+	})
+	s.Start()
+	defer s.Stop()
+
+	if err := s.Campaign(); err != nil {
+		t.Fatalf("Unable to campaign: %v", err)
+	}
+	time.Sleep(testHeartbeatInterval)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(terms) != 1 || terms[0].Term != terms[0].PrevTerm+1 || terms[0].Term != s.Term() {
+		t.Fatalf("Unexpected term changes: %v", terms)
+	}
+	if len(states) != 3 {
+		t.Fatalf("Unexpected state changes: %v", states)
+	}
+	if states[1].PrevState != Follower || states[1].State != Candidate {
+		t.Fatalf("Expected to become a candidate: %v", states[1])
+	}
+	if states[2].PrevState != Candidate || states[2].State != Leader || states[2].Term != s.Term() {
+		t.Fatalf("Expected to become leader: %v", states[2])
+	}
+}
+
+// Ensure that leader observers are told of the previous and new leader.
+func TestServerLeaderObserver(t *testing.T) {
+	var mutex sync.Mutex
+	var changes []LeaderChange
+	s := newTestServer("1", &testTransporter{})
+	s.RegisterLeaderObserver(func(change LeaderChange) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		changes = append(changes, change)
+	})
+	s.Start()
+	defer s.Stop()
+
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	req := newRequestVoteRequest(2, "2", 0, 0)
+	req.Transfer = true
+	if resp := s.RequestVote(req); !resp.VoteGranted {
+		t.Fatalf("Vote should be granted")
+	}
+	if resp := s.AppendEntries(newAppendEntriesRequest(2, 0, 0, 0, "2", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := []LeaderChange{
+		{Leader: "ldr", Term: 1},
+		{PrevLeader: "ldr", Term: 2},
+		{Leader: "2", Term: 2},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Unexpected leader changes: %v", changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("Unexpected leader change: %v", changes[i])
+		}
+	}
+}
+
+// Ensure that VerifyLeader succeeds only while a quorum answers heartbeats.
+func TestServerVerifyLeader(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	if err := s.VerifyLeader(); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	if err := s.VerifyLeader(); err != nil {
+		t.Fatalf("Unable to verify leadership: %v", err)
+	}
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	if err := s.VerifyLeader(); err != NoQuorumError {
+		t.Fatalf("Expected NoQuorumError, got %v", err)
+	}
+}
+
+// Ensure that the leader hands out a read index once it has confirmed its
+// leadership.
+func TestServerReadIndex(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.ReadIndex(gocontext.Background()); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	committed := s.CommitIndex()
+	index, err := s.ReadIndex(gocontext.Background())
+	if err != nil || index < committed || index > s.CommitIndex() {
+		t.Fatalf("Unexpected read index: %d %v (commit index %d)", index, err, committed)
+	}
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), testHeartbeatInterval)
+	defer cancel()
+	if _, err := s.ReadIndex(ctx); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected the context to expire, got %v", err)
+	}
+}
+
+// Ensure that lease reads skip the heartbeat round only while the lease is
+// valid.
+func TestServerRead(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	reads := 0
+	read := func() (interface{}, error) {
+		reads++
+		return "foo", nil
+	}
+	for _, mode := range []string{LeaseReadMode, ReadIndexReadMode} {
+		if value, err := s.Read(gocontext.Background(), mode, read); value != "foo" || err != nil {
+			t.Fatalf("Unexpected %s read: %v %v", mode, value, err)
+		}
+	}
+	if reads != 2 {
+		t.Fatalf("Each read should run once: %d", reads)
+	}
+	if _, err := s.Read(gocontext.Background(), "foo", read); err != InvalidReadModeError {
+		t.Fatalf("Expected InvalidReadModeError, got %v", err)
+	}
+
+	// Without a lease the read waits for a quorum that does not answer.
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	time.Sleep(s.ElectionTimeout())
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), testHeartbeatInterval)
+	defer cancel()
+	if _, err := s.Read(ctx, LeaseReadMode, read); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected the context to expire, got %v", err)
+	}
+	if reads != 2 {
+		t.Fatalf("Read should not run without a lease: %d", reads)
+	}
+}
+
+// Ensure that quorum reads wait only for the entries a quorum attests may be
+// committed.
+func TestServerQuorumRead(t *testing.T) {
+	var mutex sync.Mutex
+	accept := true
+	var stored uint64
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !accept {
+			return newAppendEntriesResponse(req.Term, false, stored, stored)
+		}
+		stored = req.PrevLogIndex + uint64(len(req.Entries))
+		return newAppendEntriesResponse(req.Term, true, stored, req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	read := func() (interface{}, error) {
+		return s.CommitIndex(), nil
+	}
+	value, err := s.Read(gocontext.Background(), QuorumReadMode, read)
+	if err != nil || value.(uint64) < stored {
+		t.Fatalf("Unexpected quorum read: %v %v (peer stores %d)", value, err, stored)
+	}
+
+	// An entry the peer does not store cannot be committed, so the read does
+	// not wait for it.
+	mutex.Lock()
+	accept = false
+	mutex.Unlock()
+	future := s.DoAsync(&testCommand1{Val: "foo"})
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), s.ElectionTimeout())
+	defer cancel()
+	value, err = s.Read(ctx, QuorumReadMode, read)
+	if err != nil || value.(uint64) >= future.Index() {
+		t.Fatalf("Unexpected quorum read: %v %v (pending index %d)", value, err, future.Index())
+	}
+}
+
+// Ensure that followers only serve reads within the staleness bound.
+func TestServerReadStale(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	read := func() (interface{}, error) {
+		return "foo", nil
+	}
+	if _, err := s.ReadStale(Staleness{Duration: time.Second}, read); err == nil {
+		t.Fatalf("A server that has not heard from a leader should be stale")
+	}
+
+	e1, _ := newLogEntry(nil, nil, 1, 1, &testCommand1{Val: "foo", I: 10})
+	e2, _ := newLogEntry(nil, nil, 2, 1, &testCommand1{Val: "bar", I: 20})
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", []*LogEntry{e1, e2})); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 2, 1, 5, "ldr", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+
+	_, err := s.ReadStale(Staleness{Entries: 2}, read)
+	if lag, ok := err.(*StaleReadError); !ok || lag.LagEntries != 3 {
+		t.Fatalf("Expected a lag of 3 entries, got %v", err)
+	}
+	if value, err := s.ReadStale(Staleness{Entries: 3, Duration: time.Second}, read); value != "foo" || err != nil {
+		t.Fatalf("Unexpected read: %v %v", value, err)
+	}
+
+	time.Sleep(testHeartbeatInterval)
+	_, err = s.ReadStale(Staleness{Entries: 3, Duration: testHeartbeatInterval / 2}, read)
+	if lag, ok := err.(*StaleReadError); !ok || lag.LagDuration < testHeartbeatInterval {
+		t.Fatalf("Expected a lag of at least %v, got %v", testHeartbeatInterval, err)
+	}
+}
+
+// Ensure that elections are counted.
+func TestServerElectionMetrics(t *testing.T) {
+	var mutex sync.Mutex
+	granted := false
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return newRequestVoteResponse(req.Term, granted)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
+	s := newTestServerWithLog("1", transporter, []*LogEntry{e0})
+	s.SetElectionTimeout(testElectionTimeout)
+	s.SetMaxElectionBackoff(0)
+	if err := s.AddPeer("2", ""); err != nil {
+		t.Fatalf("Unable to add peer: %v", err)
+	}
+	s.Start()
+	defer s.Stop()
+
+	if err := s.Campaign(); err != nil {
+		t.Fatalf("Unable to campaign: %v", err)
+	}
+	time.Sleep(testElectionTimeout*2 + testHeartbeatInterval)
+	mutex.Lock()
+	granted = true
+	mutex.Unlock()
+	time.Sleep(testElectionTimeout * 2)
+
+	if s.State() != Leader {
+		t.Fatalf("Server should have won an election: %v", s.State())
+	}
+	m := s.ElectionMetrics()
+	if m.Won != 1 || m.Lost < 1 || m.Started != m.Won+m.Lost {
+		t.Fatalf("Unexpected election counts: %+v", m)
+	}
+	if m.Duration.Count != m.Started || m.Duration.Sum <= 0 {
+		t.Fatalf("Unexpected election durations: %+v", m.Duration)
+	}
+
+	f := newTestServer("3", &testTransporter{})
+	f.Start()
+	defer f.Stop()
+	if resp := f.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	f.RequestVote(newRequestVoteRequest(2, "foo", 0, 0))
+	if m := f.ElectionMetrics(); m.DisruptiveVotesRejected != 1 || m.Started != 0 {
+		t.Fatalf("Unexpected metrics: %+v", m)
+	}
+}
+
+// Ensure that the leadership epoch is exposed to commands and follows the
+// terms of established leaders.
+func TestServerEpoch(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if s.Epoch() != s.Term() {
+		t.Fatalf("The leader's epoch should be its term: %d %d", s.Epoch(), s.Term())
+	}
+	epoch, err := s.Do(&testEpochCommand{})
+	if err != nil || epoch != s.Term() {
+		t.Fatalf("Unexpected epoch in the command: %v %v", epoch, err)
+	}
+
+	f := newTestServer("2", &testTransporter{})
+	f.Start()
+	defer f.Stop()
+	if resp := f.RequestVote(newRequestVoteRequest(3, "foo", 0, 0)); !resp.VoteGranted {
+		t.Fatalf("Vote should be granted")
+	}
+	if f.Epoch() != 0 {
+		t.Fatalf("The epoch should not move without a leader: %d", f.Epoch())
+	}
+	if resp := f.AppendEntries(newAppendEntriesRequest(3, 0, 0, 0, "foo", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	if f.Epoch() != 3 {
+		t.Fatalf("The epoch should be the leader's term: %d", f.Epoch())
+	}
+}
+
+// Ensure that commands are told the index and the term of their entry.
+func TestServerCommandContext(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	result, err := s.DoResult(gocontext.Background(), &testContextCommand{})
+	if err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	context := result.Value.(Context)
+	if context.Index() != result.Index || context.Term() != result.Term || context.CommitIndex() != result.Index || !context.IsLeader() {
+		t.Fatalf("Unexpected context for entry %d in term %d: %+v", result.Index, result.Term, context)
+	}
+
+	// The time and the seed come from the entry, so every server agrees.
+	for _, entry := range s.LogEntries() {
+		if entry.Index() != result.Index {
+			continue
+		}
+		if !context.Time().Equal(entry.Timestamp()) || time.Since(context.Time()) > time.Minute {
+			t.Fatalf("Unexpected time %v for an entry stamped %v", context.Time(), entry.Timestamp())
+		}
+		if n := rand.New(rand.NewSource(entry.Seed())).Int63(); context.Rand().Int63() != n {
+			t.Fatalf("Expected the entry's seed to draw %d", n)
+		}
+	}
+}
+
+// Ensure that a clock jump invalidates the lease and can make the leader
+// step down.
+func TestServerClockJump(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+	s.AddPeer("2", "")
+	s.AddPeer("3", "")
+	var jumps []*ClockJump
+	s.AddEventListener(ClockJumpEventType, func(e Event) {
+		jumps = append(jumps, e.Value().(*ClockJump))
+	})
+	ack := func() {
+		for _, peer := range s.peers {
+			peer.setLastAck(time.Now())
+		}
+		s.updateLease()
+		if s.leaseExpiry.IsZero() {
+			t.Fatalf("Lease should have been granted")
+		}
+	}
+
+	ack()
+	if s.checkClock(50*time.Millisecond, 60*time.Millisecond) {
+		t.Fatalf("Small differences should not count as a jump")
+	}
+	if s.leaseExpiry.IsZero() {
+		t.Fatalf("Lease should still be held")
+	}
+
+	if !s.checkClock(50*time.Millisecond, time.Second) {
+		t.Fatalf("Wall clock jump should have been detected")
+	}
+	if !s.leaseExpiry.IsZero() {
+		t.Fatalf("Lease should have been invalidated")
+	}
+
+	// A late heartbeat, with the clocks in agreement, is a busy event loop.
+	ack()
+	if s.checkClock(2*time.Second, 2*time.Second) {
+		t.Fatalf("Late heartbeat should not count as a jump")
+	}
+	if s.leaseExpiry.IsZero() {
+		t.Fatalf("Lease should still be held")
+	}
+	if len(jumps) != 1 || jumps[0].Wall != time.Second || jumps[0].Monotonic != 50*time.Millisecond {
+		t.Fatalf("Unexpected clock jump events: %v", jumps)
+	}
+
+	s.SetClockJumpThreshold(0)
+	if s.checkClock(50*time.Millisecond, time.Second) {
+		t.Fatalf("Detection should be disabled")
+	}
+
+	s.SetClockJumpThreshold(DefaultClockJumpThreshold)
+	s.SetStepDownOnClockJump(true)
+	s.setState(Leader)
+	s.checkClock(50*time.Millisecond, time.Second)
+	if s.State() != Follower {
+		t.Fatalf("Leader should have stepped down: %v", s.State())
+	}
+}
+
+// Ensure that the leader propagates a quiesce and that quiesced followers
+// hold off elections.
+func TestServerQuiesce(t *testing.T) {
+	var mutex sync.Mutex
+	var quiesce time.Duration
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		quiesce = req.Quiesce
+		mutex.Unlock()
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return newRequestVoteResponse(req.Term, false)
+	}
+
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if err := s.Quiesce(MaxQuiesceElectionTimeouts*s.ElectionTimeout() + 1); err != QuiesceTooLongError {
+		t.Fatalf("Expected QuiesceTooLongError, got %v", err)
+	}
+	if err := s.Quiesce(time.Second); err != nil {
+		t.Fatalf("Unable to quiesce: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	sent := quiesce
+	mutex.Unlock()
+	if sent <= 0 || sent > time.Second {
+		t.Fatalf("Heartbeats should carry the quiesce: %v", sent)
+	}
+
+	f := newTestServer("2", transporter)
+	f.Start()
+	defer f.Stop()
+	if err := f.Quiesce(time.Second); err != NotLeaderError {
+		t.Fatalf("Only the leader can quiesce: %v", err)
+	}
+	req := newAppendEntriesRequest(1, 0, 0, 0, "1", nil)
+	req.Quiesce = time.Second
+	if resp := f.AppendEntries(req); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	time.Sleep(3 * f.ElectionTimeout())
+	if f.State() != Follower {
+		t.Fatalf("A quiesced follower should not stand for election: %v", f.State())
+	}
+	if !f.QuiescedUntil().After(time.Now()) {
+		t.Fatalf("The follower should still be quiesced: %v", f.QuiescedUntil())
+	}
+
+	if resp := f.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "1", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	if !f.QuiescedUntil().IsZero() {
+		t.Fatalf("The quiesce should have ended: %v", f.QuiescedUntil())
+	}
+
+	// Followers cut a quiesce that is too long short.
+	req = newAppendEntriesRequest(1, 0, 0, 0, "1", nil)
+	req.Quiesce = 1000 * time.Hour
+	if resp := f.AppendEntries(req); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	if max := time.Now().Add(MaxQuiesceElectionTimeouts * f.ElectionTimeout()); f.QuiescedUntil().After(max) {
+		t.Fatalf("The quiesce should be capped: %v", f.QuiescedUntil())
+	}
+}
+
+// Ensure that a profile sets its settings together.
+func TestServerApplyProfile(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	p, err := ProfileByName("wan-stable")
+	if err != nil {
+		t.Fatalf("Unable to find profile: %v", err)
+	}
+	if err := s.ApplyProfile(p); err != nil {
+		t.Fatalf("Unable to apply profile: %v", err)
+	}
+	if s.ElectionTimeout() != p.ElectionTimeout || s.HeartbeatInterval() != p.HeartbeatInterval || !s.CheckQuorum() {
+		t.Fatalf("Profile not applied: %v %v %v", s.ElectionTimeout(), s.HeartbeatInterval(), s.CheckQuorum())
+	}
+
+	if err := s.ApplyProfile(TestDeterministicProfile); err != nil {
+		t.Fatalf("Unable to apply profile: %v", err)
+	}
+	other := newTestServer("1", &testTransporter{})
+	other.ApplyProfile(TestDeterministicProfile)
+	if s.ElectionSeed() != other.ElectionSeed() || s.CheckQuorum() {
+		t.Fatalf("Servers of the same name should draw the same timeouts: %d %d", s.ElectionSeed(), other.ElectionSeed())
+	}
+
+	bad := LANFastProfile
+	bad.HeartbeatInterval = bad.ElectionTimeout
+	if err := s.ApplyProfile(bad); err != InvalidTimeoutsError {
+		t.Fatalf("Invalid profile should be refused: %v", err)
+	}
+	if s.ElectionTimeout() != TestDeterministicProfile.ElectionTimeout {
+		t.Fatalf("Invalid profile should not change the settings: %v", s.ElectionTimeout())
+	}
+	if _, err := ProfileByName("foo"); err != UnknownProfileError {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensure that a candidate backs off after losing rounds in a row.
+func TestServerElectionBackoff(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+	s.SetElectionJitter(0)
+	s.SetMaxElectionBackoff(5 * s.ElectionTimeout())
+	et := s.ElectionTimeout()
+
+	for lost, expected := range []time.Duration{et, 2 * et, 4 * et, 5 * et, 5 * et} {
+		if timeout := s.candidateElectionTimeout(lost); timeout != expected {
+			t.Fatalf("Unexpected timeout after %d lost rounds: %v != %v", lost, timeout, expected)
+		}
+	}
+
+	s.SetMaxElectionBackoff(0)
+	if timeout := s.candidateElectionTimeout(3); timeout != et {
+		t.Fatalf("Backoff should be disabled: %v", timeout)
+	}
+}
+
+// Ensure that a follower does not stand for election until it can reach a
+// quorum.
+func TestServerReachabilityCheck(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := map[string]bool{}
+	transporter := &testTransporter{}
+	transporter.pingFunc = func(s Server, peer *Peer) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return reachable[peer.Name]
+	}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return newRequestVoteResponse(req.Term, false)
+	}
+	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
+	s := newTestServerWithLog("1", transporter, []*LogEntry{e0})
+	s.SetReachabilityCheck(true)
+	s.AddPeer("2", "")
+	s.AddPeer("3", "")
+	s.Start()
+	defer s.Stop()
+
+	time.Sleep(3 * s.ElectionTimeout())
+	if s.State() != Follower || s.Term() != 1 {
+		t.Fatalf("A follower cut off from the cluster should not stand for election: %v %d", s.State(), s.Term())
+	}
+	if peers := s.ReachablePeers(); len(peers) != 0 {
+		t.Fatalf("No peer should be reachable: %v", peers)
+	}
+
+	mutex.Lock()
+	reachable["2"] = true
+	mutex.Unlock()
+	deadline := time.Now().Add(3 * s.ElectionTimeout())
+	for s.Term() == 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("A follower that reaches a quorum should stand for election")
+		}
+		time.Sleep(testHeartbeatInterval / 10)
+	}
+	if peers := s.ReachablePeers(); len(peers) != 1 || peers[0] != "2" {
+		t.Fatalf("Unexpected reachable peers: %v", peers)
+	}
+}
+
+// Ensure that a command retried within a client session is applied once.
+func TestServerClientSession(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	first, err := s.Do(&testSessionCommand{Client: "a", Seq: 1})
+	if err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	retry, err := s.Do(&testSessionCommand{Client: "a", Seq: 1})
+	if err != nil || retry != first {
+		t.Fatalf("Expected the first result %v for a retry, got %v %v", first, retry, err)
+	}
+	if _, err := s.Do(&testSessionCommand{Client: "a", Seq: 2}); err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	if _, err := s.Do(&testSessionCommand{Client: "a", Seq: 1}); err != DuplicateCommandError {
+		t.Fatalf("Expected DuplicateCommandError, got %v", err)
+	}
+	if index, err := s.Do(&testSessionCommand{Client: "b", Seq: 1}); err != nil || index != s.CommitIndex() {
+		t.Fatalf("Expected another client to be applied, got %v %v", index, err)
+	}
+
+	sessions := s.(*server).sessionSequences()
+	if sessions["a"] != 2 || sessions["b"] != 1 {
+		t.Fatalf("Unexpected sessions: %v", sessions)
+	}
+}
+
+// Ensure that only the most recently used client sessions are remembered.
+func TestServerMaxSessions(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetMaxSessions(2)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	for _, c := range []*testSessionCommand{{Client: "a", Seq: 1}, {Client: "b", Seq: 1}, {Client: "a", Seq: 2}, {Client: "c", Seq: 1}} {
+		if _, err := s.Do(c); err != nil {
+			t.Fatalf("Unable to apply: %v", err)
+		}
+	}
+	if order := s.(*server).sessionOrder(); len(order) != 2 || order[0] != "a" || order[1] != "c" {
+		t.Fatalf("Unexpected sessions: %v", order)
+	}
+	if index, err := s.Do(&testSessionCommand{Client: "b", Seq: 1}); err != nil || index != s.CommitIndex() {
+		t.Fatalf("Expected a forgotten session to be applied again, got %v %v", index, err)
+	}
+
+	// Restored sessions keep their order.
+	s.(*server).restoreSessions(map[string]uint64{"a": 1, "b": 1, "c": 1}, []string{"c", "a"})
+	if order := s.(*server).sessionOrder(); len(order) != 2 || order[0] != "c" || order[1] != "a" {
+		t.Fatalf("Unexpected restored sessions: %v", order)
+	}
+
+	s.SetMaxSessions(-1)
+	if s.MaxSessions() != 0 {
+		t.Fatalf("Expected a negative limit to be clamped: %d", s.MaxSessions())
+	}
+}
+
+// Ensure that a command is applied once per remembered idempotency key.
+func TestServerIdempotencyKeys(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetMaxIdempotencyKeys(1)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	first, err := s.Do(&testIdempotentCommand{Key: "a"})
+	if err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	again, err := s.Do(&testIdempotentCommand{Key: "a"})
+	if err != nil || again != first {
+		t.Fatalf("Expected the first result %v for a repeat, got %v %v", first, again, err)
+	}
+	if _, err := s.Do(&testIdempotentCommand{Key: "b"}); err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	if index, err := s.Do(&testIdempotentCommand{Key: "a"}); err != nil || index == first {
+		t.Fatalf("Expected a forgotten key to be applied again, got %v %v", index, err)
+	}
+
+	keys := s.(*server).keyOrder
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	// A negative limit remembers no keys.
+	s.SetMaxIdempotencyKeys(-1)
+	if s.MaxIdempotencyKeys() != 0 {
+		t.Fatalf("Expected a negative limit to be clamped: %d", s.MaxIdempotencyKeys())
+	}
+	first, err = s.Do(&testIdempotentCommand{Key: "c"})
+	if err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	if again, err := s.Do(&testIdempotentCommand{Key: "c"}); err != nil || again == first {
+		t.Fatalf("Expected the key not to be remembered, got %v %v", again, err)
+	}
+}
+
+// Ensure that a subscriber receives the entries in the log and then those
+// committed later, in order.
+func TestServerSubscribe(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	sub := s.Subscribe(ctx, 2)
+	if _, err := s.Do(&testCommand1{Val: "bar"}); err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+
+	var vals []string
+	next := uint64(2)
+	for len(vals) < 2 {
+		entry := <-sub.C
+		if entry.Index() != next {
+			t.Fatalf("Expected index %d, got %d", next, entry.Index())
+		}
+		next++
+		if entry.CommandName() == "cmd_1" {
+			command := &testCommand1{}
+			json.Unmarshal(entry.Command(), command)
+			vals = append(vals, command.Val)
+		}
+	}
+	if vals[0] != "foo" || vals[1] != "bar" {
+		t.Fatalf("Unexpected commands: %v", vals)
+	}
+
+	cancel()
+	for range sub.C {
+	}
+	if sub.Err() != gocontext.Canceled {
+		t.Fatalf("Expected the subscription to be cancelled, got %v", sub.Err())
+	}
+}
+
+// Ensure that a filtered subscription only delivers the entries it keeps.
+func TestServerSubscribeFiltered(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	sub := s.SubscribeFiltered(ctx, 1, func(e *LogEntry) bool { return !e.IsNOP() })
+	for _, command := range []Command{NOPCommand{}, &testCommand1{Val: "foo"}, NOPCommand{}, &testCommand1{Val: "bar"}} {
+		if _, err := s.Do(command); err != nil {
+			t.Fatalf("Unable to apply: %v", err)
+		}
+	}
+
+	var names []string
+	for len(names) < 3 {
+		entry := <-sub.C
+		if entry.IsNOP() {
+			t.Fatalf("Unexpected NOP at index %d", entry.Index())
+		}
+		names = append(names, entry.CommandName())
+	}
+	if names[0] != "raft:join" || names[1] != "cmd_1" || names[2] != "cmd_1" {
+		t.Fatalf("Unexpected entries: %v", names)
+	}
+}
+
+// Ensure that a new leader only appends a NOP as the NOP policy decides.
+func TestServerNOPPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		nop    bool
+	}{
+		{ElectionNOPPolicy, true},
+		{UncommittedNOPPolicy, false},
+		{NeverNOPPolicy, false},
+	} {
+		s := newTestServer("1", &testTransporter{})
+		if err := s.SetNOPPolicy(tt.policy); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+			t.Fatalf("Unable to join: %v", err)
+		}
+		if _, err := s.Do(&testCommand1{Val: "foo"}); err != nil {
+			t.Fatalf("Unable to apply: %v", err)
+		}
+
+		// Every entry is committed, so the commit index is current.
+		if _, err := s.ReadIndex(gocontext.Background()); err != nil {
+			t.Fatalf("%s: Unable to read: %v", tt.policy, err)
+		}
+		if err := s.Barrier(gocontext.Background()); err != nil {
+			t.Fatalf("%s: Unable to append a barrier: %v", tt.policy, err)
+		}
+		// The leader appends its NOP asynchronously.
+		nops := 0
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+			entries, _, _ := s.CommittedEntries(0, 0)
+			nops = 0
+			for _, entry := range entries {
+				if entry.IsNOP() {
+					nops++
+				}
+			}
+			if !tt.nop || nops > 1 || time.Now().After(deadline) {
+				break
+			}
+		}
+		if (nops > 1) != tt.nop {
+			t.Fatalf("%s: Unexpected NOPs: %d", tt.policy, nops)
+		}
+		s.Stop()
+	}
+
+	s := newTestServer("1", &testTransporter{})
+	if err := s.SetNOPPolicy("bogus"); err == nil {
+		t.Fatal("Expected error setting an invalid NOP policy")
+	}
+}
+
+// Ensure that commands that fail to apply are handled as the apply error
+// policy decides.
+func TestServerApplyErrorPolicy(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetHeartbeatInterval(testHeartbeatInterval)
+	var failures []*ApplyFailure
+	s.AddEventListener(ApplyErrorEventType, func(e Event) {
+		failures = append(failures, e.Value().(*ApplyFailure))
+	})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if err := s.SetApplyErrorPolicy("foo"); err == nil {
+		t.Fatal("Expected an invalid policy to be refused")
+	}
+
+	if _, err := s.Do(&testFailCommand{Failures: 1}); err == nil {
+		t.Fatal("Expected the command to fail")
+	}
+	if recorded := s.ApplyFailures(); len(recorded) != 1 || recorded[0].CommandName != "cmd_fail" || len(failures) != 1 {
+		t.Fatalf("Expected the failure to be recorded: %v %v", recorded, failures)
+	}
+
+	s.SetApplyErrorPolicy(RetryApplyErrorPolicy)
+	if attempts, err := s.Do(&testFailCommand{Failures: 2}); err != nil || attempts != 3 {
+		t.Fatalf("Expected the command to succeed on the third attempt, got %v %v", attempts, err)
+	}
+
+	// A command being retried holds the commit index back without blocking
+	// the server.
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 4*testHeartbeatInterval)
+	defer cancel()
+	if _, err := s.DoContext(ctx, &testFailCommand{Failures: 1000}); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected the command to be retried, got %v", err)
+	}
+	if s.CommitIndex() != s.(*server).log.currentIndex()-1 || s.State() != Leader {
+		t.Fatalf("Expected the commit index to stop before the command: %d %s", s.CommitIndex(), s.State())
+	}
+	s.SetApplyErrorPolicy(SkipApplyErrorPolicy)
+	for i := 0; s.CommitIndex() != s.(*server).log.currentIndex(); i++ {
+		if i == 100 {
+			t.Fatal("Expected the command to be skipped")
+		}
+		time.Sleep(testHeartbeatInterval / 10)
+	}
+
+	s.SetApplyErrorPolicy(HaltApplyErrorPolicy)
+	if _, err := s.Do(&testFailCommand{Failures: 1}); err == nil || !s.(*server).isHalted() {
+		t.Fatalf("Expected the server to halt, got %v", err)
+	}
+	for i := 0; s.Running(); i++ {
+		if i == 100 {
+			t.Fatal("Expected the server to stop")
+		}
+		time.Sleep(testHeartbeatInterval / 10)
+	}
+}
+
+// Ensure that a command that panics marks the server unhealthy and makes it
+// step down.
+func TestServerApplyPanic(t *testing.T) {
+	// Panics crash the process by default. The panic is raised on a server
+	// that is not running, whose entries nothing else applies.
+	c := newTestServer("2", &testTransporter{})
+	entry, _ := newLogEntry(nil, nil, 1, 1, &testPanicCommand{})
+	func() {
+		defer func() {
+			if r := recover(); r != "poison" {
+				t.Fatalf("Expected the panic to be raised again, got %v", r)
+			}
+		}()
+		c.(*server).apply(entry, &testPanicCommand{})
+	}()
+
+	s := newTestServer("1", &testTransporter{})
+	s.SetHeartbeatInterval(testHeartbeatInterval)
+	var mutex sync.Mutex
+	var panics []*ApplyPanic
+	s.AddEventListener(ApplyPanicEventType, func(e Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		panics = append(panics, e.Value().(*ApplyPanic))
+	})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	s.SetApplyPanicPolicy(UnhealthyPanicPolicy)
+	_, err := s.Do(&testPanicCommand{})
+	if p, ok := err.(*ApplyPanic); !ok || p.Value != "poison" || len(p.Stack) == 0 {
+		t.Fatalf("Expected an *ApplyPanic, got %v", err)
+	}
+	mutex.Lock()
+	count := len(panics)
+	mutex.Unlock()
+	if count != 1 || s.Healthy() {
+		t.Fatalf("Expected the server to be unhealthy after %d panics", count)
+	}
+	for i := 0; s.State() == Leader; i++ {
+		if i == 100 {
+			t.Fatal("Expected the leader to step down")
+		}
+		time.Sleep(testHeartbeatInterval / 10)
+	}
+	time.Sleep(2 * s.ElectionTimeout())
+	if s.State() != Follower {
+		t.Fatalf("An unhealthy server should not stand for election: %s", s.State())
+	}
+}
+
+// Ensure that apply hooks are called around every applied entry.
+func TestServerApplyHook(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	var mutex sync.Mutex
+	var calls []string
+	s.RegisterApplyHook(func(e *LogEntry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, fmt.Sprintf("before %d", e.Index()))
+	}, func(e *LogEntry, result interface{}, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, fmt.Sprintf("after %d %v", e.Index(), result))
+	})
+	s.RegisterApplyHook(nil, nil)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	index, err := s.Do(&testIdempotentCommand{})
+	if err != nil {
+		t.Fatalf("Unable to apply: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := range calls[1:] {
+		if calls[i] == fmt.Sprintf("before %d", index) && calls[i+1] == fmt.Sprintf("after %d %d", index, index) {
+			return
+		}
+	}
+	t.Fatalf("Unexpected hook calls: %v", calls)
+}
+
+type valCommandValidator struct{}
+
+func (valCommandValidator) Validate(command Command) error {
+	if c, ok := command.(*testCommand1); ok && c.Val == "" {
+		return errors.New("missing value")
+	}
+	return nil
+}
+
+// Ensure that the leader refuses invalid commands before appending them.
+func TestServerCommandValidator(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	s.SetCommandValidator(valCommandValidator{})
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to execute a valid command: %v", err)
+	}
+
+	index := s.(*server).log.currentIndex()
+	if _, err := s.Do(&testCommand1{}); err == nil || err.Error() != "missing value" {
+		t.Fatalf("Expected the command to be refused, got %v", err)
+	}
+	if _, errs := s.DoBatch([]Command{&testCommand1{Val: "bar"}, &testCommand1{}}); errs[0] == nil || errs[1] == nil {
+		t.Fatalf("Expected the batch to be refused, got %v", errs)
+	}
+	if i := s.(*server).log.currentIndex(); i != index {
+		t.Fatalf("Invalid commands should not be appended: %d != %d", i, index)
+	}
+
+	s.SetCommandValidator(nil)
+	if _, err := s.Do(&testCommand1{}); err != nil {
+		t.Fatalf("Unable to execute without a validator: %v", err)
+	}
+}
+
+type tokenJoinValidator string
+
+func (v tokenJoinValidator) ValidateJoin(member *DefaultJoinCommand, command JoinCommand) error {
+	if c, ok := command.(*testJoinCommand); ok && c.Token == string(v) && member == &c.DefaultJoinCommand {
+		return nil
+	}
+	return errors.New("invalid token")
+}
+
+// Ensure that an application's own join and leave commands change the
+// membership like the default ones.
+func TestServerCustomJoinLeave(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	s.SetJoinValidator(tokenJoinValidator("secret"))
+
+	join := func(name string, token string) error {
+		_, err := s.Do(&testJoinCommand{
+			DefaultJoinCommand: DefaultJoinCommand{Name: name, ConnectionString: "http://" + name, Role: LearnerRole, Metadata: map[string]string{"zone": "a"}},
+			Token:              token,
+		})
+		return err
+	}
+	if err := join("2", "bogus"); err == nil || err.Error() != "invalid token" {
+		t.Fatalf("Expected the join to be refused, got %v", err)
+	}
+	if err := join("2", "secret"); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if peer := s.Peers()["2"]; peer == nil || peer.Role != LearnerRole || peer.Metadata["zone"] != "a" {
+		t.Fatalf("Unexpected peer: %+v", peer)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "4"}); err == nil || err.Error() != "invalid token" {
+		t.Fatalf("Expected a default join to be validated, got %v", err)
+	}
+
+	// A voter joining a full cluster is admitted as a learner.
+	s.SetMaxPeerCount(0)
+	if err := s.SetJoinPolicy(LearnerJoinPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Do(&testJoinCommand{DefaultJoinCommand: DefaultJoinCommand{Name: "3", ConnectionString: "http://3"}, Token: "secret"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if peer := s.Peers()["3"]; peer == nil || peer.Role != LearnerRole {
+		t.Fatalf("Expected a learner: %+v", peer)
+	}
+
+	if _, err := s.Do(&testLeaveCommand{DefaultLeaveCommand: DefaultLeaveCommand{Name: "2"}, Reason: "done"}); err != nil {
+		t.Fatalf("Unable to leave: %v", err)
+	}
+	if s.Peers()["2"] != nil {
+		t.Fatal("Expected the peer to have left")
+	}
+}
+
+type refuseJoinValidator struct{}
+
+func (refuseJoinValidator) ValidateJoin(member *DefaultJoinCommand, command JoinCommand) error {
+	return errors.New("no joins")
+}
+
+// Ensure that the join validator is only given joins, so that refusing them
+// leaves the other configuration changes alone.
+func TestServerJoinValidatorOnlyJoins(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return lookup[peer.Name].RequestVote(req)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		if lookup[peer.Name] == nil {
+			return nil
+		}
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	leader := newTestServer("1", transporter)
+	leader.SetHeartbeatInterval(testHeartbeatInterval)
+	promoted := make(chan string, 1)
+	leader.AddEventListener(PromotePeerEventType, func(e Event) {
+		promoted <- e.Value().(string)
+	})
+	lookup["1"] = leader
+	learner := newTestServer("2", transporter)
+	learner.SetElectionTimeout(testElectionTimeout)
+	lookup["2"] = learner
+
+	leader.Start()
+	defer leader.Stop()
+	learner.Start()
+	defer learner.Stop()
+
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join leader: %v", err)
+	}
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join learner: %v", err)
+	}
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "3", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join learner: %v", err)
+	}
+	leader.SetJoinValidator(refuseJoinValidator{})
+
+	if _, err := leader.Do(&testJoinCommand{DefaultJoinCommand: DefaultJoinCommand{Name: "4"}, Token: "secret"}); err == nil || err.Error() != "no joins" {
+		t.Fatalf("Expected the join to be refused, got %v", err)
+	}
+	if _, err := leader.Do(&DefaultChangePeerAddressCommand{Name: "3", ConnectionString: "http://3"}); err != nil {
+		t.Fatalf("Unable to change the address: %v", err)
+	}
+	if _, err := leader.Do(&testLeaveCommand{DefaultLeaveCommand: DefaultLeaveCommand{Name: "3"}}); err != nil {
+		t.Fatalf("Unable to leave: %v", err)
+	}
+
+	leader.SetLearnerPromotionDistance(1)
+	if _, err := leader.Do(&testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to execute: %v", err)
+	}
+	select {
+	case name := <-promoted:
+		if name != "2" {
+			t.Fatalf("Unexpected promotion: %s", name)
+		}
+	case <-time.After(testElectionTimeout * 4):
+		t.Fatal("Learner was not promoted")
+	}
+}
+
+type tokenAuthorizer string
+
+func (a tokenAuthorizer) Authorize(identity *Identity, command Command) error {
+	if identity == nil || identity.Token != string(a) {
+		if _, ok := command.(*testCommand1); ok {
+			return errors.New("admin only")
+		}
+	}
+	return nil
+}
+
+// Ensure that commands are only accepted once the authorizer allows them.
+func TestServerAuthorizer(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetAuthorizer(tokenAuthorizer("admin"))
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	if _, err := s.Do(&testCommand1{Val: "foo"}); !errors.Is(err, UnauthorizedError) {
+		t.Fatalf("Expected UnauthorizedError, got %v", err)
+	}
+	if _, err := s.DoResult(gocontext.Background(), &testCommand1{Val: "foo"}); !errors.Is(err, UnauthorizedError) {
+		t.Fatalf("Expected UnauthorizedError, got %v", err)
+	}
+	if _, errs := s.DoBatch([]Command{&testCommand2{}, &testCommand1{}}); !errors.Is(errs[0], UnauthorizedError) {
+		t.Fatalf("Expected UnauthorizedError, got %v", errs)
+	}
+
+	ctx := WithIdentity(gocontext.Background(), &Identity{Token: "admin"})
+	if _, err := s.DoContext(ctx, &testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to execute as admin: %v", err)
+	}
+	if _, err := s.DoResult(ctx, &testCommand1{Val: "bar"}); err != nil {
+		t.Fatalf("Unable to execute as admin: %v", err)
+	}
+	if _, errs := s.DoBatchContext(ctx, []Command{&testCommand1{Val: "foo"}, &testCommand1{Val: "bar"}}); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("Unable to execute a batch as admin: %v", errs)
+	}
+	if err := s.Barrier(gocontext.Background()); err != nil {
+		t.Fatalf("Unable to append a barrier: %v", err)
+	}
+}
+
+type valSimulator struct{}
+
+func (valSimulator) Simulate(context Context, command Command) (interface{}, error) {
+	return command.(*testCommand1).Val, nil
+}
+
+// Ensure that commands are evaluated without being appended.
+func TestServerDryRun(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetNOPPolicy(NeverNOPPolicy)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	index := s.(*server).log.currentIndex()
+
+	if value, err := s.DryRun(&testDryRunCommand{}); err != nil || value != index+1 {
+		t.Fatalf("Unexpected dry run: %v %v", value, err)
+	}
+	if _, err := s.DryRun(&testCommand1{Val: "foo"}); err != DryRunUnsupportedError {
+		t.Fatalf("Expected DryRunUnsupportedError, got %v", err)
+	}
+	s.SetSimulator(valSimulator{})
+	if value, err := s.DryRun(&testCommand1{Val: "foo"}); err != nil || value != "foo" {
+		t.Fatalf("Unexpected simulation: %v %v", value, err)
+	}
+	s.SetCommandValidator(valCommandValidator{})
+	if _, err := s.DryRun(&testCommand1{}); err == nil || err.Error() != "missing value" {
+		t.Fatalf("Expected the command to be refused, got %v", err)
+	}
+
+	if i := s.(*server).log.currentIndex(); i != index {
+		t.Fatalf("Dry runs should not append entries: %d != %d", i, index)
+	}
+}
+
+type versionChecker string
+
+func (v versionChecker) CheckCondition(context Context, condition string, command Command) error {
+	if condition != string(v) {
+		return fmt.Errorf("version is %s", string(v))
+	}
+	return nil
+}
+
+// Ensure that conditional commands are only applied if their condition holds.
+func TestServerConditionalCommand(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if err := s.SetApplyErrorPolicy(HaltApplyErrorPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Do(NewConditionalCommand("v1", &testEpochCommand{})); err == nil {
+		t.Fatal("Expected a conditional command without a condition checker to be refused")
+	}
+	s.SetConditionChecker(versionChecker("v1"))
+	if _, err := s.Do(NewConditionalCommand("v1", &DefaultLeaveCommand{Name: s.Name()})); err == nil {
+		t.Fatal("Expected a conditional configuration change to be refused")
+	}
+
+	if value, err := s.Do(NewConditionalCommand("v1", &testEpochCommand{})); err != nil || value != s.Term() {
+		t.Fatalf("Unexpected result: %v %v", value, err)
+	}
+	_, err := s.Do(NewConditionalCommand("v0", &testEpochCommand{}))
+	if conflict, ok := err.(*ConflictError); !ok || !errors.Is(err, ConditionFailedError) || conflict.Condition != "v0" || conflict.Err.Error() != "version is v1" {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+
+	// A conflict is not a failure to apply.
+	if len(s.ApplyFailures()) != 0 {
+		t.Fatalf("Unexpected apply failures: %v", s.ApplyFailures())
+	}
+	if _, err := s.Do(&testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to execute a command after a conflict: %v", err)
+	}
+
+	// Conditional commands are deduplicated as the commands they wrap are.
+	for _, wrap := range []func() Command{
+		func() Command { return NewConditionalCommand("v1", &testIdempotentCommand{Key: "key"}) },
+		func() Command { return NewConditionalCommand("v1", &testSessionCommand{Client: "client", Seq: 1}) },
+	} {
+		first, err := s.Do(wrap())
+		if err != nil {
+			t.Fatalf("Unable to execute: %v", err)
+		}
+		if value, err := s.Do(wrap()); err != nil || value != first {
+			t.Fatalf("Expected the command to be applied once: %v %v %v", first, value, err)
+		}
+	}
+	e, _ := newLogEntry(nil, nil, 1, 1, NewConditionalCommand("v1", &testSessionCommand{Client: "client", Seq: 2}))
+	if e.ClientID() != "client" || e.Sequence() != 2 {
+		t.Fatalf("Expected the entry to be in the session: %q %d", e.ClientID(), e.Sequence())
+	}
+	if e, _ = newLogEntry(nil, nil, 1, 1, NewConditionalCommand("v1", &testIdempotentCommand{Key: "key"})); e.IdempotencyKey() != "key" {
+		t.Fatalf("Expected the entry to have the idempotency key: %q", e.IdempotencyKey())
+	}
+
+	// Conditional commands are decoded with their command.
+	e, _ = newLogEntry(nil, nil, 1, 1, NewConditionalCommand("v1", &testCommand1{Val: "foo"}))
+	command, err := e.decodeCommand()
+	if conditional, ok := command.(*ConditionalCommand); err != nil || !ok || conditional.Condition != "v1" || conditional.Command.(*testCommand1).Val != "foo" {
+		t.Fatalf("Unable to decode: %v %v", command, err)
+	}
+}
+
+// Ensure that read-only commands committed together are applied with their
+// own results.
+func TestServerReadOnlyCommands(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+
+	// Listeners and hooks are called one at a time, in the order of the log.
+	var mutex sync.Mutex
+	var inside int32
+	var calls []string
+	record := func(call string, e *LogEntry) {
+		if atomic.AddInt32(&inside, 1) != 1 {
+			t.Errorf("Expected %s %d not to be called concurrently", call, e.Index())
+		}
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		calls = append(calls, fmt.Sprintf("%s %d", call, e.Index()))
+		mutex.Unlock()
+		atomic.AddInt32(&inside, -1)
+	}
+	s.AddEventListener(CommitEventType, func(e Event) {
+		record("commit", e.Value().(*LogEntry))
+	})
+	s.RegisterApplyHook(func(e *LogEntry) {
+		record("before", e)
+	}, func(e *LogEntry, result interface{}, err error) {
+		record("after", e)
+	})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	commands := make([]Command, 10)
+	for i := range commands {
+		commands[i] = &testReadCommand{}
+	}
+	values, errs := s.DoBatch(commands)
+	for i := range commands {
+		if errs[i] != nil || (i > 0 && values[i] != values[i-1].(uint64)+1) {
+			t.Fatalf("%d. Unexpected result: %v %v", i, values[i], errs[i])
+		}
+	}
+
+	var expected []string
+	for _, call := range []string{"commit", "before", "after"} {
+		for _, value := range values {
+			expected = append(expected, fmt.Sprintf("%s %d", call, value))
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(calls) < len(expected) || !reflect.DeepEqual(calls[len(calls)-len(expected):], expected) {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+}
+
+// Ensure that a command stops waiting for commitment once its context is done.
+func TestServerDoContext(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), testHeartbeatInterval)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.DoContext(ctx, &testCommand1{Val: "foo", I: 10}); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*testElectionTimeout {
+		t.Fatalf("DoContext returned after %v", elapsed)
+	}
+}
+
+// Ensure that commands executed asynchronously complete their futures.
+func TestServerDoAsync(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	if err := s.DoAsync(&testCommand1{}).Err(); err != StopError {
+		t.Fatalf("Expected StopError, got %v", err)
+	}
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	futures := make([]*Future, 10)
+	for i := range futures {
+		futures[i] = s.DoAsync(&testSessionCommand{})
+	}
+	for i, f := range futures {
+		<-f.Done()
+		value, err := f.Result()
+		if err != nil || value != f.Index() || f.Index() != futures[0].Index()+uint64(i) {
+			t.Fatalf("Unexpected result of command %d at index %d: %v %v", i, f.Index(), value, err)
+		}
+	}
+}
+
+// Ensure that a batch of commands is appended as consecutive entries.
+func TestServerDoBatch(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	values, errs := s.DoBatch([]Command{&testEpochCommand{}, &testEpochCommand{}, &testEpochCommand{}})
+	for i, err := range errs {
+		if err != nil || values[i] != s.Term() {
+			t.Fatalf("Unexpected result of command %d: %v %v", i, values[i], err)
+		}
+	}
+	var indexes []uint64
+	for _, entry := range s.LogEntries() {
+		if entry.CommandName() == "cmd_epoch" {
+			indexes = append(indexes, entry.Index())
+		}
+	}
+	if len(indexes) != 3 || indexes[1] != indexes[0]+1 || indexes[2] != indexes[0]+2 {
+		t.Fatalf("Expected three consecutive entries, got %v", indexes)
+	}
+
+	_, errs = s.DoBatch([]Command{&testEpochCommand{}, &DefaultJoinCommand{Name: "2"}})
+	if errs[0] != ConfigurationBatchError || errs[1] != ConfigurationBatchError {
+		t.Fatalf("Expected ConfigurationBatchError, got %v", errs)
+	}
+}
+
+// Ensure that a barrier waits for the commands appended before it.
+func TestServerBarrier(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if err := s.Barrier(gocontext.Background()); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	futures := make([]*Future, 5)
+	for i := range futures {
+		futures[i] = s.DoAsync(&testEpochCommand{})
+	}
+	if err := s.Barrier(gocontext.Background()); err != nil {
+		t.Fatalf("Barrier failed: %v", err)
+	}
+	for i, f := range futures {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatalf("Command %d was not applied before the barrier", i)
+		}
+	}
+}
+
+// Ensure that the index and the term of a command's entry are returned.
+func TestServerDoResult(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	result, err := s.DoResult(gocontext.Background(), &testEpochCommand{})
+	if err != nil || result.Value != s.Term() || result.Term != s.Term() {
+		t.Fatalf("Unexpected result: %+v %v", result, err)
+	}
+	for _, entry := range s.LogEntries() {
+		if entry.CommandName() == "cmd_epoch" && entry.Index() != result.Index {
+			t.Fatalf("Expected index %d, got %d", entry.Index(), result.Index)
+		}
+	}
+}
+
+// Ensure that a follower names the leader it knows when it refuses a request.
+func TestServerLeaderHint(t *testing.T) {
+	s := newTestServer("2", &testTransporter{})
+	s.AddPeer("1", "http://1")
+	s.Start()
+	defer s.Stop()
+
+	if err := s.StepDown(); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError without a known leader, got %v", err)
+	}
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "1", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+
+	err := s.StepDown()
+	hint, ok := err.(*LeaderHintError)
+	if !ok || hint.Leader != "1" || hint.ConnectionString != "http://1" {
+		t.Fatalf("Expected a leader hint, got %v", err)
+	}
+	if !errors.Is(err, NotLeaderError) {
+		t.Fatalf("A leader hint should be a NotLeaderError")
+	}
+}
+
+// Ensure that a server waits until an index has been applied.
+func TestServerWaitApplied(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	e1, _ := newLogEntry(nil, nil, 1, 1, &testCommand1{Val: "foo", I: 10})
+	e2, _ := newLogEntry(nil, nil, 2, 1, &testCommand1{Val: "bar", I: 20})
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 1, "ldr", []*LogEntry{e1, e2})); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	if err := s.WaitApplied(gocontext.Background(), 1); err != nil {
+		t.Fatalf("Index 1 should be applied: %v", err)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), testHeartbeatInterval)
+	defer cancel()
+	if err := s.WaitApplied(ctx, 2); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WaitApplied(gocontext.Background(), 2)
+	}()
+	if resp := s.AppendEntries(newAppendEntriesRequest(1, 2, 1, 2, "ldr", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(testElectionTimeout):
+		t.Fatalf("Index 2 should be applied")
+	}
+}
+
+// Ensure that a read given a session token sees the write it records.
+func TestServerReadAfter(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	result, err := s.DoResult(gocontext.Background(), &testEpochCommand{})
+	if err != nil || result.Token != SessionToken(result.Index) {
+		t.Fatalf("Unexpected result: %+v %v", result, err)
+	}
+	token, err := ParseSessionToken(result.Token.String())
+	if err != nil || token != result.Token {
+		t.Fatalf("Unable to parse token %v: %v", result.Token, err)
+	}
+	if token.Merge(1) != token || SessionToken(1).Merge(token) != token {
+		t.Fatalf("Merge should keep the later token")
+	}
+
+	read := func() (interface{}, error) {
+		return "foo", nil
+	}
+	if value, err := s.ReadAfter(gocontext.Background(), token, read); value != "foo" || err != nil {
+		t.Fatalf("Unexpected read: %v %v", value, err)
+	}
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), testHeartbeatInterval)
+	defer cancel()
+	if _, err := s.ReadAfter(ctx, token+100, read); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+// Ensure that the leader refuses commands once too many are pending.
+func TestServerMaxPendingCommands(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if err := s.Barrier(gocontext.Background()); err != nil {
+		t.Fatalf("Barrier failed: %v", err)
+	}
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+	s.SetMaxPendingCommands(2)
+
+	s.DoAsync(&testCommand1{})
+	s.DoAsync(&testCommand1{})
+	if _, err := s.Do(&testCommand1{}); err != OverloadedError {
+		t.Fatalf("Expected OverloadedError, got %v", err)
+	}
+	if _, errs := s.DoBatch([]Command{&testCommand1{}}); errs[0] != OverloadedError {
+		t.Fatalf("Expected OverloadedError, got %v", errs[0])
+	}
+}
+
+// Ensure that commands encoded larger than the maximum command size are
+// refused before they are appended.
+func TestServerMaxCommandSize(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	s.SetMaxCommandSize(64)
+	index := s.(*server).log.currentIndex()
+
+	large := &testCommand1{Val: string(bytes.Repeat([]byte("x"), 64))}
+	if _, err := s.Do(large); err != CommandTooLargeError {
+		t.Fatalf("Expected CommandTooLargeError, got %v", err)
+	}
+	if _, err := s.DoAsync(large).Result(); err != CommandTooLargeError {
+		t.Fatalf("Expected CommandTooLargeError, got %v", err)
+	}
+	if _, errs := s.DoBatch([]Command{&testCommand1{Val: "foo"}, large}); errs[0] != CommandTooLargeError {
+		t.Fatalf("Expected CommandTooLargeError, got %v", errs[0])
+	}
+	if s.(*server).log.currentIndex() != index {
+		t.Fatalf("Expected no entries to be appended, got %d", s.(*server).log.currentIndex()-index)
+	}
+
+	if _, err := s.Do(&testCommand1{Val: "foo"}); err != nil {
+		t.Fatalf("Unable to execute a small command: %v", err)
+	}
+	s.SetMaxCommandSize(0)
+	if _, err := s.Do(large); err != nil {
+		t.Fatalf("Unable to execute a command without a limit: %v", err)
+	}
+}
+
+// Ensure that a command whose caller stopped waiting is applied without one.
+func TestServerAbandonedCommand(t *testing.T) {
+	var mutex sync.Mutex
+	reachable := true
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			return nil
+		}
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2"}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	abandoned := make(chan *LogEntry, 1)
+	s.AddEventListener(AbandonEventType, func(e Event) {
+		abandoned <- e.Value().(*LogEntry)
+	})
+
+	mutex.Lock()
+	reachable = false
+	mutex.Unlock()
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), testHeartbeatInterval)
+	defer cancel()
+	if _, err := s.DoContext(ctx, &testEpochCommand{}); err != gocontext.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	mutex.Lock()
+	reachable = true
+	mutex.Unlock()
+	select {
+	case entry := <-abandoned:
+		if entry.CommandName() != "cmd_epoch" {
+			t.Fatalf("Unexpected abandoned command: %s", entry.CommandName())
+		}
+	case <-time.After(testElectionTimeout):
+		t.Fatalf("The abandoned command should be applied")
+	}
+}
+
+// Ensure that the leader reports how far behind a peer is.
+func TestServerPeerStatus(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.SetHeartbeatInterval(time.Second)
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	s.(*server).peers["2"].setPrevLogIndex(1)
+
+	status, err := s.PeerStatus("2")
+	if err != nil {
+		t.Fatalf("Unable to get peer status: %v", err)
+	}
+	lag := s.(*server).log.currentIndex() - 1
+	if status.MatchIndex != 1 || status.NextIndex != 2 || status.LagEntries != lag || status.LagBytes <= 0 {
+		t.Fatalf("Invalid peer status: %+v", status)
+	}
+
+	if _, err := s.PeerStatus("3"); err == nil {
+		t.Fatalf("Expected error for an unknown peer")
+	}
+}
+
+// Ensure that new entries are sent straight away to peers in the leader's zone
+// and with the next heartbeat to peers in other zones.
+func TestServerZoneReplication(t *testing.T) {
+	var mutex sync.Mutex
+	received := map[string]int{}
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.Lock()
+		received[peer.Name] += len(req.Entries)
+		mutex.Unlock()
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(time.Second)
+	s.Start()
+	defer s.Stop()
+
+	zone := func(name string) map[string]string {
+		return map[string]string{ZoneMetadataKey: name}
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1", Metadata: zone("a")}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	for name, z := range map[string]string{"2": "a", "3": "b"} {
+		if _, err := s.Do(&DefaultJoinCommand{Name: name, Role: LearnerRole, Metadata: zone(z)}); err != nil {
+			t.Fatalf("Unable to join %s: %v", name, err)
+		}
+	}
+
+	mutex.Lock()
+	received = map[string]int{}
+	mutex.Unlock()
+	if _, err := s.Do(&testCommand1{}); err != nil {
+		t.Fatalf("Unable to apply command: %v", err)
+	}
+	time.Sleep(testHeartbeatInterval)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if received["2"] == 0 {
+		t.Fatalf("Peer in the leader's zone should receive entries straight away")
+	}
+	if received["3"] != 0 {
+		t.Fatalf("Peer in another zone should wait for its heartbeat")
+	}
+}
+
+// Ensure that joins past MaxPeerCount follow the join policy.
+func TestServerJoinPolicy(t *testing.T) {
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return newAppendEntriesResponse(req.Term, true, req.PrevLogIndex+uint64(len(req.Entries)), req.CommitIndex)
+	}
+	s := newTestServer("1", transporter)
+	s.SetHeartbeatInterval(testHeartbeatInterval)
+	s.SetMaxPeerCount(1)
+	s.Start()
+	defer s.Stop()
+
+	for _, name := range []string{"1", "2"} {
+		if _, err := s.Do(&DefaultJoinCommand{Name: name}); err != nil {
+			t.Fatalf("Unable to join %s: %v", name, err)
+		}
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "3"}); err != ClusterFullError {
+		t.Fatalf("Expected ClusterFullError, got %v", err)
+	}
+
+	if err := s.SetJoinPolicy(LearnerJoinPolicy); err != nil {
+		t.Fatalf("Unable to set join policy: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "3"}); err != nil {
+		t.Fatalf("Unable to join as learner: %v", err)
+	}
+	if peer := s.Peers()["3"]; peer == nil || peer.Role != LearnerRole {
+		t.Fatalf("Expected learner: %v", peer)
+	}
+
+	s.SetJoinPolicy(QueueJoinPolicy)
+	joined := make(chan error, 1)
+	go func() {
+		_, err := s.Do(&DefaultJoinCommand{Name: "4"})
+		joined <- err
+	}()
+	select {
+	case err := <-joined:
+		t.Fatalf("Join should be queued: %v", err)
+	case <-time.After(2 * testHeartbeatInterval):
+	}
+
+	s.SetMaxPeerCount(2)
+	select {
+	case err := <-joined:
+		if err != nil {
+			t.Fatalf("Unable to join queued peer: %v", err)
+		}
+	case <-time.After(10 * testHeartbeatInterval):
+		t.Fatalf("Queued join was not admitted")
+	}
+	if peer := s.Peers()["4"]; peer == nil || !peer.Voting() {
+		t.Fatalf("Expected voter: %v", peer)
+	}
+
+	// Only joins are held to the limit, not other changes naming a server
+	// that is not a member.
+	for _, policy := range []string{RejectJoinPolicy, QueueJoinPolicy} {
+		s.SetJoinPolicy(policy)
+		for _, command := range []Command{
+			&DefaultChangePeerAddressCommand{Name: "5", ConnectionString: "http://5"},
+			&DefaultLeaveCommand{Name: "5"},
+			&DefaultPromoteCommand{Name: "5"},
+			&DefaultDemoteCommand{Name: "5"},
+		} {
+			ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 10*testHeartbeatInterval)
+			_, err := s.DoContext(ctx, command)
+			cancel()
+			if err == ClusterFullError || err == gocontext.DeadlineExceeded {
+				t.Fatalf("%s: %s should not be held to the limit: %v", policy, command.CommandName(), err)
+			}
+		}
+	}
+
+	if err := s.SetJoinPolicy("bogus"); err == nil {
+		t.Fatalf("Expected error setting an invalid join policy")
+	}
+}
+
+type versionJoinValidator string
+
+func (v versionJoinValidator) ValidateJoin(member *DefaultJoinCommand, command JoinCommand) error {
+	if member.Metadata["version"] != string(v) {
+		return fmt.Errorf("incompatible version: %s", member.Metadata["version"])
+	}
+	return nil
+}
+
+// Ensure that a dry-run join reports whether the join would be accepted.
+func TestServerValidateJoin(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.ValidateJoin(&DefaultJoinCommand{Name: "2"}); err != NotLeaderError {
+		t.Fatalf("Expected NotLeaderError, got %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", ConnectionString: "http://2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	s.SetMaxPeerCount(1)
+	s.SetJoinValidator(versionJoinValidator("2"))
+	version := map[string]string{"version": "2"}
+
+	tests := []struct {
+		command  *DefaultJoinCommand
+		accepted bool
+		role     string
+	}{
+		{&DefaultJoinCommand{Name: "2", ConnectionString: "http://2", Metadata: version}, true, ""},
+		{&DefaultJoinCommand{Name: "2", ConnectionString: "http://other", Metadata: version}, true, ""},
+		{&DefaultJoinCommand{Name: "3", Metadata: map[string]string{"version": "1"}}, false, ""},
+		{&DefaultJoinCommand{Name: "3", Metadata: version, Role: LearnerRole}, true, LearnerRole},
+		{&DefaultJoinCommand{Name: "3", Metadata: version}, true, ""},
+	}
+	for i, tt := range tests {
+		verdict, err := s.ValidateJoin(tt.command)
+		if err != nil {
+			t.Fatalf("%d. Unable to validate join: %v", i, err)
+		}
+		if verdict.Accepted != tt.accepted || verdict.Role != tt.role || (!verdict.Accepted && verdict.Reason == "") {
+			t.Fatalf("%d. Invalid verdict: %+v", i, verdict)
+		}
+	}
+
+	s.SetMaxPeerCount(0)
+	if verdict, _ := s.ValidateJoin(&DefaultJoinCommand{Name: "3", Metadata: version}); verdict.Accepted || verdict.Reason != ClusterFullError.Error() {
+		t.Fatalf("Expected a full cluster: %+v", verdict)
+	}
+	if len(s.Peers()) != 1 {
+		t.Fatalf("Dry-run joins should not change the configuration: %v", s.Peers())
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "4", Role: LearnerRole}); err == nil {
+		t.Fatalf("Expected the validator to refuse the join")
+	}
+}
+
+// Ensure that applied configuration changes dispatch the old and new members.
+func TestServerConfigurationChangeEvent(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	var changes []Event
+	s.AddEventListener(ConfigurationChangeEventType, func(e Event) {
+		changes = append(changes, e)
+	})
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join peer: %v", err)
+	}
+	if _, err := s.Do(&testCommand1{}); err != nil {
+		t.Fatalf("Unable to apply command: %v", err)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Invalid configuration change count: %d", len(changes))
+	}
+	first := changes[0].Value().(*ConfigurationChangeEventInfo)
+	info := changes[1].Value().(*ConfigurationChangeEventInfo)
+	prev := changes[1].PrevValue().(*ConfigurationChangeEventInfo)
+	if info.Command != "raft:join" || info.Index <= first.Index || info.Index != prev.Index {
+		t.Fatalf("Invalid configuration change: %v", info)
+	}
+	if len(prev.Peers) != 1 || len(info.Peers) != 2 {
+		t.Fatalf("Invalid configuration change peers: %v -> %v", prev.Peers, info.Peers)
+	}
+	if info.Peers[0].Name != "2" || info.Peers[0].Role != LearnerRole {
+		t.Fatalf("Invalid joined peer: %v", info.Peers[0])
+	}
+}
+
+// Ensure that learners are not counted towards the quorum.
+func TestServerQuorumExcludesLearners(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+
+	for _, name := range []string{"2", "3", "4"} {
+		if err := s.AddPeer(name, ""); err != nil {
+			t.Fatalf("Unable to add peer %s: %v", name, err)
+		}
+	}
+	if s.QuorumSize() != 3 {
+		t.Fatalf("Invalid quorum size: %d", s.QuorumSize())
+	}
+
+	s.SetPeerRole("3", LearnerRole)
+	s.SetPeerRole("4", LearnerRole)
+	if s.MemberCount() != 4 {
+		t.Fatalf("Invalid member count: %d", s.MemberCount())
+	}
+	if s.QuorumSize() != 2 {
+		t.Fatalf("Invalid quorum size with learners: %d", s.QuorumSize())
+	}
+	if s.Peers()["3"].Voting() {
+		t.Fatalf("Learner should not be voting")
+	}
+
+	if err := s.SetPeerRole("5", LearnerRole); err == nil {
+		t.Fatalf("Expected error setting role of unknown peer")
+	}
+	if err := s.SetPeerRole("2", "observer"); err == nil {
+		t.Fatalf("Expected error setting invalid role")
+	}
+}
+
+// Ensure that the leader promotes a learner once it has caught up.
+func TestServerPromoteLearner(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return lookup[peer.Name].RequestVote(req)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	leader := newTestServer("1", transporter)
+	leader.SetHeartbeatInterval(testHeartbeatInterval)
+	leader.SetLearnerPromotionDistance(1)
+	promoted := make(chan string, 1)
+	leader.AddEventListener(PromotePeerEventType, func(e Event) {
+		promoted <- e.Value().(string)
+	})
+	lookup["1"] = leader
+
+	learner := newTestServer("2", transporter)
+	learner.SetElectionTimeout(testElectionTimeout)
+	lookup["2"] = learner
+
+	leader.Start()
+	defer leader.Stop()
+	learner.Start()
+	defer learner.Stop()
+
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join leader: %v", err)
+	}
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole}); err != nil {
+		t.Fatalf("Unable to join learner: %v", err)
+	}
+
+	select {
+	case name := <-promoted:
+		if name != "2" {
+			t.Fatalf("Unexpected peer promoted: %s", name)
+		}
+	case <-time.After(10 * testHeartbeatInterval):
+		t.Fatalf("Learner was not promoted")
+	}
+	if !leader.Peers()["2"].Voting() {
+		t.Fatalf("Peer should be a voter after promotion")
+	}
+}
+
+// Ensure that a witness votes and replicates entries without payloads but
+// never campaigns.
+func TestServerWitness(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	leader := newTestServer("1", transporter)
+	leader.SetHeartbeatInterval(testHeartbeatInterval)
+	lookup["1"] = leader
+	witness := newTestServer("2", transporter)
+	witness.SetElectionTimeout(testElectionTimeout)
+	lookup["2"] = witness
+
+	leader.Start()
+	defer leader.Stop()
+	witness.Start()
+	defer witness.Stop()
+
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join leader: %v", err)
+	}
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "2", Role: WitnessRole}); err != nil {
+		t.Fatalf("Unable to join witness: %v", err)
+	}
+	if leader.QuorumSize() != 2 {
+		t.Fatalf("Witness should count towards the quorum: %d", leader.QuorumSize())
+	}
+	if _, err := leader.Do(&testCommand1{Val: "foo", I: 10}); err != nil {
+		t.Fatalf("Unable to replicate command: %v", err)
+	}
+
+	time.Sleep(2 * testElectionTimeout)
+
+	if witness.State() != Follower || witness.Role() != WitnessRole {
+		t.Fatalf("Witness should stay a follower: %v/%v", witness.State(), witness.Role())
+	}
+	for _, entry := range witness.(*server).log.entries {
+		if entry.CommandName() == "cmd_1" {
+			t.Fatalf("Witness should not store command payloads")
+		}
+	}
+	if witness.CommitIndex() != leader.CommitIndex() {
+		t.Fatalf("Witness commit index mismatch: %d/%d", witness.CommitIndex(), leader.CommitIndex())
+	}
+}
+
+// Ensure that a joint configuration needs a majority of both the old and
+// the new voters.
+func TestServerJointQuorum(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+	s.joint = &jointConfiguration{
+		old: map[string]int{"1": 1, "2": 1, "3": 1},
+		new: map[string]int{"3": 1, "4": 1, "5": 1},
+	}
+
+	if s.hasCommitQuorum(map[string]bool{"1": true, "2": true}) {
+		t.Fatalf("Old majority alone should not be a quorum")
+	}
+	if s.hasCommitQuorum(map[string]bool{"3": true, "4": true, "5": true}) {
+		t.Fatalf("New majority alone should not be a quorum")
+	}
+	if !s.hasCommitQuorum(map[string]bool{"1": true, "3": true, "4": true}) {
+		t.Fatalf("Majority of both configurations should be a quorum")
+	}
+}
+
+// Ensure that elections and commitment count weighted majorities.
+func TestServerWeightedQuorum(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+
+	for _, name := range []string{"2", "3"} {
+		if err := s.AddPeer(name, ""); err != nil {
+			t.Fatalf("Unable to add peer %s: %v", name, err)
+		}
+	}
+	if s.hasCommitQuorum(map[string]bool{"1": true}) {
+		t.Fatalf("Single unweighted vote should not be a quorum")
+	}
+
+	s.SetPeerWeight("1", 3)
+	if s.Weight() != 3 {
+		t.Fatalf("Invalid weight: %d", s.Weight())
+	}
+	if !s.hasCommitQuorum(map[string]bool{"1": true}) {
+		t.Fatalf("Heavier member alone should be a quorum")
+	}
+	if s.hasCommitQuorum(map[string]bool{"2": true, "3": true}) {
+		t.Fatalf("Lighter members should not be a quorum")
+	}
+	if s.QuorumSize() != 1 {
+		t.Fatalf("Invalid weighted quorum size: %d", s.QuorumSize())
+	}
+
+	indices := map[string]uint64{"1": 5, "2": 9, "3": 9}
+	index := quorumIndex(MajorityQuorumPolicy{}, s.voters(), func(name string) uint64 { return indices[name] })
+	if index != 5 {
+		t.Fatalf("Invalid weighted commit index: %d", index)
+	}
+
+	if err := s.SetPeerWeight("2", -1); err == nil {
+		t.Fatalf("Expected error setting negative weight")
+	}
+}
+
+// A policy that requires every voter.
+type unanimousQuorumPolicy struct{}
+
+func (unanimousQuorumPolicy) ElectionQuorum(voters map[string]int, acks map[string]bool) bool {
+	return unanimous(voters, acks)
+}
+
+func (unanimousQuorumPolicy) CommitQuorum(voters map[string]int, acks map[string]bool) bool {
+	return unanimous(voters, acks)
+}
+
+func unanimous(voters map[string]int, acks map[string]bool) bool {
+	for name := range voters {
+		if !acks[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Ensure that a custom quorum policy decides elections and commitment.
+func TestServerQuorumPolicy(t *testing.T) {
+	s := newTestServer("1", &testTransporter{}).(*server)
+
+	for _, name := range []string{"2", "3"} {
+		if err := s.AddPeer(name, ""); err != nil {
+			t.Fatalf("Unable to add peer %s: %v", name, err)
+		}
+	}
+	s.SetQuorumPolicy(unanimousQuorumPolicy{})
+
+	if s.hasElectionQuorum(map[string]bool{"1": true, "2": true}) {
+		t.Fatalf("Majority should not elect under a unanimous policy")
+	}
+	if !s.hasCommitQuorum(map[string]bool{"1": true, "2": true, "3": true}) {
+		t.Fatalf("All voters should be a quorum")
+	}
+	if s.QuorumSize() != 3 {
+		t.Fatalf("Invalid unanimous quorum size: %d", s.QuorumSize())
+	}
+
+	indices := map[string]uint64{"1": 5, "2": 9, "3": 7}
+	if index := quorumIndex(s.QuorumPolicy(), s.voters(), func(name string) uint64 { return indices[name] }); index != 5 {
+		t.Fatalf("Invalid unanimous commit index: %d", index)
+	}
+
+	s.SetQuorumPolicy(nil)
+	if _, ok := s.QuorumPolicy().(MajorityQuorumPolicy); !ok {
+		t.Fatalf("Expected nil policy to restore the majority policy")
+	}
+}
+
+// Ensure that several members can be replaced in one membership change.
+func TestServerMembershipChange(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return lookup[peer.Name].RequestVote(req)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	var servers []Server
+	for _, name := range []string{"1", "2", "3"} {
+		s := newTestServer(name, transporter)
+		s.SetHeartbeatInterval(testHeartbeatInterval)
+		s.SetElectionTimeout(testElectionTimeout)
+		s.Start()
+		defer s.Stop()
+		lookup[name] = s
+		servers = append(servers, s)
+	}
+	leader := servers[0]
+	removed := make(chan string, 1)
+	leader.AddEventListener(RemovePeerEventType, func(e Event) {
+		if e.Value().(string) == leader.Name() {
+			removed <- leader.Name()
+		}
+	})
+
+	if _, err := leader.Do(&DefaultJoinCommand{Name: "1"}); err != nil {
+		t.Fatalf("Unable to join leader: %v", err)
+	}
+	change := &DefaultMembershipChangeCommand{Peers: []*Peer{{Name: "2"}, {Name: "3"}}}
+	if _, err := leader.Do(change); err != nil {
+		t.Fatalf("Unable to change membership: %v", err)
+	}
+
+	select {
+	case <-removed:
+	case <-time.After(10 * testHeartbeatInterval):
+		t.Fatalf("Membership change was not committed")
+	}
+	if leader.State() == Leader {
+		t.Fatalf("Removed leader should step down")
+	}
+	if leader.(*server).joint != nil {
+		t.Fatalf("Joint configuration should be cleared")
+	}
+	if len(leader.Peers()) != 2 {
+		t.Fatalf("Invalid peers after membership change: %v", leader.Peers())
+	}
+}
+
+// Ensure that a leader leaving the cluster hands leadership to a peer
+// instead of waiting for an election timeout.
+func TestServerLeaderLeaveHandOff(t *testing.T) {
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		return lookup[peer.Name].RequestVote(req)
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	var servers []Server
+	for _, name := range []string{"1", "2", "3"} {
+		s := newTestServer(name, transporter)
+		s.SetHeartbeatInterval(testHeartbeatInterval)
+		s.SetElectionTimeout(testElectionTimeout)
+		s.Start()
+		defer s.Stop()
+		lookup[name] = s
+		servers = append(servers, s)
+	}
+	leader := servers[0]
+
+	for _, s := range servers {
+		if _, err := leader.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+			t.Fatalf("Unable to join %s: %v", s.Name(), err)
+		}
+	}
+	if _, err := leader.Do(&DefaultLeaveCommand{Name: leader.Name()}); err != nil {
+		t.Fatalf("Unable to leave: %v", err)
+	}
+
+	// Followers would not time out before the election timeout.
+	deadline := time.After(testElectionTimeout)
+	for servers[1].State() != Leader && servers[2].State() != Leader {
+		select {
+		case <-deadline:
+			t.Fatalf("Leadership was not handed off")
+		case <-time.After(testHeartbeatInterval / 10):
+		}
+	}
+	if leader.State() != Stopped {
+		t.Fatalf("Leader should stop after leaving: %s", leader.State())
+	}
+	if _, err := leader.Do(&testCommand1{}); err == nil {
+		t.Fatalf("Leaving leader should not accept commands")
+	}
+}
+
+// Ensure that a stopping leader hands leadership to a peer.
+func TestServerStopHandsOffLeadership(t *testing.T) {
+	var mutex sync.RWMutex
+	lookup := map[string]Server{}
+	transporter := &testTransporter{}
+	transporter.sendVoteRequestFunc = func(s Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
+		mutex.RLock()
+		defer mutex.RUnlock()
+		resp := lookup[peer.Name].RequestVote(req)
+		return resp
+	}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		mutex.RLock()
+		defer mutex.RUnlock()
+		return lookup[peer.Name].AppendEntries(req)
+	}
+
+	var servers []Server
+	for _, name := range []string{"1", "2", "3"} {
+		s := newTestServer(name, transporter)
+		s.SetHeartbeatInterval(testHeartbeatInterval)
+		s.SetElectionTimeout(testElectionTimeout)
+		s.Start()
+		defer s.Stop()
+		mutex.Lock()
+		lookup[name] = s
+		mutex.Unlock()
+		servers = append(servers, s)
+	}
+	leader := servers[0]
+	for _, s := range servers {
+		if _, err := leader.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+			t.Fatalf("Unable to join %s: %v", s.Name(), err)
+		}
+	}
+
+	// Let the followers apply the whole membership.
+	time.Sleep(2 * testHeartbeatInterval)
+
+	start := time.Now()
+	leader.Stop()
+	for servers[1].State() != Leader && servers[2].State() != Leader {
+		if time.Now().Sub(start) > testElectionTimeout {
+			t.Fatalf("Leadership was not handed off")
+		}
+		time.Sleep(testHeartbeatInterval / 10)
+	}
+	if leader.State() != Stopped {
+		t.Fatalf("Leader should have stopped: %s", leader.State())
+	}
+}
+
 //--------------------------------------
 // Append Entries
 //--------------------------------------
@@ -243,7 +3892,7 @@ func TestServerAppendEntries(t *testing.T) {
 	entries := []*LogEntry{e}
 	resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", entries))
 	if resp.Term() != 1 || !resp.Success() {
-		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 	}
 	if index, term := s.(*server).log.commitInfo(); index != 0 || term != 0 {
 		t.Fatalf("Invalid commit info [IDX=%v, TERM=%v]", index, term)
@@ -255,7 +3904,7 @@ func TestServerAppendEntries(t *testing.T) {
 	entries = []*LogEntry{e1, e2}
 	resp = s.AppendEntries(newAppendEntriesRequest(1, 1, 1, 1, "ldr", entries))
 	if resp.Term() != 1 || !resp.Success() {
-		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 	}
 	if index, term := s.(*server).log.commitInfo(); index != 1 || term != 1 {
 		t.Fatalf("Invalid commit info [IDX=%v, TERM=%v]", index, term)
@@ -264,7 +3913,7 @@ func TestServerAppendEntries(t *testing.T) {
 	// Send zero entries and commit everything.
 	resp = s.AppendEntries(newAppendEntriesRequest(2, 3, 1, 3, "ldr", []*LogEntry{}))
 	if resp.Term() != 2 || !resp.Success() {
-		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 	}
 	if index, term := s.(*server).log.commitInfo(); index != 3 || term != 1 {
 		t.Fatalf("Invalid commit info [IDX=%v, TERM=%v]", index, term)
@@ -287,7 +3936,7 @@ func TestServerAppendEntriesWithStaleTermsAreRejected(t *testing.T) {
 	entries := []*LogEntry{e}
 	resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "ldr", entries))
 	if resp.Term() != 2 || resp.Success() {
-		t.Fatalf("AppendEntries should have failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries should have failed: %v/%v", resp.Term(), resp.Success())
 	}
 	if index, term := s.(*server).log.commitInfo(); index != 0 || term != 0 {
 		t.Fatalf("Invalid commit info [IDX=%v, TERM=%v]", index, term)
@@ -306,7 +3955,7 @@ func TestServerAppendEntriesRejectedIfAlreadyCommitted(t *testing.T) {
 	entries := []*LogEntry{e1, e2}
 	resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 2, "ldr", entries))
 	if resp.Term() != 1 || !resp.Success() {
-		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 	}
 
 	// Append entry again (post-commit).
@@ -314,7 +3963,7 @@ func TestServerAppendEntriesRejectedIfAlreadyCommitted(t *testing.T) {
 	entries = []*LogEntry{e}
 	resp = s.AppendEntries(newAppendEntriesRequest(1, 2, 1, 1, "ldr", entries))
 	if resp.Term() != 1 || resp.Success() {
-		t.Fatalf("AppendEntries should have failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries should have failed: %v/%v", resp.Term(), resp.Success())
 	}
 }
 
@@ -332,12 +3981,12 @@ func TestServerAppendEntriesOverwritesUncommittedEntries(t *testing.T) {
 	entries := []*LogEntry{entry1, entry2}
 	resp := s.AppendEntries(newAppendEntriesRequest(1, 0, 0, 1, "ldr", entries))
 	if resp.Term() != 1 || !resp.Success() || s.(*server).log.commitIndex != 1 {
-		t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 	}
 
 	for i, entry := range s.(*server).log.entries {
 		if entry.Term() != entries[i].Term() || entry.Index() != entries[i].Index() || !bytes.Equal(entry.Command(), entries[i].Command()) {
-			t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+			t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 		}
 	}
 
@@ -345,13 +3994,13 @@ func TestServerAppendEntriesOverwritesUncommittedEntries(t *testing.T) {
 	entries = []*LogEntry{entry3}
 	resp = s.AppendEntries(newAppendEntriesRequest(2, 1, 1, 2, "ldr", entries))
 	if resp.Term() != 2 || !resp.Success() || s.(*server).log.commitIndex != 2 {
-		t.Fatalf("AppendEntries should have succeeded: %v/%v", resp.Term, resp.Success)
+		t.Fatalf("AppendEntries should have succeeded: %v/%v", resp.Term(), resp.Success())
 	}
 
 	entries = []*LogEntry{entry1, entry3}
 	for i, entry := range s.(*server).log.entries {
 		if entry.Term() != entries[i].Term() || entry.Index() != entries[i].Index() || !bytes.Equal(entry.Command(), entries[i].Command()) {
-			t.Fatalf("AppendEntries failed: %v/%v", resp.Term, resp.Success)
+			t.Fatalf("AppendEntries failed: %v/%v", resp.Term(), resp.Success())
 		}
 	}
 }
@@ -2,11 +2,14 @@ package raft
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/iproj/raft/protobuf"
@@ -21,15 +24,78 @@ type Snapshot struct {
 	Peers []*Peer `json:"peers"`
 	State []byte  `json:"state"`
 	Path  string  `json:"path"`
+
+	// Manifest is nil for snapshots written before manifests existed.
+	Manifest *SnapshotManifest `json:"manifest,omitempty"`
+
+	// The last sequence applied for each client session as of LastIndex. The
+	// sessions are kept beside the application state so that commands are
+	// still applied once after the snapshot is restored.
+	Sessions map[string]uint64 `json:"sessions,omitempty"`
+
+	// The client sessions from the least to the most recently used, so that
+	// servers restored from the snapshot forget the same sessions as those
+	// that applied the entries.
+	SessionOrder []string `json:"sessionOrder,omitempty"`
+
+	// The idempotency keys applied most recently as of LastIndex, oldest
+	// first.
+	IdempotencyKeys []string `json:"idempotencyKeys,omitempty"`
+}
+
+// SnapshotManifest describes the origin of a snapshot so that a restore can
+// check compatibility before the state is loaded into the state machine.
+type SnapshotManifest struct {
+	ClusterID          string    `json:"clusterID,omitempty"`
+	ConfigurationIndex uint64    `json:"configurationIndex"`
+	SchemaVersion      string    `json:"schemaVersion,omitempty"`
+	Host               string    `json:"host,omitempty"`
+	CreatedAt          time.Time `json:"createdAt"`
+}
+
+// The suffix of snapshot files that are still being written.
+const snapshotTmpSuffix = ".tmp"
+
+// SnapshotEventInfo is the value attached to snapshot lifecycle events. Peer
+// is set for snapshots sent to or installed from another server and Err is
+// set for failures.
+type SnapshotEventInfo struct {
+	LastIndex uint64
+	LastTerm  uint64
+	Size      int64
+	Duration  time.Duration
+	Peer      string
+	Err       error
+}
+
+// SnapshotSource lets the application provide the state of a snapshot when
+// the leader sends it to a follower, for example from its live state or a
+// cached artifact, instead of the leader reading the snapshot file. Open is
+// given the snapshot metadata and the returned reader is read to the end and
+// closed for each transfer.
+type SnapshotSource interface {
+	Open(snapshot *Snapshot) (io.ReadCloser, error)
+}
+
+// sharedSnapshot is a snapshot with its state loaded that is shared between
+// concurrent sends to peers.
+type sharedSnapshot struct {
+	*Snapshot
+	refs int
 }
 
 // The request sent to a server to start from the snapshot.
 type SnapshotRecoveryRequest struct {
-	LeaderName string
-	LastIndex  uint64
-	LastTerm   uint64
-	Peers      []*Peer
-	State      []byte
+	LeaderName      string
+	LastIndex       uint64
+	LastTerm        uint64
+	Peers           []*Peer
+	State           []byte
+	Manifest        *SnapshotManifest
+	ClusterID       string
+	Sessions        map[string]uint64
+	SessionOrder    []string
+	IdempotencyKeys []string
 }
 
 // The response returned from a server appending entries to the log.
@@ -44,6 +110,7 @@ type SnapshotRequest struct {
 	LeaderName string
 	LastIndex  uint64
 	LastTerm   uint64
+	ClusterID  string
 }
 
 // The response returned if the follower entered snapshot state
@@ -51,15 +118,40 @@ type SnapshotResponse struct {
 	Success bool `json:"success"`
 }
 
-// save writes the snapshot to file.
+// save writes the snapshot to file. The snapshot is written to a temporary
+// file first and renamed into place once it is on disk so that a crash
+// never leaves a truncated snapshot behind.
 func (ss *Snapshot) save() error {
+	tmpPath := ss.Path + snapshotTmpSuffix
+
 	// Open the file for writing.
-	file, err := os.OpenFile(ss.Path, os.O_CREATE|os.O_WRONLY, 0600)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
+	if err := ss.write(file); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Atomically move the snapshot into place and make the rename durable.
+	if err := os.Rename(tmpPath, ss.Path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(filepath.Dir(ss.Path))
+}
+
+// write serializes the snapshot with its checksum header and flushes it.
+func (ss *Snapshot) write(file *os.File) error {
 	// Serialize to JSON.
 	b, err := json.Marshal(ss)
 	if err != nil {
@@ -78,11 +170,128 @@ func (ss *Snapshot) save() error {
 	}
 
 	// Ensure that the snapshot has been flushed to disk before continuing.
-	if err := file.Sync(); err != nil {
-		return err
+	return file.Sync()
+}
+
+// SnapshotDetails describes a snapshot file that passed verification.
+type SnapshotDetails struct {
+	Path      string
+	LastIndex uint64
+	LastTerm  uint64
+	Checksum  uint32
+	Size      int64
+	StateSize int
+	Peers     []*Peer
+	Manifest  *SnapshotManifest
+}
+
+// VerifySnapshot opens the snapshot file at the given path and validates its
+// header, checksum and peer configuration without starting a server. It is
+// intended for backup pipelines that need to check snapshot artifacts.
+func VerifySnapshot(path string) (*SnapshotDetails, error) {
+	ss, checksum, err := readSnapshotFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	if ss.LastIndex == 0 {
+		return nil, errors.New("raft.Snapshot: Snapshot has no last index")
+	}
+
+	// Snapshots are named after the term and index they contain.
+	var term, index uint64
+	if n, _ := fmt.Sscanf(filepath.Base(path), "%d_%d.ss", &term, &index); n == 2 {
+		if term != ss.LastTerm || index != ss.LastIndex {
+			return nil, fmt.Errorf("raft.Snapshot: File name does not match contents (TERM=%v, IDX=%v)", ss.LastTerm, ss.LastIndex)
+		}
+	}
+
+	// Validate the peer configuration.
+	if len(ss.Peers) == 0 {
+		return nil, errors.New("raft.Snapshot: Snapshot has no peers")
+	}
+	names := make(map[string]bool)
+	for _, peer := range ss.Peers {
+		if peer == nil || peer.Name == "" {
+			return nil, errors.New("raft.Snapshot: Peer name cannot be blank")
+		}
+		if names[peer.Name] {
+			return nil, fmt.Errorf("raft.Snapshot: Duplicate peer: %s", peer.Name)
+		}
+		names[peer.Name] = true
+	}
+
+	return &SnapshotDetails{
+		Path:      path,
+		LastIndex: ss.LastIndex,
+		LastTerm:  ss.LastTerm,
+		Checksum:  checksum,
+		Size:      ss.fileSize(),
+		StateSize: len(ss.State),
+		Peers:     ss.Peers,
+		Manifest:  ss.Manifest,
+	}, nil
+}
+
+// readSnapshotFile reads a snapshot file, checks its checksum and decodes it.
+func readSnapshotFile(path string) (*Snapshot, uint32, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	// Check checksum.
+	var checksum uint32
+	n, err := fmt.Fscanf(file, "%08x\n", &checksum)
+	if err != nil {
+		return nil, 0, err
+	} else if n != 1 {
+		return nil, 0, errors.New("checksum.err: bad.snapshot.file")
+	}
+
+	// Load remaining snapshot contents.
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Generate checksum.
+	byteChecksum := crc32.ChecksumIEEE(b)
+	if checksum != byteChecksum {
+		debugln(checksum, " ", byteChecksum)
+		return nil, 0, errors.New("bad snapshot file")
+	}
+
+	// Decode snapshot.
+	ss := &Snapshot{}
+	if err = json.Unmarshal(b, ss); err != nil {
+		return nil, 0, err
+	}
+	ss.Path = path
+
+	return ss, checksum, nil
+}
+
+// readSnapshotSource reads the state of a snapshot from an application
+// provided source.
+func readSnapshotSource(source SnapshotSource, snapshot *Snapshot) ([]byte, error) {
+	r, err := source.Open(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// fileSize returns the size of the snapshot file on disk or zero if it
+// cannot be determined.
+func (ss *Snapshot) fileSize() int64 {
+	info, err := os.Stat(ss.Path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 // remove deletes the snapshot file.
@@ -96,11 +305,15 @@ func (ss *Snapshot) remove() error {
 // Creates a new Snapshot request.
 func newSnapshotRecoveryRequest(leaderName string, snapshot *Snapshot) *SnapshotRecoveryRequest {
 	return &SnapshotRecoveryRequest{
-		LeaderName: leaderName,
-		LastIndex:  snapshot.LastIndex,
-		LastTerm:   snapshot.LastTerm,
-		Peers:      snapshot.Peers,
-		State:      snapshot.State,
+		LeaderName:      leaderName,
+		LastIndex:       snapshot.LastIndex,
+		LastTerm:        snapshot.LastTerm,
+		Peers:           snapshot.Peers,
+		State:           snapshot.State,
+		Manifest:        snapshot.Manifest,
+		Sessions:        snapshot.Sessions,
+		SessionOrder:    snapshot.SessionOrder,
+		IdempotencyKeys: snapshot.IdempotencyKeys,
 	}
 }
 
@@ -114,16 +327,34 @@ func (req *SnapshotRecoveryRequest) Encode(w io.Writer) (int, error) {
 		protoPeers[i] = &protobuf.SnapshotRecoveryRequest_Peer{
 			Name:             proto.String(peer.Name),
 			ConnectionString: proto.String(peer.ConnectionString),
+			Role:             proto.String(peer.Role),
+			Metadata:         peer.Metadata,
+			Weight:           proto.Int64(int64(peer.Weight)),
 		}
 	}
 
 	pb := &protobuf.SnapshotRecoveryRequest{
-		LeaderName: proto.String(req.LeaderName),
-		LastIndex:  proto.Uint64(req.LastIndex),
-		LastTerm:   proto.Uint64(req.LastTerm),
-		Peers:      protoPeers,
-		State:      req.State,
+		LeaderName:      proto.String(req.LeaderName),
+		LastIndex:       proto.Uint64(req.LastIndex),
+		LastTerm:        proto.Uint64(req.LastTerm),
+		Peers:           protoPeers,
+		State:           req.State,
+		ClusterID:       proto.String(req.ClusterID),
+		Sessions:        req.Sessions,
+		SessionOrder:    req.SessionOrder,
+		IdempotencyKeys: req.IdempotencyKeys,
+	}
+
+	if m := req.Manifest; m != nil {
+		pb.Manifest = &protobuf.SnapshotRecoveryRequest_Manifest{
+			ClusterID:          proto.String(m.ClusterID),
+			ConfigurationIndex: proto.Uint64(m.ConfigurationIndex),
+			SchemaVersion:      proto.String(m.SchemaVersion),
+			Host:               proto.String(m.Host),
+			CreatedAt:          proto.Int64(m.CreatedAt.UnixNano()),
+		}
 	}
+
 	p, err := proto.Marshal(pb)
 	if err != nil {
 		return -1, err
@@ -152,6 +383,10 @@ func (req *SnapshotRecoveryRequest) Decode(r io.Reader) (int, error) {
 	req.LastIndex = pb.GetLastIndex()
 	req.LastTerm = pb.GetLastTerm()
 	req.State = pb.GetState()
+	req.ClusterID = pb.GetClusterID()
+	req.Sessions = pb.GetSessions()
+	req.SessionOrder = pb.GetSessionOrder()
+	req.IdempotencyKeys = pb.GetIdempotencyKeys()
 
 	req.Peers = make([]*Peer, len(pb.Peers))
 
@@ -159,6 +394,19 @@ func (req *SnapshotRecoveryRequest) Decode(r io.Reader) (int, error) {
 		req.Peers[i] = &Peer{
 			Name:             peer.GetName(),
 			ConnectionString: peer.GetConnectionString(),
+			Role:             peer.GetRole(),
+			Metadata:         peer.GetMetadata(),
+			Weight:           int(peer.GetWeight()),
+		}
+	}
+
+	if m := pb.GetManifest(); m != nil {
+		req.Manifest = &SnapshotManifest{
+			ClusterID:          m.GetClusterID(),
+			ConfigurationIndex: m.GetConfigurationIndex(),
+			SchemaVersion:      m.GetSchemaVersion(),
+			Host:               m.GetHost(),
+			CreatedAt:          time.Unix(0, m.GetCreatedAt()),
 		}
 	}
 
@@ -228,6 +476,7 @@ func (req *SnapshotRequest) Encode(w io.Writer) (int, error) {
 		LeaderName: proto.String(req.LeaderName),
 		LastIndex:  proto.Uint64(req.LastIndex),
 		LastTerm:   proto.Uint64(req.LastTerm),
+		ClusterID:  proto.String(req.ClusterID),
 	}
 	p, err := proto.Marshal(pb)
 	if err != nil {
@@ -257,6 +506,7 @@ func (req *SnapshotRequest) Decode(r io.Reader) (int, error) {
 	req.LeaderName = pb.GetLeaderName()
 	req.LastIndex = pb.GetLastIndex()
 	req.LastTerm = pb.GetLastTerm()
+	req.ClusterID = pb.GetClusterID()
 
 	return totalBytes, nil
 }
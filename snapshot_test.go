@@ -1,9 +1,17 @@
 package raft
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -67,6 +75,563 @@ func TestSnapshotRecovery(t *testing.T) {
 	})
 }
 
+// A state machine that recovers from its state in small reads.
+type streamStateMachine struct {
+	state     []byte
+	recovered []byte
+}
+
+func (sm *streamStateMachine) Save() ([]byte, error) {
+	return sm.state, nil
+}
+
+func (sm *streamStateMachine) Recovery(state []byte) error {
+	panic("expected a streamed recovery")
+}
+
+func (sm *streamStateMachine) RecoverFrom(r io.Reader, size int64) error {
+	sm.recovered = nil
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		sm.recovered = append(sm.recovered, buf[:n]...)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Ensure that recovery observers follow the state machine's recovery.
+func TestSnapshotRecoveryProgress(t *testing.T) {
+	sm := &streamStateMachine{state: bytes.Repeat([]byte("x"), 1000)}
+	s := newTestServer("1", &testTransporter{})
+	s.(*server).stateMachine = sm
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join server to self: %v", err)
+	}
+	assert.NoError(t, s.TakeSnapshot())
+	ss := s.(*server).snapshot
+	s.Stop()
+
+	load := func(sm StateMachine) []RecoveryProgress {
+		var progress []RecoveryProgress
+		newS, _ := NewServer("1", s.Path(), &testTransporter{}, sm, nil, "")
+		newS.RegisterRecoveryObserver(func(p RecoveryProgress) {
+			progress = append(progress, p)
+		})
+		assert.NoError(t, newS.LoadSnapshot())
+		for i, p := range progress {
+			if p.Index != ss.LastIndex || p.Term != ss.LastTerm || p.Total != 1000 || (i > 0 && p.Read <= progress[i-1].Read) {
+				t.Fatalf("Unexpected progress: %+v", progress)
+			}
+		}
+		if len(progress) < 2 || progress[0].Read != 0 || progress[len(progress)-1].Read != 1000 {
+			t.Fatalf("Unexpected progress: %+v", progress)
+		}
+		return progress
+	}
+
+	sm.state = nil
+	if progress := load(sm); len(progress) < 10 || !bytes.Equal(sm.recovered, bytes.Repeat([]byte("x"), 1000)) {
+		t.Fatalf("Expected the state to be reported as it was read: %d reports", len(progress))
+	}
+
+	var m mockStateMachine
+	m.On("Recovery", bytes.Repeat([]byte("x"), 1000)).Return(nil)
+	if progress := load(&m); len(progress) != 2 {
+		t.Fatalf("Expected the start and the end of the recovery: %+v", progress)
+	}
+}
+
+// Ensure that snapshots are written to and loaded from a configured directory.
+func TestSnapshotCustomDir(t *testing.T) {
+	var m mockStateMachine
+	m.On("Save").Return([]byte("foo"), nil)
+	m.On("Recovery", []byte("foo")).Return(nil)
+
+	dir, _ := ioutil.TempDir("", "raft-snapshot-")
+	defer os.RemoveAll(dir)
+
+	s := newTestServer("1", &testTransporter{})
+	s.(*server).stateMachine = &m
+	s.SetSnapshotDir(dir)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join server to self: %v", err)
+	}
+	s.Do(&testCommand1{})
+	assert.NoError(t, s.TakeSnapshot())
+	s.Stop()
+
+	filenames, _ := filepath.Glob(filepath.Join(dir, "*.ss"))
+	assert.Equal(t, len(filenames), 1)
+	filenames, _ = filepath.Glob(filepath.Join(s.Path(), "snapshot", "*.ss"))
+	assert.Equal(t, len(filenames), 0)
+
+	newS, _ := NewServer("1", s.Path(), &testTransporter{}, &m, nil, "")
+	newS.SetSnapshotDir(dir)
+	assert.NoError(t, newS.LoadSnapshot())
+	assert.Equal(t, newS.(*server).snapshot != nil, true)
+}
+
+// Ensure that a snapshot file can be verified without a server and that
+// corruption is detected.
+func TestVerifySnapshot(t *testing.T) {
+	runServerWithMockStateMachine(Leader, func(s Server, m *mock.Mock) {
+		m.On("Save").Return([]byte("foo"), nil)
+
+		s.Do(&testCommand1{})
+		assert.NoError(t, s.TakeSnapshot())
+		ss := s.(*server).snapshot
+
+		details, err := VerifySnapshot(ss.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, details.LastIndex, ss.LastIndex)
+		assert.Equal(t, details.LastTerm, ss.LastTerm)
+		assert.Equal(t, details.StateSize, 3)
+		assert.Equal(t, len(details.Peers), 1)
+
+		// Flip a byte in the body and make sure the checksum catches it.
+		b, _ := ioutil.ReadFile(ss.Path)
+		b[len(b)-2] ^= 0xff
+		corrupt := filepath.Join(s.Path(), "corrupt.ss")
+		ioutil.WriteFile(corrupt, b, 0600)
+		_, err = VerifySnapshot(corrupt)
+		assert.Error(t, err)
+	})
+}
+
+// Ensure that a partially written snapshot left by a crash is never loaded.
+func TestSnapshotIgnoresIncompleteFile(t *testing.T) {
+	runServerWithMockStateMachine(Leader, func(s Server, m *mock.Mock) {
+		m.On("Save").Return([]byte("foo"), nil)
+		m.On("Recovery", []byte("foo")).Return(nil)
+
+		s.Do(&testCommand1{})
+		assert.NoError(t, s.TakeSnapshot())
+		ss := s.(*server).snapshot
+
+		// No temporary file should remain after a successful save.
+		_, err := os.Stat(ss.Path + snapshotTmpSuffix)
+		assert.Equal(t, os.IsNotExist(err), true)
+
+		// Simulate a crash while writing a newer snapshot.
+		tmpPath := s.SnapshotPath(ss.LastIndex+100, ss.LastTerm+100) + snapshotTmpSuffix
+		ioutil.WriteFile(tmpPath, []byte("0000"), 0600)
+
+		s.Stop()
+		assert.NoError(t, s.LoadSnapshot())
+		assert.Equal(t, s.(*server).snapshot.LastIndex, ss.LastIndex)
+		_, err = os.Stat(tmpPath)
+		assert.Equal(t, os.IsNotExist(err), true)
+		s.Start()
+	})
+}
+
+// Ensure that the leader sends a snapshot to several lagging peers in
+// parallel and that the sends share a single copy of the snapshot.
+func TestSnapshotConcurrentSends(t *testing.T) {
+	var m mockStateMachine
+	m.On("Save").Return([]byte("foo"), nil)
+
+	var mutex sync.Mutex
+	inFlight := map[string]bool{}
+	states := map[string]*sharedSnapshot{}
+	both := make(chan bool)
+
+	transporter := &testTransporter{}
+	transporter.sendAppendEntriesRequestFunc = func(s Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+		return nil
+	}
+	transporter.sendSnapshotRequestFunc = func(s Server, peer *Peer, req *SnapshotRequest) *SnapshotResponse {
+		mutex.Lock()
+		inFlight[peer.Name] = true
+		s.(*server).snapshotMutex.Lock()
+		states[peer.Name] = s.(*server).sharedSnapshot
+		s.(*server).snapshotMutex.Unlock()
+		if len(inFlight) == 2 {
+			close(both)
+		}
+		mutex.Unlock()
+
+		// Hold the send open until both peers are being served.
+		select {
+		case <-both:
+		case <-time.After(time.Second):
+		}
+		return newSnapshotResponse(false)
+	}
+
+	s := newTestServer("1", transporter)
+	s.(*server).stateMachine = &m
+	s.SetHeartbeatInterval(testHeartbeatInterval)
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join server to self: %v", err)
+	}
+	s.Do(&testCommand1{})
+	assert.NoError(t, s.TakeSnapshot())
+
+	// Drop the log so that peers can only catch up from the snapshot.
+	ss := s.(*server).snapshot
+	s.(*server).log.compact(ss.LastIndex, ss.LastTerm)
+
+	s.AddPeer("2", "")
+	s.AddPeer("3", "")
+
+	select {
+	case <-both:
+	case <-time.After(time.Second):
+		t.Fatal("Snapshot sends were not concurrent")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, states["2"] != nil, true)
+	assert.Equal(t, states["2"] == states["3"], true)
+}
+
+// Ensure that the snapshot catch-up threshold decides between replaying the
+// log and sending a snapshot.
+func TestSnapshotCatchUpThreshold(t *testing.T) {
+	var entries []*LogEntry
+	for i := uint64(1); i <= 10; i++ {
+		e, _ := newLogEntry(nil, nil, i, 1, &testCommand1{Val: "foo", I: int(i)})
+		entries = append(entries, e)
+	}
+	s := newTestServerWithLog("1", &testTransporter{}, entries)
+	assert.NoError(t, s.Init())
+	s.(*server).snapshot = &Snapshot{LastIndex: 8, LastTerm: 1}
+
+	// Disabled by default.
+	assert.Equal(t, s.(*server).shouldSendSnapshot(0), false)
+
+	s.SetSnapshotCatchUpEntries(5)
+	assert.Equal(t, s.(*server).shouldSendSnapshot(2), true)
+	assert.Equal(t, s.(*server).shouldSendSnapshot(6), false)
+
+	// The snapshot must cover entries the peer is missing.
+	assert.Equal(t, s.(*server).shouldSendSnapshot(8), false)
+
+	s.SetSnapshotCatchUpEntries(0)
+	s.SetSnapshotCatchUpBytes(int64(proto.Size(entries[0].pb)) * 4)
+	assert.Equal(t, s.(*server).shouldSendSnapshot(6), true)
+	assert.Equal(t, s.(*server).shouldSendSnapshot(7), false)
+}
+
+type versionedStateMachine struct {
+	testStateMachine
+	version string
+}
+
+func (sm *versionedStateMachine) SchemaVersion() string {
+	return sm.version
+}
+
+// Ensure that snapshots record a manifest and that restores with an
+// incompatible schema version are refused.
+func TestSnapshotManifest(t *testing.T) {
+	sm := &versionedStateMachine{version: "2"}
+	sm.saveFunc = func() ([]byte, error) { return []byte("foo"), nil }
+	sm.recoveryFunc = func([]byte) error { return nil }
+
+	s := newTestServer("1", &testTransporter{})
+	s.(*server).stateMachine = sm
+	s.SetClusterID("c1")
+	s.Start()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join server to self: %v", err)
+	}
+	s.Do(&testCommand1{})
+	assert.NoError(t, s.TakeSnapshot())
+	s.Stop()
+
+	details, err := VerifySnapshot(s.(*server).snapshot.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, details.Manifest.ClusterID, "c1")
+	assert.Equal(t, details.Manifest.SchemaVersion, "2")
+	assert.Equal(t, details.Manifest.ConfigurationIndex, uint64(1))
+
+	// A newer application refuses the old schema.
+	sm.version = "3"
+	newS, _ := NewServer("1", s.Path(), &testTransporter{}, sm, nil, "")
+	assert.Error(t, newS.LoadSnapshot())
+
+	// So does a server from another cluster.
+	sm.version = "2"
+	newS, _ = NewServer("1", s.Path(), &testTransporter{}, sm, nil, "")
+	newS.SetClusterID("c2")
+	assert.Error(t, newS.LoadSnapshot())
+
+	newS, _ = NewServer("1", s.Path(), &testTransporter{}, sm, nil, "")
+	assert.NoError(t, newS.LoadSnapshot())
+	assert.Equal(t, newS.ConfigurationIndex(), uint64(1))
+}
+
+// Ensure that client sessions are restored from a snapshot.
+func TestSnapshotSessions(t *testing.T) {
+	runServerWithMockStateMachine(Leader, func(s Server, m *mock.Mock) {
+		m.On("Save").Return([]byte("foo"), nil)
+		m.On("Recovery", []byte("foo")).Return(nil)
+
+		s.Do(&testSessionCommand{Client: "a", Seq: 1})
+		s.Do(&testSessionCommand{Client: "a", Seq: 2})
+		assert.NoError(t, s.TakeSnapshot())
+		assert.Equal(t, s.(*server).snapshot.Sessions["a"], uint64(2))
+		assert.Equal(t, s.(*server).snapshot.SessionOrder, []string{"a"})
+		s.Stop()
+
+		newS, _ := NewServer("1", s.Path(), &testTransporter{}, s.StateMachine(), nil, "")
+		assert.NoError(t, newS.LoadSnapshot())
+		assert.Equal(t, newS.(*server).sessionSequences()["a"], uint64(2))
+
+		// A retry is suppressed even though its result was not kept.
+		e, _ := newLogEntry(nil, nil, 10, 1, &testSessionCommand{Client: "a", Seq: 2})
+		_, err := newS.(*server).applyOnce(e, &testSessionCommand{Client: "a", Seq: 2})
+		assert.Equal(t, err, DuplicateCommandError)
+	})
+}
+
+// Ensure that a snapshot drops the configurations made before the one it holds.
+func TestSnapshotTruncatesConfigurationHistory(t *testing.T) {
+	runServerWithMockStateMachine(Leader, func(s Server, m *mock.Mock) {
+		m.On("Save").Return([]byte("foo"), nil)
+
+		s.Do(&DefaultJoinCommand{Name: "2", Role: LearnerRole})
+		s.Do(&DefaultJoinCommand{Name: "3", Role: LearnerRole})
+		s.Do(&testCommand1{})
+		before := s.ConfigurationHistory()
+		assert.Equal(t, len(before) > 1, true)
+		assert.NoError(t, s.TakeSnapshot())
+
+		history := s.ConfigurationHistory()
+		assert.Equal(t, len(history), 1)
+		assert.Equal(t, history[0].Index, s.ConfigurationIndex())
+		assert.Equal(t, len(s.ConfigurationAt(s.ConfigurationIndex())), 3)
+
+		b, err := ioutil.ReadFile(filepath.Join(s.Path(), "configurations"))
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Count(string(b), "\n"), 1)
+	})
+}
+
+// Ensure that a copied data directory can be re-stamped to seed a new cluster.
+func TestRestampDataDir(t *testing.T) {
+	sm := &versionedStateMachine{version: "1"}
+	sm.saveFunc = func() ([]byte, error) { return []byte("foo"), nil }
+	sm.recoveryFunc = func([]byte) error { return nil }
+
+	s := newTestServer("1", &testTransporter{})
+	s.(*server).stateMachine = sm
+	s.SetClusterID("c1")
+	s.Start()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join server to self: %v", err)
+	}
+	s.Do(&testCommand1{})
+	assert.NoError(t, s.TakeSnapshot())
+	s.Stop()
+
+	assert.Error(t, RestampDataDir(s.Path(), "3", "2", "c2"))
+	assert.Error(t, RestampDataDir(s.Path(), "1", "2", "c1"))
+	assert.NoError(t, RestampDataDir(s.Path(), "1", "2", "c2"))
+
+	details, err := VerifySnapshot(s.(*server).snapshot.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, details.Manifest.ClusterID, "c2")
+	assert.Equal(t, len(details.Peers), 1)
+	assert.Equal(t, details.Peers[0].Name, "2")
+
+	newS, _ := NewServer("2", s.Path(), &testTransporter{}, sm, nil, "")
+	assert.NoError(t, newS.ForceNewCluster())
+	assert.NoError(t, newS.Start())
+	defer newS.Stop()
+	assert.Equal(t, newS.ClusterID(), "c2")
+	assert.Equal(t, len(newS.Peers()), 0)
+}
+
+// Ensure that a follower learns the configuration index from the snapshot it
+// recovers from.
+func TestSnapshotRecoveryConfigurationIndex(t *testing.T) {
+	runServerWithMockStateMachine(Follower, func(s Server, m *mock.Mock) {
+		m.On("Recovery", []byte("bar")).Return(nil)
+
+		s.RequestSnapshot(&SnapshotRequest{LeaderName: "2", LastIndex: 5, LastTerm: 1})
+		resp := s.SnapshotRecoveryRequest(&SnapshotRecoveryRequest{
+			LeaderName: "2",
+			LastIndex:  5,
+			LastTerm:   1,
+			Peers:      []*Peer{{Name: "1"}, {Name: "2"}},
+			State:      []byte("bar"),
+			Manifest:   &SnapshotManifest{ConfigurationIndex: 3},
+		})
+		assert.Equal(t, resp.Success, true)
+		assert.Equal(t, s.ConfigurationIndex(), uint64(3))
+	})
+}
+
+// Ensure that the manifest survives encoding a snapshot recovery request.
+func TestSnapshotRecoveryRequestManifestEncoding(t *testing.T) {
+	req := &SnapshotRecoveryRequest{
+		LeaderName: "1",
+		LastIndex:  5,
+		LastTerm:   2,
+		Peers:      []*Peer{{Name: "1", ConnectionString: "http://1"}},
+		State:      []byte("foo"),
+		Manifest:   &SnapshotManifest{ClusterID: "c1", ConfigurationIndex: 3, SchemaVersion: "2", Host: "h", CreatedAt: time.Unix(100, 0)},
+	}
+	var buf bytes.Buffer
+	_, err := req.Encode(&buf)
+	assert.NoError(t, err)
+
+	decoded := &SnapshotRecoveryRequest{}
+	_, err = decoded.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, decoded.Manifest.ClusterID, "c1")
+	assert.Equal(t, decoded.Manifest.ConfigurationIndex, uint64(3))
+	assert.Equal(t, decoded.Manifest.SchemaVersion, "2")
+	assert.Equal(t, decoded.Manifest.Host, "h")
+	assert.Equal(t, decoded.Manifest.CreatedAt.Equal(time.Unix(100, 0)), true)
+}
+
+// Ensure that peer roles, weights and metadata survive snapshot recovery
+// encoding.
+func TestSnapshotRecoveryRequestPeerEncoding(t *testing.T) {
+	req := &SnapshotRecoveryRequest{
+		LeaderName: "1",
+		LastIndex:  5,
+		LastTerm:   2,
+		Peers:      []*Peer{{Name: "2", Role: LearnerRole, Weight: 2, Metadata: map[string]string{"zone": "b"}}},
+		State:      []byte("foo"),
+	}
+	var buf bytes.Buffer
+	_, err := req.Encode(&buf)
+	assert.NoError(t, err)
+
+	decoded := &SnapshotRecoveryRequest{}
+	_, err = decoded.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, decoded.Peers[0].Role, LearnerRole)
+	assert.Equal(t, decoded.Peers[0].Metadata["zone"], "b")
+	assert.Equal(t, decoded.Peers[0].Weight, 2)
+}
+
+// Ensure that client sessions and idempotency keys survive snapshot recovery
+// encoding.
+func TestSnapshotRecoveryRequestSessionEncoding(t *testing.T) {
+	req := &SnapshotRecoveryRequest{
+		LeaderName: "1",
+		LastIndex:  5,
+		LastTerm:   2,
+		Peers:      []*Peer{{Name: "1", ConnectionString: "http://1"}},
+		State:      []byte("foo"),
+		Sessions:   map[string]uint64{"a": 3},
+	}
+	req.SessionOrder = []string{"a"}
+	req.IdempotencyKeys = []string{"k"}
+	var buf bytes.Buffer
+	_, err := req.Encode(&buf)
+	assert.NoError(t, err)
+
+	decoded := &SnapshotRecoveryRequest{}
+	_, err = decoded.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, decoded.Sessions["a"], uint64(3))
+	assert.Equal(t, decoded.SessionOrder, []string{"a"})
+	assert.Equal(t, decoded.IdempotencyKeys, []string{"k"})
+}
+
+type testSnapshotSource struct {
+	opens int
+}
+
+func (src *testSnapshotSource) Open(snapshot *Snapshot) (io.ReadCloser, error) {
+	src.opens++
+	return ioutil.NopCloser(strings.NewReader("live")), nil
+}
+
+// Ensure that an application snapshot source is used when sending snapshots.
+func TestSnapshotSource(t *testing.T) {
+	runServerWithMockStateMachine(Leader, func(s Server, m *mock.Mock) {
+		m.On("Save").Return([]byte("foo"), nil)
+
+		s.Do(&testCommand1{})
+		assert.NoError(t, s.TakeSnapshot())
+
+		src := &testSnapshotSource{}
+		s.SetSnapshotSource(src)
+
+		shared, err := s.(*server).acquireSnapshot()
+		assert.NoError(t, err)
+		assert.Equal(t, string(shared.State), "live")
+		assert.Equal(t, shared.LastIndex, s.(*server).snapshot.LastIndex)
+
+		// Concurrent sends share the same open.
+		other, _ := s.(*server).acquireSnapshot()
+		assert.Equal(t, other == shared, true)
+		assert.Equal(t, src.opens, 1)
+		s.(*server).releaseSnapshot(shared)
+		s.(*server).releaseSnapshot(other)
+
+		s.(*server).acquireSnapshot()
+		assert.Equal(t, src.opens, 2)
+	})
+}
+
+// Ensure that snapshot lifecycle events are dispatched.
+func TestSnapshotEvents(t *testing.T) {
+	runServerWithMockStateMachine(Leader, func(s Server, m *mock.Mock) {
+		m.On("Save").Return([]byte("foo"), nil)
+
+		var started, completed *SnapshotEventInfo
+		s.AddEventListener(SnapshotStartedEventType, func(e Event) {
+			started = e.Value().(*SnapshotEventInfo)
+		})
+		s.AddEventListener(SnapshotCompletedEventType, func(e Event) {
+			completed = e.Value().(*SnapshotEventInfo)
+		})
+
+		s.Do(&testCommand1{})
+		err := s.TakeSnapshot()
+		assert.NoError(t, err)
+		assert.Equal(t, started.LastIndex, s.(*server).snapshot.LastIndex)
+		assert.Equal(t, completed.LastIndex, s.(*server).snapshot.LastIndex)
+		assert.Equal(t, completed.Size > 0, true)
+	})
+}
+
+// Ensure that a snapshot installed from a leader dispatches an event.
+func TestSnapshotInstalledEvent(t *testing.T) {
+	runServerWithMockStateMachine(Follower, func(s Server, m *mock.Mock) {
+		m.On("Recovery", []byte("bar")).Return(nil)
+
+		var installed *SnapshotEventInfo
+		s.AddEventListener(SnapshotInstalledEventType, func(e Event) {
+			installed = e.Value().(*SnapshotEventInfo)
+		})
+
+		s.RequestSnapshot(&SnapshotRequest{LastIndex: 5, LastTerm: 1})
+		s.SnapshotRecoveryRequest(&SnapshotRecoveryRequest{
+			LeaderName: "2",
+			LastIndex:  5,
+			LastTerm:   2,
+			Peers:      make([]*Peer, 0),
+			State:      []byte("bar"),
+		})
+		assert.Equal(t, installed.Peer, "2")
+		assert.Equal(t, installed.LastIndex, uint64(5))
+		assert.Equal(t, installed.Size, int64(3))
+	})
+}
+
 // Ensure that a snapshot request can be sent and received.
 func TestSnapshotRequest(t *testing.T) {
 	runServerWithMockStateMachine(Follower, func(s Server, m *mock.Mock) {
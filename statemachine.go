@@ -1,5 +1,7 @@
 package raft
 
+import "io"
+
 // StateMachine is the interface for allowing the host application to save and
 // recovery the state machine. This makes it possible to make snapshots
 // and compact the log.
@@ -7,3 +9,36 @@ type StateMachine interface {
 	Save() ([]byte, error)
 	Recovery([]byte) error
 }
+
+// BatchApplier can be implemented by a state machine to share the cost of its
+// own transactions across consecutive committed commands. ApplyBatch is
+// passed the entries of the commands and apply, which applies each of them
+// in order as it would be without a BatchApplier. The state machine would
+// typically begin a transaction, call apply and commit the transaction. The
+// results are only returned to callers once ApplyBatch has returned.
+// Configuration changes are never part of a batch.
+type BatchApplier interface {
+	ApplyBatch(entries []*LogEntry, apply func())
+}
+
+// StreamRecoverer can be implemented by a state machine to recover from the
+// state of a snapshot as a stream of size bytes, in place of Recovery, so
+// that the server can report how much of a large state has been restored as
+// it is read.
+type StreamRecoverer interface {
+	RecoverFrom(r io.Reader, size int64) error
+}
+
+// SchemaVersioner can be implemented by a state machine to record the version
+// of its application schema in snapshot manifests. Snapshots with a different
+// schema version are rejected on restore unless the state machine is also a
+// ManifestValidator.
+type SchemaVersioner interface {
+	SchemaVersion() string
+}
+
+// ManifestValidator can be implemented by a state machine to decide whether
+// a snapshot is compatible before its state is recovered.
+type ManifestValidator interface {
+	ValidateManifest(manifest *SnapshotManifest) error
+}
@@ -0,0 +1,30 @@
+package raft
+
+// A Subscription delivers committed log entries in order on C, from the log
+// first and then as they are committed. C is closed once the subscription
+// ends and Err then tells why.
+type Subscription struct {
+	C <-chan *LogEntry
+
+	c   chan *LogEntry
+	err error
+}
+
+// Creates a subscription whose channel holds up to size undelivered entries.
+func newSubscription(size int) *Subscription {
+	c := make(chan *LogEntry, size)
+	return &Subscription{C: c, c: c}
+}
+
+// Err returns why the subscription ended: the context's error, StopError, or
+// CompactedError if the entries still to be delivered were compacted into a
+// snapshot first. It must only be called once C has been closed.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Ends the subscription with err.
+func (sub *Subscription) end(err error) {
+	sub.err = err
+	close(sub.c)
+}
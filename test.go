@@ -1,10 +1,15 @@
 package raft
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/golang/protobuf/proto"
 )
 
 const (
@@ -19,6 +24,32 @@ const (
 func init() {
 	RegisterCommand(&testCommand1{})
 	RegisterCommand(&testCommand2{})
+	RegisterCommand(&testEpochCommand{})
+	RegisterCommand(&testContextCommand{})
+	RegisterCommand(&testSessionCommand{})
+	RegisterCommand(&testIdempotentCommand{})
+	RegisterCommandResult(&testIdempotentCommand{}, uint64(0))
+	RegisterCommand(&testFailCommand{})
+	RegisterCommand(&testPanicCommand{})
+	RegisterCommand(&testDryRunCommand{})
+	RegisterCommand(&testReadCommand{})
+	RegisterCommand(&testJoinCommand{})
+	RegisterCommand(&testLeaveCommand{})
+	RegisterCommandCodec(&testProtoCommand{}, ProtobufCodec)
+	RegisterCommandCodec(&testCBORCommand{}, CBORCodec)
+	RegisterCommandID(&testCBORCommand{}, 1)
+	RegisterCommandVersion(&testVersionedCommand{}, 2, func(version uint32, data []byte) (Command, error) {
+		// Version 1 held a single name.
+		var v1 struct{ Name string }
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+		first, last := v1.Name, ""
+		if i := strings.Index(first, " "); i >= 0 {
+			first, last = first[:i], first[i+1:]
+		}
+		return &testVersionedCommand{First: first, Last: last}, nil
+	})
 }
 
 //------------------------------------------------------------------------------
@@ -132,22 +163,36 @@ type testTransporter struct {
 	sendVoteRequestFunc          func(server Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse
 	sendAppendEntriesRequestFunc func(server Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse
 	sendSnapshotRequestFunc      func(server Server, peer *Peer, req *SnapshotRequest) *SnapshotResponse
+	sendSnapshotRecoveryFunc     func(server Server, peer *Peer, req *SnapshotRecoveryRequest) *SnapshotRecoveryResponse
+	pingFunc                     func(server Server, peer *Peer) bool
+}
+
+func (t *testTransporter) Redirect(server Server, command Command) error {
+	return NotLeaderError
 }
 
 func (t *testTransporter) SendVoteRequest(server Server, peer *Peer, req *RequestVoteRequest) *RequestVoteResponse {
 	return t.sendVoteRequestFunc(server, peer, req)
 }
 
+// Peers without a send function are unreachable.
 func (t *testTransporter) SendAppendEntriesRequest(server Server, peer *Peer, req *AppendEntriesRequest) *AppendEntriesResponse {
+	if t.sendAppendEntriesRequestFunc == nil {
+		return nil
+	}
 	return t.sendAppendEntriesRequestFunc(server, peer, req)
 }
 
+func (t *testTransporter) Ping(server Server, peer *Peer) bool {
+	return t.pingFunc != nil && t.pingFunc(server, peer)
+}
+
 func (t *testTransporter) SendSnapshotRequest(server Server, peer *Peer, req *SnapshotRequest) *SnapshotResponse {
 	return t.sendSnapshotRequestFunc(server, peer, req)
 }
 
 func (t *testTransporter) SendSnapshotRecoveryRequest(server Server, peer *Peer, req *SnapshotRecoveryRequest) *SnapshotRecoveryResponse {
-	return t.SendSnapshotRecoveryRequest(server, peer, req)
+	return t.sendSnapshotRecoveryFunc(server, peer, req)
 }
 
 type testStateMachine struct {
@@ -195,3 +240,224 @@ func (c *testCommand2) CommandName() string {
 func (c *testCommand2) Apply(server Server) (interface{}, error) {
 	return nil, nil
 }
+
+//--------------------------------------
+// Epoch command
+//--------------------------------------
+
+// A command that returns the epoch it is applied in.
+type testEpochCommand struct{}
+
+func (c *testEpochCommand) CommandName() string {
+	return "cmd_epoch"
+}
+
+func (c *testEpochCommand) Apply(context Context) (interface{}, error) {
+	return context.Epoch(), nil
+}
+
+// A command that returns the context it was applied in.
+type testContextCommand struct{}
+
+func (c *testContextCommand) CommandName() string {
+	return "cmd_context"
+}
+
+func (c *testContextCommand) Apply(context Context) (interface{}, error) {
+	return context, nil
+}
+
+//--------------------------------------
+// Session command
+//--------------------------------------
+
+// A command sent within a client session that returns the index it is
+// applied at.
+type testSessionCommand struct {
+	Client string `json:"client"`
+	Seq    uint64 `json:"seq"`
+}
+
+func (c *testSessionCommand) CommandName() string {
+	return "cmd_session"
+}
+
+func (c *testSessionCommand) ClientID() string {
+	return c.Client
+}
+
+func (c *testSessionCommand) Sequence() uint64 {
+	return c.Seq
+}
+
+func (c *testSessionCommand) Apply(context Context) (interface{}, error) {
+	return context.CurrentIndex(), nil
+}
+
+type testIdempotentCommand struct {
+	Key string `json:"key"`
+}
+
+func (c *testIdempotentCommand) CommandName() string {
+	return "cmd_idempotent"
+}
+
+func (c *testIdempotentCommand) IdempotencyKey() string {
+	return c.Key
+}
+
+func (c *testIdempotentCommand) Apply(context Context) (interface{}, error) {
+	return context.CurrentIndex(), nil
+}
+
+// A command whose first Failures attempts to apply fail.
+type testFailCommand struct {
+	Failures int `json:"failures"`
+}
+
+// The attempts to apply each testFailCommand entry, by server and index, as
+// an entry is decoded again for each attempt.
+var testFailAttempts = struct {
+	sync.Mutex
+	attempts map[string]int
+}{attempts: map[string]int{}}
+
+func (c *testFailCommand) CommandName() string {
+	return "cmd_fail"
+}
+
+func (c *testFailCommand) Apply(context Context) (interface{}, error) {
+	key := fmt.Sprintf("%p/%d", context.Server(), context.Index())
+	testFailAttempts.Lock()
+	testFailAttempts.attempts[key]++
+	attempts := testFailAttempts.attempts[key]
+	testFailAttempts.Unlock()
+	if attempts <= c.Failures {
+		return nil, fmt.Errorf("attempt %d failed", attempts)
+	}
+	return attempts, nil
+}
+
+// A command that is a protocol buffer message.
+type testProtoCommand struct {
+	Val              *string `protobuf:"bytes,1,opt" json:"Val,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (c *testProtoCommand) Reset()         { *c = testProtoCommand{} }
+func (c *testProtoCommand) String() string { return proto.CompactTextString(c) }
+func (*testProtoCommand) ProtoMessage()    {}
+
+func (c *testProtoCommand) GetVal() string {
+	if c != nil && c.Val != nil {
+		return *c.Val
+	}
+	return ""
+}
+
+func (c *testProtoCommand) CommandName() string {
+	return "cmd_proto"
+}
+
+func (c *testProtoCommand) Apply(context Context) (interface{}, error) {
+	return c.Val, nil
+}
+
+// A command that is encoded as CBOR.
+type testCBORCommand struct {
+	Val    string              `json:"val"`
+	I      int                 `json:"i"`
+	F      float64             `json:"f,omitempty"`
+	Data   []byte              `json:"data"`
+	Tags   []string            `json:"tags"`
+	Labels map[string]uint32   `json:"labels"`
+	Next   *testCBORCommand    `json:"next,omitempty"`
+	Any    interface{}         `json:"any"`
+	At     time.Time           `json:"at"`
+	Keys   map[interface{}]int `json:"keys,omitempty"`
+	hidden int
+}
+
+func (c *testCBORCommand) CommandName() string {
+	return "cmd_cbor"
+}
+
+func (c *testCBORCommand) Apply(context Context) (interface{}, error) {
+	return c.Val, nil
+}
+
+// A command at version 2 of its type.
+type testVersionedCommand struct {
+	First string
+	Last  string
+}
+
+func (c *testVersionedCommand) CommandName() string {
+	return "cmd_versioned"
+}
+
+func (c *testVersionedCommand) Apply(context Context) (interface{}, error) {
+	return c.First + " " + c.Last, nil
+}
+
+// A command that can be dry run, returning the index it would be applied at.
+type testDryRunCommand struct{}
+
+func (c *testDryRunCommand) CommandName() string {
+	return "cmd_dry_run"
+}
+
+func (c *testDryRunCommand) Apply(context Context) (interface{}, error) {
+	return context.Index(), nil
+}
+
+func (c *testDryRunCommand) DryRun(context Context) (interface{}, error) {
+	return context.Index(), nil
+}
+
+// A query that is applied concurrently with other queries unless Write is set.
+type testReadCommand struct {
+	Write bool `json:"write,omitempty"`
+}
+
+func (c *testReadCommand) CommandName() string {
+	return "cmd_read"
+}
+
+func (c *testReadCommand) ReadOnly() bool {
+	return !c.Write
+}
+
+func (c *testReadCommand) Apply(context Context) (interface{}, error) {
+	return context.Index(), nil
+}
+
+// An application's join command with a credential.
+type testJoinCommand struct {
+	DefaultJoinCommand
+	Token string `json:"token"`
+}
+
+func (c *testJoinCommand) CommandName() string {
+	return "cmd_join"
+}
+
+// An application's leave command with a reason.
+type testLeaveCommand struct {
+	DefaultLeaveCommand
+	Reason string `json:"reason"`
+}
+
+func (c *testLeaveCommand) CommandName() string {
+	return "cmd_leave"
+}
+
+type testPanicCommand struct{}
+
+func (c *testPanicCommand) CommandName() string {
+	return "cmd_panic"
+}
+
+func (c *testPanicCommand) Apply(context Context) (interface{}, error) {
+	panic("poison")
+}
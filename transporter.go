@@ -1,5 +1,7 @@
 package raft
 
+import gocontext "context"
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -15,3 +17,21 @@ type Transporter interface {
 	SendSnapshotRequest(server Server, peer *Peer, req *SnapshotRequest) *SnapshotResponse
 	SendSnapshotRecoveryRequest(server Server, peer *Peer, req *SnapshotRecoveryRequest) *SnapshotRecoveryResponse
 }
+
+// Pinger is implemented by transporters that can check whether a peer is
+// reachable without sending it a Raft request. Followers use it to avoid
+// standing for elections they cannot win.
+type Pinger interface {
+	Ping(server Server, peer *Peer) bool
+}
+
+// Forwarder is implemented by transporters that can send a command to the
+// leader and return the result it was applied with. Followers use it in Do
+// instead of Redirect. A result that is sent over the network may not come
+// back as the type it was applied with; transporters that encode results as
+// JSON decode them as the type registered with RegisterCommandResult. The
+// context carries the identity the command was submitted with, for the leader
+// to authorize it with.
+type Forwarder interface {
+	Forward(ctx gocontext.Context, server Server, leader *Peer, command Command) (interface{}, error)
+}
@@ -0,0 +1,51 @@
+//go:build go1.18
+
+package raft
+
+import (
+	gocontext "context"
+	"fmt"
+	"reflect"
+)
+
+// A ResultTypeError is returned by the typed Do helpers when a command was
+// applied but its result is not of the type asked for. Value is the result
+// the command was applied with.
+type ResultTypeError struct {
+	Value interface{}
+	Type  string
+}
+
+func (e *ResultTypeError) Error() string {
+	return fmt.Sprintf("raft: Command result %T is not %s", e.Value, e.Type)
+}
+
+// Do executes a command on a server like Server.Do and returns its result as
+// a T. A nil result is returned as the zero value of T. On a follower that
+// forwards the command to the leader, results come back as the type
+// registered with RegisterCommandResult; without one they are generic JSON
+// values, such as float64, and Do returns a ResultTypeError for other Ts.
+func Do[T any](s Server, command Command) (T, error) {
+	return DoContext[T](gocontext.Background(), s, command)
+}
+
+// DoContext executes a command on a server like Server.DoContext and returns
+// its result as a T.
+func DoContext[T any](ctx gocontext.Context, s Server, command Command) (T, error) {
+	value, err := s.DoContext(ctx, command)
+	return typedResult[T](value, err)
+}
+
+// Converts the result of a command to a T. The error the command failed with
+// takes precedence over a mismatched type.
+func typedResult[T any](value interface{}, err error) (T, error) {
+	var result T
+	if err != nil || value == nil {
+		return result, err
+	}
+	result, ok := value.(T)
+	if !ok {
+		return result, &ResultTypeError{Value: value, Type: reflect.TypeOf((*T)(nil)).Elem().String()}
+	}
+	return result, nil
+}
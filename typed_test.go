@@ -0,0 +1,70 @@
+//go:build go1.18
+
+package raft
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Ensure that a command's result is returned as the type asked for.
+func TestDoTyped(t *testing.T) {
+	s := newTestServer("1", &testTransporter{})
+	s.Start()
+	defer s.Stop()
+	if _, err := s.Do(&DefaultJoinCommand{Name: s.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+
+	index, err := Do[uint64](s, &testIdempotentCommand{})
+	if err != nil || index == 0 {
+		t.Fatalf("Unexpected result: %v %v", index, err)
+	}
+	if _, err := Do[string](s, &testIdempotentCommand{}); err == nil {
+		t.Fatal("Expected a ResultTypeError")
+	} else if e := new(ResultTypeError); !errors.As(err, &e) || e.Type != "string" {
+		t.Fatalf("Expected a ResultTypeError for string, got %v", err)
+	}
+	if name, err := Do[string](s, NOPCommand{}); err != nil || name != "" {
+		t.Fatalf("Expected the zero value for a nil result, got %q %v", name, err)
+	}
+}
+
+// Ensure that a follower forwarding a command to the leader returns its
+// result as the registered type, and as a generic value without one.
+func TestDoTypedForwarded(t *testing.T) {
+	leader := newTestServer("1", &testTransporter{})
+	leader.Start()
+	defer leader.Stop()
+	if _, err := leader.Do(&DefaultJoinCommand{Name: leader.Name()}); err != nil {
+		t.Fatalf("Unable to join: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewHTTPTransporter("/raft", testElectionTimeout).Install(leader, mux)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	follower := newTestServer("2", NewHTTPTransporter("/raft", testElectionTimeout))
+	follower.SetElectionTimeout(time.Hour)
+	follower.AddPeer("1", httpServer.URL)
+	follower.Start()
+	defer follower.Stop()
+	if resp := follower.AppendEntries(newAppendEntriesRequest(1, 0, 0, 0, "1", nil)); !resp.Success() {
+		t.Fatalf("AppendEntries failed")
+	}
+
+	index, err := Do[uint64](follower, &testIdempotentCommand{})
+	if err != nil || index != leader.CommitIndex() {
+		t.Fatalf("Unexpected forwarded result: %v %v", index, err)
+	}
+	if _, err := Do[uint64](follower, &testEpochCommand{}); err == nil {
+		t.Fatal("Expected a ResultTypeError")
+	} else if e := new(ResultTypeError); !errors.As(err, &e) {
+		t.Fatalf("Expected a ResultTypeError, got %v", err)
+	} else if _, ok := e.Value.(float64); !ok {
+		t.Fatalf("Expected a generic value without a registered type, got %T", e.Value)
+	}
+}
@@ -1,6 +1,9 @@
 package raft
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math/rand"
@@ -15,6 +18,15 @@ func (p uint64Slice) Len() int           { return len(p) }
 func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// newClusterID generates a random identifier for a new cluster.
+func newClusterID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // WriteFile writes data to a file named by filename.
 // If the file does not exist, WriteFile creates it with permissions perm;
 // otherwise WriteFile truncates it before writing.
@@ -41,15 +53,34 @@ func writeFileSynced(filename string, data []byte, perm os.FileMode) error {
 	return f.Close()
 }
 
-// Waits for a random time between two durations and sends the current time on
-// the returned channel.
-func afterBetween(min time.Duration, max time.Duration) <-chan time.Time {
-	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+// syncDir flushes a directory to disk so that renames and file creations
+// within it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// newSeed generates a random seed for a random number generator, so that
+// servers started at the same time do not share a sequence.
+func newSeed() int64 {
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// Returns a random duration from r between two durations.
+func randomBetween(r *rand.Rand, min time.Duration, max time.Duration) time.Duration {
 	d, delta := min, (max - min)
 	if delta > 0 {
-		d += time.Duration(rand.Int63n(int64(delta)))
+		d += time.Duration(r.Int63n(int64(delta)))
 	}
-	return time.After(d)
+	return d
 }
 
 // TODO(xiangli): Remove assertions when we reach version 1.0